@@ -0,0 +1,66 @@
+// Command dirserver serves an upspin.DirServer over HTTPS, backed by a SQLite
+// database, a PostgreSQL database shared between instances or, for throwaway
+// instances, by memory.
+package main
+
+import (
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"github.com/vvanpo/upspin-fly/dirserver/postgres"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/cloud/https"
+	"upspin.io/config"
+	"upspin.io/flags"
+	rpcdir "upspin.io/rpc/dirserver"
+	"upspin.io/upspin"
+
+	_ "upspin.io/pack/ee"
+	_ "upspin.io/pack/eeintegrity"
+	_ "upspin.io/pack/plain"
+	_ "upspin.io/transports"
+)
+
+func main() {
+	backend := flag.String("state", "sqlite", "state `backend` to use: sqlite, postgres, or memory for a server that forgets everything on exit")
+	db := flag.String("db", "dirserver.db", "SQLite database `file`, or PostgreSQL connection string")
+	flags.Parse(flags.Server)
+
+	cfg, err := config.FromFile(flags.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var st state.State
+	switch *backend {
+	case "sqlite":
+		s, err := sqlite.Open(*db)
+		if err != nil {
+			log.Fatalf("open %s: %v", *db, err)
+		}
+		defer s.Close()
+		st = s
+	case "postgres":
+		s, err := postgres.Open(*db)
+		if err != nil {
+			log.Fatalf("open postgres: %v", err)
+		}
+		defer s.Close()
+		st = s
+	case "memory":
+		slog.Warn("serving from memory; all state is lost on exit")
+		st = memory.New()
+	default:
+		log.Fatalf("unknown state backend %q", *backend)
+	}
+
+	dir := dirserver.New(cfg, st, cache.New(cfg, nil), slog.Default())
+	http.Handle("/api/Dir/", rpcdir.New(cfg, dir, upspin.NetAddr(flags.NetAddr)))
+	https.ListenAndServeFromFlags(nil)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+)
+
+func compact(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	db := dbFlag(fs)
+	age := fs.Duration("age", 0, "retain operations within this `duration`")
+	versions := fs.Int("versions", 1, "retain this `number` of versions of each path")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin compact [-age duration] [-versions n] [-db file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	st := openDB(*db)
+	defer st.Close()
+
+	n, err := st.Compact(context.Background(), sqlite.Retention{Age: *age, Versions: *versions})
+	log.Printf("removed %d operations, %d puts and %d blocks", n.Operations, n.Puts, n.Blocks)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+func diff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	db := dbFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin diff [-db file] other path")
+		fmt.Fprintln(os.Stderr, "Lists the paths at or below path at which the trees in the database and in other differ, such as those of a primary and its replica.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	p, err := path.Parse(upspin.PathName(fs.Arg(1)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a := openDB(*db)
+	defer a.Close()
+	b := openDB(fs.Arg(0))
+	defer b.Close()
+
+	ds, err := state.Diff(context.Background(), a, b, p.Path())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, d := range ds {
+		fmt.Println(d)
+	}
+}
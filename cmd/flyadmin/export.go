@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver/archive"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/upspin"
+)
+
+func export(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	db := dbFlag(fs)
+	history := fs.Bool("history", false, "export the full log history rather than the current tree")
+	out := fs.String("out", "", "output `file` (default standard output)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin export [-history] [-db file] [-out file] user")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	user := upspin.UserName(fs.Arg(0))
+
+	st := openDB(*db)
+	defer st.Close()
+
+	var f io.Writer = os.Stdout
+	if *out != "" {
+		o, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer o.Close()
+		f = o
+	}
+	bw := bufio.NewWriter(f)
+
+	w, err := archive.NewWriter(bw, user, *history)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	if *history {
+		err = st.WalkLog(ctx, user, 0, func(op sqlite.Operation) error {
+			if op.Entry == nil {
+				return w.Delete(op.Name, op.Time)
+			}
+			return w.Put(op.Entry)
+		})
+	} else {
+		err = st.WalkProj(ctx, user, w.Put)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	db := dbFlag(fs)
+	in := fs.String("in", "", "input `file` (default standard input)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin import [-db file] [-in file]")
+		fmt.Fprintln(os.Stderr, "A directory server using the database must be restarted afterwards, as it caches access rights.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var f io.Reader = os.Stdin
+	if *in != "" {
+		i, err := os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer i.Close()
+		f = i
+	}
+
+	// The database is created if it doesn't exist.
+	st, err := sqlite.Open(*db)
+	if err != nil {
+		log.Fatalf("open %s: %v", *db, err)
+	}
+	defer st.Close()
+
+	r, err := archive.NewReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := archive.Import(context.Background(), r, st)
+	if err != nil {
+		log.Fatalf("imported %d records: %v", n, err)
+	}
+	log.Printf("imported %d records into the tree of %s", n, r.Root)
+}
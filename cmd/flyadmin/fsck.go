@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+)
+
+func fsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfg := configFlag(fs)
+	noFiles := fs.Bool("nofiles", false, "skip retrieving and parsing Access and Group files")
+	repair := fs.Bool("repair", false, "rebuild the projection from the log")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin fsck [-repair] [-nofiles] [-db file] [-config file]")
+		fmt.Fprintln(os.Stderr, "A directory server using the database must be restarted after -repair, as it caches access rights.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	st := openDB(*db)
+	defer st.Close()
+
+	var c state.Cache
+	if !*noFiles {
+		c = cache.New(loadConfig(*cfg), nil)
+	}
+
+	ps, err := st.Fsck(context.Background(), c, *repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unrepaired := 0
+	for _, p := range ps {
+		fmt.Println(p)
+		if !p.Repaired {
+			unrepaired++
+		}
+	}
+	if unrepaired > 0 {
+		log.Printf("%d problems found", unrepaired)
+		st.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/gc"
+	"github.com/vvanpo/upspin-fly/storeserver"
+	storesqlite "github.com/vvanpo/upspin-fly/storeserver/sqlite"
+	"upspin.io/bind"
+	"upspin.io/upspin"
+)
+
+func gcCmd(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	ep := fs.String("endpoint", "", "`endpoint` of the store server (default the server user's store server)")
+	local := fs.Bool("local", false, "collect blocks stored in the database, as served by flyserver, instead of dialing the store server")
+	history := fs.Duration("history", 0, "retain blocks used within this `duration`")
+	grace := fs.Duration("grace", time.Hour, "retain blocks used or put within this `duration`")
+	noGrace := fs.Bool("nograce", false, "collect from a store server that can not report when blocks were put, retaining only blocks used within the grace period")
+	batch := fs.Int("batch", 100, "number of blocks deleted per batch")
+	dryRun := fs.Bool("n", false, "dry run; report unreachable blocks without deleting them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin gc [-n] [-history duration] [-grace duration] [-nograce] [-batch n] [-endpoint endpoint | -local] [-db file] [-config file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	st := openDB(*db)
+	defer st.Close()
+
+	cfg := loadConfig(*cfgFile)
+	var store upspin.StoreServer
+	switch {
+	case *local:
+		blocks, err := storesqlite.Open(*db)
+		if err != nil {
+			log.Fatalf("open %s: %v", *db, err)
+		}
+		defer blocks.Close()
+		store = storeserver.New(cfg, blocks, nil, slog.Default())
+	case *ep != "":
+		e, err := upspin.ParseEndpoint(*ep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if store, err = bind.StoreServer(cfg, *e); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		var err error
+		if store, err = bind.StoreServer(cfg, cfg.StoreEndpoint()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r, err := gc.Collect(context.Background(), st, store, gc.Options{
+		History: *history,
+		Grace:   *grace,
+		NoGrace: *noGrace,
+		Batch:   *batch,
+		DryRun:  *dryRun,
+	}, slog.Default())
+	for _, ref := range r.Deleted {
+		fmt.Println(ref)
+	}
+	for _, f := range r.Failed {
+		fmt.Fprintln(os.Stderr, f)
+	}
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	log.Printf("%d unreachable blocks, %s %d, %d put within grace period, failed %d", r.Unreachable, verb, len(r.Deleted), r.Recent, len(r.Failed))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(r.Failed) > 0 {
+		st.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"upspin.io/upspin"
+)
+
+func health(args []string) {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	user := fs.String("user", "", "list only the problems in the tree of this `user`")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin health [-user user] [-db file] [-config file]")
+		fmt.Fprintln(os.Stderr, "Lists the Access files that could not be read or parsed when last used.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	st := openDB(*db)
+	defer st.Close()
+	cfg := loadConfig(*cfgFile)
+	// Acting as the server user, who may list the problems of all users.
+	h := dirserver.New(cfg, st, cache.New(cfg, nil), slog.Default()).(dirserver.AccessHealth)
+
+	ps, err := h.AccessProblems(upspin.UserName(*user))
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSEQUENCE\tPROBLEM\tFIRST\tLAST\tERROR")
+	for _, p := range ps {
+		kind := "unreadable"
+		if p.Malformed {
+			kind = "malformed"
+		}
+		first := p.First.Go().UTC().Format(time.RFC3339)
+		last := p.Last.Go().UTC().Format(time.RFC3339)
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", p.Name, p.Sequence, kind, first, last, p.Err)
+	}
+	w.Flush()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/keyserver"
+	keysqlite "github.com/vvanpo/upspin-fly/keyserver/sqlite"
+	"upspin.io/bind"
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+func lint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	local := fs.Bool("local", false, "check keys against the users stored in the database, as served by flyserver, instead of dialing the key server")
+	noKeys := fs.Bool("nokeys", false, "do not check that the users named have keys")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin lint [-local | -nokeys] [-db file] [-config file] root")
+		fmt.Fprintln(os.Stderr, "Prints the problems with the Access and Group files under root as JSON, and exits")
+		fmt.Fprintln(os.Stderr, "with status 1 if there are any, or with status 2 if the tree can not be linted.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// As openDB and loadConfig, but exiting with status 2.
+	if _, err := os.Stat(*db); err != nil {
+		lintFatal(err)
+	}
+	st, err := sqlite.Open(*db)
+	if err != nil {
+		lintFatal(fmt.Sprintf("open %s: %v", *db, err))
+	}
+	defer st.Close()
+	cfg, err := config.FromFile(*cfgFile)
+	if err != nil {
+		lintFatal(fmt.Sprintf("load config: %v", err))
+	}
+	var key upspin.KeyServer
+	switch {
+	case *noKeys:
+	case *local:
+		users, err := keysqlite.Open(*db)
+		if err != nil {
+			lintFatal(fmt.Sprintf("open %s: %v", *db, err))
+		}
+		defer users.Close()
+		key = keyserver.New(cfg, users, nil, slog.Default())
+	default:
+		if key, err = bind.KeyServer(cfg, cfg.KeyEndpoint()); err != nil {
+			lintFatal(err)
+		}
+	}
+	// Acting as the server user, who may lint every tree.
+	l := dirserver.New(cfg, st, cache.New(cfg, nil), slog.Default()).(dirserver.Linter)
+
+	ps, err := l.Lint(upspin.PathName(fs.Arg(0)), key)
+	if err != nil {
+		lintFatal(err)
+	}
+	if ps == nil {
+		ps = []dirserver.LintProblem{}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(ps); err != nil {
+		lintFatal(err)
+	}
+	if len(ps) > 0 {
+		os.Exit(1)
+	}
+}
+
+// lintFatal reports an error and exits with status 2, as status 1 reports that
+// problems were found.
+func lintFatal(v any) {
+	log.Print(v)
+	os.Exit(2)
+}
@@ -0,0 +1,101 @@
+// Command flyadmin performs administrative tasks directly against the
+// database of a directory server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/config"
+	"upspin.io/upspin"
+
+	_ "upspin.io/pack/ee"
+	_ "upspin.io/pack/eeintegrity"
+	_ "upspin.io/pack/plain"
+	_ "upspin.io/transports"
+)
+
+var commands = map[string]func(args []string){
+	"compact":  compact,
+	"diff":     diff,
+	"export":   export,
+	"fsck":     fsck,
+	"gc":       gcCmd,
+	"health":   health,
+	"import":   importCmd,
+	"lint":     lint,
+	"migrate":  migrateCmd,
+	"report":   report,
+	"restore":  restore,
+	"simulate": simulate,
+	"snapshot": snapshot,
+	"versions": versions,
+	"who":      who,
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("flyadmin: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "flyadmin: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	cmd(flag.Args()[1:])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: flyadmin <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintln(os.Stderr, "\t"+n)
+	}
+}
+
+// dbFlag registers the flag common to all commands for the database location.
+func dbFlag(fs *flag.FlagSet) *string {
+	return fs.String("db", "dirserver.db", "SQLite database `file`")
+}
+
+// configFlag registers a flag for the upspin config of the server user.
+func configFlag(fs *flag.FlagSet) *string {
+	home, _ := os.UserHomeDir()
+	return fs.String("config", filepath.Join(home, "upspin", "config"), "upspin `config` file of the server user")
+}
+
+func openDB(name string) *sqlite.State {
+	if _, err := os.Stat(name); err != nil {
+		log.Fatal(err)
+	}
+	st, err := sqlite.Open(name)
+	if err != nil {
+		log.Fatalf("open %s: %v", name, err)
+	}
+	return st
+}
+
+func loadConfig(name string) upspin.Config {
+	cfg, err := config.FromFile(name)
+	if err != nil {
+		log.Fatalf("load config: %v", err)
+	}
+	return cfg
+}
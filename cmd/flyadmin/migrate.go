@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver/migrate"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/bind"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+func migrateCmd(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	ep := fs.String("endpoint", "", "`endpoint` of the source directory server (default the user's directory server)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin migrate [-endpoint endpoint] [-db file] [-config file] path")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	p, err := path.Parse(upspin.PathName(fs.Arg(0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := loadConfig(*cfgFile)
+	var src upspin.DirServer
+	if *ep != "" {
+		e, err := upspin.ParseEndpoint(*ep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src, err = bind.DirServer(cfg, *e)
+	} else {
+		src, err = bind.DirServerFor(cfg, p.User())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The database is created if it doesn't exist.
+	st, err := sqlite.Open(*db)
+	if err != nil {
+		log.Fatalf("open %s: %v", *db, err)
+	}
+	defer st.Close()
+
+	r, err := migrate.Tree(context.Background(), src, st, p.Path(), slog.Default())
+	for _, f := range r.Failed {
+		fmt.Println(f)
+	}
+	log.Printf("copied %d entries, skipped %d, failed %d", r.Copied, r.Skipped, len(r.Failed))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(r.Failed) > 0 {
+		st.Close()
+		os.Exit(1)
+	}
+}
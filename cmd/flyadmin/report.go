@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"upspin.io/access"
+	"upspin.io/upspin"
+)
+
+func report(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	user := fs.String("user", "", "report the rights of this `user`")
+	right := fs.String("right", "", "list only the paths on which the user holds this `right`")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin report -user user [-right right] [-db file] [-config file] root")
+		fmt.Fprintln(os.Stderr, "Lists every path under root on which the user holds any right, grouped by right.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *user == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	rights := dirserver.Rights
+	if *right != "" {
+		i := slices.IndexFunc(rights, func(r access.Right) bool { return r.String() == *right })
+		if i < 0 {
+			log.Fatalf("unknown right %q", *right)
+		}
+		rights = rights[i : i+1]
+	}
+
+	st := openDB(*db)
+	defer st.Close()
+	cfg := loadConfig(*cfgFile)
+	// Acting as the server user, who may report on every tree.
+	rep := dirserver.New(cfg, st, cache.New(cfg, nil), slog.Default()).(dirserver.AccessReport)
+
+	if err := reportByRight(rep, upspin.PathName(fs.Arg(0)), upspin.UserName(*user), rights); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// reportByRight prints a section per right listing the paths under root on
+// which user holds it. The paths are spooled per right, as the tree may be too
+// large to hold them in memory, and printed once the walk is done.
+func reportByRight(rep dirserver.AccessReport, root upspin.PathName, user upspin.UserName, rights []access.Right) error {
+	sections := make(map[access.Right]*section, len(rights))
+	for _, r := range rights {
+		sec, err := newSection()
+		if err != nil {
+			return err
+		}
+		defer sec.close()
+		sections[r] = sec
+	}
+	err := rep.ReportAccess(root, user, func(name upspin.PathName, held []access.Right) error {
+		for _, r := range held {
+			if sec, ok := sections[r]; ok {
+				if _, err := fmt.Fprintln(sec.w, name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, r := range rights {
+		fmt.Fprintf(out, "%s:\n", r)
+		if err := sections[r].copy(out); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// section spools the paths reported for one right to a temporary file.
+type section struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newSection() (*section, error) {
+	f, err := os.CreateTemp("", "flyadmin-report-")
+	if err != nil {
+		return nil, err
+	}
+	return &section{f, bufio.NewWriter(f)}, nil
+}
+
+// copy writes the spooled paths to w, indented.
+func (s *section) copy(w io.Writer) error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(s.f)
+	for sc.Scan() {
+		if _, err := fmt.Fprintf(w, "\t%s\n", sc.Text()); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (s *section) close() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
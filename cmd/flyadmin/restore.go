@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite/sink"
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+)
+
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfg := configFlag(fs)
+	from := fs.String("from", "", "`sink` holding the backup: a directory or s3://bucket/prefix?endpoint=url&region=region")
+	at := fs.String("at", "", "restore as of this RFC 3339 `time` rather than the latest backup")
+	noFiles := fs.Bool("nofiles", false, "skip retrieving and parsing Access and Group files when checking the restored database")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin restore -from sink [-at time] [-nofiles] [-db file] [-config file]")
+		fmt.Fprintln(os.Stderr, "The database file must not exist. The restored database is checked as by fsck.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *from == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var t time.Time
+	if *at != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, *at); err != nil {
+			log.Fatalf("parse -at: %v", err)
+		}
+	}
+	sk, err := sink.Open(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	restored, err := sqlite.Restore(ctx, sk, *db, t)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("restored %s as of %s", *db, restored.Format(time.RFC3339Nano))
+
+	st := openDB(*db)
+	defer st.Close()
+	var c state.Cache
+	if !*noFiles {
+		c = cache.New(loadConfig(*cfg), nil)
+	}
+	ps, err := st.Fsck(ctx, c, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range ps {
+		fmt.Println(p)
+	}
+	if len(ps) > 0 {
+		log.Printf("%d problems found; run fsck -repair on the restored database", len(ps))
+		st.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"upspin.io/upspin"
+)
+
+func simulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	file := fs.String("access", "-", "read the candidate Access file from `file`, or standard input if -")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin simulate [-access file] [-db file] [-config file] dir")
+		fmt.Fprintln(os.Stderr, "Lists who would gain and lose each right under dir if its Access file were replaced.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	st := openDB(*db)
+	defer st.Close()
+	cfg := loadConfig(*cfgFile)
+	// Acting as the server user, who may simulate in every tree.
+	s := dirserver.New(cfg, st, cache.New(cfg, nil), slog.Default()).(dirserver.AccessSimulator)
+
+	diff, err := s.SimulateAccess(upspin.PathName(fs.Arg(0)), data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case diff.Current == nil:
+		fmt.Println("current: none, owner-only rights")
+	case diff.Malformed:
+		fmt.Printf("current: %s (sequence %d) is malformed, owner-only rights\n", diff.Current.Name, diff.Current.Sequence)
+	default:
+		fmt.Printf("current: %s (sequence %d)\n", diff.Current.Name, diff.Current.Sequence)
+	}
+	for _, name := range diff.Shadowed {
+		fmt.Printf("shadowed by: %s\n", name)
+	}
+	for _, c := range diff.Changes {
+		printHolders(c.Path, c.Right.String(), "+", c.Added)
+		printHolders(c.Path, c.Right.String(), "-", c.Removed)
+	}
+}
+
+// printHolders prints a line per holder of a right on a path.
+func printHolders(name upspin.PathName, right, sign string, h *dirserver.Holders) {
+	for _, u := range h.Users {
+		fmt.Printf("%s\t%s\t%s%s\n", name, right, sign, u)
+	}
+	for _, d := range h.Domains {
+		fmt.Printf("%s\t%s\t%s*@%s\n", name, right, sign, d)
+	}
+	for _, g := range h.Unresolved {
+		fmt.Printf("%s\t%s\t%s%s (unresolved)\n", name, right, sign, g)
+	}
+}
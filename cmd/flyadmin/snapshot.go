@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+)
+
+func snapshot(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	db := dbFlag(fs)
+	passFile := fs.String("passphrase", "", "encrypt the snapshot with the passphrase in this `file`")
+	decrypt := fs.Bool("decrypt", false, "decrypt the snapshot given as the first argument into the second")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin snapshot [-passphrase file] [-db file] out")
+		fmt.Fprintln(os.Stderr, "       flyadmin snapshot -decrypt -passphrase file in out")
+		fmt.Fprintln(os.Stderr, "Writes a consistent copy of the database, which may be in use, to a new file.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var pass []byte
+	if *passFile != "" {
+		b, err := os.ReadFile(*passFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if pass = bytes.TrimRight(b, "\r\n"); len(pass) == 0 {
+			log.Fatalf("%s: empty passphrase", *passFile)
+		}
+	}
+
+	if *decrypt {
+		if fs.NArg() != 2 || pass == nil {
+			fs.Usage()
+			os.Exit(2)
+		}
+		decryptSnapshot(fs.Arg(0), fs.Arg(1), pass)
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	st := openDB(*db)
+	defer st.Close()
+	if err := st.Snapshot(context.Background(), fs.Arg(0), pass); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func decryptSnapshot(in, out string, pass []byte) {
+	r, err := os.Open(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	w, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = sqlite.DecryptSnapshot(w, r, pass)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"upspin.io/upspin"
+)
+
+func versions(args []string) {
+	fs := flag.NewFlagSet("versions", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	get := fs.Int64("get", 0, "print the entry put by the operation with this `id`")
+	restore := fs.Int64("restore", 0, "put the entry of the operation with this `id` again")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin versions [-get id | -restore id] [-db file] [-config file] path")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *get != 0 && *restore != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := upspin.PathName(fs.Arg(0))
+
+	st := openDB(*db)
+	defer st.Close()
+	cfg := loadConfig(*cfgFile)
+	// Acting as the server user, whose access to history is unrestricted.
+	h := dirserver.New(cfg, st, cache.New(cfg, nil), slog.Default()).(dirserver.History)
+
+	switch {
+	case *get != 0:
+		e, err := h.Version(name, *get)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printEntry(e)
+	case *restore != 0:
+		e, err := h.Restore(name, *restore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("restored %s at sequence %d", e.Name, e.Sequence)
+	default:
+		vs, err := h.Versions(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIME\tSEQUENCE\tOPERATION\tWRITER")
+		for _, v := range vs {
+			kind := "put"
+			if v.Deleted {
+				kind = "delete"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", v.Id, v.Time.Go().UTC().Format(time.RFC3339), v.Sequence, kind, v.Writer)
+		}
+		w.Flush()
+	}
+}
+
+func printEntry(e *upspin.DirEntry) {
+	fmt.Printf("name: %s\n", e.Name)
+	fmt.Printf("writer: %s\n", e.Writer)
+	fmt.Printf("time: %s\n", e.Time.Go().UTC().Format(time.RFC3339))
+	fmt.Printf("sequence: %d\n", e.Sequence)
+	switch {
+	case e.IsDir():
+		fmt.Println("attr: directory")
+	case e.IsLink():
+		fmt.Println("attr: link")
+		fmt.Printf("link: %s\n", e.Link)
+	default:
+		fmt.Printf("packing: %s\n", e.Packing)
+		for _, b := range e.Blocks {
+			fmt.Printf("block: %s %s offset %d size %d\n", b.Location.Endpoint, b.Location.Reference, b.Offset, b.Size)
+		}
+	}
+}
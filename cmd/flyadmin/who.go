@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"upspin.io/upspin"
+)
+
+func who(args []string) {
+	fs := flag.NewFlagSet("who", flag.ExitOnError)
+	db := dbFlag(fs)
+	cfgFile := configFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: flyadmin who [-db file] [-config file] path")
+		fmt.Fprintln(os.Stderr, "Lists who holds each right on the path, expanding groups.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	st := openDB(*db)
+	defer st.Close()
+	cfg := loadConfig(*cfgFile)
+	// Acting as the server user, who may query every tree.
+	w := dirserver.New(cfg, st, cache.New(cfg, nil), slog.Default()).(dirserver.WhoCan)
+
+	g, err := w.WhoCan(upspin.PathName(fs.Arg(0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case g.Access == nil:
+		fmt.Println("access: none, owner-only rights")
+	case g.Malformed:
+		fmt.Printf("access: %s (sequence %d) is malformed, owner-only rights\n", g.Access.Name, g.Access.Sequence)
+	default:
+		fmt.Printf("access: %s (sequence %d)\n", g.Access.Name, g.Access.Sequence)
+	}
+	for _, r := range dirserver.Rights {
+		h := g.Rights[r]
+		var holders []string
+		for _, u := range h.Users {
+			holders = append(holders, string(u))
+		}
+		for _, d := range h.Domains {
+			holders = append(holders, "*@"+d)
+		}
+		fmt.Printf("%s: %s\n", r, strings.Join(holders, ", "))
+		for _, u := range h.Unresolved {
+			fmt.Printf("\tunresolved group: %s\n", u)
+		}
+	}
+}
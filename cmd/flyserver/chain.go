@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/upspin"
+	"upspin.io/user"
+)
+
+// chainHead serves the head of the hash chain of a tree at /chain/<user>, so
+// that auditors can record it and later detect rewrites of the history. As the
+// head reveals whether a tree changed, requests must present the replication
+// secret as a bearer token.
+func chainHead(st *sqlite.State, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, secret) {
+			return
+		}
+
+		name := upspin.UserName(strings.TrimPrefix(r.URL.Path, "/chain/"))
+		if _, err := user.Clean(name); err != nil {
+			http.Error(w, "invalid user name", http.StatusBadRequest)
+			return
+		}
+
+		h, err := st.ChainHead(r.Context(), name)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "chain head retrieval failed", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		} else if h.Hash == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Id       int64  `json:"id"`
+			Sequence int64  `json:"sequence"`
+			Hash     string `json:"hash"`
+		}{h.Id, h.Sequence, hex.EncodeToString(h.Hash)})
+	}
+}
@@ -0,0 +1,184 @@
+// Command flyserver serves a directory server, a store server and optionally a
+// key server over a single HTTPS listener, all backed by one SQLite database,
+// for small self-contained deployments.
+//
+// Before serving for the first time, run it with -setup to create the tree of
+// the server user, granting the admin user full rights to it.
+//
+// With -replicas, replicas may follow the directory server's log at /replicate.
+// A server started with -primary is such a replica: it serves only a
+// directory server, from its own copy of the primary's trees, reports its lag
+// at /replica, and rejects writes, which must be made to the primary. With
+// -tree, both serve the Merkle hashes of their trees' roots, which match once
+// the replica has caught up.
+//
+// With -backup, the database is continuously backed up to a directory or an
+// S3-compatible bucket, from which flyadmin restore rebuilds it as of any point
+// in time.
+//
+// Counters of the outcomes of fetching Group files are published with expvar
+// at /debug/vars.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"github.com/vvanpo/upspin-fly/dirserver/replica"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite/sink"
+	"github.com/vvanpo/upspin-fly/keyserver"
+	keysqlite "github.com/vvanpo/upspin-fly/keyserver/sqlite"
+	"github.com/vvanpo/upspin-fly/storeserver"
+	storesqlite "github.com/vvanpo/upspin-fly/storeserver/sqlite"
+	"upspin.io/cloud/https"
+	"upspin.io/config"
+	"upspin.io/flags"
+	rpcdir "upspin.io/rpc/dirserver"
+	rpckey "upspin.io/rpc/keyserver"
+	rpcstore "upspin.io/rpc/storeserver"
+	"upspin.io/upspin"
+
+	_ "upspin.io/pack/ee"
+	_ "upspin.io/pack/eeintegrity"
+	_ "upspin.io/pack/plain"
+	_ "upspin.io/transports"
+)
+
+func main() {
+	db := flag.String("db", "flyserver.db", "SQLite database `file`")
+	serveKey := flag.Bool("key", false, "serve a key server for local users")
+	admin := flag.String("admin", "", "upspin `user` administering the server")
+	writers := flag.String("writers", "", "comma-separated `users`, besides the admin, allowed to put blocks in the store")
+	doSetup := flag.Bool("setup", false, "create the server user's tree and exit")
+	compact := flag.Duration("compact", 0, "compact the log at this `interval`; zero disables compaction")
+	retainAge := flag.Duration("retain-age", 30*24*time.Hour, "when compacting, retain operations within this `duration`")
+	retainVersions := flag.Int("retain-versions", 1, "when compacting, retain this `number` of versions of each path")
+	publishChain := flag.Bool("chain", false, "serve the head of the hash chain of every tree at /chain/<user> to holders of the -replica-secret")
+	publishTree := flag.Bool("tree", false, "serve the Merkle hash of every tree's root at /tree/<user> to holders of the -replica-secret")
+	replicas := flag.Bool("replicas", false, "serve the log at /replicate to replicas holding the -replica-secret")
+	primary := flag.String("primary", "", "run as a read-only replica of the primary served at this HTTPS `url`")
+	secretFile := flag.String("replica-secret", "", "`file` containing the secret shared by the primary and its replicas")
+	groupTTL := flag.Duration("group-ttl", cache.DefaultGroupTTL, "cache remote groups, whose changes go unnoticed, for this `duration`")
+	groupTimeout := flag.Duration("group-timeout", cache.DefaultGroupTimeout, "give up fetching a group after this `duration`, serving its last known copy if any")
+	backupTo := flag.String("backup", "", "continuously back up the database to this `sink`: a directory or s3://bucket/prefix?endpoint=url&region=region")
+	backupInterval := flag.Duration("backup-interval", 10*time.Second, "ship committed transactions to the backup at this `interval`")
+	backupRetain := flag.Duration("backup-retain", 7*24*time.Hour, "delete backup generations superseded for this `duration`; zero retains them forever")
+	flags.Parse(flags.Server)
+
+	cfg, err := config.FromFile(flags.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var admins []upspin.UserName
+	if *admin != "" {
+		admins = append(admins, upspin.UserName(*admin))
+	}
+
+	st, err := sqlite.Open(*db)
+	if err != nil {
+		log.Fatalf("open %s: %v", *db, err)
+	}
+	defer st.Close()
+
+	if *backupTo != "" {
+		sk, err := sink.Open(*backupTo)
+		if err != nil {
+			log.Fatalf("open backup sink: %v", err)
+		}
+		b, err := st.NewBackup(context.Background(), sk, sqlite.BackupOptions{Retain: *backupRetain}, slog.Default())
+		if err != nil {
+			log.Fatal(err)
+		}
+		go b.Run(context.Background(), *backupInterval)
+	}
+
+	if *primary != "" {
+		serveReplica(cfg, st, *primary, readSecret(*secretFile), *publishTree, *groupTTL, *groupTimeout)
+		return
+	}
+
+	blocks, err := storesqlite.Open(*db)
+	if err != nil {
+		log.Fatalf("open %s: %v", *db, err)
+	}
+	defer blocks.Close()
+	storeWriters := admins
+	for _, w := range strings.Split(*writers, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			storeWriters = append(storeWriters, upspin.UserName(w))
+		}
+	}
+	store := storeserver.New(cfg, blocks, storeWriters, slog.Default())
+
+	var key upspin.KeyServer
+	if *serveKey {
+		users, err := keysqlite.Open(*db)
+		if err != nil {
+			log.Fatalf("open %s: %v", *db, err)
+		}
+		defer users.Close()
+		key = keyserver.New(cfg, users, admins, slog.Default())
+	}
+
+	if *doSetup {
+		if *admin == "" {
+			log.Fatal("-setup requires -admin")
+		}
+		if err := setup(context.Background(), cfg, st, store, key, upspin.UserName(*admin)); err != nil {
+			log.Fatalf("setup: %v", err)
+		}
+		return
+	}
+
+	if *compact > 0 {
+		retention := sqlite.Retention{Age: *retainAge, Versions: *retainVersions}
+		go st.RunCompaction(context.Background(), *compact, retention, slog.Default())
+	}
+
+	c := cache.New(cfg, st)
+	c.GroupTTL, c.GroupTimeout = *groupTTL, *groupTimeout
+	dir := dirserver.New(cfg, st, c, slog.Default())
+	addr := upspin.NetAddr(flags.NetAddr)
+	http.Handle("/api/Dir/", rpcdir.New(cfg, dir, addr))
+	http.Handle("/api/Store/", rpcstore.New(cfg, store, addr))
+	if key != nil {
+		http.Handle("/api/Key/", rpckey.New(cfg, key, addr))
+	}
+	if *publishChain {
+		http.Handle("/chain/", chainHead(st, readSecret(*secretFile)))
+	}
+	if *replicas {
+		http.Handle("/replicate", replica.NewPrimary(st, readSecret(*secretFile), slog.Default()))
+	}
+	if *publishTree {
+		http.Handle("/tree/", treeRoot(st, readSecret(*secretFile)))
+	}
+	https.ListenAndServeFromFlags(nil)
+}
+
+// serveReplica serves a directory server replicating the primary at url.
+func serveReplica(cfg upspin.Config, st *sqlite.State, url string, secret []byte, publishTree bool, groupTTL, groupTimeout time.Duration) {
+	if !strings.HasPrefix(url, "https://") {
+		log.Fatalf("-primary %s: must be an https URL", url)
+	}
+	r := replica.NewReplica(st, secret, slog.Default())
+	go r.Follow(context.Background(), http.DefaultClient, strings.TrimSuffix(url, "/")+"/replicate", 5*time.Second)
+
+	c := cache.New(cfg, st)
+	c.GroupTTL, c.GroupTimeout = groupTTL, groupTimeout
+	dir := r.DirServer(dirserver.New(cfg, st, c, slog.Default()))
+	http.Handle("/api/Dir/", rpcdir.New(cfg, dir, upspin.NetAddr(flags.NetAddr)))
+	http.Handle("/replica", replicaStatus(r))
+	if publishTree {
+		http.Handle("/tree/", treeRoot(st, secret))
+	}
+	https.ListenAndServeFromFlags(nil)
+}
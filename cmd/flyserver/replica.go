@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/replica"
+	"upspin.io/upspin"
+)
+
+// readSecret reads the secret shared between a primary and its replicas.
+func readSecret(file string) []byte {
+	if file == "" {
+		log.Fatal("replication requires -replica-secret")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) < 16 {
+		log.Fatalf("%s: replication secret must be at least 16 bytes", file)
+	}
+
+	return b
+}
+
+// replicaStatus serves the replication status of every tree at /replica.
+func replicaStatus(r *replica.Replica) http.HandlerFunc {
+	type status struct {
+		Primary  int64     `json:"primary"`
+		Applied  int64     `json:"applied"`
+		Lag      int64     `json:"lag"`
+		Reported time.Time `json:"reported"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		st := make(map[upspin.UserName]status)
+		for u, s := range r.Status() {
+			st[u] = status{s.Primary, s.Applied, s.Lag(), s.Reported}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
+
+// authorized reports whether a request presents the replication secret as a
+// bearer token, otherwise replying that it is unauthorized.
+func authorized(w http.ResponseWriter, r *http.Request, secret []byte) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), secret) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
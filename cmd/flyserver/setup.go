@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/errors"
+	"upspin.io/pack"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// setup creates the root of the server user and an Access file granting the
+// server user and admin all rights, and registers the server user with the key
+// server if there is one. Whatever is already present is left untouched, so
+// setup may be run again after a failure.
+func setup(ctx context.Context, cfg upspin.Config, st state.State, store upspin.StoreServer, key upspin.KeyServer, admin upspin.UserName) error {
+	srv := cfg.UserName()
+
+	if key != nil {
+		if _, err := key.Lookup(srv); errors.Is(errors.NotExist, err) {
+			err := key.Put(&upspin.User{
+				Name:      srv,
+				Dirs:      []upspin.Endpoint{cfg.DirEndpoint()},
+				Stores:    []upspin.Endpoint{cfg.StoreEndpoint()},
+				PublicKey: cfg.Factotum().PublicKey(),
+			})
+			if err != nil {
+				return fmt.Errorf("register %s: %w", srv, err)
+			}
+			slog.Info("registered server user", "username", srv)
+		} else if err != nil {
+			return fmt.Errorf("look up %s: %w", srv, err)
+		}
+	}
+
+	root := upspin.PathName(srv + "/")
+	if e, err := st.Lookup(ctx, root); err != nil {
+		return fmt.Errorf("look up %s: %w", root, err)
+	} else if e == nil {
+		err := st.Put(ctx, &upspin.DirEntry{
+			Name:       root,
+			SignedName: root,
+			Attr:       upspin.AttrDirectory,
+			Writer:     srv,
+			Time:       upspin.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("create %s: %w", root, err)
+		}
+		slog.Info("created root", "pathname", root)
+	}
+
+	name := path.Join(root, "Access")
+	if e, err := st.Lookup(ctx, name); err != nil {
+		return fmt.Errorf("look up %s: %w", name, err)
+	} else if e != nil {
+		return nil
+	}
+
+	grant := fmt.Sprintf("*: %s\n", srv)
+	if admin != srv {
+		grant = fmt.Sprintf("*: %s, %s\n", srv, admin)
+	}
+	e, err := packFile(cfg, store, name, []byte(grant))
+	if err != nil {
+		return fmt.Errorf("store %s: %w", name, err)
+	}
+	if err := st.Put(ctx, e); err != nil {
+		return fmt.Errorf("create %s: %w", name, err)
+	}
+	slog.Info("created access file", "pathname", name, "admin", admin)
+
+	return nil
+}
+
+// packFile stores data in a single plain-packed block, which the directory
+// server can read without holding any keys, and returns its entry.
+func packFile(cfg upspin.Config, store upspin.StoreServer, name upspin.PathName, data []byte) (*upspin.DirEntry, error) {
+	e := &upspin.DirEntry{
+		Name:       name,
+		SignedName: name,
+		Packing:    upspin.PlainPack,
+		Writer:     cfg.UserName(),
+		Time:       upspin.Now(),
+		Sequence:   upspin.SeqIgnore,
+	}
+
+	bp, err := pack.Lookup(upspin.PlainPack).Pack(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := bp.Pack(data)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := store.Put(cipher)
+	if err != nil {
+		return nil, err
+	}
+	bp.SetLocation(upspin.Location{Endpoint: cfg.StoreEndpoint(), Reference: ref.Reference})
+	if err := bp.Close(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/upspin"
+	"upspin.io/user"
+)
+
+// treeRoot serves the Merkle hash of a tree's root directory at /tree/<user>,
+// so that the operators of replicas can check whether a replica's copy of the
+// tree is identical to the primary's by comparing the hashes they serve. Where
+// copies differ is found by comparing the databases with flyadmin diff. As the
+// hash reveals whether a tree changed, requests must present the replication
+// secret as a bearer token.
+func treeRoot(st *sqlite.State, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, secret) {
+			return
+		}
+
+		name := upspin.UserName(strings.TrimPrefix(r.URL.Path, "/tree/"))
+		if _, err := user.Clean(name); err != nil {
+			http.Error(w, "invalid user name", http.StatusBadRequest)
+			return
+		}
+
+		n, err := st.Node(r.Context(), upspin.PathName(name+"/"))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "tree root retrieval failed", "err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		} else if n.Hash == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Hash string `json:"hash"`
+		}{hex.EncodeToString(n.Hash)})
+	}
+}
@@ -0,0 +1,228 @@
+package dirserver
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"upspin.io/access"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+/*
+The access cache spares lookups the walk up the tree to the governing Access
+file, and the evaluation of its rules, which may involve loading groups. It
+holds:
+- for every directory, the entry of the Access file governing it, or none
+- for every requester, version of an Access file, and right, whether the right
+  is granted
+
+Decisions are keyed by the sequence of the Access file, so that putting or
+deleting one only requires forgetting the directories it governs. Decisions
+made by Access files granting rights to groups are forgotten whenever a Group
+file is put or deleted, as groups may include each other.
+
+Results computed from the state are only cached if no invalidation happened
+while they were computed, as they may predate it.
+
+Only the changes made through Put and Delete, and those reported to
+Invalidate, are noticed. Other processes writing to the state, such as
+flyadmin import and fsck -repair, must not run while the server is, or the
+server must be restarted after them. Compaction only removes past versions, so
+leaves what is cached valid.
+*/
+
+// Bounds on the number of directories and decisions cached; once reached, the
+// respective map is cleared.
+const (
+	maxCachedDirs      = 1 << 16
+	maxCachedDecisions = 1 << 16
+)
+
+// accessCache is safe for concurrent use. A nil accessCache caches nothing.
+type accessCache struct {
+	mu sync.Mutex
+	// Incremented by every invalidation.
+	gen       uint64
+	dirs      map[upspin.PathName]*upspin.DirEntry
+	decisions map[decisionKey]decision
+}
+
+type decisionKey struct {
+	requester upspin.UserName
+	// The Access file and its sequence, or the root of the tree and -1 when
+	// the default owner-only rights apply.
+	access upspin.PathName
+	seq    int64
+	right  access.Right
+	// access.Can treats Access and Group files specially.
+	accessFile, groupFile bool
+}
+
+type decision struct {
+	granted bool
+	// Whether the Access file grants any right to a group.
+	groups bool
+}
+
+func newAccessCache() *accessCache {
+	return &accessCache{
+		dirs:      make(map[upspin.PathName]*upspin.DirEntry),
+		decisions: make(map[decisionKey]decision),
+	}
+}
+
+func (c *accessCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// governing returns a copy of the entry of the Access file governing a
+// directory, and whether it was cached.
+func (c *accessCache) governing(dir upspin.PathName) (*upspin.DirEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ae, ok := c.dirs[dir]
+	if ae != nil {
+		ae = ae.Copy()
+	}
+
+	return ae, ok
+}
+
+// setGoverning records the Access file governing directories, as found in the
+// state at generation gen.
+func (c *accessCache) setGoverning(gen uint64, dirs []upspin.PathName, ae *upspin.DirEntry) {
+	if c == nil {
+		return
+	}
+	if ae != nil {
+		ae = ae.Copy()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if len(c.dirs)+len(dirs) > maxCachedDirs {
+		clear(c.dirs)
+	}
+	for _, d := range dirs {
+		c.dirs[d] = ae
+	}
+}
+
+func (c *accessCache) decision(k decisionKey) (bool, bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.decisions[k]
+
+	return d.granted, ok
+}
+
+// setDecision records a decision made at generation gen.
+func (c *accessCache) setDecision(gen uint64, k decisionKey, d decision) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if len(c.decisions) >= maxCachedDecisions {
+		clear(c.decisions)
+	}
+	c.decisions[k] = d
+}
+
+// invalidate forgets what depends on an entry that was put or deleted, if it is
+// an Access or Group file.
+func (c *accessCache) invalidate(name upspin.PathName) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case access.IsAccessFile(name):
+		prefix := strings.TrimSuffix(string(path.DropPath(name, 1)), "/") + "/"
+		for d := range c.dirs {
+			if string(d)+"/" == prefix || strings.HasPrefix(string(d), prefix) {
+				delete(c.dirs, d)
+			}
+		}
+		// Decisions for other versions are unreachable.
+		for k := range c.decisions {
+			if k.access == name {
+				delete(c.decisions, k)
+			}
+		}
+	case access.IsGroupFile(name):
+		for k, d := range c.decisions {
+			if d.groups {
+				delete(c.decisions, k)
+			}
+		}
+	default:
+		return
+	}
+	c.gen++
+}
+
+// grantsGroups reports whether an Access file grants any right to a group.
+func grantsGroups(a *access.Access) bool {
+	for _, r := range []access.Right{access.Read, access.Write, access.List, access.Create, access.Delete} {
+		for _, p := range a.List(r) {
+			if p.NElem() > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Invalidator is implemented by the servers returned by New and their Dial
+// method.
+type Invalidator interface {
+	// Invalidate must be called after an entry is put or deleted in the
+	// state other than through the server, such as by replication, for the
+	// server to forget what it cached about the access rights it governs.
+	// Writes by other processes go unnoticed, so the server must be
+	// restarted after them.
+	Invalidate(upspin.PathName)
+}
+
+// Invalidate implements Invalidator.
+func (d *dialed) Invalidate(name upspin.PathName) {
+	d.changed(context.TODO(), name)
+}
+
+// changed is called after an entry is put or deleted, to invalidate what was
+// cached about Access and Group files.
+func (d *dialed) changed(ctx context.Context, name upspin.PathName) {
+	d.rights.invalidate(name)
+	if access.IsGroupFile(name) {
+		if err := d.cache.RemoveGroup(ctx, name); err != nil {
+			d.log.WarnContext(ctx, "failed to remove group from cache", "group", name, "err", err)
+		}
+	}
+}
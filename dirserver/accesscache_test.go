@@ -0,0 +1,163 @@
+package dirserver
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// countingState counts the lookups made by accessFor.
+type countingState struct {
+	state.State
+	lookups int
+}
+
+func (s *countingState) Lookup(ctx context.Context, name upspin.PathName) (*upspin.DirEntry, error) {
+	s.lookups++
+	return s.State.Lookup(ctx, name)
+}
+
+// groupCache serves group files from a map, and removes them from the access
+// package's cache as the real cache does.
+type groupCache struct {
+	*cache
+	groups  map[upspin.PathName]string
+	expired func(upspin.PathName)
+}
+
+func (c *groupCache) GetGroup(ctx context.Context, n upspin.PathName) ([]byte, error) {
+	g, ok := c.groups[n]
+	if !ok {
+		return nil, errors.E(n, errors.NotExist)
+	}
+	return []byte(g), nil
+}
+
+func (c *groupCache) RemoveGroup(ctx context.Context, n upspin.PathName) error {
+	access.RemoveGroup(n)
+	return nil
+}
+
+func (c *groupCache) OnGroupExpired(f func(upspin.PathName)) {
+	c.expired = f
+}
+
+// expire removes a group as the real cache does once its TTL has passed.
+func (c *groupCache) expire(n upspin.PathName) {
+	access.RemoveGroup(n)
+	c.expired(n)
+}
+
+func TestAccessCache(t *testing.T) {
+	entries := []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/dir"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/dir/file"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"},
+	}
+
+	st := &countingState{State: memory.New()}
+	c := &groupCache{cache: &cache{map[upspin.PathName]string{"foo@example.com/Access": "*: foo@example.com"}}, groups: map[upspin.PathName]string{}}
+	s := newTestServer(t, st, c, entries)
+	foo := s.as("foo@example.com")
+	bar := s.as("bar@example.com")
+
+	// Put reads Access and Group files to check them.
+	defer func(f func(upspin.Config, *upspin.DirEntry) ([]byte, error)) { readAll = f }(readAll)
+	readAll = func(_ upspin.Config, e *upspin.DirEntry) ([]byte, error) {
+		if access.IsAccessFile(e.Name) {
+			return []byte(c.access[e.Name]), nil
+		}
+		return []byte(c.groups[e.Name]), nil
+	}
+	fooPut := func(e *upspin.DirEntry) {
+		t.Helper()
+		if _, err := foo.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// lookup checks the kind of error bar gets, or errors.Other for none.
+	lookup := func(want errors.Kind) {
+		t.Helper()
+		_, err := bar.Lookup("foo@example.com/dir/file")
+		if want == errors.Other && err != nil || want != errors.Other && !errors.Is(want, err) {
+			t.Errorf("lookup: got %v, want %v", err, want)
+		}
+	}
+
+	lookup(errors.Private)
+	first := st.lookups
+	lookup(errors.Private)
+	if second := st.lookups - first; second >= first {
+		t.Errorf("governing Access file looked up again: %d lookups, then %d", first, second)
+	}
+
+	// The cached decision stands until the Access file is put.
+	c.access["foo@example.com/Access"] = "*: foo@example.com\nread: bar@example.com"
+	lookup(errors.Private)
+	fooPut(&upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"})
+	lookup(errors.Other)
+
+	// An Access file put in a subdirectory governs it from then on.
+	c.access["foo@example.com/dir/Access"] = "read: foo@example.com, foo@example.com/Group/friends"
+	c.groups["foo@example.com/Group/friends"] = "baz@example.com"
+	fooPut(&upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/dir/Access"})
+	if ae, err := foo.WhichAccess("foo@example.com/dir/file"); err != nil || ae == nil || ae.Name != "foo@example.com/dir/Access" {
+		t.Errorf("WhichAccess after putting an Access file: %v, %v", ae, err)
+	}
+	lookup(errors.Private)
+
+	// Decisions involving groups are forgotten when a group changes.
+	fooPut(&upspin.DirEntry{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/Group"})
+	c.groups["foo@example.com/Group/friends"] = "baz@example.com, bar@example.com"
+	fooPut(&upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Group/friends"})
+	lookup(errors.Other)
+
+	// Deleting the Access file restores the governance of the parent's.
+	if _, err := foo.Delete("foo@example.com/dir/Access"); err != nil {
+		t.Fatal(err)
+	}
+	if ae, err := foo.WhichAccess("foo@example.com/dir/file"); err != nil || ae == nil || ae.Name != "foo@example.com/Access" {
+		t.Errorf("WhichAccess after deleting an Access file: %v, %v", ae, err)
+	}
+}
+
+func TestGroupExpiry(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	st.Put(ctx, &upspin.DirEntry{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"})
+	st.Put(ctx, &upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/file"})
+	st.Put(ctx, &upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"})
+
+	c := &groupCache{
+		cache:  &cache{map[upspin.PathName]string{"foo@example.com/Access": "read: remote@example.net/Group/readers"}},
+		groups: map[upspin.PathName]string{"remote@example.net/Group/readers": "baz@example.com"},
+	}
+	srv := New(config.SetUserName(config.New(), "srv@example.com"), st, c, slog.Default())
+	svc, err := srv.Dial(config.SetUserName(config.New(), "bar@example.com"), upspin.Endpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar := svc.(upspin.DirServer)
+
+	if _, err := bar.Lookup("foo@example.com/file"); !errors.Is(errors.Private, err) {
+		t.Fatalf("lookup before joining the group: %v", err)
+	}
+	// The membership change goes unnoticed until the group expires.
+	c.groups["remote@example.net/Group/readers"] = "baz@example.com, bar@example.com"
+	if _, err := bar.Lookup("foo@example.com/file"); !errors.Is(errors.Private, err) {
+		t.Errorf("lookup before the group expired: %v", err)
+	}
+	c.expire("remote@example.net/Group/readers")
+	if _, err := bar.Lookup("foo@example.com/file"); err != nil {
+		t.Errorf("lookup after the group expired: %v", err)
+	}
+}
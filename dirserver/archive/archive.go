@@ -0,0 +1,244 @@
+// Defines a portable, streamable format for the contents of a user tree, used
+// to back up trees or move them between servers.
+//
+// An archive is a sequence of JSON values separated by newlines. The first is
+// a Header, followed by one Record per operation, and a final Trailer. Each
+// record carries a checksum chained over the checksum of the preceding record,
+// such that corruption, reordering or removal of records is detected while
+// streaming; the trailer detects truncation.
+package archive
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Version is the version of the format written by Writer.
+const Version = 1
+
+// Header is the first line of an archive.
+type Header struct {
+	Version int             `json:"version"`
+	Root    upspin.UserName `json:"root"`
+	// Whether the archive contains the full log history of the tree, rather
+	// than only its current state.
+	History bool `json:"history"`
+}
+
+// Record is a put or delete operation on the tree.
+type Record struct {
+	Name upspin.PathName `json:"name"`
+	// The time of a delete operation. The time of a put is that of its entry.
+	Time   upspin.Time `json:"time,omitempty"`
+	Delete bool        `json:"delete,omitempty"`
+	// The marshaled upspin.DirEntry of a put operation.
+	Entry []byte `json:"entry,omitempty"`
+	Sum   string `json:"sum"`
+}
+
+// Trailer is the last line of an archive.
+type Trailer struct {
+	Count int    `json:"count"`
+	Sum   string `json:"sum"`
+}
+
+// Writer writes an archive.
+type Writer struct {
+	enc   *json.Encoder
+	root  upspin.UserName
+	sum   []byte
+	count int
+}
+
+// NewWriter writes the header for an archive of the given user tree to w.
+func NewWriter(w io.Writer, root upspin.UserName, history bool) (*Writer, error) {
+	enc := json.NewEncoder(w)
+	h := Header{Version, root, history}
+	if err := enc.Encode(h); err != nil {
+		return nil, fmt.Errorf("write archive header: %w", err)
+	}
+
+	return &Writer{enc: enc, root: root, sum: headerSum(h)}, nil
+}
+
+// Put writes a put operation of a complete entry.
+func (w *Writer) Put(e *upspin.DirEntry) error {
+	b, err := e.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", e.Name, err)
+	}
+
+	return w.write(Record{Name: e.Name, Entry: b})
+}
+
+// Delete writes a delete operation.
+func (w *Writer) Delete(name upspin.PathName, t upspin.Time) error {
+	return w.write(Record{Name: name, Time: t, Delete: true})
+}
+
+func (w *Writer) write(r Record) error {
+	if p, err := path.Parse(r.Name); err != nil {
+		return err
+	} else if p.User() != w.root {
+		return fmt.Errorf("%s not in the tree of %s", r.Name, w.root)
+	}
+
+	w.sum = r.checksum(w.sum)
+	r.Sum = hex.EncodeToString(w.sum)
+	w.count++
+	if err := w.enc.Encode(r); err != nil {
+		return fmt.Errorf("write record for %s: %w", r.Name, err)
+	}
+
+	return nil
+}
+
+// Close writes the trailer. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.enc.Encode(Trailer{w.count, hex.EncodeToString(w.sum)}); err != nil {
+		return fmt.Errorf("write archive trailer: %w", err)
+	}
+
+	return nil
+}
+
+// Reader reads and verifies an archive.
+type Reader struct {
+	Header
+
+	dec   *json.Decoder
+	sum   []byte
+	count int
+}
+
+// NewReader reads the header of an archive from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var h Header
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("read archive header: %w", err)
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported archive version %d", h.Version)
+	}
+
+	return &Reader{Header: h, dec: dec, sum: headerSum(h)}, nil
+}
+
+// Next returns the next record in the archive, with its checksum verified.
+// After the last record it verifies the trailer and returns io.EOF.
+func (r *Reader) Next() (Record, error) {
+	// Records and the trailer are distinguished by their fields.
+	var v struct {
+		Record
+		Count *int `json:"count"`
+	}
+	if err := r.dec.Decode(&v); err == io.EOF {
+		return Record{}, fmt.Errorf("archive truncated after %d records", r.count)
+	} else if err != nil {
+		return Record{}, fmt.Errorf("read record %d: %w", r.count+1, err)
+	}
+
+	if v.Count != nil {
+		if *v.Count != r.count || v.Sum != hex.EncodeToString(r.sum) {
+			return Record{}, fmt.Errorf("archive trailer does not match its %d records", r.count)
+		}
+		return Record{}, io.EOF
+	}
+
+	rec := v.Record
+	r.sum = rec.checksum(r.sum)
+	r.count++
+	if rec.Sum != hex.EncodeToString(r.sum) {
+		return Record{}, fmt.Errorf("checksum mismatch for record %d (%s)", r.count, rec.Name)
+	}
+	if p, err := path.Parse(rec.Name); err != nil {
+		return Record{}, fmt.Errorf("record %d: %w", r.count, err)
+	} else if p.User() != r.Root {
+		return Record{}, fmt.Errorf("record %d: %s not in the tree of %s", r.count, rec.Name, r.Root)
+	}
+
+	return rec, nil
+}
+
+// DirEntry unmarshals the entry of a put record.
+func (r Record) DirEntry() (*upspin.DirEntry, error) {
+	e := new(upspin.DirEntry)
+	if _, err := e.Unmarshal(r.Entry); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %w", r.Name, err)
+	}
+	if e.Name != r.Name {
+		return nil, fmt.Errorf("entry %s does not match record %s", e.Name, r.Name)
+	}
+
+	return e, nil
+}
+
+// checksum returns the checksum of the record chained over prev.
+func (r Record) checksum(prev []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	fmt.Fprintf(h, "%s\x00%d\x00%t\x00", r.Name, r.Time, r.Delete)
+	h.Write(r.Entry)
+	return h.Sum(nil)
+}
+
+func headerSum(h Header) []byte {
+	s := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%t", h.Version, h.Root, h.History)))
+	return s[:]
+}
+
+// Import replays the records of an archive into st, returning the number of
+// records applied. Sequences are assigned by st as the records are applied,
+// and operations are recorded at the current time, but entries keep their
+// recorded Time, as do deletions if st implements state.TimedDeleter. The root
+// of the archive must not already exist in st.
+//
+// Records are applied as they are read, so an archive that fails verification
+// part way is left partially imported.
+func Import(ctx context.Context, r *Reader, st state.State) (int, error) {
+	root := upspin.PathName(r.Root + "/")
+	if e, err := st.Lookup(ctx, root); err != nil {
+		return 0, err
+	} else if e != nil {
+		return 0, fmt.Errorf("%s already exists", root)
+	}
+	td, timed := st.(state.TimedDeleter)
+
+	n := 0
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		if rec.Delete {
+			p, _ := path.Parse(rec.Name)
+			if timed {
+				err = td.DeleteAt(ctx, p, rec.Time)
+			} else {
+				err = st.Delete(ctx, p)
+			}
+		} else {
+			var e *upspin.DirEntry
+			if e, err = rec.DirEntry(); err == nil {
+				err = st.Put(ctx, e)
+			}
+		}
+		if err != nil {
+			return n, fmt.Errorf("apply record %d (%s): %w", n+1, rec.Name, err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,192 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+func populate(t *testing.T) *sqlite.State {
+	ctx := context.Background()
+	st, err := sqlite.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/bar"},
+		{
+			Packing:  upspin.PlainPack,
+			Packdata: []byte("packd"),
+			Blocks: []upspin.DirBlock{{
+				Location: upspin.Location{
+					Endpoint:  upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:123"},
+					Reference: "bazref",
+				},
+				Size: 24,
+			}},
+			Writer: "foo@example.com",
+			Time:   1000,
+			Name:   "foo@example.com/bar/baz",
+		},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/qux"},
+	} {
+		if err := st.Put(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quxp, _ := path.Parse("foo@example.com/qux")
+	if err := st.DeleteAt(ctx, quxp, 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	return st
+}
+
+func export(t *testing.T, st *sqlite.State, history bool) *bytes.Buffer {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "foo@example.com", history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if history {
+		err = st.WalkLog(ctx, "foo@example.com", 0, func(op sqlite.Operation) error {
+			if op.Entry == nil {
+				return w.Delete(op.Name, op.Time)
+			}
+			return w.Put(op.Entry)
+		})
+	} else {
+		err = st.WalkProj(ctx, "foo@example.com", w.Put)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+// An imported archive reproduces the tree it was exported from, whether it
+// contains the history or the current state of the tree.
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := populate(t)
+	defer src.Close()
+
+	for _, history := range []bool{true, false} {
+		buf := export(t, src, history)
+
+		dst, err := sqlite.Open(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := Import(ctx, r, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if history && n != 5 || !history && n != 3 {
+			t.Errorf("wrong number of records imported (history %t): %d", history, n)
+		}
+
+		bazp, _ := path.Parse("foo@example.com/bar/baz")
+		es, _, err := dst.LookupAll(ctx, bazp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(es) != 3 {
+			t.Fatalf("wrong number of entries: %d", len(es))
+		}
+		if history && es[0].Sequence != 5 {
+			t.Errorf("wrong sequence for root: %d", es[0].Sequence)
+		}
+		if es[2].Time != 1000 {
+			t.Errorf("time not preserved for baz: %d", es[2].Time)
+		}
+		baz, err := dst.Lookup(ctx, "foo@example.com/bar/baz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(baz.Blocks) != 1 || baz.Blocks[0].Location.Reference != "bazref" {
+			t.Errorf("blocks not preserved for baz: %v", baz.Blocks)
+		}
+		if e, err := dst.Lookup(ctx, "foo@example.com/qux"); err != nil {
+			t.Error(err)
+		} else if e != nil {
+			t.Errorf("deleted entry imported: %v", e)
+		}
+		if history {
+			vs, err := dst.Versions(ctx, "foo@example.com/qux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vs) != 2 || !vs[1].Deleted || vs[1].Time != 2000 {
+				t.Errorf("time not preserved for deletion of qux: %+v", vs)
+			}
+		}
+
+		// The tree now exists.
+		r, err = NewReader(export(t, src, history))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Import(ctx, r, dst); err == nil {
+			t.Error("archive imported over an existing tree")
+		}
+
+		dst.Close()
+	}
+}
+
+// Reading fails on modified or truncated archives.
+func TestCorruption(t *testing.T) {
+	src := populate(t)
+	defer src.Close()
+	archive := export(t, src, true).String()
+
+	readAll := func(s string) error {
+		r, err := NewReader(strings.NewReader(s))
+		if err != nil {
+			return err
+		}
+		for {
+			if _, err := r.Next(); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+
+	if err := readAll(archive); err != nil {
+		t.Fatalf("intact archive failed verification: %v", err)
+	}
+
+	lines := strings.SplitAfter(archive, "\n")
+	if err := readAll(strings.Join(lines[:len(lines)-2], "")); err == nil {
+		t.Error("truncated archive passed verification")
+	}
+	swapped := append([]string{lines[0], lines[2], lines[1]}, lines[3:]...)
+	if err := readAll(strings.Join(swapped, "")); err == nil {
+		t.Error("reordered archive passed verification")
+	}
+	modified := strings.Replace(archive, "foo@example.com/qux", "foo@example.com/quux", 1)
+	if err := readAll(modified); err == nil {
+		t.Error("modified archive passed verification")
+	}
+}
@@ -0,0 +1,123 @@
+// Implements a state.Cache that retrieves access and group file contents
+// through the upspin client, as the server user. Group files held by the
+// server's own state are read from it, without consulting the configured key
+// server or the directory server.
+//
+// upspin.io/access keeps the groups it loads in a global cache, consulting the
+// loader passed to access.Can only for groups missing from it. Groups are
+// therefore only ever loaded through GetGroup, and removed from the global cache
+// whenever they are removed from this one: local groups when RemoveGroup is
+// called as their files change, and remote groups, whose changes go unnoticed,
+// once they are older than GroupTTL.
+//
+// Remote groups that cannot be fetched again once expired, because their
+// servers are unreachable or too slow, are served as last fetched. Fetches
+// still in progress after FetchTimeout are abandoned, and made again by the
+// next request. Groups found missing, unparseable or unreadable by the server
+// user are remembered as such for MissingTTL. Every outcome of fetching a
+// group is logged and counted in the "groups" expvar map.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/client"
+	"upspin.io/client/clientutil"
+	"upspin.io/upspin"
+)
+
+// Defaults of the fields of caches returned by New.
+const (
+	DefaultGroupTTL     = 5 * time.Minute
+	DefaultMissingTTL   = time.Minute
+	DefaultGroupTimeout = 10 * time.Second
+	DefaultFetchTimeout = time.Minute
+)
+
+// The exported fields must not be changed once the cache is in use.
+type Cache struct {
+	// How long remote groups are cached for.
+	GroupTTL time.Duration
+	// How long groups found missing, unparseable or unreadable are
+	// remembered for.
+	MissingTTL time.Duration
+	// How long requests wait for a group to be fetched.
+	GroupTimeout time.Duration
+	// How long a fetch is left to complete for later requests before it is
+	// abandoned. The clients used to fetch groups can not be cancelled, so
+	// an abandoned fetch is only ignored when it completes.
+	FetchTimeout time.Duration
+	Log          *slog.Logger
+
+	cfg    upspin.Config
+	client upspin.Client
+	// The state of the directory server using the cache, or nil.
+	local state.State
+
+	mu sync.Mutex
+	// Parsed access files, keyed by the entry they were parsed from. Entries
+	// are immutable, so these never need to be invalidated.
+	access map[accessKey]*access.Access
+	// Group file contents, as also held by upspin.io/access, and groups
+	// found missing or expired.
+	groups map[upspin.PathName]*group
+	// Fetches of groups in progress.
+	fetches map[upspin.PathName]*fetch
+	// Called with the name of every group that expires.
+	expired []func(upspin.PathName)
+}
+
+type accessKey struct {
+	name upspin.PathName
+	seq  int64
+}
+
+// New returns a cache that reads files as the user in cfg. If local is not nil,
+// group files it holds are looked up in it rather than through the client.
+func New(cfg upspin.Config, local state.State) *Cache {
+	return &Cache{
+		GroupTTL:     DefaultGroupTTL,
+		MissingTTL:   DefaultMissingTTL,
+		GroupTimeout: DefaultGroupTimeout,
+		FetchTimeout: DefaultFetchTimeout,
+		Log:          slog.Default(),
+		cfg:          cfg,
+		client:       client.New(cfg),
+		local:        local,
+		access:       make(map[accessKey]*access.Access),
+		groups:       make(map[upspin.PathName]*group),
+		fetches:      make(map[upspin.PathName]*fetch),
+	}
+}
+
+// GetAccess implements state.Cache.
+func (c *Cache) GetAccess(ctx context.Context, e *upspin.DirEntry) (*access.Access, error) {
+	k := accessKey{e.Name, e.Sequence}
+	c.mu.Lock()
+	a, ok := c.access[k]
+	c.mu.Unlock()
+	if ok {
+		return a, nil
+	}
+
+	data, err := clientutil.ReadAll(c.cfg, e)
+	if err != nil {
+		return nil, fmt.Errorf("read access file %s: %w", e.Name, err)
+	}
+	a, err = access.Parse(e.Name, data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.access[k] = a
+	c.mu.Unlock()
+
+	return a, nil
+}
@@ -0,0 +1,349 @@
+package cache
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// fakeClient serves files from a map, failing with err if set, and waiting for
+// block to be closed if set.
+type fakeClient struct {
+	upspin.Client
+
+	mu    sync.Mutex
+	files map[upspin.PathName]string
+	err   error
+	block chan struct{}
+	gets  int
+}
+
+func (c *fakeClient) Get(name upspin.PathName) ([]byte, error) {
+	c.mu.Lock()
+	c.gets++
+	block := c.block
+	c.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	f, ok := c.files[name]
+	if !ok {
+		return nil, errors.E(name, errors.NotExist)
+	}
+	return []byte(f), nil
+}
+
+func (c *fakeClient) put(name upspin.PathName, data string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.files[name] = data
+}
+
+func (c *fakeClient) set(err error, block chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err, c.block = err, block
+}
+
+func (c *fakeClient) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gets
+}
+
+func newCache(ttl time.Duration, files map[upspin.PathName]string) (*Cache, *fakeClient) {
+	cl := &fakeClient{files: files}
+	c := &Cache{
+		GroupTTL:     ttl,
+		MissingTTL:   ttl,
+		GroupTimeout: time.Second,
+		FetchTimeout: time.Hour,
+		Log:          slog.Default(),
+		client:       cl,
+		access:       make(map[accessKey]*access.Access),
+		groups:       make(map[upspin.PathName]*group),
+		fetches:      make(map[upspin.PathName]*fetch),
+	}
+
+	return c, cl
+}
+
+// metric returns the value of a counter in the groups expvar map.
+func metric(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// canRead reports whether the Access file at root grants bar@example.com the
+// right to read a file beside it, loading groups through the cache.
+func canRead(t *testing.T, c *Cache, root upspin.PathName, rules string) bool {
+	t.Helper()
+	a, err := access.Parse(root+"/Access", []byte(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(n upspin.PathName) ([]byte, error) {
+		return c.GetGroup(context.Background(), n)
+	}
+	ok, err := a.Can("bar@example.com", access.Read, root+"/file", load)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ok
+}
+
+func TestRemoveGroup(t *testing.T) {
+	const group = "local@example.com/Group/readers"
+	rules := "read: " + group
+	c, cl := newCache(time.Hour, map[upspin.PathName]string{group: "baz@example.com"})
+
+	if canRead(t, c, "local@example.com", rules) {
+		t.Fatal("read granted before joining the group")
+	}
+	cl.put(group, "baz@example.com, bar@example.com")
+	if canRead(t, c, "local@example.com", rules) {
+		t.Error("group fetched again before it was removed")
+	}
+	if err := c.RemoveGroup(context.Background(), group); err != nil {
+		t.Fatal(err)
+	}
+	if !canRead(t, c, "local@example.com", rules) {
+		t.Error("membership change ignored after the group was removed")
+	}
+}
+
+func TestGroupTTL(t *testing.T) {
+	const (
+		outer = "remote@example.net/Group/all"
+		inner = "remote@example.net/Group/readers"
+	)
+	rules := "read: " + outer
+	c, cl := newCache(200*time.Millisecond, map[upspin.PathName]string{
+		outer: inner,
+		inner: "baz@example.com",
+	})
+	expired := make(chan upspin.PathName, 2)
+	c.OnGroupExpired(func(n upspin.PathName) { expired <- n })
+
+	if canRead(t, c, "remote@example.net", rules) {
+		t.Fatal("read granted before joining the group")
+	}
+	cl.put(inner, "baz@example.com, bar@example.com")
+	if canRead(t, c, "remote@example.net", rules) {
+		t.Error("group fetched again before it expired")
+	}
+
+	got := map[upspin.PathName]bool{}
+	for len(got) < 2 {
+		select {
+		case n := <-expired:
+			got[n] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("groups not expired: got %v", got)
+		}
+	}
+	if !got[outer] || !got[inner] {
+		t.Errorf("expired %v, want %s and %s", got, outer, inner)
+	}
+	if !canRead(t, c, "remote@example.net", rules) {
+		t.Error("membership change ignored after the group expired")
+	}
+}
+
+func TestMissingGroup(t *testing.T) {
+	const group = "missing@example.net/Group/readers"
+	ctx := context.Background()
+	c, cl := newCache(200*time.Millisecond, map[upspin.PathName]string{})
+
+	missing := metric("missing_cached")
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetGroup(ctx, group); !errors.Is(errors.NotExist, err) {
+			t.Fatalf("got %v, want NotExist", err)
+		}
+	}
+	if n := cl.count(); n != 1 {
+		t.Errorf("missing group fetched %d times, want once", n)
+	}
+	if n := metric("missing_cached") - missing; n != 2 {
+		t.Errorf("missing_cached increased by %d, want 2", n)
+	}
+
+	cl.put(group, "bar@example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := c.GetGroup(ctx, group)
+		if err == nil {
+			if string(data) != "bar@example.com" {
+				t.Errorf("got %q", data)
+			}
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("missing group never fetched again: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStaleGroup(t *testing.T) {
+	const group = "stale@example.net/Group/readers"
+	rules := "read: " + group
+	c, cl := newCache(100*time.Millisecond, map[upspin.PathName]string{group: "bar@example.com"})
+	expired := make(chan upspin.PathName, 1)
+	c.OnGroupExpired(func(n upspin.PathName) { expired <- n })
+
+	if !canRead(t, c, "stale@example.net", rules) {
+		t.Fatal("read denied to a member")
+	}
+	cl.set(errors.E(errors.Net, errors.Str("connection refused")), nil)
+	select {
+	case <-expired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("group not expired")
+	}
+
+	stale := metric("stale")
+	if !canRead(t, c, "stale@example.net", rules) {
+		t.Error("last known copy not served while the server is unreachable")
+	}
+	if n := metric("stale") - stale; n != 1 {
+		t.Errorf("stale increased by %d, want 1", n)
+	}
+
+	// Once the group changed, the last known copy is forgotten.
+	if err := c.RemoveGroup(context.Background(), group); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetGroup(context.Background(), group); !errors.Is(errors.Net, err) {
+		t.Errorf("got %v, want the error of the client", err)
+	}
+}
+
+func TestGroupTimeout(t *testing.T) {
+	const group = "slow@example.net/Group/readers"
+	ctx := context.Background()
+	c, cl := newCache(time.Hour, map[upspin.PathName]string{group: "bar@example.com"})
+	c.GroupTimeout = 50 * time.Millisecond
+	block := make(chan struct{})
+	cl.set(nil, block)
+
+	timeouts := metric("timeout")
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetGroup(ctx, group); !errors.Is(errors.IO, err) {
+			t.Errorf("got %v, want a timeout", err)
+		}
+	}
+	if n := metric("timeout") - timeouts; n != 2 {
+		t.Errorf("timeout increased by %d, want 2", n)
+	}
+	if n := cl.count(); n != 1 {
+		t.Errorf("group fetched %d times while the first fetch was in progress", n)
+	}
+
+	// The abandoned fetch completes for later requests.
+	close(block)
+	data, err := c.GetGroup(ctx, group)
+	if err != nil || string(data) != "bar@example.com" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if n := cl.count(); n != 1 {
+		t.Errorf("group fetched %d times, want once", n)
+	}
+}
+
+func TestUnreadableGroup(t *testing.T) {
+	const group = "private@example.net/Group/readers"
+	ctx := context.Background()
+	c, cl := newCache(200*time.Millisecond, map[upspin.PathName]string{})
+	cl.set(errors.E(group, errors.Permission), nil)
+
+	failed := metric("failed_cached")
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetGroup(ctx, group); !errors.Is(errors.Permission, err) {
+			t.Fatalf("got %v, want Permission", err)
+		}
+	}
+	if n := cl.count(); n != 1 {
+		t.Errorf("unreadable group fetched %d times, want once", n)
+	}
+	if n := metric("failed_cached") - failed; n != 2 {
+		t.Errorf("failed_cached increased by %d, want 2", n)
+	}
+
+	// Unparseable groups are remembered as well.
+	const bad = "bad@example.net/Group/readers"
+	cl.set(nil, nil)
+	cl.put(bad, "not a group: !")
+	gets := cl.count()
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetGroup(ctx, bad); err == nil {
+			t.Fatal("unparseable group loaded")
+		}
+	}
+	if n := cl.count() - gets; n != 1 {
+		t.Errorf("unparseable group fetched %d times, want once", n)
+	}
+
+	cl.put(group, "bar@example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := c.GetGroup(ctx, group)
+		if err == nil {
+			if string(data) != "bar@example.com" {
+				t.Errorf("got %q", data)
+			}
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("unreadable group never fetched again: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	const group = "stuck@example.net/Group/readers"
+	ctx := context.Background()
+	c, cl := newCache(time.Hour, map[upspin.PathName]string{group: "bar@example.com"})
+	c.FetchTimeout = 50 * time.Millisecond
+	block := make(chan struct{})
+	cl.set(nil, block)
+
+	abandoned := metric("abandoned")
+	if _, err := c.GetGroup(ctx, group); !errors.Is(errors.IO, err) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if n := metric("abandoned") - abandoned; n != 1 {
+		t.Errorf("abandoned increased by %d, want 1", n)
+	}
+
+	// The next request fetches the group again.
+	cl.set(nil, nil)
+	data, err := c.GetGroup(ctx, group)
+	if err != nil || string(data) != "bar@example.com" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if n := cl.count(); n != 2 {
+		t.Errorf("group fetched %d times, want twice", n)
+	}
+
+	// The abandoned fetch completing is ignored.
+	close(block)
+}
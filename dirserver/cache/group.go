@@ -0,0 +1,373 @@
+package cache
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"time"
+
+	"upspin.io/access"
+	"upspin.io/client/clientutil"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Counts the outcomes of fetching groups, and the requests for groups known to
+// be missing.
+var metrics = expvar.NewMap("groups")
+
+// How soon a remote group served as last fetched is fetched again.
+const staleRetry = 30 * time.Second
+
+type group struct {
+	// The contents of the group, or nil if it is missing, unparseable or
+	// unreadable.
+	data []byte
+	// Why data is nil: errors.NotExist if the group is missing, else the
+	// error parsing or reading it.
+	err error
+	// Whether it was read from the local state.
+	local bool
+	// Whether it expired, and was removed from upspin.io/access; data is then
+	// the last known copy.
+	expired bool
+	// Whether data is the last known copy, served as the group could not be
+	// fetched again.
+	stale bool
+	// Expires remote and missing groups; nil for local groups.
+	timer *time.Timer
+}
+
+// A fetch of a group, shared by all requests for it until it completes or is
+// abandoned.
+type fetch struct {
+	done chan struct{}
+	// Set when done is closed, unless the fetch is stale.
+	data []byte
+	err  error
+	// Whether the group was removed since the fetch started, in which case
+	// it may have been fetched as it was before it changed.
+	stale bool
+	// Whether the fetch completed, and whether it was abandoned after
+	// FetchTimeout, in which case done was closed and its outcome is
+	// ignored.
+	completed, abandoned bool
+	timer                *time.Timer
+}
+
+// storeError is returned by getLocal for a group whose entry was found, but
+// whose contents could not be read.
+type storeError struct {
+	err error
+}
+
+func (e storeError) Error() string {
+	return e.err.Error()
+}
+
+// GetGroup implements state.Cache. Fetches taking longer than GroupTimeout are
+// abandoned by the request, but left to complete for later ones until
+// FetchTimeout.
+func (c *Cache) GetGroup(ctx context.Context, name upspin.PathName) ([]byte, error) {
+	c.mu.Lock()
+	for {
+		if g, ok := c.groups[name]; ok && !g.expired {
+			c.mu.Unlock()
+			if g.data == nil {
+				if errors.Is(errors.NotExist, g.err) {
+					metrics.Add("missing_cached", 1)
+				} else {
+					metrics.Add("failed_cached", 1)
+				}
+				return nil, g.err
+			}
+			return g.data, nil
+		}
+		f, ok := c.fetches[name]
+		if !ok {
+			f = c.startFetch(name)
+		}
+		c.mu.Unlock()
+
+		t := time.NewTimer(c.GroupTimeout)
+		select {
+		case <-f.done:
+			t.Stop()
+		case <-t.C:
+			return c.timedOut(ctx, name)
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+
+		c.mu.Lock()
+		if !f.stale {
+			c.mu.Unlock()
+			return f.data, f.err
+		}
+	}
+}
+
+// startFetch fetches a group in the background, abandoning the fetch after
+// FetchTimeout. The lock must be held.
+func (c *Cache) startFetch(name upspin.PathName) *fetch {
+	f := &fetch{done: make(chan struct{})}
+	c.fetches[name] = f
+	f.timer = time.AfterFunc(c.FetchTimeout, func() { c.abandon(name, f) })
+
+	go func() {
+		data, local, err := c.readGroup(name)
+
+		c.mu.Lock()
+		f.timer.Stop()
+		f.completed = true
+		if f.abandoned {
+			c.mu.Unlock()
+			c.Log.InfoContext(context.Background(), "abandoned fetch of group completed", "group", name, "err", err)
+			return
+		}
+		if c.fetches[name] == f {
+			delete(c.fetches, name)
+		}
+		var evict bool
+		if !f.stale {
+			f.data, evict, f.err = c.fetched(name, data, local, err)
+		}
+		fs := c.expired
+		c.mu.Unlock()
+		close(f.done)
+
+		// upspin.io/access holds the last known copy served meanwhile.
+		if evict {
+			access.RemoveGroup(name)
+			for _, fn := range fs {
+				fn(name)
+			}
+		}
+	}()
+
+	return f
+}
+
+// abandon gives up a fetch still in progress, so that the next request for
+// the group fetches it again. Requests waiting for it are served the last known
+// copy of the group, if any.
+func (c *Cache) abandon(name upspin.PathName, f *fetch) {
+	ctx := context.Background()
+	c.mu.Lock()
+	if f.completed {
+		c.mu.Unlock()
+		return
+	}
+	if c.fetches[name] == f {
+		delete(c.fetches, name)
+	}
+	f.abandoned = true
+
+	metrics.Add("abandoned", 1)
+	c.Log.WarnContext(ctx, "fetch of group abandoned", "group", name, "timeout", c.FetchTimeout)
+	if !f.stale {
+		var ok bool
+		if f.data, ok = c.serveStale(ctx, name); !ok {
+			f.err = errors.E(name, errors.IO, errors.Str("timed out"))
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// fetched records, logs and counts the outcome of fetching a group, returning
+// the result of the fetch for requests, and whether a last known copy served
+// earlier must be evicted from upspin.io/access. The lock must be held.
+func (c *Cache) fetched(name upspin.PathName, data []byte, local bool, err error) ([]byte, bool, error) {
+	ctx := context.Background()
+	log := c.Log.With("group", name, "local", local)
+	last := c.groups[name]
+	evict := last != nil && last.stale && !last.expired
+
+	if err == nil {
+		p, _ := path.Parse(name)
+		if _, err := access.ParseGroup(p, data); err != nil {
+			metrics.Add("invalid", 1)
+			// Only local groups can be fixed by the users of this server.
+			level := slog.LevelWarn
+			if local {
+				level = slog.LevelError
+			}
+			log.Log(ctx, level, "group unparseable", "err", err)
+			c.set(name, &group{err: err, local: local})
+			return nil, evict, err
+		}
+		metrics.Add("loaded", 1)
+		log.DebugContext(ctx, "group loaded")
+		c.set(name, &group{data: data, local: local})
+		return data, evict, nil
+	}
+	if errors.Is(errors.NotExist, err) {
+		metrics.Add("missing", 1)
+		log.InfoContext(ctx, "group not found")
+		c.set(name, &group{err: errors.E(name, errors.NotExist), local: local})
+		return nil, evict, err
+	}
+
+	switch {
+	case local:
+		server := "state"
+		if _, ok := err.(storeError); ok {
+			server = "store"
+		}
+		metrics.Add("unreachable", 1)
+		log.WarnContext(ctx, "local group server unreachable", "server", server, "err", err)
+	case errors.Is(errors.Permission, err) || errors.Is(errors.Private, err):
+		// The server user may have lost its right to read the group.
+		metrics.Add("denied", 1)
+		log.WarnContext(ctx, "remote group unreadable", "err", err)
+		c.set(name, &group{err: err})
+		return nil, evict, err
+	default:
+		metrics.Add("unreachable", 1)
+		log.WarnContext(ctx, "remote group server unreachable", "err", err)
+	}
+	if data, ok := c.serveStale(ctx, name); ok {
+		return data, false, nil
+	}
+
+	return nil, false, err
+}
+
+// timedOut is called when fetching a group takes longer than GroupTimeout.
+func (c *Cache) timedOut(ctx context.Context, name upspin.PathName) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	metrics.Add("timeout", 1)
+	c.Log.WarnContext(ctx, "fetching group timed out", "group", name, "timeout", c.GroupTimeout)
+	if data, ok := c.serveStale(ctx, name); ok {
+		return data, nil
+	}
+
+	return nil, errors.E(name, errors.IO, errors.Str("timed out"))
+}
+
+// serveStale returns the last known copy of an expired remote group, until it
+// is fetched again after staleRetry. The lock must be held.
+func (c *Cache) serveStale(ctx context.Context, name upspin.PathName) ([]byte, bool) {
+	g, ok := c.groups[name]
+	if !ok || g.data == nil || !g.expired && !g.stale {
+		return nil, false
+	}
+
+	metrics.Add("stale", 1)
+	c.Log.WarnContext(ctx, "serving last known copy of group", "group", name)
+	if g.expired {
+		g.expired, g.stale = false, true
+		g.timer = time.AfterFunc(staleRetry, func() { c.expire(name, g) })
+	}
+
+	return g.data, true
+}
+
+// set caches a group, expiring it unless it is local and has data. The lock must
+// be held.
+func (c *Cache) set(name upspin.PathName, g *group) {
+	if old, ok := c.groups[name]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	switch {
+	case g.data == nil:
+		g.timer = time.AfterFunc(c.MissingTTL, func() { c.expire(name, g) })
+	case !g.local:
+		g.timer = time.AfterFunc(c.GroupTTL, func() { c.expire(name, g) })
+	}
+	c.groups[name] = g
+}
+
+// readGroup reads a group file, reporting whether it was read from the local
+// state.
+func (c *Cache) readGroup(name upspin.PathName) ([]byte, bool, error) {
+	if c.local != nil {
+		data, err := c.getLocal(name)
+		if err == nil || !errors.Is(errors.NotExist, err) {
+			return data, true, err
+		}
+	}
+	data, err := c.client.Get(name)
+
+	return data, false, err
+}
+
+// getLocal reads a file held by the local state. Returns errors.NotExist if it
+// is not, or if the file must be resolved through links, in which case the
+// client should be used instead.
+func (c *Cache) getLocal(name upspin.PathName) ([]byte, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	e, err := c.local.Lookup(context.Background(), p.Path())
+	if err != nil {
+		return nil, err
+	} else if e == nil || e.IsLink() {
+		return nil, errors.E(name, errors.NotExist)
+	}
+
+	data, err := clientutil.ReadAll(c.cfg, e)
+	if err != nil {
+		return nil, storeError{err}
+	}
+
+	return data, nil
+}
+
+// RemoveGroup implements state.Cache.
+func (c *Cache) RemoveGroup(ctx context.Context, name upspin.PathName) error {
+	c.mu.Lock()
+	if g, ok := c.groups[name]; ok && g.timer != nil {
+		g.timer.Stop()
+	}
+	delete(c.groups, name)
+	if f, ok := c.fetches[name]; ok {
+		f.stale = true
+		delete(c.fetches, name)
+	}
+	c.mu.Unlock()
+
+	if err := access.RemoveGroup(name); err != nil && !errors.Is(errors.NotExist, err) {
+		return err
+	}
+	return nil
+}
+
+// OnGroupExpired implements state.GroupExpirer.
+func (c *Cache) OnGroupExpired(f func(upspin.PathName)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expired = append(c.expired, f)
+}
+
+// expire removes a remote group from upspin.io/access once its TTL has passed,
+// keeping it as the last known copy, and forgets a group that was missing,
+// unparseable or unreadable, unless it has since been replaced or removed.
+func (c *Cache) expire(name upspin.PathName, g *group) {
+	c.mu.Lock()
+	if c.groups[name] != g {
+		c.mu.Unlock()
+		return
+	}
+	if g.data == nil {
+		// Groups without data were never loaded by upspin.io/access.
+		delete(c.groups, name)
+		c.mu.Unlock()
+		return
+	}
+	g.expired = true
+	fs := c.expired
+	c.mu.Unlock()
+
+	access.RemoveGroup(name)
+	for _, f := range fs {
+		f(name)
+	}
+}
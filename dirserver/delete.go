@@ -1,8 +1,77 @@
 package dirserver
 
-import "upspin.io/upspin"
+import (
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+/*
+If the Delete path...
+- contains a link element other than the final one, return the link closest to
+  the root and upspin.ErrFollowLink if the user has any access right on the
+  link; a final link is deleted itself
+- does not grant any access rights to the requester, return errors.Private
+- does not exist, return errors.NotExist
+- is a directory with entries, return errors.NotEmpty
+- is a special file (Access or /Group/...), the user must be the owner
+- else the user must have the Delete permission at the path
+
+The deleted entry is returned without blocks or packing data, marked as
+incomplete.
+*/
 
 // Delete implements upspin.DirServer.
 func (d *dialed) Delete(name upspin.PathName) (*upspin.DirEntry, error) {
-	return nil, upspin.ErrNotSupported
+	ctx, op := d.setCtx("Delete")
+	d.log = d.log.With("pathname", name)
+
+	d.writes.Lock()
+	defer d.writes.Unlock()
+
+	p, e, ent, a, ae, err := d.lookup(ctx, name)
+	if err == upspin.ErrFollowLink && e.Name == p.Path() {
+		// The rights on the link are those of its directory.
+		ae, err = d.accessFor(ctx, p, false)
+		if err == nil && ae != nil {
+			a, err = d.loadAccess(ctx, ae)
+		}
+	}
+	if err == upspin.ErrFollowLink {
+		return e, err
+	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) || errors.Is(errors.NotExist, err) {
+		return nil, errors.E(op, p.Path(), err)
+	} else if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	if e.Name != p.Path() {
+		return nil, errors.E(op, p.Path(), errors.NotExist)
+	}
+
+	if access.IsAccessFile(p.Path()) || p.NElem() > 0 && p.Elem(0) == "Group" {
+		if d.requester != p.User() {
+			return nil, errors.E(op, p.Path(), errors.Permission, errors.Str("only the owner may delete Access and Group files"))
+		}
+	} else if granted, err := d.can(ctx, ae, a, access.Delete, p); err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	} else if !granted {
+		return nil, errors.E(op, p.Path(), errors.Permission)
+	}
+
+	if e.IsDir() {
+		children, err := d.state.List(ctx, ent)
+		if err != nil {
+			return nil, d.internalErr(ctx, op, p.Path(), err)
+		} else if len(children) > 0 {
+			return nil, errors.E(op, p.Path(), errors.NotEmpty)
+		}
+	}
+
+	if err := d.state.Delete(ctx, p); err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	d.changed(ctx, p.Path())
+
+	e.MarkIncomplete()
+	return e, nil
 }
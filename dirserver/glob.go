@@ -21,16 +21,10 @@ func (d *dialed) Glob(pattern string) ([]*upspin.DirEntry, error) {
 		return d.list(ctx, op, name)
 	}
 
-	// TODO multiple consecutive lookups should be in a transaction, to prevent
-	// race conditions with Delete(). But access checks involve ipc (multiple
-	// for remote group checks), ~~so perhaps the best solution is to perform the
-	// glob as though read+list rights are granted, queue the various access
-	// checks, and once they've completed elide what's needed from the result.~~
-	// Or, change the State interface to return and accept opaque entry
-	// identifiers on lookups which map to the append-only log, which foregoes
-	// the need for a transaction. This requires a tree of entries navigable
-	// from the root for every sequence update, now I understand why the
-	// reference implementation uses a Merkle tree.
+	// Access checks involve ipc (multiple for remote group checks), so no
+	// transaction is held across the lookups. Instead, list() works against
+	// the state handles of the versions it resolved, which remain valid if
+	// the tree is modified concurrently.
 	es, err := serverutil.Glob(pattern, lookup, ls)
 	if err != nil && err != upspin.ErrFollowLink {
 		// list() returns errors decorated with op, but serverutil.Glob()
@@ -59,16 +53,16 @@ func (d *dialed) list(ctx context.Context, op errors.Op, name upspin.PathName) (
 	// redundant partial lookups of the base path entries that were already
 	// retrieved. This could be solved by closing over a map of paths ->
 	// EntryIds.
-	p, e, a, _, err := d.lookup(ctx, name)
+	p, e, ent, a, ae, err := d.lookup(ctx, name)
 	if err == upspin.ErrFollowLink {
 		return []*upspin.DirEntry{e}, err
-	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) {
+	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) || errors.Is(errors.NotExist, err) {
 		return nil, errors.E(op, p.Path(), err)
 	} else if err != nil {
 		return nil, d.internalErr(ctx, op, p.Path(), err)
 	}
 
-	canList, err := d.can(ctx, a, access.List, p)
+	canList, err := d.can(ctx, ae, a, access.List, p)
 	if err != nil {
 		return nil, d.internalErr(ctx, op, p.Path(), err)
 	} else if !canList {
@@ -81,13 +75,22 @@ func (d *dialed) list(ctx context.Context, op errors.Op, name upspin.PathName) (
 		return nil, nil
 	}
 
-	es, err := d.state.List(ctx, p.Path())
+	// List the version of the directory that access was checked against.
+	ents, err := d.state.List(ctx, ent)
 	if err != nil {
 		return nil, d.internalErr(ctx, op, p.Path(), err)
 	}
+	es := make([]*upspin.DirEntry, 0, len(ents))
+	for _, ent := range ents {
+		e, err := d.state.Get(ctx, ent)
+		if err != nil {
+			return nil, d.internalErr(ctx, op, p.Path(), err)
+		}
+		es = append(es, e)
+	}
 
 	// Read access applies uniformly for files within a directory.
-	canRead, err := d.can(ctx, a, access.Read, p)
+	canRead, err := d.can(ctx, ae, a, access.Read, p)
 	if err != nil {
 		return nil, d.internalErr(ctx, op, p.Path(), err)
 	}
@@ -101,5 +104,5 @@ func (d *dialed) list(ctx context.Context, op errors.Op, name upspin.PathName) (
 		}
 	}
 
-	return nil, nil
+	return es, nil
 }
@@ -5,16 +5,12 @@ import (
 	"log/slog"
 	"testing"
 
-	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
 	"upspin.io/upspin"
 )
 
 func TestGlob(t *testing.T) {
-	st, err := sqlite.Open(":memory:")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer st.Close()
+	st := memory.New()
 	ctx := context.Background()
 	st.Put(ctx, &upspin.DirEntry{
 		Attr:   upspin.AttrDirectory,
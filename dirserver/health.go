@@ -0,0 +1,170 @@
+package dirserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+/*
+An Access file that can not be used to check access rights...
+- if it can not be parsed, is ignored in favour of the default owner-only
+  rights, so that the owner may still fix it; as Put rejects such files, it
+  can only predate the check
+- if it can not be read, is retried with backoff, after which the request
+  fails, rather than downgrading the rights of everyone but the owner
+In both cases the problem is recorded in the state, if it implements
+state.Health, at most once per healthInterval, and cleared once the file is
+used successfully. The problems are listed through AccessHealth.
+*/
+
+const (
+	accessAttempts = 3
+	// Doubled after every failed attempt.
+	accessBackoff  = 100 * time.Millisecond
+	healthInterval = time.Minute
+)
+
+// AccessHealth is an administrative query implemented by the servers returned
+// by New and their Dial method. Its method returns upspin.ErrNotSupported if
+// the state does not implement state.Health.
+type AccessHealth interface {
+	// AccessProblems lists the problems with the current versions of Access
+	// files in the tree of a user, or of all users if empty.
+	AccessProblems(upspin.UserName) ([]state.AccessProblem, error)
+}
+
+// AccessProblems implements AccessHealth.
+func (d *dialed) AccessProblems(user upspin.UserName) ([]state.AccessProblem, error) {
+	ctx, op := d.setCtx("AccessProblems")
+	d.log = d.log.With("user", user)
+
+	h, ok := d.state.(state.Health)
+	if !ok {
+		return nil, upspin.ErrNotSupported
+	}
+	if d.requester != d.cfg.UserName() {
+		return nil, errors.E(op, user, errors.Permission)
+	}
+
+	ps, err := h.AccessProblems(ctx, user)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, "", err)
+	}
+
+	return ps, nil
+}
+
+// accessHealth tracks the Access files with problems recorded. A nil
+// accessHealth records nothing.
+type accessHealth struct {
+	mu sync.Mutex
+	// When a problem was last recorded for each file, or the zero time if it
+	// was recorded before the server started.
+	recorded map[upspin.PathName]time.Time
+}
+
+// newAccessHealth returns an accessHealth aware of the problems recorded in
+// the state.
+func newAccessHealth(ctx context.Context, st state.State) (*accessHealth, error) {
+	h := &accessHealth{recorded: make(map[upspin.PathName]time.Time)}
+	if hs, ok := st.(state.Health); ok {
+		ps, err := hs.AccessProblems(ctx, "")
+		if err != nil {
+			return h, err
+		}
+		for _, p := range ps {
+			h.recorded[p.Name] = time.Time{}
+		}
+	}
+
+	return h, nil
+}
+
+// loadAccess retrieves the parsed Access file for an entry, or nil if it can
+// not be parsed, retrying if it can not be read. Returned errors are internal.
+func (d *dialed) loadAccess(ctx context.Context, ae *upspin.DirEntry) (*access.Access, error) {
+	var a *access.Access
+	var err error
+	wait := accessBackoff
+	for i := 0; i < accessAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			wait *= 2
+		}
+
+		a, err = d.cache.GetAccess(ctx, ae)
+		if err == nil {
+			d.problems.clear(ctx, d, ae.Name)
+			return a, nil
+		} else if errors.Is(errors.Invalid, err) {
+			// Only parsing fails with errors.Invalid; read errors are
+			// wrapped by the cache.
+			d.log.ErrorContext(ctx, "access file malformed", "access_file", ae.Name, "err", err)
+			d.problems.record(ctx, d, ae, true, err)
+			return nil, nil
+		}
+		d.log.WarnContext(ctx, "access file retrieval failed", "access_file", ae.Name, "attempt", i+1, "err", err)
+	}
+	d.problems.record(ctx, d, ae, false, err)
+
+	return nil, err
+}
+
+// record records a problem with an Access file, unless it was recorded less
+// than healthInterval ago.
+func (h *accessHealth) record(ctx context.Context, d *dialed, ae *upspin.DirEntry, malformed bool, err error) {
+	hs, ok := d.state.(state.Health)
+	if h == nil || !ok {
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	if last, ok := h.recorded[ae.Name]; ok && now.Sub(last) < healthInterval {
+		h.mu.Unlock()
+		return
+	}
+	h.recorded[ae.Name] = now
+	h.mu.Unlock()
+
+	t := upspin.TimeFromGo(now)
+	p := state.AccessProblem{
+		Name:      ae.Name,
+		Sequence:  ae.Sequence,
+		Malformed: malformed,
+		Err:       err.Error(),
+		First:     t,
+		Last:      t,
+	}
+	if err := hs.RecordAccessProblem(ctx, p); err != nil {
+		d.log.ErrorContext(ctx, "failed to record access file problem", "access_file", ae.Name, "err", err)
+	}
+}
+
+// clear forgets the problem recorded with an Access file, if any.
+func (h *accessHealth) clear(ctx context.Context, d *dialed, name upspin.PathName) {
+	hs, ok := d.state.(state.Health)
+	if h == nil || !ok {
+		return
+	}
+	h.mu.Lock()
+	_, ok = h.recorded[name]
+	delete(h.recorded, name)
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := hs.ClearAccessProblem(ctx, name); err != nil {
+		d.log.ErrorContext(ctx, "failed to clear access file problem", "access_file", name, "err", err)
+	}
+}
@@ -0,0 +1,126 @@
+package dirserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"upspin.io/access"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// flakyCache fails to read Access files as many times as set.
+type flakyCache struct {
+	*cache
+	failures, reads int
+}
+
+func (c *flakyCache) GetAccess(ctx context.Context, e *upspin.DirEntry) (*access.Access, error) {
+	c.reads++
+	if c.failures > 0 {
+		c.failures--
+		return nil, fmt.Errorf("read access file %s: store unreachable", e.Name)
+	}
+	return c.cache.GetAccess(ctx, e)
+}
+
+func TestParseAccess(t *testing.T) {
+	err := parseAccess("foo@example.com/Access", []byte("read: foo@example.com\n# comment\nno colon\nfrobnicate: foo@example.com\n"))
+	if !errors.Is(errors.Invalid, err) {
+		t.Fatalf("got %v, want errors.Invalid", err)
+	}
+	for _, l := range []string{"line 3", "line 4"} {
+		if !strings.Contains(err.Error(), l) {
+			t.Errorf("%q not reported: %v", l, err)
+		}
+	}
+	if strings.Contains(err.Error(), "line 1") {
+		t.Errorf("valid line reported: %v", err)
+	}
+
+	if err := parseAccess("foo@example.com/Access", []byte("read: foo@example.com\n")); err != nil {
+		t.Errorf("valid file rejected: %v", err)
+	}
+}
+
+func TestAccessHealth(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	putAccess := func() {
+		st.Put(ctx, &upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"})
+	}
+	st.Put(ctx, &upspin.DirEntry{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"})
+	st.Put(ctx, &upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/file"})
+	putAccess()
+
+	c := &flakyCache{cache: &cache{map[upspin.PathName]string{"foo@example.com/Access": "no colon"}}}
+	problems, err := newAccessHealth(ctx, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{state: st, cache: c, rights: newAccessCache(), problems: problems, cfg: config.SetUserName(config.New(), "srv@example.com")}
+	foo := &dialed{s, slog.Default(), "foo@example.com"}
+	bar := &dialed{s, slog.Default(), "bar@example.com"}
+	srv := &dialed{s, slog.Default(), "srv@example.com"}
+
+	checkProblems := func(want ...bool) {
+		t.Helper()
+		ps, err := srv.AccessProblems("foo@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ps) != len(want) {
+			t.Fatalf("got problems %v, want %d", ps, len(want))
+		}
+		for i, p := range ps {
+			if p.Name != "foo@example.com/Access" || p.Malformed != want[i] {
+				t.Errorf("got problem %+v, want malformed %t", p, want[i])
+			}
+		}
+	}
+
+	// A malformed Access file leaves only the owner with rights.
+	if _, err := foo.Lookup("foo@example.com/file"); err != nil {
+		t.Errorf("owner lookup with a malformed Access file: %v", err)
+	}
+	if _, err := bar.Lookup("foo@example.com/file"); !errors.Is(errors.Private, err) {
+		t.Errorf("lookup with a malformed Access file: got %v, want errors.Private", err)
+	}
+	checkProblems(true)
+	if _, err := foo.AccessProblems("foo@example.com"); !errors.Is(errors.Permission, err) {
+		t.Errorf("problems listed for a user other than the server user: %v", err)
+	}
+
+	// Fixing the file clears the problem.
+	c.access["foo@example.com/Access"] = "read: foo@example.com, bar@example.com"
+	putAccess()
+	bar.Invalidate("foo@example.com/Access")
+	if _, err := bar.Lookup("foo@example.com/file"); err != nil {
+		t.Errorf("lookup with a fixed Access file: %v", err)
+	}
+	checkProblems()
+
+	// An unreadable Access file fails requests after retrying.
+	c.failures, c.reads = accessAttempts, 0
+	putAccess()
+	bar.Invalidate("foo@example.com/Access")
+	if _, err := bar.Lookup("foo@example.com/file"); !errors.Is(errors.Internal, err) {
+		t.Errorf("lookup with an unreadable Access file: got %v, want errors.Internal", err)
+	}
+	if c.reads != accessAttempts {
+		t.Errorf("Access file read %d times, want %d", c.reads, accessAttempts)
+	}
+	checkProblems(false)
+
+	// Retries may succeed.
+	c.failures = accessAttempts - 1
+	if _, err := bar.Lookup("foo@example.com/file"); err != nil {
+		t.Errorf("lookup with an Access file read on the last attempt: %v", err)
+	}
+	checkProblems()
+}
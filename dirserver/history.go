@@ -0,0 +1,185 @@
+package dirserver
+
+import (
+	"context"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+/*
+The version history of a path is available only to the server user and to the
+owner of the tree, and then only with the rights granted to the owner by the
+Access file currently governing the path, regardless of the Access files that
+governed past versions:
+- listing versions and retrieving past entries requires the Read right
+- restoring a version requires the Write right if the path exists, else the
+  Create right
+
+Restoring puts the past entry as a new operation, keeping its original time and
+writer, which are covered by its signature. Directories can not be restored,
+nor can a path currently holding a directory be overwritten. The parent of the
+path must be an existing directory.
+*/
+
+// History is implemented by the servers returned by New and their Dial
+// method. Its methods return upspin.ErrNotSupported if the state does not
+// implement state.History.
+type History interface {
+	// Versions lists the operations retained for a path, oldest first.
+	Versions(upspin.PathName) ([]state.Version, error)
+
+	// Version returns the complete entry put by an operation on a path.
+	Version(upspin.PathName, int64) (*upspin.DirEntry, error)
+
+	// Restore puts the entry of a past operation on a path again, and
+	// returns the resulting entry.
+	Restore(upspin.PathName, int64) (*upspin.DirEntry, error)
+}
+
+// Versions implements History.
+func (d *dialed) Versions(name upspin.PathName) ([]state.Version, error) {
+	ctx, op := d.setCtx("Versions")
+	d.log = d.log.With("pathname", name)
+
+	p, h, err := d.history(ctx, name, access.Read)
+	if err != nil {
+		return nil, errors.E(op, name, err)
+	}
+
+	vs, err := h.Versions(ctx, p.Path())
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+
+	return vs, nil
+}
+
+// Version implements History.
+func (d *dialed) Version(name upspin.PathName, id int64) (*upspin.DirEntry, error) {
+	ctx, op := d.setCtx("Version")
+	d.log = d.log.With("pathname", name, "operation_id", id)
+
+	p, h, err := d.history(ctx, name, access.Read)
+	if err != nil {
+		return nil, errors.E(op, name, err)
+	}
+
+	e, err := h.Version(ctx, p.Path(), id)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	} else if e == nil {
+		return nil, errors.E(op, p.Path(), errors.NotExist, errors.Errorf("no version %d", id))
+	}
+
+	return e, nil
+}
+
+// Restore implements History.
+func (d *dialed) Restore(name upspin.PathName, id int64) (*upspin.DirEntry, error) {
+	ctx, op := d.setCtx("Restore")
+	d.log = d.log.With("pathname", name, "operation_id", id)
+
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, errors.E(op, name, errors.Invalid, err)
+	}
+	es, _, err := d.state.LookupAll(ctx, p)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	var cur *upspin.DirEntry
+	if len(es) == p.NElem()+1 {
+		cur = es[p.NElem()]
+	}
+
+	right := access.Create
+	if cur != nil {
+		right = access.Write
+	}
+	p, h, err := d.history(ctx, name, right)
+	if err != nil {
+		return nil, errors.E(op, name, err)
+	}
+
+	if p.IsRoot() || cur != nil && cur.IsDir() {
+		return nil, errors.E(op, p.Path(), errors.IsDir)
+	}
+	if n := len(es); n > 0 && n <= p.NElem() && es[n-1].IsLink() {
+		return es[n-1], upspin.ErrFollowLink
+	}
+	if len(es) < p.NElem() {
+		return nil, errors.E(op, p.Path(), errors.NotExist, errors.Str("parent directory does not exist"))
+	} else if !es[p.NElem()-1].IsDir() {
+		return nil, errors.E(op, p.Path(), errors.NotDir)
+	}
+
+	e, err := h.Version(ctx, p.Path(), id)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	} else if e == nil {
+		return nil, errors.E(op, p.Path(), errors.NotExist, errors.Errorf("no version %d", id))
+	} else if e.IsDir() {
+		return nil, errors.E(op, p.Path(), errors.IsDir, errors.Str("directories can not be restored"))
+	} else if access.IsAccessFile(p.Path()) && e.IsRegular() {
+		if err := d.checkAccess(ctx, e); err != nil {
+			return nil, errors.E(op, p.Path(), err)
+		}
+	}
+
+	if err := d.state.Put(ctx, e); err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	d.changed(ctx, p.Path())
+	d.log.InfoContext(ctx, "restored version")
+
+	e, err = d.state.Lookup(ctx, p.Path())
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+
+	return e, nil
+}
+
+// history checks that the requester may access the history of a path with the
+// given right, and returns the parsed path and the state's history. Returned
+// errors are sanitized.
+func (d *dialed) history(ctx context.Context, name upspin.PathName, right access.Right) (path.Parsed, state.History, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return p, nil, errors.E(errors.Invalid, err)
+	}
+	h, ok := d.state.(state.History)
+	if !ok {
+		return p, nil, upspin.ErrNotSupported
+	}
+
+	if d.requester == d.cfg.UserName() {
+		return p, h, nil
+	} else if d.requester != p.User() {
+		return p, nil, errors.E(errors.Private)
+	}
+
+	ae, err := d.accessFor(ctx, p, false)
+	if err != nil {
+		return p, nil, d.internalErr(ctx, "", p.Path(), err)
+	}
+	var a *access.Access
+	if ae != nil {
+		a, err = d.loadAccess(ctx, ae)
+		if err != nil {
+			return p, nil, d.internalErr(ctx, "", p.Path(), err)
+		}
+	}
+
+	if granted, err := d.can(ctx, ae, a, right, p); err != nil {
+		return p, nil, d.internalErr(ctx, "", p.Path(), err)
+	} else if !granted {
+		return p, nil, errors.E(errors.Permission)
+	}
+
+	return p, h, nil
+}
@@ -0,0 +1,96 @@
+package dirserver
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+func TestHistory(t *testing.T) {
+	st := memory.New()
+	ctx := context.Background()
+	st.Put(ctx, &upspin.DirEntry{
+		Attr:   upspin.AttrDirectory,
+		Writer: "foo@example.com",
+		Name:   "foo@example.com/",
+	})
+	st.Put(ctx, &upspin.DirEntry{
+		Packing:  upspin.PlainPack,
+		Packdata: []byte("v1"),
+		Writer:   "foo@example.com",
+		Time:     1000,
+		Name:     "foo@example.com/bar",
+	})
+	st.Put(ctx, &upspin.DirEntry{
+		Packing:  upspin.PlainPack,
+		Packdata: []byte("v2"),
+		Writer:   "foo@example.com",
+		Name:     "foo@example.com/bar",
+	})
+	barp, _ := path.Parse("foo@example.com/bar")
+	st.Delete(ctx, barp)
+
+	c := &cache{make(map[upspin.PathName]string)}
+	s := &server{state: st, cache: c, cfg: config.SetUserName(config.New(), "srv@example.com")}
+	owner := &dialed{s, slog.Default(), "foo@example.com"}
+
+	vs, err := owner.Versions("foo@example.com/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 3 || !vs[2].Deleted {
+		t.Fatalf("wrong versions: %v", vs)
+	}
+
+	// Undelete the first version
+	e, err := owner.Restore("foo@example.com/bar", vs[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Packdata) != "v1" || e.Time != 1000 || e.Sequence != 5 {
+		t.Errorf("wrong entry restored: %v", e)
+	}
+	if vs, err := owner.Versions("foo@example.com/bar"); err != nil {
+		t.Error(err)
+	} else if len(vs) != 4 {
+		t.Errorf("restore not recorded as a new version: %v", vs)
+	}
+
+	// Other users have no access to the history, even if granted rights
+	st.Put(ctx, &upspin.DirEntry{
+		Packing: upspin.PlainPack,
+		Writer:  "foo@example.com",
+		Name:    "foo@example.com/Access",
+	})
+	c.access["foo@example.com/Access"] = "*: bar@example.com"
+	other := &dialed{s, slog.Default(), "bar@example.com"}
+	if _, err := other.Version("foo@example.com/bar", vs[1].Id); !errors.Is(errors.Private, err) {
+		t.Errorf("history accessible by other user: %v", err)
+	}
+
+	// The current Access file applies to the owner
+	if _, err := owner.Version("foo@example.com/bar", vs[1].Id); !errors.Is(errors.Permission, err) {
+		t.Errorf("history accessible by owner without rights: %v", err)
+	}
+	c.access["foo@example.com/Access"] = "r: foo@example.com"
+	if e, err := owner.Version("foo@example.com/bar", vs[1].Id); err != nil {
+		t.Error(err)
+	} else if string(e.Packdata) != "v2" {
+		t.Errorf("wrong entry for version: %v", e)
+	}
+	if _, err := owner.Restore("foo@example.com/bar", vs[1].Id); !errors.Is(errors.Permission, err) {
+		t.Errorf("version restored without write rights: %v", err)
+	}
+
+	// The server user is not subject to access files
+	admin := &dialed{s, slog.Default(), "srv@example.com"}
+	if _, err := admin.Restore("foo@example.com/bar", vs[1].Id); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,358 @@
+package dirserver
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+/*
+Linting walks a tree from a root, at the versions listed and without following
+links. It is requested through Linter. Access files are read as for access
+checks, and groups through the cache, including groups outside the root that
+are referenced from within it, whose members are checked in turn. Problems are
+reported...
+- with the Access files that can not be read or parsed
+- with the groups referenced that do not exist, can not be retrieved, or can
+  not be parsed
+- with the users named by Access files and groups whose keys the key server
+  does not hold, unless none is given; access.AllUsers and wildcard users
+  are not checked
+- with the cycles among the groups retrieved, at least one per set of groups
+  including each other
+- with the Group files in the tree not referenced by any Access file or group
+  seen by the walk, or retrieved through it
+- with the Access files that only govern their own directory and themselves,
+  every other entry in it being a subdirectory with its own Access file
+- with the entries of the Group subtree that Put rejects: a <user>/Group that is
+  not a directory, links below it, and elements below it that resemble a
+  username, that is that contain an @
+- with the entries named Access that Put rejects, being directories or links
+- with the Access and Group files whose packing Put rejects, being encrypted;
+  these are not read
+*/
+
+// Linter is an administrative query implemented by the servers returned by New
+// and their Dial method.
+type Linter interface {
+	// Lint returns the problems with the Access and Group files under root,
+	// checking the keys of the users they name against key, if not nil.
+	Lint(root upspin.PathName, key upspin.KeyServer) ([]LintProblem, error)
+}
+
+// LintKind identifies a kind of problem found by Lint.
+type LintKind string
+
+const (
+	LintMalformedAccess   LintKind = "malformed-access"
+	LintUnreadableAccess  LintKind = "unreadable-access"
+	LintMissingGroup      LintKind = "missing-group"
+	LintUnresolvedGroup   LintKind = "unresolved-group"
+	LintMalformedGroup    LintKind = "malformed-group"
+	LintMissingKey        LintKind = "missing-key"
+	LintUnverifiedKey     LintKind = "unverified-key"
+	LintGroupCycle        LintKind = "group-cycle"
+	LintUnusedGroup       LintKind = "unused-group"
+	LintShadowedAccess    LintKind = "shadowed-access"
+	LintInvalidGroupEntry LintKind = "invalid-group-entry"
+	LintInvalidAccess     LintKind = "invalid-access-entry"
+	LintInvalidPacking    LintKind = "invalid-packing"
+)
+
+// LintProblem describes a problem found by Lint.
+type LintProblem struct {
+	Kind LintKind `json:"kind"`
+	// The Access file, group or entry with the problem.
+	Path upspin.PathName `json:"path"`
+	// The group or user it concerns, if any.
+	Ref string `json:"ref,omitempty"`
+	Msg string `json:"message"`
+}
+
+// Lint implements Linter.
+func (d *dialed) Lint(root upspin.PathName, key upspin.KeyServer) ([]LintProblem, error) {
+	ctx, op := d.setCtx("Lint")
+	d.log = d.log.With("pathname", root)
+
+	p, err := path.Parse(root)
+	if err != nil {
+		return nil, errors.E(op, root, errors.Invalid, err)
+	}
+	if d.requester != d.cfg.UserName() {
+		return nil, errors.E(op, p.Path(), errors.Permission)
+	}
+
+	es, ents, err := d.state.LookupAll(ctx, p)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	if len(es) != p.NElem()+1 {
+		if n := len(es); n > 0 && es[n-1].IsLink() {
+			return nil, errors.E(op, p.Path(), errors.Invalid, errors.Errorf("%s is a link", es[n-1].Name))
+		}
+		return nil, errors.E(op, p.Path(), errors.NotExist)
+	}
+
+	l := &lint{
+		d:          d,
+		key:        key,
+		groups:     make(map[upspin.PathName][]path.Parsed),
+		failed:     make(map[upspin.PathName]bool),
+		referenced: make(map[upspin.PathName]bool),
+		keys:       make(map[upspin.UserName]error),
+	}
+	if _, err := l.walk(ctx, ents[len(ents)-1]); err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	l.cycles()
+	for _, g := range l.local {
+		if !l.referenced[g] {
+			l.add(LintUnusedGroup, g, "", "group not referenced")
+		}
+	}
+
+	return l.problems, nil
+}
+
+// lint is the state of a walk for Lint.
+type lint struct {
+	d        *dialed
+	key      upspin.KeyServer
+	problems []LintProblem
+	// The members of the groups retrieved, and the groups that could not
+	// be.
+	groups map[upspin.PathName][]path.Parsed
+	failed map[upspin.PathName]bool
+	// The Group files in the tree, in walk order, and the groups referenced.
+	local      []upspin.PathName
+	referenced map[upspin.PathName]bool
+	// The results of the key lookups of the users named.
+	keys map[upspin.UserName]error
+}
+
+func (l *lint) add(kind LintKind, name upspin.PathName, ref, msg string) {
+	l.problems = append(l.problems, LintProblem{Kind: kind, Path: name, Ref: ref, Msg: msg})
+}
+
+// walk lints an entry and, if it is a directory, its contents. It returns
+// whether the entry is a directory with an Access file. Returned errors are
+// internal.
+func (l *lint) walk(ctx context.Context, ent state.Entry) (bool, error) {
+	p := ent.Path
+	last := ""
+	if p.NElem() > 0 {
+		last = p.Elem(p.NElem() - 1)
+	}
+
+	if p.NElem() > 0 && p.Elem(0) == "Group" {
+		switch {
+		case p.NElem() == 1 && ent.Attr != upspin.AttrDirectory:
+			l.add(LintInvalidGroupEntry, p.Path(), "", "Group is not a directory")
+		case p.NElem() > 1 && ent.Attr == upspin.AttrLink:
+			l.add(LintInvalidGroupEntry, p.Path(), "", "link in the Group subtree")
+		case p.NElem() > 1 && strings.Contains(last, "@"):
+			l.add(LintInvalidGroupEntry, p.Path(), "", "element resembles a username")
+		case p.NElem() > 1 && ent.Attr != upspin.AttrDirectory:
+			ge, err := l.d.state.Get(ctx, ent)
+			if err != nil {
+				return false, err
+			} else if !signedPacking(ge.Packing) {
+				l.add(LintInvalidPacking, p.Path(), "", "Group file is encrypted")
+				break
+			}
+			l.local = append(l.local, p.Path())
+			l.group(ctx, p.Path(), p.Path())
+		}
+	}
+	if ent.Attr != upspin.AttrDirectory {
+		return false, nil
+	}
+
+	children, err := l.d.state.List(ctx, ent)
+	if err != nil {
+		return false, err
+	}
+	hasAccess, governs, shadowing := false, false, 0
+	for _, c := range children {
+		named := c.Path.Elem(c.Path.NElem()-1) == access.AccessFile
+		isAccess := named && c.Attr&(upspin.AttrDirectory|upspin.AttrLink) == 0
+		if named && !isAccess {
+			l.add(LintInvalidAccess, c.Path.Path(), "", "Access is not a regular file")
+		}
+		if isAccess {
+			hasAccess = true
+			if err := l.access(ctx, c); err != nil {
+				return false, err
+			}
+		}
+
+		childAccess, err := l.walk(ctx, c)
+		if err != nil {
+			return false, err
+		}
+		if childAccess {
+			shadowing++
+		} else if !isAccess {
+			governs = true
+		}
+	}
+	if hasAccess && !governs && shadowing > 0 {
+		l.add(LintShadowedAccess, path.Join(p.Path(), access.AccessFile), "", "Access file governs no entry other than its directory")
+	}
+
+	return hasAccess, nil
+}
+
+// access lints an Access file.
+func (l *lint) access(ctx context.Context, ent state.Entry) error {
+	ae, err := l.d.state.Get(ctx, ent)
+	if err != nil {
+		return err
+	} else if !signedPacking(ae.Packing) {
+		l.add(LintInvalidPacking, ae.Name, "", "Access file is encrypted")
+		return nil
+	}
+	// Read through the cache rather than loadAccess, so that linting neither
+	// retries nor records problems in the Access file health.
+	a, err := l.d.cache.GetAccess(ctx, ae)
+	if errors.Is(errors.Invalid, err) {
+		l.add(LintMalformedAccess, ae.Name, "", err.Error())
+		return nil
+	} else if err != nil {
+		l.add(LintUnreadableAccess, ae.Name, "", err.Error())
+		return nil
+	}
+
+	var refs []path.Parsed
+	for _, r := range Rights {
+		for _, p := range a.List(r) {
+			if !slices.ContainsFunc(refs, func(q path.Parsed) bool { return q.Path() == p.Path() }) {
+				refs = append(refs, p)
+			}
+		}
+	}
+	l.refs(ctx, ae.Name, refs)
+
+	return nil
+}
+
+// refs lints the users and groups named by an Access file or group.
+func (l *lint) refs(ctx context.Context, from upspin.PathName, ps []path.Parsed) {
+	for _, p := range ps {
+		if p.NElem() > 0 {
+			if p.Path() != from {
+				l.referenced[p.Path()] = true
+			}
+			l.group(ctx, from, p.Path())
+			continue
+		}
+
+		u := p.User()
+		if l.key == nil || u == access.AllUsers || strings.HasPrefix(string(u), "*@") {
+			continue
+		}
+		err, ok := l.keys[u]
+		if !ok {
+			_, err = l.key.Lookup(u)
+			l.keys[u] = err
+		}
+		if errors.Is(errors.NotExist, err) {
+			l.add(LintMissingKey, from, string(u), "no key for user")
+		} else if err != nil {
+			l.add(LintUnverifiedKey, from, string(u), err.Error())
+		}
+	}
+}
+
+// group retrieves a group referenced from an Access file or group, or found in
+// the tree, the first time it is, and lints its members.
+func (l *lint) group(ctx context.Context, from, name upspin.PathName) {
+	if _, ok := l.groups[name]; ok || l.failed[name] {
+		return
+	}
+
+	p, err := path.Parse(name)
+	if err != nil {
+		l.failed[name] = true
+		l.add(LintMissingGroup, from, string(name), err.Error())
+		return
+	}
+	data, err := l.d.cache.GetGroup(ctx, name)
+	if errors.Is(errors.NotExist, err) {
+		l.failed[name] = true
+		l.add(LintMissingGroup, from, string(name), "group does not exist")
+		return
+	} else if err != nil {
+		l.failed[name] = true
+		l.add(LintUnresolvedGroup, from, string(name), err.Error())
+		return
+	}
+	members, err := access.ParseGroup(p, data)
+	if err != nil {
+		l.failed[name] = true
+		l.add(LintMalformedGroup, name, "", err.Error())
+		return
+	}
+
+	l.groups[name] = members
+	l.refs(ctx, name, members)
+}
+
+// cycles reports the cycles found among the groups retrieved, once each,
+// starting from their least group.
+func (l *lint) cycles() {
+	names := make([]upspin.PathName, 0, len(l.groups))
+	for n := range l.groups {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	marks := make(map[upspin.PathName]int)
+	seen := make(map[string]bool)
+	var stack []upspin.PathName
+	var visit func(upspin.PathName)
+	visit = func(n upspin.PathName) {
+		marks[n] = visiting
+		stack = append(stack, n)
+		for _, m := range l.groups[n] {
+			g := m.Path()
+			if _, ok := l.groups[g]; !ok || m.NElem() == 0 {
+				continue
+			}
+			switch marks[g] {
+			case 0:
+				visit(g)
+			case visiting:
+				cycle := slices.Clone(stack[slices.Index(stack, g):])
+				least := slices.Index(cycle, slices.Min(cycle))
+				cycle = slices.Concat(cycle[least:], cycle[:least])
+				var elems []string
+				for _, c := range cycle {
+					elems = append(elems, string(c))
+				}
+				key := strings.Join(elems, " -> ")
+				if !seen[key] {
+					seen[key] = true
+					l.add(LintGroupCycle, cycle[0], key+" -> "+string(cycle[0]), "groups include each other")
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		marks[n] = done
+	}
+	for _, n := range names {
+		if marks[n] == 0 {
+			visit(n)
+		}
+	}
+}
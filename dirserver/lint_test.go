@@ -0,0 +1,103 @@
+package dirserver
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// keys is a key server holding the records of a set of users.
+type keys struct {
+	upspin.KeyServer
+	users map[upspin.UserName]bool
+}
+
+func (k *keys) Lookup(u upspin.UserName) (*upspin.User, error) {
+	if !k.users[u] {
+		return nil, errors.E(u, errors.NotExist)
+	}
+	return &upspin.User{Name: u}, nil
+}
+
+func TestLint(t *testing.T) {
+	entries := []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/Group"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Group/bad@example.com"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Group/inner"},
+		{Attr: upspin.AttrLink, Writer: "foo@example.com", Name: "foo@example.com/Group/link", Link: "foo@example.com/Group/pals"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Group/pals"},
+		{Packing: upspin.EEPack, Writer: "foo@example.com", Name: "foo@example.com/Group/secret"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Group/unused"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/enc"},
+		{Packing: upspin.EEPack, Writer: "foo@example.com", Name: "foo@example.com/enc/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/odd"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/odd/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/shadow"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/shadow/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/shadow/sub"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/shadow/sub/Access"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/shadow/sub/file"},
+	}
+
+	c := &groupCache{
+		cache: &cache{map[upspin.PathName]string{
+			"foo@example.com/Access":            "read: bar@example.com, ghost@example.com, foo@example.com/Group/pals, foo@example.com/Group/gone",
+			"foo@example.com/shadow/Access":     "read: bar@example.com",
+			"foo@example.com/shadow/sub/Access": "read: baz@example.com",
+		}},
+		groups: map[upspin.PathName]string{
+			"foo@example.com/Group/pals":   "baz@example.com, foo@example.com/Group/inner",
+			"foo@example.com/Group/inner":  "foo@example.com/Group/pals",
+			"foo@example.com/Group/unused": "bar@example.com",
+		},
+	}
+	s := newTestServer(t, memory.New(), c, entries)
+	srv := s.as("srv@example.com")
+	key := &keys{users: map[upspin.UserName]bool{"foo@example.com": true, "bar@example.com": true, "baz@example.com": true}}
+
+	ps, err := srv.Lint("foo@example.com/", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ps {
+		ps[i].Msg = ""
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Path < ps[j].Path || ps[i].Path == ps[j].Path && ps[i].Ref < ps[j].Ref
+	})
+	want := []LintProblem{
+		{Kind: LintMissingGroup, Path: "foo@example.com/Access", Ref: "foo@example.com/Group/gone"},
+		{Kind: LintMissingKey, Path: "foo@example.com/Access", Ref: "ghost@example.com"},
+		{Kind: LintInvalidGroupEntry, Path: "foo@example.com/Group/bad@example.com"},
+		{Kind: LintGroupCycle, Path: "foo@example.com/Group/inner", Ref: "foo@example.com/Group/inner -> foo@example.com/Group/pals -> foo@example.com/Group/inner"},
+		{Kind: LintInvalidGroupEntry, Path: "foo@example.com/Group/link"},
+		{Kind: LintInvalidPacking, Path: "foo@example.com/Group/secret"},
+		{Kind: LintUnusedGroup, Path: "foo@example.com/Group/unused"},
+		{Kind: LintInvalidPacking, Path: "foo@example.com/enc/Access"},
+		{Kind: LintInvalidAccess, Path: "foo@example.com/odd/Access"},
+		{Kind: LintShadowedAccess, Path: "foo@example.com/shadow/Access"},
+	}
+	if !reflect.DeepEqual(ps, want) {
+		t.Errorf("got problems:\n%+v\nwant:\n%+v", ps, want)
+	}
+
+	// Keys are not checked without a key server.
+	ps, err = srv.Lint("foo@example.com/shadow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Kind != LintShadowedAccess || ps[0].Path != "foo@example.com/shadow/Access" {
+		t.Errorf("got problems %+v, want only the shadowed Access file", ps)
+	}
+
+	foo := s.as("foo@example.com")
+	if _, err := foo.Lint("foo@example.com/", nil); !errors.Is(errors.Permission, err) {
+		t.Errorf("lint requested by a user other than the server user: got %v, want errors.Permission", err)
+	}
+}
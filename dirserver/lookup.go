@@ -3,6 +3,7 @@ package dirserver
 import (
 	"context"
 
+	"github.com/vvanpo/upspin-fly/dirserver/state"
 	"upspin.io/access"
 	"upspin.io/errors"
 	"upspin.io/path"
@@ -33,16 +34,16 @@ func (d *dialed) Lookup(name upspin.PathName) (*upspin.DirEntry, error) {
 }
 
 func (d *dialed) lookupContext(ctx context.Context, op errors.Op, name upspin.PathName) (*upspin.DirEntry, error) {
-	p, e, a, _, err := d.lookup(ctx, name)
+	p, e, _, a, ae, err := d.lookup(ctx, name)
 	if err == upspin.ErrFollowLink {
 		return e, err
-	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) {
+	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) || errors.Is(errors.NotExist, err) {
 		return nil, errors.E(op, p.Path(), err)
 	} else if err != nil {
 		return nil, d.internalErr(ctx, op, p.Path(), err)
 	}
 
-	canRead, err := d.can(ctx, a, access.Read, p)
+	canRead, err := d.can(ctx, ae, a, access.Read, p)
 	if err != nil {
 		return nil, d.internalErr(ctx, op, p.Path(), err)
 	} else if !canRead && !access.IsAccessControlFile(e.Name) {
@@ -55,13 +56,15 @@ func (d *dialed) lookupContext(ctx context.Context, op errors.Op, name upspin.Pa
 }
 
 // lookup is a convenience method that returns the parsed input path, the
-// directory entry if it's found, the access file controlling access to the
-// entry, the corresponding directory entry for the access file, and a possible
-// error. If the path does not exist, nil is returned. The returned entry for
-// the input path is incomplete (i.e. without blocks or packing) but not marked
-// as such. The returned access file entry is always complete if present.
+// directory entry if it's found along with the state handle of its version,
+// the access file controlling access to the entry, the corresponding directory
+// entry for the access file, and a possible error. If the path does not exist,
+// nil is returned. The returned entry for the input path is incomplete (i.e.
+// without blocks or packing) but not marked as such. The returned access file
+// entry is always complete if present.
 //
 // If the requested pathname is invalid, errors.Invalid is returned.
+// If the tree of the pathname does not exist, errors.NotExist is returned.
 // If the requesting user has no access rights on the pathname, errors.Private
 // is returned.
 // If a link is found anywhere along the path, upspin.ErrFollowLink is
@@ -72,53 +75,50 @@ func (d *dialed) lookupContext(ctx context.Context, op errors.Op, name upspin.Pa
 func (d *dialed) lookup(ctx context.Context, name upspin.PathName) (
 	p path.Parsed,
 	e *upspin.DirEntry,
+	ent state.Entry,
 	a *access.Access,
 	ae *upspin.DirEntry,
 	err error,
 ) {
 	p, err = path.Parse(name)
 	if err != nil {
-		return p, nil, nil, nil, err
+		return p, nil, ent, nil, nil, err
 	}
 
-	es, err := d.state.LookupAll(ctx, p)
+	es, ents, err := d.state.LookupAll(ctx, p)
 	if err != nil {
-		return p, nil, nil, nil, err
+		return p, nil, ent, nil, nil, err
+	}
+
+	if len(es) == 0 {
+		return p, nil, ent, nil, nil, errors.E(errors.NotExist)
 	}
 
 	// The closest existing entry or the entry itself. Could be a link.
-	e = es[len(es)-1]
+	e, ent = es[len(es)-1], ents[len(ents)-1]
 	ae, err = d.accessFor(ctx, p, e.Attr == upspin.AttrDirectory)
 	if err != nil {
-		return p, nil, nil, nil, err
+		return p, nil, ent, nil, nil, err
 	}
 
 	if ae != nil {
-		a, err = d.cache.GetAccess(ctx, ae)
+		// A malformed access file is ignored in favour of the default
+		// owner-only rights; see health.go.
+		a, err = d.loadAccess(ctx, ae)
 		if err != nil {
-			// TODO distinguish between error in access file fetching (warning)
-			// and parsing (error)
-			d.log.ErrorContext(
-				ctx,
-				"access file retrieval failed",
-				"err", err,
-			)
-			// If the access file is malformed or the store server serving it
-			// can't be reached, we don't want the directory server to be
-			// unusable, so we pretend the access file isn't there and fall
-			// back on the default owner-only rights.
+			return p, nil, ent, nil, nil, err
 		}
 	}
 
-	if granted, err := d.can(ctx, a, access.AnyRight, p); err != nil {
-		return p, nil, nil, nil, err
+	if granted, err := d.can(ctx, ae, a, access.AnyRight, p); err != nil {
+		return p, nil, ent, nil, nil, err
 	} else if !granted {
-		return p, nil, nil, nil, errors.E(errors.Private)
+		return p, nil, ent, nil, nil, errors.E(errors.Private)
 	}
 
 	if e.IsLink() {
-		return p, e, nil, nil, upspin.ErrFollowLink
+		return p, e, ent, nil, nil, upspin.ErrFollowLink
 	}
 
-	return p, e, a, ae, nil
+	return p, e, ent, a, ae, nil
 }
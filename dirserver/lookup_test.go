@@ -5,13 +5,12 @@ import (
 	"log/slog"
 	"testing"
 
-	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
 	"upspin.io/upspin"
 )
 
 func TestLookup(t *testing.T) {
-	st, _ := sqlite.Open(":memory:")
-	defer st.Close()
+	st := memory.New()
 	ctx := context.Background()
 	st.Put(ctx, &upspin.DirEntry{
 		Attr:   upspin.AttrDirectory,
@@ -36,8 +35,7 @@ func TestLookup(t *testing.T) {
 }
 
 func TestErrFollowLink(t *testing.T) {
-	st, _ := sqlite.Open(":memory:")
-	defer st.Close()
+	st := memory.New()
 	ctx := context.Background()
 	st.Put(ctx, &upspin.DirEntry{
 		Attr:   upspin.AttrDirectory,
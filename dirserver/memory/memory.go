@@ -0,0 +1,440 @@
+// Implements state.State in memory, for tests and ephemeral servers. Like the
+// sqlite implementation it keeps an append-only log of operations, from which
+// the current tree is projected.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// op is a record of the log.
+type op struct {
+	name upspin.PathName
+	time upspin.Time
+	// The sequence of the root directory after this operation was applied.
+	seq int64
+	// The entry that was put, or nil for a deletion. Its Sequence is unset.
+	entry *upspin.DirEntry
+}
+
+// node is an entry in the projection of the log.
+type node struct {
+	// Index of the operation in the log that put the entry.
+	op  int
+	seq int64
+	// The Merkle hash of the entry and, for directories, the sum of those of
+	// its children. See state.Tree.
+	hash []byte
+	sum  state.Sum
+}
+
+type State struct {
+	mu   sync.RWMutex
+	log  []op
+	proj map[upspin.PathName]*node
+	// Problems recorded with Access files.
+	health map[upspin.PathName]state.AccessProblem
+}
+
+// New returns an empty state.
+func New() *State {
+	return &State{
+		proj:   make(map[upspin.PathName]*node),
+		health: make(map[upspin.PathName]state.AccessProblem),
+	}
+}
+
+// entry returns a copy of the projected entry at name without blocks, or nil.
+// The lock must be held.
+func (s *State) entry(name upspin.PathName) *upspin.DirEntry {
+	n, ok := s.proj[name]
+	if !ok {
+		return nil
+	}
+
+	e := s.log[n.op].entry.Copy()
+	e.Sequence = n.seq
+	e.Blocks = nil
+	return e
+}
+
+// LookupElem implements state.State.
+func (s *State) LookupElem(ctx context.Context, p path.Parsed) (state.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ent state.Entry
+	for i := 0; i <= p.NElem(); i++ {
+		e := s.entry(p.First(i).Path())
+		if e == nil {
+			break
+		}
+
+		ent = state.Entry{Path: p.First(i), Attr: e.Attr, Seq: e.Sequence, Id: s.id(e.Name)}
+		if e.Attr != upspin.AttrDirectory {
+			break
+		}
+	}
+
+	return ent, nil
+}
+
+// List implements state.State. Entries are ordered by name.
+//
+// The children of the directory version are found by replaying the operations
+// on the tree that follow the one identified by the entry, up to the entry's
+// sequence.
+func (s *State) List(ctx context.Context, ent state.Entry) ([]state.Entry, error) {
+	if ent.Attr != upspin.AttrDirectory {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	children := make(map[upspin.PathName]*state.Entry)
+	for i := int(ent.Id); i < len(s.log); i++ {
+		o := s.log[i]
+		p, _ := path.Parse(o.name)
+		if p.User() != ent.Path.User() {
+			continue
+		} else if o.seq > ent.Seq {
+			break
+		}
+
+		// Operations within the subtree of a child update its sequence.
+		if p.NElem() <= ent.Path.NElem() || !p.HasPrefix(ent.Path) {
+			continue
+		}
+		name := p.First(ent.Path.NElem() + 1).Path()
+		if p.NElem() > ent.Path.NElem()+1 {
+			if c, ok := children[name]; ok {
+				c.Seq = o.seq
+			}
+		} else if o.entry == nil {
+			delete(children, name)
+		} else {
+			children[name] = &state.Entry{Path: p, Attr: o.entry.Attr, Seq: o.seq, Id: int64(i + 1)}
+		}
+	}
+
+	ents := make([]state.Entry, 0, len(children))
+	for _, c := range children {
+		ents = append(ents, *c)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Path.Path() < ents[j].Path.Path() })
+
+	return ents, nil
+}
+
+// LookupAll implements state.State.
+func (s *State) LookupAll(ctx context.Context, p path.Parsed) ([]*upspin.DirEntry, []state.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	es := make([]*upspin.DirEntry, 0, p.NElem())
+	ents := make([]state.Entry, 0, p.NElem())
+	for i := 0; i <= p.NElem(); i++ {
+		e := s.entry(p.First(i).Path())
+		if e == nil {
+			break
+		}
+
+		es = append(es, e)
+		ents = append(ents, state.Entry{Path: p.First(i), Attr: e.Attr, Seq: e.Sequence, Id: s.id(e.Name)})
+
+		if e.IsLink() {
+			break
+		}
+	}
+
+	return es, ents, nil
+}
+
+// Lookup implements state.State.
+func (s *State) Lookup(ctx context.Context, name upspin.PathName) (*upspin.DirEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n, ok := s.proj[name]
+	if !ok {
+		return nil, nil
+	}
+
+	e := s.log[n.op].entry.Copy()
+	e.Sequence = n.seq
+	return e, nil
+}
+
+// Get implements state.State.
+func (s *State) Get(ctx context.Context, ent state.Entry) (*upspin.DirEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ent.Id < 1 || ent.Id > int64(len(s.log)) || s.log[ent.Id-1].entry == nil {
+		return nil, fmt.Errorf("memory.Get(%s): no put with id %d", ent.Path, ent.Id)
+	}
+
+	e := s.log[ent.Id-1].entry.Copy()
+	e.Sequence = ent.Seq
+	return e, nil
+}
+
+// id returns the identifier of the operation that put the projected entry at
+// name, which is its position in the log starting at 1, as for Versions. The
+// lock must be held.
+func (s *State) id(name upspin.PathName) int64 {
+	return int64(s.proj[name].op + 1)
+}
+
+// Put implements state.State. If the entry's Time is set it is recorded as the
+// time of the operation, otherwise the current time is used.
+func (s *State) Put(ctx context.Context, e *upspin.DirEntry) error {
+	p, _ := path.Parse(e.Name)
+
+	// Only keep what the sqlite implementation persists.
+	c := &upspin.DirEntry{
+		Name:       p.Path(),
+		SignedName: p.Path(),
+		Writer:     e.Writer,
+		Time:       e.Time,
+	}
+	switch e.Attr {
+	case upspin.AttrDirectory:
+		c.Attr = upspin.AttrDirectory
+	case upspin.AttrLink:
+		c.Attr = upspin.AttrLink
+		c.Link = e.Link
+	default:
+		c.Packing = e.Packing
+		c.Packdata = append([]byte(nil), e.Packdata...)
+		c.Blocks = append([]upspin.DirBlock(nil), e.Blocks...)
+		for i := range c.Blocks {
+			c.Blocks[i].Packdata = append([]byte(nil), c.Blocks[i].Packdata...)
+		}
+	}
+	if c.Time == 0 {
+		c.Time = upspin.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkAncestors(p); err != nil {
+		return fmt.Errorf("memory.Put(%s): %w", p, err)
+	}
+	seq := s.nextSeq(p)
+	s.log = append(s.log, op{c.Name, c.Time, seq, c})
+
+	n, ok := s.proj[c.Name]
+	if !ok {
+		n = &node{}
+		s.proj[c.Name] = n
+	}
+	old := n.hash
+	n.op = len(s.log) - 1
+	n.seq = seq
+	n.hash = state.NodeHash(c, n.sum)
+	if !p.IsRoot() {
+		s.updateSeq(p.Drop(1), seq)
+		s.updateHashes(p, old)
+	}
+
+	return nil
+}
+
+// Delete implements state.State.
+func (s *State) Delete(ctx context.Context, p path.Parsed) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkAncestors(p); err != nil {
+		return fmt.Errorf("memory.Delete(%s): %w", p, err)
+	}
+	seq := s.nextSeq(p)
+	s.log = append(s.log, op{p.Path(), upspin.Now(), seq, nil})
+
+	var old []byte
+	if n, ok := s.proj[p.Path()]; ok {
+		old = n.hash
+	}
+	delete(s.proj, p.Path())
+	if !p.IsRoot() {
+		s.updateSeq(p.Drop(1), seq)
+		s.updateHashes(p, old)
+	}
+
+	return nil
+}
+
+// checkAncestors returns an error if an ancestor of p is not in the
+// projection, before the operation on p is logged, as the sqlite implementation
+// fails to find the parent of such a path. The lock must be held.
+func (s *State) checkAncestors(p path.Parsed) error {
+	for i := 0; i < p.NElem(); i++ {
+		if _, ok := s.proj[p.First(i).Path()]; !ok {
+			return fmt.Errorf("ancestor %s not found", p.First(i))
+		}
+	}
+
+	return nil
+}
+
+// nextSeq returns the sequence the next operation on the tree containing p
+// will be assigned. The lock must be held.
+func (s *State) nextSeq(p path.Parsed) int64 {
+	if n, ok := s.proj[p.First(0).Path()]; ok {
+		return n.seq + 1
+	}
+	return upspin.SeqBase
+}
+
+// updateSeq sets the sequence of all elements in the path to seq, which must
+// all exist. The lock must be held.
+func (s *State) updateSeq(p path.Parsed, seq int64) {
+	for i := 0; i <= p.NElem(); i++ {
+		s.proj[p.First(i).Path()].seq = seq
+	}
+}
+
+// updateHashes updates the Merkle hashes of the ancestors of the entry at p,
+// whose hash changed from old, nil if it was added, to its current one, if
+// any. All ancestors must exist. The lock must be held.
+func (s *State) updateHashes(p path.Parsed, old []byte) {
+	for i := p.NElem(); i > 0; i-- {
+		name := p.First(i).Path()
+		parent := s.proj[p.First(i-1).Path()]
+
+		if old != nil {
+			parent.sum = parent.sum.Remove(name, old)
+		}
+		if n, ok := s.proj[name]; ok {
+			parent.sum = parent.sum.Add(name, n.hash)
+		}
+		old = parent.hash
+		parent.hash = state.NodeHash(s.log[parent.op].entry, parent.sum)
+	}
+}
+
+// Node implements state.Tree.
+func (s *State) Node(ctx context.Context, name upspin.PathName) (state.Node, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n, ok := s.proj[name]
+	if !ok {
+		return state.Node{Name: name}, nil
+	}
+	return state.Node{Name: name, Dir: s.log[n.op].entry.IsDir(), Hash: n.hash}, nil
+}
+
+// Children implements state.Tree.
+func (s *State) Children(ctx context.Context, name upspin.PathName) ([]state.Node, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("memory.Children(%s): %w", name, err)
+	}
+	var ns []state.Node
+	for c, n := range s.proj {
+		cp, _ := path.Parse(c)
+		if cp.NElem() != p.NElem()+1 || !cp.HasPrefix(p) {
+			continue
+		}
+		ns = append(ns, state.Node{Name: c, Dir: s.log[n.op].entry.IsDir(), Hash: n.hash})
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Name < ns[j].Name })
+
+	return ns, nil
+}
+
+// Versions implements state.History. Operations are identified by their
+// position in the log, starting at 1.
+func (s *State) Versions(ctx context.Context, name upspin.PathName) ([]state.Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var vs []state.Version
+	for i, o := range s.log {
+		if o.name != name {
+			continue
+		}
+
+		v := state.Version{Id: int64(i + 1), Time: o.time, Sequence: o.seq, Deleted: o.entry == nil}
+		if o.entry != nil {
+			v.Writer = o.entry.Writer
+		}
+		vs = append(vs, v)
+	}
+
+	return vs, nil
+}
+
+// Version implements state.History.
+func (s *State) Version(ctx context.Context, name upspin.PathName, id int64) (*upspin.DirEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id < 1 || id > int64(len(s.log)) {
+		return nil, nil
+	}
+	o := s.log[id-1]
+	if o.name != name || o.entry == nil {
+		return nil, nil
+	}
+
+	e := o.entry.Copy()
+	e.Sequence = o.seq
+	return e, nil
+}
+
+// RecordAccessProblem implements state.Health.
+func (s *State) RecordAccessProblem(ctx context.Context, p state.AccessProblem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.health[p.Name]; ok && old.Sequence == p.Sequence {
+		p.First = old.First
+	}
+	s.health[p.Name] = p
+	return nil
+}
+
+// ClearAccessProblem implements state.Health.
+func (s *State) ClearAccessProblem(ctx context.Context, name upspin.PathName) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.health, name)
+	return nil
+}
+
+// AccessProblems implements state.Health.
+func (s *State) AccessProblems(ctx context.Context, user upspin.UserName) ([]state.AccessProblem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ps []state.AccessProblem
+	for name, p := range s.health {
+		n, ok := s.proj[name]
+		if !ok || n.seq != p.Sequence {
+			continue
+		}
+		if parsed, _ := path.Parse(name); user != "" && parsed.User() != user {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+
+	return ps, nil
+}
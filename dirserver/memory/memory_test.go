@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"github.com/vvanpo/upspin-fly/dirserver/state/statetest"
+)
+
+func TestConformance(t *testing.T) {
+	statetest.Run(t, func(t *testing.T) state.State {
+		return New()
+	})
+}
@@ -0,0 +1,171 @@
+// Copies user trees from another upspin.DirServer, such as the reference
+// implementation, into a state.State.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Failure records an entry that could not be copied.
+type Failure struct {
+	Name upspin.PathName
+	Err  error
+}
+
+func (f Failure) String() string {
+	return fmt.Sprintf("%s: %v", f.Name, f.Err)
+}
+
+// Report summarizes a migration.
+type Report struct {
+	// The number of entries copied.
+	Copied int
+	// The number of entries already present in the destination.
+	Skipped int
+	// Entries that could not be copied. The contents of directories that
+	// could not be copied or listed are not attempted and not reported.
+	Failed []Failure
+}
+
+// Tree copies the tree rooted at the given path from src into dst, preserving
+// writers, times, packing and blocks. The entries are put in breadth-first
+// order, so directories are always created before their contents.
+//
+// Entries already present in dst with the same contents are skipped, so a
+// migration that was interrupted can be resumed by running it again. Regular
+// files and links that differ are overwritten. src must grant the config it
+// was dialed with read and list rights on the entire tree.
+//
+// Only failures to access dst abort the migration; an error is returned
+// alongside the report of what was completed.
+func Tree(ctx context.Context, src upspin.DirServer, dst state.State, root upspin.PathName, log *slog.Logger) (Report, error) {
+	var r Report
+
+	e, err := src.Lookup(root)
+	if err != nil {
+		r.Failed = append(r.Failed, Failure{root, err})
+		return r, nil
+	}
+	if ok, err := copyEntry(ctx, dst, e, &r, log); err != nil || !ok || !e.IsDir() {
+		return r, err
+	}
+
+	dirs := []upspin.PathName{e.Name}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		es, err := src.Glob(string(path.Join(quoteGlob(dir), "*")))
+		if err != nil {
+			r.Failed = append(r.Failed, Failure{dir, fmt.Errorf("list: %w", err)})
+			continue
+		}
+
+		for _, e := range es {
+			if name := e.Name; e.IsIncomplete() {
+				if e, err = src.Lookup(name); err != nil {
+					r.Failed = append(r.Failed, Failure{name, err})
+					continue
+				} else if e.IsIncomplete() {
+					r.Failed = append(r.Failed, Failure{name, fmt.Errorf("no read access")})
+					continue
+				}
+			}
+
+			ok, err := copyEntry(ctx, dst, e, &r, log)
+			if err != nil {
+				return r, err
+			} else if ok && e.IsDir() {
+				dirs = append(dirs, e.Name)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// quoteGlob escapes the metacharacters of Glob patterns in name, so that it
+// only matches itself.
+func quoteGlob(name upspin.PathName) upspin.PathName {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`\*?[`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return upspin.PathName(b.String())
+}
+
+// copyEntry puts e into dst unless an identical entry is present, and records
+// the outcome. Returns whether the entry is present in dst afterwards.
+func copyEntry(ctx context.Context, dst state.State, e *upspin.DirEntry, r *Report, log *slog.Logger) (bool, error) {
+	old, err := dst.Lookup(ctx, e.Name)
+	if err != nil {
+		return false, fmt.Errorf("look up %s: %w", e.Name, err)
+	}
+
+	if old != nil {
+		if old.IsDir() != e.IsDir() {
+			r.Failed = append(r.Failed, Failure{e.Name, fmt.Errorf("conflicts with existing entry")})
+			return false, nil
+		}
+		if e.IsDir() || same(old, e) {
+			r.Skipped++
+			return true, nil
+		}
+	}
+
+	if _, err := path.Parse(e.Name); err != nil {
+		r.Failed = append(r.Failed, Failure{e.Name, err})
+		return false, nil
+	}
+
+	e = e.Copy()
+	if e.IsDir() {
+		// Directory entries on this server have no blocks or packing.
+		e.Blocks = nil
+		e.Packdata = nil
+	}
+	if err := dst.Put(ctx, e); err != nil {
+		return false, fmt.Errorf("put %s: %w", e.Name, err)
+	}
+	log.DebugContext(ctx, "copied entry", "pathname", e.Name)
+	r.Copied++
+
+	return true, nil
+}
+
+// same reports whether two non-directory entries have the same contents.
+func same(a, b *upspin.DirEntry) bool {
+	if a.Attr != b.Attr || a.Writer != b.Writer {
+		return false
+	}
+	if a.IsLink() {
+		// Links are stored without packing.
+		return a.Link == b.Link
+	}
+	if a.Packing != b.Packing || !bytes.Equal(a.Packdata, b.Packdata) ||
+		len(a.Blocks) != len(b.Blocks) {
+		return false
+	}
+	for i := range a.Blocks {
+		if a.Blocks[i].Location != b.Blocks[i].Location ||
+			a.Blocks[i].Offset != b.Blocks[i].Offset ||
+			a.Blocks[i].Size != b.Blocks[i].Size ||
+			!bytes.Equal(a.Blocks[i].Packdata, b.Blocks[i].Packdata) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/bind"
+	"upspin.io/test/testenv"
+	"upspin.io/upspin"
+)
+
+const owner = "user1@google.com"
+
+// A tree on the inprocess reference server is copied in full, and copying it
+// again skips every entry.
+func TestTree(t *testing.T) {
+	env, err := testenv.New(&testenv.Setup{
+		OwnerName: owner,
+		Kind:      "inprocess",
+		Packing:   upspin.PlainPack,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Exit()
+
+	c := env.Client
+	if _, err := c.MakeDirectory(owner + "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MakeDirectory(owner + "/dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(owner+"/dir/sub/file", []byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PutLink(owner+"/dir/sub/file", owner+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(owner+"/Access", []byte("*: "+owner)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MakeDirectory(owner + "/Group"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(owner+"/Group/friends", []byte(owner)); err != nil {
+		t.Fatal(err)
+	}
+	// The name is a pattern matching dir as well.
+	if _, err := c.MakeDirectory(owner + "/d*r"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(owner+"/d*r/file", []byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := bind.DirServer(env.Config, env.Config.DirEndpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := sqlite.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	ctx := context.Background()
+
+	r, err := Tree(ctx, src, dst, owner+"/", slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Failed) != 0 {
+		t.Errorf("failures: %v", r.Failed)
+	}
+	if r.Copied != 10 || r.Skipped != 0 {
+		t.Errorf("copied %d and skipped %d entries, want 10 copied", r.Copied, r.Skipped)
+	}
+
+	want, err := src.Lookup(owner + "/dir/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dst.Lookup(ctx, owner+"/dir/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	} else if got == nil {
+		t.Fatal("file not copied")
+	}
+	if !same(got, want) {
+		t.Errorf("copied file differs: %v, want %v", got, want)
+	}
+	if got.Time != want.Time {
+		t.Errorf("time not preserved: %d, want %d", got.Time, want.Time)
+	}
+	if l, err := dst.Lookup(ctx, owner+"/link"); err != nil {
+		t.Fatal(err)
+	} else if l == nil || l.Link != owner+"/dir/sub/file" {
+		t.Errorf("link not copied: %v", l)
+	}
+
+	r, err = Tree(ctx, src, dst, owner+"/", slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Copied != 0 || r.Skipped != 10 {
+		t.Errorf("resumed migration copied %d and skipped %d entries", r.Copied, r.Skipped)
+	}
+}
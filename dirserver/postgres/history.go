@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Versions implements state.History.
+func (s *State) Versions(ctx context.Context, name upspin.PathName) ([]state.Version, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := s.db.QueryContext(
+		ctx,
+		`SELECT o.id, coalesce(o.time, o.timestamp), o.sequence, p.writer
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		LEFT JOIN log_put p ON o.put = p.id
+		WHERE r.username = $1 AND o.path = $2
+		ORDER BY o.id`,
+		p.User(),
+		p.FilePath(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("postgres.Versions(%s): %w", name, err)
+	}
+	defer rs.Close()
+
+	var vs []state.Version
+	for rs.Next() {
+		var v state.Version
+		var writer sql.NullString
+		if err := rs.Scan(&v.Id, &v.Time, &v.Sequence, &writer); err != nil {
+			return nil, fmt.Errorf("postgres.Versions(%s): %w", name, err)
+		}
+		v.Writer = upspin.UserName(writer.String)
+		v.Deleted = !writer.Valid
+		vs = append(vs, v)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("postgres.Versions(%s): %w", name, err)
+	}
+
+	return vs, nil
+}
+
+// Version implements state.History.
+func (s *State) Version(ctx context.Context, name upspin.PathName, id int64) (*upspin.DirEntry, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("postgres.Version(%s, %d): begin transaction: %w", name, id, err)
+	}
+	defer tx.Commit()
+
+	e, pid, err := scanEntry(tx.QueryRow(
+		`SELECT $1::TEXT, o.sequence, coalesce(o.time, o.timestamp), p.id, p.writer, p.dir, p.link, p.packing, p.packdata
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE o.id = $2 AND r.username = $3 AND o.path = $4`,
+		p.Path(),
+		id,
+		p.User(),
+		p.FilePath(),
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("postgres.Version(%s, %d): %w", name, id, err)
+	}
+
+	if e.IsRegular() {
+		if e.Blocks, err = getBlocks(tx, pid); err != nil {
+			return nil, fmt.Errorf("postgres.Version(%s, %d): %w", name, id, err)
+		}
+	}
+
+	return e, nil
+}
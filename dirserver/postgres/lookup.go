@@ -0,0 +1,279 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// The columns selected by queries for entries, which scanEntry scans.
+const entryColumns = `e.name, e.sequence, coalesce(o.time, o.timestamp), p.id, p.writer, p.dir, p.link, p.packing, p.packdata`
+
+// LookupElem implements state.State.
+func (s *State) LookupElem(ctx context.Context, p path.Parsed) (state.Entry, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return state.Entry{}, fmt.Errorf("postgres.LookupElem(%s): begin transaction: %w", p, err)
+	}
+	defer tx.Commit()
+
+	var ent state.Entry
+	for i := 0; i <= p.NElem(); i++ {
+		e, _, op, err := get(tx, p.First(i).Path())
+		if err != nil {
+			return state.Entry{}, err
+		} else if e == nil {
+			break
+		}
+
+		ent = state.Entry{Path: p.First(i), Attr: e.Attr, Seq: e.Sequence, Id: op}
+		if e.Attr != upspin.AttrDirectory {
+			break
+		}
+	}
+
+	return ent, nil
+}
+
+// LookupAll implements state.State.
+func (s *State) LookupAll(ctx context.Context, p path.Parsed) ([]*upspin.DirEntry, []state.Entry, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin transaction for LookupAll(%s): %w", p, err)
+	}
+	defer tx.Commit()
+
+	es := make([]*upspin.DirEntry, 0, p.NElem())
+	ents := make([]state.Entry, 0, p.NElem())
+	for i := 0; i <= p.NElem(); i++ {
+		e, _, op, err := get(tx, p.First(i).Path())
+		if err != nil {
+			return nil, nil, err
+		} else if e == nil {
+			break
+		}
+
+		es = append(es, e)
+		ents = append(ents, state.Entry{Path: p.First(i), Attr: e.Attr, Seq: e.Sequence, Id: op})
+
+		if e.IsLink() {
+			break
+		}
+	}
+
+	return es, ents, nil
+}
+
+// Lookup implements state.State.
+func (s *State) Lookup(ctx context.Context, name upspin.PathName) (*upspin.DirEntry, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction for Lookup(%s): %w", name, err)
+	}
+	defer tx.Commit()
+
+	e, pid, _, err := get(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil && e.IsRegular() {
+		if e.Blocks, err = getBlocks(tx, pid); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// Get implements state.State.
+func (s *State) Get(ctx context.Context, ent state.Entry) (*upspin.DirEntry, error) {
+	name := ent.Path.Path()
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("postgres.Get(%s): begin transaction: %w", name, err)
+	}
+	defer tx.Commit()
+
+	e, pid, err := scanEntry(tx.QueryRow(
+		`SELECT $1::TEXT, $2::BIGINT, coalesce(o.time, o.timestamp), p.id, p.writer, p.dir, p.link, p.packing, p.packdata
+		FROM log_operation o
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE o.id = $3`,
+		name,
+		ent.Seq,
+		ent.Id,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("postgres.Get(%s): operation %d: %w", name, ent.Id, err)
+	}
+
+	if e.IsRegular() {
+		if e.Blocks, err = getBlocks(tx, pid); err != nil {
+			return nil, fmt.Errorf("postgres.Get(%s): %w", name, err)
+		}
+	}
+
+	return e, nil
+}
+
+// List implements state.State. Entries are ordered by name.
+//
+// The children of the directory version are the latest operations on each
+// path directly under it that were applied after the directory was put, and
+// up to its sequence; those that are puts are listed. The sequence of each
+// child is that of the latest operation in its subtree within the same range.
+func (s *State) List(ctx context.Context, ent state.Entry) ([]state.Entry, error) {
+	name := ent.Path.Path()
+	if ent.Attr != upspin.AttrDirectory {
+		return nil, nil
+	}
+
+	// Paths in the log are relative to the root directory.
+	prefix := ent.Path.FilePath()
+	if !ent.Path.IsRoot() {
+		prefix += "/"
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("postgres.List(%s): begin transaction: %w", name, err)
+	}
+	defer tx.Commit()
+
+	rs, err := tx.Query(
+		`SELECT r.username || '/' || o.path, (
+				SELECT max(d.sequence)
+				FROM log_operation d
+				WHERE d.root = o.root AND d.id >= o.id AND d.sequence <= $1
+					AND (d.path = o.path OR left(d.path, length(o.path) + 1) = o.path || '/')
+			),
+			coalesce(o.time, o.timestamp), p.id, p.writer, p.dir, p.link, p.packing, p.packdata, o.id
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE o.id IN (
+			SELECT max(c.id)
+			FROM log_operation c
+			WHERE c.root = r.id AND c.id > $3 AND c.sequence <= $1
+				AND length(c.path) > length($4::TEXT) AND left(c.path, length($4::TEXT)) = $4::TEXT
+				AND strpos(substr(c.path, length($4::TEXT) + 1), '/') = 0
+			GROUP BY c.path
+		) AND r.username = $2
+		ORDER BY o.path COLLATE "C"`,
+		ent.Seq,
+		ent.Path.User(),
+		ent.Id,
+		prefix,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("postgres.List(%s): query: %w", name, err)
+	}
+	defer rs.Close()
+
+	var ents []state.Entry
+	for rs.Next() {
+		var op int64
+		e, _, err := scanEntry(rs, &op)
+		if err != nil {
+			return nil, fmt.Errorf("postgres.List(%s): %w", name, err)
+		}
+		p, err := path.Parse(e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("postgres.List(%s): %w", name, err)
+		}
+		ents = append(ents, state.Entry{Path: p, Attr: e.Attr, Seq: e.Sequence, Id: op})
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("postgres.List(%s): %w", name, err)
+	}
+
+	return ents, nil
+}
+
+// get retrieves the projected entry at name, without blocks, along with the ids
+// of its log_put and log_operation records.
+func get(tx *sql.Tx, name upspin.PathName) (*upspin.DirEntry, int64, int64, error) {
+	r := tx.QueryRow(
+		`SELECT `+entryColumns+`, o.id
+		FROM proj_entry e
+		INNER JOIN log_operation o ON e.op = o.id
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE e.name = $1`,
+		name,
+	)
+
+	var op int64
+	e, pid, err := scanEntry(r, &op)
+	if err == sql.ErrNoRows {
+		return nil, -1, -1, nil
+	} else if err != nil {
+		return nil, -1, -1, fmt.Errorf("querying DirEntry: %w", err)
+	}
+
+	return e, pid, op, nil
+}
+
+// scanEntry scans the columns in entryColumns into an entry without blocks,
+// and returns it along with its log_put id. Any additional columns are scanned
+// into extra.
+func scanEntry(r interface{ Scan(...any) error }, extra ...any) (*upspin.DirEntry, int64, error) {
+	e := &upspin.DirEntry{}
+	var pid int64
+	var dir bool
+	var link sql.NullString
+	var packing sql.NullInt16
+	var packdata []byte
+	dest := []any{&e.Name, &e.Sequence, &e.Time, &pid, &e.Writer, &dir, &link, &packing, &packdata}
+	if err := r.Scan(append(dest, extra...)...); err != nil {
+		return nil, -1, err
+	}
+
+	e.SignedName = e.Name
+	if dir {
+		e.Attr = upspin.AttrDirectory
+	} else if link.Valid {
+		e.Attr = upspin.AttrLink
+		e.Link = upspin.PathName(link.String)
+	} else {
+		e.Packing = upspin.Packing(packing.Int16)
+		e.Packdata = packdata
+	}
+
+	return e, pid, nil
+}
+
+// getBlocks retrieves the blocks belonging to a log_put record, in order.
+func getBlocks(tx *sql.Tx, pid int64) ([]upspin.DirBlock, error) {
+	rs, err := tx.Query(
+		`SELECT endpoint, reference, "offset", size, packdata
+		FROM log_block
+		WHERE put = $1
+		ORDER BY "offset"`,
+		pid,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying blocks: %w", err)
+	}
+	defer rs.Close()
+
+	var bs []upspin.DirBlock
+	for rs.Next() {
+		var b upspin.DirBlock
+		var ep string
+		if err := rs.Scan(&ep, &b.Location.Reference, &b.Offset, &b.Size, &b.Packdata); err != nil {
+			return nil, fmt.Errorf("querying block: %w", err)
+		}
+		e, err := upspin.ParseEndpoint(ep)
+		if err != nil {
+			return nil, fmt.Errorf("block %s: %w", b.Location.Reference, err)
+		}
+		b.Location.Endpoint = *e
+		bs = append(bs, b)
+	}
+
+	return bs, rs.Err()
+}
@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+	"upspin.io/upspin"
+)
+
+// The channel committed operations are announced on.
+const notifyChannel = "upspin_fly_op"
+
+// Notification announces a committed operation. A notification with an empty
+// Root indicates that the connection to the database was re-established, and
+// notifications may have been missed.
+type Notification struct {
+	Root upspin.UserName `json:"root"`
+	// The sequence of the root directory after the operation.
+	Sequence int64 `json:"sequence"`
+}
+
+// notify queues a notification for the operation, to be delivered when the
+// transaction commits.
+func notify(tx *sql.Tx, root upspin.UserName, seq int64) error {
+	payload, err := json.Marshal(Notification{root, seq})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, notifyChannel, string(payload))
+	return err
+}
+
+// Listen returns a channel receiving notifications of operations committed by
+// any client of the database, until the context is cancelled.
+func (s *State) Listen(ctx context.Context) (<-chan Notification, error) {
+	l := pq.NewListener(s.dsn, time.Second, time.Minute, nil)
+	if err := l.Listen(notifyChannel); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	ch := make(chan Notification)
+	go func() {
+		defer close(ch)
+		defer l.Close()
+
+		for {
+			var n Notification
+			select {
+			case <-ctx.Done():
+				return
+			case pn, ok := <-l.Notify:
+				if !ok {
+					return
+				}
+				// A nil notification is sent on reconnection.
+				if pn != nil && json.Unmarshal([]byte(pn.Extra), &n) != nil {
+					continue
+				}
+			case <-time.After(time.Minute):
+				// Detect dead connections.
+				go l.Ping()
+				continue
+			}
+
+			select {
+			case ch <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"github.com/vvanpo/upspin-fly/dirserver/state/statetest"
+	"upspin.io/upspin"
+)
+
+// The tests run against the database given by this environment variable, as a
+// key/value connection string, or a default local server. They are skipped if
+// the database can't be reached.
+const dsnEnv = "UPSPIN_FLY_POSTGRES"
+
+var schemas atomic.Int64
+
+// open returns a state in a new schema of the test database, dropped when the
+// test completes.
+func open(t *testing.T) *State {
+	dsn := os.Getenv(dsnEnv)
+	if dsn == "" {
+		dsn = "host=localhost sslmode=disable connect_timeout=2"
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Skipf("postgres not available: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if err := admin.Ping(); err != nil {
+		t.Skipf("postgres not available (set %s): %v", dsnEnv, err)
+	}
+
+	schema := fmt.Sprintf("upspin_fly_test_%d_%d", os.Getpid(), schemas.Add(1))
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	s, err := Open(dsn + " search_path=" + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	statetest.Run(t, func(t *testing.T) state.State {
+		return open(t)
+	})
+}
+
+// Operations committed through one State are announced to listeners on
+// another sharing the database.
+func TestListen(t *testing.T) {
+	s := open(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	other, err := Open(s.dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	ch, err := other.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(ctx, &upspin.DirEntry{
+		Attr:   upspin.AttrDirectory,
+		Writer: "listen@example.com",
+		Name:   "listen@example.com/",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case n := <-ch:
+			// Other tests may share the notification channel.
+			if n.Root != "listen@example.com" {
+				continue
+			}
+			if n.Sequence != upspin.SeqBase {
+				t.Errorf("wrong sequence: %d", n.Sequence)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no notification received")
+		}
+	}
+}
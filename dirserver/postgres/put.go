@@ -0,0 +1,240 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Put implements state.State. The entry keeps its Time if set, otherwise it is
+// given the current time; the operation is recorded at the current time
+// regardless.
+func (s *State) Put(ctx context.Context, e *upspin.DirEntry) error {
+	p, _ := path.Parse(e.Name)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction for Put: %w", err)
+	}
+
+	root, err := lockRoot(tx, p, p.IsRoot())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	pid, err := appendPut(tx, e)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("persist put to log: %w", err)
+	}
+
+	seq, err := nextSeq(tx, p)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("compute sequence: %w", err)
+	}
+
+	oid, err := appendOp(tx, root, p, pid, seq, e.Time)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("persist operation to log: %w", err)
+	}
+
+	for _, b := range e.Blocks {
+		_, err := tx.Exec(
+			`INSERT INTO log_block VALUES ($1, $2, $3, $4, $5, $6)`,
+			pid,
+			b.Location.Endpoint.String(),
+			b.Location.Reference,
+			b.Offset,
+			b.Size,
+			b.Packdata,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("persist block %v: %w", b.Location, err)
+		}
+	}
+
+	if err := projPut(tx, p, oid, seq); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("caching put: %w", err)
+	}
+
+	if err := notify(tx, p.User(), seq); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("notify: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func appendPut(tx *sql.Tx, e *upspin.DirEntry) (int64, error) {
+	var r *sql.Row
+	switch e.Attr {
+	case upspin.AttrDirectory:
+		r = tx.QueryRow(
+			`INSERT INTO log_put (writer, dir) VALUES ($1, $2) RETURNING id`,
+			e.Writer,
+			true,
+		)
+	case upspin.AttrLink:
+		r = tx.QueryRow(
+			`INSERT INTO log_put (writer, link) VALUES ($1, $2) RETURNING id`,
+			e.Writer,
+			e.Link,
+		)
+	default:
+		r = tx.QueryRow(
+			`INSERT INTO log_put (writer, packing, packdata) VALUES ($1, $2, $3) RETURNING id`,
+			e.Writer,
+			int16(e.Packing),
+			e.Packdata,
+		)
+	}
+
+	var id int64
+	if err := r.Scan(&id); err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+// Delete implements state.State.
+func (s *State) Delete(ctx context.Context, p path.Parsed) error {
+	return s.DeleteAt(ctx, p, 0)
+}
+
+// DeleteAt implements state.TimedDeleter.
+func (s *State) DeleteAt(ctx context.Context, p path.Parsed, t upspin.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction for Delete: %w", err)
+	}
+
+	root, err := lockRoot(tx, p, false)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	seq, err := nextSeq(tx, p)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("compute sequence: %w", err)
+	}
+
+	if _, err := appendOp(tx, root, p, -1, seq, t); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("persist delete to log: %w", err)
+	}
+
+	old, err := projStoredHash(tx, p)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete cache entry: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM proj_entry WHERE name = $1`, p.Path()); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete cache entry: %w", err)
+	}
+	if err := projUpdateSeq(tx, p.Drop(1), seq); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete cache entry: %w", err)
+	}
+	if err := projHashPath(tx, p, old); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update hashes: %w", err)
+	}
+
+	if err := notify(tx, p.User(), seq); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("notify: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Updates a path in the projection. seq is the sequence assigned to the
+// operation op.
+func projPut(tx *sql.Tx, p path.Parsed, op int64, seq int64) error {
+	if !p.IsRoot() {
+		if err := projUpdateSeq(tx, p.Drop(1), seq); err != nil {
+			return err
+		}
+	}
+
+	var parent *sql.Row
+	if p.IsRoot() {
+		// The root directory is its own parent.
+		parent = tx.QueryRow(
+			`SELECT put
+			FROM log_operation
+			WHERE id = $1`,
+			op,
+		)
+	} else {
+		parent = tx.QueryRow(
+			`SELECT o.put
+			FROM proj_entry e
+			INNER JOIN log_operation o ON e.op = o.id
+			WHERE e.name = $1`,
+			p.Drop(1).Path(),
+		)
+	}
+	var pid int64
+	if err := parent.Scan(&pid); err != nil {
+		return fmt.Errorf("find parent of %s: %w", p, err)
+	}
+
+	old, err := projStoredHash(tx, p)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO proj_entry (name, op, sequence, parent)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET
+			op = excluded.op,
+			sequence = excluded.sequence,
+			parent = excluded.parent`,
+		p.Path(),
+		op,
+		seq,
+		pid,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := projHash(tx, p.Path()); err != nil {
+		return err
+	}
+
+	return projHashPath(tx, p, old)
+}
+
+// Sets the sequence of all elements in the path to seq. See the sqlite
+// implementation for details.
+func projUpdateSeq(tx *sql.Tx, p path.Parsed, seq int64) error {
+	names := make([]string, p.NElem()+1)
+	for i := range names {
+		names[i] = p.First(i).String()
+	}
+
+	_, err := tx.Exec(
+		`UPDATE proj_entry
+		SET sequence = $1
+		WHERE name = ANY($2)`,
+		seq,
+		pq.Array(names),
+	)
+
+	return err
+}
@@ -0,0 +1,52 @@
+-- Mirrors the schema of the sqlite implementation; see its schema.sql for a
+-- description of the tables.
+
+CREATE TABLE IF NOT EXISTS log_root (
+	id BIGSERIAL PRIMARY KEY,
+	username TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS log_put (
+	id BIGSERIAL PRIMARY KEY,
+	writer TEXT NOT NULL,
+	dir BOOLEAN DEFAULT FALSE NOT NULL,
+	link TEXT,
+	packing SMALLINT,
+	packdata BYTEA
+);
+
+CREATE TABLE IF NOT EXISTS log_operation (
+	id BIGSERIAL PRIMARY KEY,
+	timestamp BIGINT DEFAULT extract(epoch FROM now())::BIGINT NOT NULL,
+	root BIGINT REFERENCES log_root NOT NULL,
+	path TEXT NOT NULL,
+	sequence BIGINT NOT NULL,
+	put BIGINT REFERENCES log_put UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS log_block (
+	put BIGINT REFERENCES log_put NOT NULL,
+	endpoint TEXT NOT NULL,
+	reference TEXT NOT NULL,
+	"offset" BIGINT NOT NULL,
+	size BIGINT NOT NULL,
+	packdata BYTEA,
+	PRIMARY KEY(put, reference)
+);
+
+CREATE TABLE IF NOT EXISTS proj_entry (
+	name TEXT PRIMARY KEY NOT NULL,
+	op BIGINT REFERENCES log_operation UNIQUE NOT NULL,
+	sequence BIGINT NOT NULL,
+	parent BIGINT REFERENCES log_put NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS proj_entry_parent ON proj_entry (parent);
+
+-- The time of an operation reported to clients, if other than its timestamp.
+ALTER TABLE log_operation ADD COLUMN IF NOT EXISTS time BIGINT;
+
+-- Added after the table; the hashes of existing entries are computed on open.
+ALTER TABLE proj_entry ADD COLUMN IF NOT EXISTS hash BYTEA;
+
+ALTER TABLE proj_entry ADD COLUMN IF NOT EXISTS children BYTEA;
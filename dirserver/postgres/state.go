@@ -0,0 +1,141 @@
+// Implements state.State on PostgreSQL, with the same log and projection design
+// as the sqlite implementation, such that several server instances may share
+// one database.
+//
+// Operations on a tree are serialized by locking the row of its root in
+// log_root for the duration of the transaction, and each committed operation
+// is announced to listeners with NOTIFY.
+package postgres
+
+import (
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+//go:embed schema.sql
+var schema string
+
+type State struct {
+	db  *sql.DB
+	dsn string
+}
+
+// Open accepts a PostgreSQL connection string and initializes the database,
+// creating the schema if not present.
+func Open(dsn string) (*State, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{db, dsn}
+
+	if err := s.create(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the database.
+func (s *State) Close() error {
+	return s.db.Close()
+}
+
+func (s *State) create() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range strings.Split(schema, ";\n") {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := rehash(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("rehash projection: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// lockRoot locks the root record of the tree containing p until the end of the
+// transaction, and returns its id. If create is true the root is created.
+func lockRoot(tx *sql.Tx, p path.Parsed, create bool) (int64, error) {
+	if create {
+		var id int64
+		err := tx.QueryRow(
+			`INSERT INTO log_root (username) VALUES ($1) RETURNING id`,
+			p.User(),
+		).Scan(&id)
+		if err != nil {
+			return -1, fmt.Errorf("create root for %s: %w", p.User(), err)
+		}
+		return id, nil
+	}
+
+	var id int64
+	err := tx.QueryRow(
+		`SELECT id FROM log_root WHERE username = $1 FOR UPDATE`,
+		p.User(),
+	).Scan(&id)
+	if err != nil {
+		return -1, fmt.Errorf("lock root for %s: %w", p.User(), err)
+	}
+
+	return id, nil
+}
+
+// appendOp appends an operation to the log and returns its id. pid is the id
+// of the corresponding log_put record, <0 indicates a deletion operation. seq
+// is the sequence of the root directory resulting from the operation. The
+// operation is recorded at the current time; t is the time of the operation
+// reported to clients, if set.
+func appendOp(tx *sql.Tx, root int64, p path.Parsed, pid int64, seq int64, t upspin.Time) (int64, error) {
+	put := sql.NullInt64{Int64: pid, Valid: pid >= 0}
+	var id int64
+	err := tx.QueryRow(
+		`INSERT INTO log_operation (time, root, path, sequence, put)
+		VALUES (NULLIF($1, 0), $2, $3, $4, $5)
+		RETURNING id`,
+		t,
+		root,
+		p.FilePath(),
+		seq,
+		put,
+	).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+// nextSeq returns the sequence the next operation on the tree containing p
+// will be assigned. The root must be locked.
+func nextSeq(tx *sql.Tx, p path.Parsed) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(
+		`SELECT sequence
+		FROM proj_entry
+		WHERE name = $1`,
+		p.First(0).Path(),
+	).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return upspin.SeqBase, nil
+	} else if err != nil {
+		return -1, err
+	}
+
+	return seq + 1, nil
+}
@@ -1,6 +1,17 @@
 package dirserver
 
-import "upspin.io/upspin"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"upspin.io/access"
+	"upspin.io/client/clientutil"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
 
 /*
 If the Put entry...
@@ -28,10 +39,222 @@ If the Put entry...
 */
 
 // Put implements upspin.DirServer.
-func (s *server) Put(entry *upspin.DirEntry) (*upspin.DirEntry, error) {
+func (d *dialed) Put(entry *upspin.DirEntry) (*upspin.DirEntry, error) {
+	ctx, op := d.setCtx("Put")
+	d.log = d.log.With("pathname", entry.Name)
+
+	p, err := path.Parse(entry.Name)
+	if err != nil {
+		return nil, errors.E(op, entry.Name, err)
+	} else if p.Path() != entry.Name {
+		return nil, errors.E(op, entry.Name, errors.Invalid, errors.Str("path is not clean"))
+	}
+	if err := d.checkEntry(ctx, p, entry); err != nil {
+		return nil, errors.E(op, entry.Name, err)
+	}
+
+	d.writes.Lock()
+	defer d.writes.Unlock()
+
+	existing, err := d.state.Lookup(ctx, entry.Name)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, entry.Name, err)
+	}
+	if p.IsRoot() {
+		if existing != nil {
+			return nil, errors.E(op, entry.Name, errors.Exist)
+		}
+	} else if e, err := d.checkPut(ctx, op, p, existing != nil); err != nil {
+		return e, err
+	}
+
+	switch {
+	case existing != nil && (existing.IsDir() || entry.IsDir()):
+		return nil, errors.E(op, entry.Name, errors.Exist, errors.Str("directories can not be replaced"))
+	case existing != nil && entry.Sequence == upspin.SeqNotExist:
+		return nil, errors.E(op, entry.Name, errors.Exist)
+	case existing != nil && entry.Sequence != upspin.SeqIgnore && entry.Sequence != existing.Sequence:
+		return nil, errors.E(op, entry.Name, errors.Invalid, errors.Str("sequence number does not match"))
+	case existing == nil && entry.Sequence != upspin.SeqIgnore && entry.Sequence != upspin.SeqNotExist:
+		return nil, errors.E(op, entry.Name, errors.NotExist)
+	}
+
+	if err := d.state.Put(ctx, entry.Copy()); err != nil {
+		return nil, d.internalErr(ctx, op, entry.Name, err)
+	}
+	d.changed(ctx, entry.Name)
+
+	e, err := d.state.Lookup(ctx, entry.Name)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, entry.Name, err)
+	}
 
 	return &upspin.DirEntry{
 		Attr:     upspin.AttrIncomplete,
-		Sequence: 1,
+		Sequence: e.Sequence,
 	}, nil
 }
+
+// checkEntry checks the entry to put against the rules for Access files and
+// the Group subtree, which depend on neither the tree nor the rights of the
+// requester. The contents of Access and Group files are read and parsed.
+// Returned errors are sanitized.
+func (d *dialed) checkEntry(ctx context.Context, p path.Parsed, e *upspin.DirEntry) error {
+	if e.IsIncomplete() {
+		return errors.E(errors.Invalid, errors.Str("entry is incomplete"))
+	}
+	if p.IsRoot() {
+		if p.User() != d.requester {
+			return errors.E(errors.Permission)
+		} else if !e.IsDir() {
+			return errors.E(errors.NotDir)
+		}
+		return nil
+	}
+
+	isAccess := access.IsAccessFile(p.Path())
+	isGroup := p.Elem(0) == "Group"
+	switch {
+	case isAccess && !e.IsRegular():
+		return errors.E(errors.Invalid, errors.Str("Access file must be a regular file"))
+	case isGroup && p.NElem() == 1 && !e.IsDir():
+		return errors.E(errors.NotDir, errors.Str("Group must be a directory"))
+	case isGroup && e.IsLink():
+		return errors.E(errors.Invalid, errors.Str("links are not allowed in the Group subtree"))
+	}
+	if isGroup {
+		for i := 1; i < p.NElem(); i++ {
+			if strings.Contains(p.Elem(i), "@") {
+				return errors.E(errors.Invalid, errors.Str("path elements in the Group subtree can not resemble a username"))
+			}
+		}
+	}
+	if !isAccess && !isGroup {
+		return nil
+	}
+
+	if p.User() != d.requester {
+		return errors.E(errors.Permission, errors.Str("only the owner may put Access and Group files"))
+	}
+	if !e.IsRegular() {
+		return nil
+	}
+	if !signedPacking(e.Packing) {
+		return errors.E(errors.Invalid, errors.Str("Access and Group files must be signed but not encrypted"))
+	}
+	if isAccess {
+		return d.checkAccess(ctx, e)
+	}
+
+	return d.checkGroup(ctx, p, e)
+}
+
+// signedPacking reports whether a packing is allowed for Access and Group
+// files, which must be signed but not encrypted for the server to read them.
+func signedPacking(p upspin.Packing) bool {
+	return p == upspin.PlainPack || p == upspin.EEIntegrityPack
+}
+
+// checkPut checks that the parent of a non-root entry to put exists, and that
+// the requester has the right to create it, or to replace it if it exists. If
+// the parent path contains a link, it is returned with upspin.ErrFollowLink.
+// Other returned errors are sanitized and ready to be returned by Put.
+func (d *dialed) checkPut(ctx context.Context, op errors.Op, p path.Parsed, exists bool) (*upspin.DirEntry, error) {
+	name := p.Path()
+	parent, e, _, _, _, err := d.lookup(ctx, p.Drop(1).Path())
+	if err == upspin.ErrFollowLink {
+		return e, err
+	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) || errors.Is(errors.NotExist, err) {
+		return nil, errors.E(op, name, err)
+	} else if err != nil {
+		return nil, d.internalErr(ctx, op, name, err)
+	}
+	if e.Name != parent.Path() {
+		return nil, errors.E(op, name, errors.NotExist, errors.Str("parent directory does not exist"))
+	} else if !e.IsDir() {
+		return nil, errors.E(op, name, errors.NotDir, errors.Str("parent is not a directory"))
+	}
+
+	ae, err := d.accessFor(ctx, p, false)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, name, err)
+	}
+	var a *access.Access
+	if ae != nil {
+		if a, err = d.loadAccess(ctx, ae); err != nil {
+			return nil, d.internalErr(ctx, op, name, err)
+		}
+	}
+	right := access.Create
+	if exists {
+		right = access.Write
+	}
+	if granted, err := d.can(ctx, ae, a, right, p); err != nil {
+		return nil, d.internalErr(ctx, op, name, err)
+	} else if !granted {
+		return nil, errors.E(op, name, errors.Permission)
+	}
+
+	return nil, nil
+}
+
+// readAll reads the contents of a file as the server user. Replaced by tests.
+var readAll = clientutil.ReadAll
+
+// checkAccess reads the Access file an entry refers to, and reports every line
+// that can not be parsed. Returned errors are sanitized.
+func (d *dialed) checkAccess(ctx context.Context, e *upspin.DirEntry) error {
+	data, err := readAll(d.cfg, e)
+	if err != nil {
+		d.log.WarnContext(ctx, "failed to read access file", "err", err)
+		return errors.E(errors.IO, errors.Errorf("reading Access file: %v", err))
+	}
+
+	return parseAccess(e.Name, data)
+}
+
+// checkGroup reads the Group file an entry refers to, and reports whether it
+// can be parsed. Returned errors are sanitized.
+func (d *dialed) checkGroup(ctx context.Context, p path.Parsed, e *upspin.DirEntry) error {
+	data, err := readAll(d.cfg, e)
+	if err != nil {
+		d.log.WarnContext(ctx, "failed to read group file", "err", err)
+		return errors.E(errors.IO, errors.Errorf("reading Group file: %v", err))
+	}
+	if _, err := access.ParseGroup(p, data); err != nil {
+		return errors.E(errors.Invalid, err)
+	}
+
+	return nil
+}
+
+// parseAccess reports the errors of every line of an Access file that can not
+// be parsed, rather than only the first.
+func parseAccess(name upspin.PathName, data []byte) error {
+	_, err := access.Parse(name, data)
+	if err == nil {
+		return nil
+	}
+
+	var msgs []string
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		// Preceding the line with empty ones keeps the line numbers
+		// reported by the parser.
+		l := append(bytes.Repeat([]byte("\n"), i), line...)
+		if _, err := access.Parse(name, l); err != nil {
+			msg := err.Error()
+			if e, ok := err.(*errors.Error); ok && e.Err != nil {
+				msg = e.Err.Error()
+			}
+			if n := fmt.Sprintf("line %d", i+1); !strings.Contains(msg, n) {
+				msg = n + ": " + msg
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) == 0 {
+		return errors.E(errors.Invalid, err)
+	}
+
+	return errors.E(errors.Invalid, errors.Str(strings.Join(msgs, "\n")))
+}
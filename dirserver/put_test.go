@@ -0,0 +1,87 @@
+package dirserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func TestPut(t *testing.T) {
+	entries := []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/dir"},
+		{Attr: upspin.AttrLink, Writer: "foo@example.com", Name: "foo@example.com/link", Link: "foo@example.com/dir"},
+	}
+
+	files := map[upspin.PathName]string{
+		"foo@example.com/Access":           "*: foo@example.com\ncreate, read: bar@example.com",
+		"foo@example.com/bad/Access":       "frobnicate: bar@example.com",
+		"foo@example.com/dir/Access":       "*: foo@example.com\nread: bar@example.com",
+		"foo@example.com/Group/friends":    "bar@example.com",
+		"foo@example.com/Group/malformed":  "not a group: !",
+		"foo@example.com/Group/@lookalike": "bar@example.com",
+	}
+	defer func(f func(upspin.Config, *upspin.DirEntry) ([]byte, error)) { readAll = f }(readAll)
+	readAll = func(_ upspin.Config, e *upspin.DirEntry) ([]byte, error) {
+		return []byte(files[e.Name]), nil
+	}
+	st := memory.New()
+	s := newTestServer(t, st, &cache{files}, entries)
+	foo := s.as("foo@example.com")
+	bar := s.as("bar@example.com")
+
+	dir := func(name upspin.PathName) *upspin.DirEntry {
+		return &upspin.DirEntry{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: name, Sequence: upspin.SeqIgnore}
+	}
+	file := func(name upspin.PathName, seq int64) *upspin.DirEntry {
+		return &upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: name, Sequence: seq}
+	}
+	for _, c := range []struct {
+		d     *dialed
+		entry *upspin.DirEntry
+		// The kind of error wanted, or errors.Other for none.
+		want errors.Kind
+	}{
+		{foo, dir("foo@example.com/Group"), errors.Other},
+		{foo, file("foo@example.com/Group/friends", upspin.SeqNotExist), errors.Other},
+		{foo, file("foo@example.com/Group/malformed", upspin.SeqIgnore), errors.Invalid},
+		{foo, file("foo@example.com/Group/@lookalike", upspin.SeqIgnore), errors.Invalid},
+		{foo, file("foo@example.com/Group", upspin.SeqIgnore), errors.NotDir},
+		{foo, file("foo@example.com/dir/Access", upspin.SeqIgnore), errors.Other},
+		{foo, dir("foo@example.com/dir/Access"), errors.Invalid},
+		{foo, dir("foo@example.com/bad"), errors.Other},
+		{foo, file("foo@example.com/bad/Access", upspin.SeqIgnore), errors.Invalid},
+		{foo, file("foo@example.com/missing/file", upspin.SeqIgnore), errors.NotExist},
+		{foo, dir("foo@example.com/dir"), errors.Exist},
+		{foo, file("foo@example.com/Access", upspin.SeqNotExist), errors.Exist},
+		{foo, file("foo@example.com/Access", 1000), errors.Invalid},
+		{foo, file("foo@example.com/new", 1000), errors.NotExist},
+		{foo, dir("bar@example.com/"), errors.Permission},
+		{bar, file("foo@example.com/file", upspin.SeqNotExist), errors.Other},
+		{bar, file("foo@example.com/file", upspin.SeqIgnore), errors.Permission},
+		{bar, file("foo@example.com/Access", upspin.SeqIgnore), errors.Permission},
+		{bar, file("foo@example.com/dir/file", upspin.SeqIgnore), errors.Permission},
+	} {
+		_, err := c.d.Put(c.entry)
+		if c.want == errors.Other && err != nil || c.want != errors.Other && !errors.Is(c.want, err) {
+			t.Errorf("%s puts %s: got %v, want %v", c.d.requester, c.entry.Name, err, c.want)
+		}
+	}
+
+	// Links in the parent path are returned to be followed.
+	if e, err := foo.Put(file("foo@example.com/link/file", upspin.SeqIgnore)); err != upspin.ErrFollowLink || e == nil || e.Name != "foo@example.com/link" {
+		t.Errorf("put through a link: got %v, %v", e, err)
+	}
+
+	e, err := foo.Put(file("foo@example.com/dir/file", upspin.SeqIgnore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.Lookup(context.Background(), "foo@example.com/dir/file"); err != nil || got == nil || got.Sequence != e.Sequence {
+		t.Errorf("put entry: got %v, %v, want sequence %d", got, err, e.Sequence)
+	}
+}
@@ -0,0 +1,164 @@
+// Replicates the log of a primary directory server to read-only replicas.
+//
+// A replica requests the log from the primary over HTTPS, presenting a secret
+// shared with the primary as a bearer token along with the position it has
+// reached in the log of every tree, and is then streamed the operations that
+// follow, which it applies to its own sqlite.State with the sequences assigned
+// by the primary.
+// The primary polls its log for new operations and reports the head of every
+// tree after each poll, from which the replica derives its lag.
+//
+// Replicas serve lookups from their own state and reject writes, which clients
+// must make to the primary: a replica can not prove to the primary who a
+// requester is, so it can not make writes on their behalf.
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// The maximum number of operations sent in one message.
+const batchSize = 256
+
+// Primary streams the log of a state to replicas.
+type Primary struct {
+	st     *sqlite.State
+	secret []byte
+	log    *slog.Logger
+
+	// The interval at which the log is polled for new operations.
+	poll time.Duration
+}
+
+// NewPrimary returns a primary serving the log of st to replicas holding the
+// secret.
+func NewPrimary(st *sqlite.State, secret []byte, log *slog.Logger) *Primary {
+	return &Primary{st, secret, log, time.Second}
+}
+
+// ServeHTTP implements http.Handler. It streams the log to a replica presenting
+// the secret as a bearer token, following the positions in the request body,
+// until the request is done or the replica stops reading.
+func (p *Primary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if !authorized(r, p.secret) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A replica that stalls sending its positions must not hold the
+	// connection. The deadline is lifted once they are read, as the server
+	// keeps reading the connection to notice the replica leaving.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(requestTimeout))
+	var pos map[upspin.UserName]int64
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPositions)).Decode(&pos); err != nil {
+		http.Error(w, "invalid positions", http.StatusBadRequest)
+		return
+	}
+	rc.SetReadDeadline(time.Time{})
+	if pos == nil {
+		pos = make(map[upspin.UserName]int64)
+	}
+
+	ctx := r.Context()
+	log := p.log.With("replica", r.RemoteAddr)
+	log.InfoContext(ctx, "replica connected")
+	w.Header().Set("Content-Type", "application/json")
+	err := p.serve(ctx, newStream(w), pos)
+	log.InfoContext(ctx, "replica disconnected", "err", err)
+}
+
+// serve streams the operations following the positions until ctx is done or
+// the stream fails.
+func (p *Primary) serve(ctx context.Context, s *stream, pos map[upspin.UserName]int64) error {
+	for {
+		if err := p.send(ctx, s, pos); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.poll):
+		}
+	}
+}
+
+// send sends the operations on every tree that follow the positions, which it
+// advances, followed by the heads of the trees.
+func (p *Primary) send(ctx context.Context, s *stream, pos map[upspin.UserName]int64) error {
+	roots, err := p.st.Roots(ctx)
+	if err != nil {
+		return err
+	}
+
+	heads := make(map[upspin.UserName]head)
+	for _, u := range roots {
+		for {
+			ops, err := p.batch(ctx, u, pos[u])
+			if err != nil {
+				return err
+			} else if len(ops) == 0 {
+				break
+			}
+			if err := s.write(message{Ops: ops}); err != nil {
+				return err
+			}
+			pos[u] = ops[len(ops)-1].Id
+			if len(ops) < batchSize {
+				break
+			}
+		}
+
+		h, err := p.st.ChainHead(ctx, u)
+		if err != nil {
+			return err
+		}
+		heads[u] = head{h.Id, h.Sequence}
+	}
+
+	return s.write(message{Heads: heads})
+}
+
+var errBatchFull = errors.Str("batch full")
+
+// batch reads the operations on the tree of user following the given id, up
+// to batchSize. The log is not held open while they are sent.
+func (p *Primary) batch(ctx context.Context, user upspin.UserName, after int64) ([]op, error) {
+	var ops []op
+	err := p.st.WalkLog(ctx, user, after, func(o sqlite.Operation) error {
+		m := op{Id: o.Id, Name: o.Name, Time: o.Time, Timestamp: o.Timestamp, Sequence: o.Sequence}
+		if o.Entry != nil {
+			b, err := o.Entry.Marshal()
+			if err != nil {
+				return fmt.Errorf("marshal %s: %w", o.Name, err)
+			}
+			m.Entry = b
+		}
+
+		ops = append(ops, m)
+		if len(ops) == batchSize {
+			return errBatchFull
+		}
+		return nil
+	})
+	if err != nil && err != errBatchFull {
+		return nil, err
+	}
+
+	return ops, nil
+}
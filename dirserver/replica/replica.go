@@ -0,0 +1,208 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Replica applies the log streamed by a primary to a state.
+type Replica struct {
+	st     *sqlite.State
+	secret []byte
+	log    *slog.Logger
+
+	mu     sync.Mutex
+	status map[upspin.UserName]Status
+	// The directory servers over the state, told of applied entries.
+	invalidators []dirserver.Invalidator
+}
+
+// Status describes how far a replica's copy of a tree is behind the primary.
+type Status struct {
+	// The sequence of the tree on the primary when it was last reported.
+	Primary int64
+	// The sequence of the last operation applied by the replica.
+	Applied int64
+	// When the primary last reported the sequence of the tree.
+	Reported time.Time
+}
+
+// Lag returns the number of sequences by which the replica was behind the
+// primary when last reported. It is not the number of operations, as the
+// primary's log may have been compacted.
+func (s Status) Lag() int64 {
+	return s.Primary - s.Applied
+}
+
+// NewReplica returns a replica applying the log of a primary holding the
+// secret to st.
+func NewReplica(st *sqlite.State, secret []byte, log *slog.Logger) *Replica {
+	return &Replica{
+		st:     st,
+		secret: secret,
+		log:    log,
+		status: make(map[upspin.UserName]Status),
+	}
+}
+
+// Follow requests the log from the primary at url with client and applies it
+// until ctx is done, requesting it again after retry when the stream fails.
+func (r *Replica) Follow(ctx context.Context, client *http.Client, url string, retry time.Duration) {
+	for {
+		err := r.Run(ctx, client, url)
+		if ctx.Err() != nil {
+			return
+		}
+		r.log.WarnContext(ctx, "replication from primary interrupted", "err", err, "retry", retry)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+var errIdle = errors.Str("no message from primary")
+
+// Run requests the log from the primary at url with client, which must be an
+// HTTPS URL as the secret is sent with the request, and applies it until ctx
+// is done or the stream fails.
+func (r *Replica) Run(ctx context.Context, client *http.Client, url string) error {
+	if !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("primary %s not served over HTTPS", url)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	pos, err := r.st.Positions(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(pos)
+	if err != nil {
+		return fmt.Errorf("marshal positions: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(r.secret))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded %s", resp.Status)
+	}
+	r.log.InfoContext(ctx, "connected to primary")
+
+	// The primary reports the heads of its trees after every poll, so a
+	// stream silent for longer has failed.
+	idle := time.AfterFunc(idleTimeout, func() { cancel(errIdle) })
+	defer idle.Stop()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var m message
+		err := dec.Decode(&m)
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		} else if err != nil {
+			return fmt.Errorf("read message: %w", err)
+		}
+		idle.Reset(idleTimeout)
+
+		switch {
+		case m.Ops != nil:
+			if err := r.apply(ctx, m.Ops); err != nil {
+				return err
+			}
+		case m.Heads != nil:
+			if err := r.report(ctx, m.Heads); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected message from primary")
+		}
+	}
+}
+
+// apply applies operations to the state.
+func (r *Replica) apply(ctx context.Context, ops []op) error {
+	for _, o := range ops {
+		so := sqlite.Operation{Id: o.Id, Name: o.Name, Time: o.Time, Timestamp: o.Timestamp, Sequence: o.Sequence}
+		if o.Entry != nil {
+			so.Entry = new(upspin.DirEntry)
+			if _, err := so.Entry.Unmarshal(o.Entry); err != nil {
+				return fmt.Errorf("unmarshal operation %d: %w", o.Id, err)
+			}
+		}
+
+		if err := r.st.Apply(ctx, so); err != nil {
+			return err
+		}
+
+		p, _ := path.Parse(o.Name)
+		u := p.User()
+		r.mu.Lock()
+		s := r.status[u]
+		s.Applied = o.Sequence
+		r.status[u] = s
+		invs := r.invalidators
+		r.mu.Unlock()
+		for _, inv := range invs {
+			inv.Invalidate(o.Name)
+		}
+	}
+
+	return nil
+}
+
+// report records the heads of the primary's trees.
+func (r *Replica) report(ctx context.Context, heads map[upspin.UserName]head) error {
+	now := time.Now()
+	for u, h := range heads {
+		local, err := r.st.ChainHead(ctx, u)
+		if err != nil {
+			return err
+		}
+
+		s := Status{Primary: h.Sequence, Applied: local.Sequence, Reported: now}
+		r.mu.Lock()
+		r.status[u] = s
+		r.mu.Unlock()
+
+		if s.Lag() > 0 {
+			r.log.DebugContext(ctx, "replica behind primary", "root", u, "lag", s.Lag())
+		}
+	}
+
+	return nil
+}
+
+// Status returns the replication status of every tree of the primary.
+func (r *Replica) Status() map[upspin.UserName]Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := make(map[upspin.UserName]Status, len(r.status))
+	for u, s := range r.status {
+		st[u] = s
+	}
+	return st
+}
@@ -0,0 +1,204 @@
+package replica
+
+import (
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"github.com/vvanpo/upspin-fly/dirserver/cache"
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+var secret = []byte("replication secret")
+
+func open(t *testing.T, name string) *sqlite.State {
+	s, err := sqlite.Open(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func put(t *testing.T, s *sqlite.State, es ...*upspin.DirEntry) {
+	t.Helper()
+	for _, e := range es {
+		if err := s.Put(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func dir(name upspin.PathName) *upspin.DirEntry {
+	return &upspin.DirEntry{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: name}
+}
+
+func file(name upspin.PathName) *upspin.DirEntry {
+	return &upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: name}
+}
+
+// serve serves p over HTTPS until the test ends.
+func serve(t *testing.T, p *Primary) *httptest.Server {
+	ts := httptest.NewTLSServer(p)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// connect runs r against p, and returns a function that disconnects them and
+// waits for the replica to stop.
+func connect(t *testing.T, ts *httptest.Server, r *Replica) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx, ts.Client(), ts.URL)
+		close(done)
+	}()
+
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// caughtUp waits until the replica reports having applied the tree of user up
+// to the primary's sequence seq.
+func caughtUp(t *testing.T, r *Replica, user upspin.UserName, seq int64) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if s := r.Status()[user]; s.Primary == seq && s.Lag() == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("replica not caught up: %+v", r.Status())
+}
+
+// same fails the test if the trees of foo@example.com differ.
+func same(t *testing.T, a, b *sqlite.State) {
+	t.Helper()
+	d, err := state.Diff(context.Background(), a, b, "foo@example.com/")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(d) != 0 {
+		t.Errorf("trees differ: %v", d)
+	}
+}
+
+// A replica applies the primary's log, keeps following it, and resumes from
+// its position after reconnecting.
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+	pst, rst := open(t, "primary.db"), open(t, "replica.db")
+	put(t, pst, dir("foo@example.com/"), dir("foo@example.com/dir"), file("foo@example.com/dir/file"), file("foo@example.com/old"))
+
+	p := NewPrimary(pst, secret, slog.Default())
+	p.poll = 10 * time.Millisecond
+	r := NewReplica(rst, secret, slog.Default())
+	ts := serve(t, p)
+
+	stop := connect(t, ts, r)
+	caughtUp(t, r, "foo@example.com", 4)
+	same(t, pst, rst)
+
+	/// Follow new operations
+	oldp, _ := path.Parse("foo@example.com/old")
+	if err := pst.Delete(ctx, oldp); err != nil {
+		t.Fatal(err)
+	}
+	put(t, pst, file("foo@example.com/dir/new"), dir("bar@example.com/"))
+	caughtUp(t, r, "foo@example.com", 6)
+	caughtUp(t, r, "bar@example.com", 1)
+	same(t, pst, rst)
+
+	e, err := rst.Lookup(ctx, "foo@example.com/dir/new")
+	if err != nil {
+		t.Fatal(err)
+	} else if e == nil || e.Sequence != 6 {
+		t.Errorf("wrong entry on replica: %v", e)
+	}
+
+	/// Resume after reconnecting
+	stop()
+	r = NewReplica(rst, secret, slog.Default())
+	put(t, pst, file("foo@example.com/dir/newer"))
+	connect(t, ts, r)
+	caughtUp(t, r, "foo@example.com", 7)
+	same(t, pst, rst)
+
+	ps, err := rst.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ps) != 0 {
+		t.Errorf("problems found on replica: %v", ps)
+	}
+}
+
+// The replica must present the primary's secret, over HTTPS.
+func TestAuthentication(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pst, rst := open(t, "primary.db"), open(t, "replica.db")
+	put(t, pst, dir("foo@example.com/"))
+	ts := serve(t, NewPrimary(pst, secret, slog.Default()))
+
+	r := NewReplica(rst, []byte("wrong secret"), slog.Default())
+	if err := r.Run(ctx, ts.Client(), ts.URL); err == nil {
+		t.Error("replica connected with wrong secret")
+	}
+	r = NewReplica(rst, secret, slog.Default())
+	if err := r.Run(ctx, ts.Client(), "http"+strings.TrimPrefix(ts.URL, "https")); err == nil {
+		t.Error("replica connected without HTTPS")
+	}
+	if e, err := rst.Lookup(ctx, "foo@example.com/"); err != nil || e != nil {
+		t.Errorf("tree replicated without authentication: %v, %v", e, err)
+	}
+}
+
+// Replicas serve lookups locally and reject writes.
+func TestServer(t *testing.T) {
+	pst, rst := open(t, "primary.db"), open(t, "replica.db")
+	put(t, pst, dir("foo@example.com/"), file("foo@example.com/file"))
+
+	p := NewPrimary(pst, secret, slog.Default())
+	p.poll = 10 * time.Millisecond
+	r := NewReplica(rst, secret, slog.Default())
+
+	cfg := config.SetUserName(config.New(), "srv@example.com")
+	srv := r.DirServer(dirserver.New(cfg, rst, cache.New(cfg, nil), slog.Default()))
+	svc, err := srv.Dial(config.SetUserName(config.New(), "foo@example.com"), upspin.Endpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo := svc.(upspin.DirServer)
+
+	connect(t, serve(t, p), r)
+	caughtUp(t, r, "foo@example.com", 2)
+
+	if e, err := foo.Lookup("foo@example.com/file"); err != nil {
+		t.Error(err)
+	} else if e.Sequence != 2 {
+		t.Errorf("wrong entry served by replica: %v", e)
+	}
+
+	if _, err := foo.Put(file("foo@example.com/new")); !errors.Is(errors.Permission, err) {
+		t.Errorf("put not rejected: %v", err)
+	}
+	if _, err := foo.Delete("foo@example.com/file"); !errors.Is(errors.Permission, err) {
+		t.Errorf("delete not rejected: %v", err)
+	}
+	if e, err := rst.Lookup(context.Background(), "foo@example.com/file"); err != nil || e == nil {
+		t.Errorf("rejected delete applied: %v, %v", e, err)
+	}
+}
@@ -0,0 +1,51 @@
+package replica
+
+import (
+	"github.com/vvanpo/upspin-fly/dirserver"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// server is an upspin.DirServer that serves lookups from the replica's state,
+// and rejects writes.
+type server struct {
+	upspin.DirServer
+}
+
+// DirServer returns a directory server which serves Lookup, Glob and
+// WhichAccess with dir, a directory server over the replica's state, and whose
+// Dial method returns servers for other users. Put and Delete are rejected;
+// writes must be made to the primary, and are seen once replicated. If dir
+// implements dirserver.Invalidator, it is told of every entry the replica
+// applies.
+func (r *Replica) DirServer(dir upspin.DirServer) upspin.DirServer {
+	if inv, ok := dir.(dirserver.Invalidator); ok {
+		r.mu.Lock()
+		r.invalidators = append(r.invalidators, inv)
+		r.mu.Unlock()
+	}
+
+	return &server{dir}
+}
+
+// Dial implements upspin.Dialer.
+func (s *server) Dial(rc upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
+	svc, err := s.DirServer.Dial(rc, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &server{svc.(upspin.DirServer)}, nil
+}
+
+// Put implements upspin.DirServer.
+func (s *server) Put(e *upspin.DirEntry) (*upspin.DirEntry, error) {
+	const op errors.Op = "dir.Put"
+	return nil, errors.E(op, e.Name, errors.Permission, errors.Str("read-only replica; write to the primary"))
+}
+
+// Delete implements upspin.DirServer.
+func (s *server) Delete(name upspin.PathName) (*upspin.DirEntry, error) {
+	const op errors.Op = "dir.Delete"
+	return nil, errors.E(op, name, errors.Permission, errors.Str("read-only replica; write to the primary"))
+}
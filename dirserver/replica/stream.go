@@ -0,0 +1,82 @@
+package replica
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+const (
+	// The maximum size of the positions sent by a replica.
+	maxPositions = 16 << 20
+	// How long a replica may take to send its positions, and to accept each
+	// message, before the primary gives up on it.
+	requestTimeout = 30 * time.Second
+	// How long a replica waits for a message before giving up on the
+	// primary, which reports the heads of its trees after every poll.
+	idleTimeout = time.Minute
+)
+
+// message is the unit of the stream sent by the primary, as a sequence of JSON
+// values. Exactly one field is set.
+type message struct {
+	// Operations from the primary's log, in order.
+	Ops []op `json:"ops,omitempty"`
+
+	// Sent by the primary once it has sent all operations on its trees.
+	Heads map[upspin.UserName]head `json:"heads,omitempty"`
+}
+
+// op is an operation of the primary's log.
+type op struct {
+	Id        int64           `json:"id"`
+	Name      upspin.PathName `json:"name"`
+	Time      upspin.Time     `json:"time"`
+	Timestamp upspin.Time     `json:"timestamp"`
+	Sequence  int64           `json:"sequence"`
+	// The marshaled upspin.DirEntry of a put; nil for a deletion.
+	Entry []byte `json:"entry,omitempty"`
+}
+
+// head is the latest operation on a tree of the primary.
+type head struct {
+	Id       int64 `json:"id"`
+	Sequence int64 `json:"sequence"`
+}
+
+// authorized reports whether r presents the secret as a bearer token.
+func authorized(r *http.Request, secret []byte) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), secret) == 1
+}
+
+// stream writes messages to a replica.
+type stream struct {
+	enc *json.Encoder
+	rc  *http.ResponseController
+}
+
+func newStream(w http.ResponseWriter) *stream {
+	return &stream{json.NewEncoder(w), http.NewResponseController(w)}
+}
+
+// write sends a message and flushes it to the replica. A replica that stops
+// reading fails the write once requestTimeout has passed.
+func (s *stream) write(m message) error {
+	// Deadlines are only unsupported by ResponseWriters without a
+	// connection of their own, which the stream can then not hold.
+	s.rc.SetWriteDeadline(time.Now().Add(requestTimeout))
+	if err := s.enc.Encode(m); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	if err := s.rc.Flush(); err != nil {
+		return fmt.Errorf("flush message: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package dirserver
+
+import (
+	"context"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+/*
+An access report lists every path under a root where a user holds any right.
+It is requested through AccessReport.
+
+The tree is walked depth-first from the root, at the versions listed, without
+following links. The Access file governing the root is found by accessFor;
+below it, the Access file governing every directory is threaded through the
+walk, so that each is retrieved and parsed once, and the rights it grants are
+evaluated by can once for the entries it governs, and once more for Access and
+Group files, to which access.Can applies special rules.
+*/
+
+// AccessReport is an administrative query implemented by the servers returned
+// by New and their Dial method.
+type AccessReport interface {
+	// ReportAccess calls fn for every path under root, including root, on
+	// which user holds any right, with the rights held in the order of
+	// Rights. Directories are reported after the Access file governing them
+	// is read, before their contents. An error returned by fn stops the
+	// walk and is returned.
+	ReportAccess(root upspin.PathName, user upspin.UserName, fn func(upspin.PathName, []access.Right) error) error
+}
+
+// ReportAccess implements AccessReport.
+func (d *dialed) ReportAccess(root upspin.PathName, user upspin.UserName, fn func(upspin.PathName, []access.Right) error) error {
+	ctx, op := d.setCtx("ReportAccess")
+	d.log = d.log.With("pathname", root, "user", user)
+
+	p, err := path.Parse(root)
+	if err != nil {
+		return errors.E(op, root, errors.Invalid, err)
+	}
+	if d.requester != d.cfg.UserName() {
+		return errors.E(op, p.Path(), errors.Permission)
+	}
+
+	es, ents, err := d.state.LookupAll(ctx, p)
+	if err != nil {
+		return d.internalErr(ctx, op, p.Path(), err)
+	}
+	if len(es) != p.NElem()+1 {
+		if n := len(es); n > 0 && es[n-1].IsLink() {
+			return errors.E(op, p.Path(), errors.Invalid, errors.Errorf("%s is a link", es[n-1].Name))
+		}
+		return errors.E(op, p.Path(), errors.NotExist)
+	}
+	ent := ents[len(ents)-1]
+
+	ae, err := d.accessFor(ctx, p, ent.Attr == upspin.AttrDirectory)
+	if err != nil {
+		return d.internalErr(ctx, op, p.Path(), err)
+	}
+
+	r := &report{
+		u:      &dialed{server: d.server, log: d.log, requester: user},
+		fn:     fn,
+		parsed: make(map[upspin.PathName]*access.Access),
+		rights: make(map[reportKey][]access.Right),
+	}
+	err = r.walk(ctx, ent, ae)
+	if ie, ok := err.(internalError); ok {
+		return d.internalErr(ctx, op, ie.name, ie.err)
+	}
+
+	return err
+}
+
+// internalError distinguishes the errors of the walk from those of the
+// callback.
+type internalError struct {
+	name upspin.PathName
+	err  error
+}
+
+func (e internalError) Error() string {
+	return e.err.Error()
+}
+
+// report is the state of a walk for an access report.
+type report struct {
+	// The server serving the user the report is for.
+	u  *dialed
+	fn func(upspin.PathName, []access.Right) error
+	// The Access files parsed, by name, and the rights evaluated. Only those
+	// of the Access files governing the directories being walked are kept.
+	parsed map[upspin.PathName]*access.Access
+	rights map[reportKey][]access.Right
+}
+
+type reportKey struct {
+	// The Access file and its sequence, or the root of the tree and -1 when
+	// the default owner-only rights apply.
+	access                upspin.PathName
+	seq                   int64
+	accessFile, groupFile bool
+}
+
+// walk reports an entry and, if it is a directory, its contents. ae is the
+// Access file governing the entry's parent, or the entry itself if it is the
+// root of the walk.
+func (r *report) walk(ctx context.Context, ent state.Entry, ae *upspin.DirEntry) error {
+	if ent.Attr != upspin.AttrDirectory {
+		return r.report(ctx, ent.Path, ae)
+	}
+
+	children, err := r.u.state.List(ctx, ent)
+	if err != nil {
+		return internalError{ent.Path.Path(), err}
+	}
+	var own *upspin.DirEntry
+	for _, c := range children {
+		if c.Path.Elem(c.Path.NElem()-1) != access.AccessFile || c.Attr&(upspin.AttrDirectory|upspin.AttrLink) != 0 {
+			continue
+		}
+		if own, err = r.u.state.Get(ctx, c); err != nil {
+			return internalError{c.Path.Path(), err}
+		}
+		ae = own
+		break
+	}
+	if own != nil {
+		// The directory's Access file governs nothing outside it.
+		defer r.forget(own)
+	}
+
+	if err := r.report(ctx, ent.Path, ae); err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err := r.walk(ctx, c, ae); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forget drops what was parsed and evaluated for an Access file.
+func (r *report) forget(ae *upspin.DirEntry) {
+	delete(r.parsed, ae.Name)
+	for _, k := range []reportKey{
+		{access: ae.Name, seq: ae.Sequence},
+		{access: ae.Name, seq: ae.Sequence, accessFile: true},
+		{access: ae.Name, seq: ae.Sequence, groupFile: true},
+		{access: ae.Name, seq: ae.Sequence, accessFile: true, groupFile: true},
+	} {
+		delete(r.rights, k)
+	}
+}
+
+// report calls the callback for an entry governed by an Access file, if the
+// user holds any right on it.
+func (r *report) report(ctx context.Context, p path.Parsed, ae *upspin.DirEntry) error {
+	k := reportKey{
+		access:     p.First(0).Path(),
+		seq:        -1,
+		accessFile: access.IsAccessFile(p.Path()),
+		groupFile:  access.IsGroupFile(p.Path()),
+	}
+	if ae != nil {
+		k.access, k.seq = ae.Name, ae.Sequence
+	}
+
+	rights, ok := r.rights[k]
+	if !ok {
+		var a *access.Access
+		if ae != nil {
+			if a, ok = r.parsed[ae.Name]; !ok {
+				var err error
+				if a, err = r.u.loadAccess(ctx, ae); err != nil {
+					return internalError{ae.Name, err}
+				}
+				r.parsed[ae.Name] = a
+			}
+		}
+		for _, right := range Rights {
+			granted, err := r.u.can(ctx, ae, a, right, p)
+			if err != nil {
+				return internalError{p.Path(), err}
+			} else if granted {
+				rights = append(rights, right)
+			}
+		}
+		r.rights[k] = rights
+	}
+
+	if len(rights) == 0 {
+		return nil
+	}
+	return r.fn(p.Path(), rights)
+}
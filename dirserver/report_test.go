@@ -0,0 +1,89 @@
+package dirserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func TestReportAccess(t *testing.T) {
+	entries := []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/file"},
+		{Attr: upspin.AttrLink, Writer: "foo@example.com", Name: "foo@example.com/link", Link: "foo@example.com/priv/secret"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/priv"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/priv/Access"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/priv/secret"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/pub"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/pub/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/pub/dir"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/pub/dir/doc"},
+	}
+
+	c := &flakyCache{cache: &cache{map[upspin.PathName]string{
+		"foo@example.com/Access":      "read, list: bar@example.com",
+		"foo@example.com/priv/Access": "*: foo@example.com",
+		"foo@example.com/pub/Access":  "*: bar@example.com",
+	}}}
+	s := newTestServer(t, memory.New(), c, entries)
+	srv := s.as("srv@example.com")
+
+	got := make(map[upspin.PathName][]access.Right)
+	err := srv.ReportAccess("foo@example.com/", "bar@example.com", func(name upspin.PathName, rights []access.Right) error {
+		got[name] = rights
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[upspin.PathName][]access.Right{
+		"foo@example.com/":             {access.Read, access.List},
+		"foo@example.com/file":         {access.Read, access.List},
+		"foo@example.com/link":         {access.Read, access.List},
+		"foo@example.com/pub":          Rights,
+		"foo@example.com/pub/dir":      Rights,
+		"foo@example.com/pub/dir/doc":  Rights,
+		"foo@example.com/priv":         nil,
+		"foo@example.com/priv/secret":  nil,
+		"foo@example.com/priv/Access":  nil,
+		"foo@example.com/pub/dir/none": nil,
+	} {
+		if !reflect.DeepEqual(got[name], want) {
+			t.Errorf("%s: got rights %v, want %v", name, got[name], want)
+		}
+	}
+	// Every Access file is read once.
+	if c.reads != 3 {
+		t.Errorf("Access files read %d times, want 3", c.reads)
+	}
+
+	// Reports may start below the root, and be stopped.
+	var names []upspin.PathName
+	stop := errors.Str("stop")
+	err = srv.ReportAccess("foo@example.com/pub/dir", "bar@example.com", func(name upspin.PathName, rights []access.Right) error {
+		names = append(names, name)
+		return stop
+	})
+	if err != stop {
+		t.Errorf("got %v, want the error of the callback", err)
+	}
+	if want := []upspin.PathName{"foo@example.com/pub/dir"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	foo := s.as("foo@example.com")
+	err = foo.ReportAccess("foo@example.com/", "bar@example.com", func(upspin.PathName, []access.Right) error { return nil })
+	if !errors.Is(errors.Permission, err) {
+		t.Errorf("report requested by a user other than the server user: got %v, want errors.Permission", err)
+	}
+	err = srv.ReportAccess("foo@example.com/link/x", "bar@example.com", func(upspin.PathName, []access.Right) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "link") {
+		t.Errorf("report through a link: got %v, want an error", err)
+	}
+}
@@ -2,11 +2,16 @@
 // The server behaviour differs from the reference implementation in that
 // DirEntry's for directories do not contain blocks or packing, and are never
 // marked incomplete.
+//
+// Besides upspin.DirServer, the servers answer administrative queries, such as
+// AccessHealth. These are only reachable in the server's process, such as from
+// flyadmin, and are refused to requesters other than the server user.
 package dirserver
 
 import (
 	"context"
 	"log/slog"
+	"sync"
 
 	"github.com/vvanpo/upspin-fly/dirserver/state"
 	"upspin.io/errors"
@@ -18,12 +23,45 @@ type server struct {
 	state state.State
 	cache state.Cache
 	log   *slog.Logger
+	// Access files governing directories, and access decisions.
+	rights *accessCache
+	// Access files that could not be used.
+	problems *accessHealth
+	// Serializes Put and Delete, so that what they check still holds when
+	// they are persisted.
+	writes sync.Mutex
 
 	// The upspin user the server is running as; used to retrieve access and
 	// group file contents.
 	cfg upspin.Config
 }
 
+// New returns an upspin.DirServer serving as the user in cfg, whose Dial method
+// returns servers for other users.
+func New(cfg upspin.Config, st state.State, c state.Cache, log *slog.Logger) upspin.DirServer {
+	problems, err := newAccessHealth(context.TODO(), st)
+	if err != nil {
+		log.Error("failed to load access file problems", "err", err)
+	}
+	s := &server{
+		state:    st,
+		cache:    c,
+		log:      log,
+		rights:   newAccessCache(),
+		problems: problems,
+		cfg:      cfg,
+	}
+	if ge, ok := c.(state.GroupExpirer); ok {
+		ge.OnGroupExpired(s.rights.invalidate)
+	}
+
+	return &dialed{
+		server:    s,
+		log:       log.With("requester", cfg.UserName()),
+		requester: cfg.UserName(),
+	}
+}
+
 // Implements an upspin.DirServer serving a user that must be authenticated.
 type dialed struct {
 	*server
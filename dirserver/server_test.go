@@ -0,0 +1,29 @@
+package dirserver
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+// newTestServer returns a server running as srv@example.com over st, after
+// putting the given entries in it, and with c as its cache.
+func newTestServer(t *testing.T, st state.State, c state.Cache, entries []*upspin.DirEntry) *server {
+	t.Helper()
+	for _, e := range entries {
+		if err := st.Put(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &server{state: st, cache: c, rights: newAccessCache(), cfg: config.SetUserName(config.New(), "srv@example.com")}
+}
+
+// as returns the server dialed by a requester.
+func (s *server) as(requester upspin.UserName) *dialed {
+	return &dialed{s, slog.Default(), requester}
+}
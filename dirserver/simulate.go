@@ -0,0 +1,215 @@
+package dirserver
+
+import (
+	"context"
+	"slices"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+/*
+Simulating an Access file for a directory compares the rights it would grant
+with those granted by the Access file governing the directory, as found by
+accessFor, or the default owner-only rights. Simulations are requested through
+AccessSimulator.
+
+The paths affected are the directory, its Access file, and every entry below
+it, except those in subdirectories with their own Access files, which shadow
+it; these are walked at the versions listed, without following links. Holders
+are expanded as by WhoCan, so rights are compared per user, domain and
+unresolved group. As the holders only differ between regular entries, Access
+files and Group files, each is expanded once per kind.
+*/
+
+// AccessSimulator is an administrative query implemented by the servers
+// returned by New and their Dial method.
+type AccessSimulator interface {
+	// SimulateAccess returns the changes to the rights on the paths under a
+	// directory if its Access file had the given contents. It returns an
+	// errors.Invalid error if the contents can not be parsed.
+	SimulateAccess(dir upspin.PathName, data []byte) (*AccessDiff, error)
+}
+
+// AccessDiff describes the changes an Access file would make.
+type AccessDiff struct {
+	// The Access file currently governing the directory, or nil if the
+	// default owner-only rights apply.
+	Current *upspin.DirEntry
+	// Whether the current Access file could not be parsed, in which case the
+	// default owner-only rights apply.
+	Malformed bool
+	// The Access files below the directory shadowing it, in walk order.
+	Shadowed []upspin.PathName
+	// The changed rights, by path in walk order and in the order of Rights.
+	Changes []Change
+}
+
+// Change describes who would gain and lose a right on a path.
+type Change struct {
+	Path           upspin.PathName
+	Right          access.Right
+	Added, Removed *Holders
+}
+
+// SimulateAccess implements AccessSimulator.
+func (d *dialed) SimulateAccess(dir upspin.PathName, data []byte) (*AccessDiff, error) {
+	ctx, op := d.setCtx("SimulateAccess")
+	d.log = d.log.With("pathname", dir)
+
+	p, err := path.Parse(dir)
+	if err != nil {
+		return nil, errors.E(op, dir, errors.Invalid, err)
+	}
+	if d.requester != d.cfg.UserName() {
+		return nil, errors.E(op, p.Path(), errors.Permission)
+	}
+
+	name := path.Join(p.Path(), access.AccessFile)
+	if err := parseAccess(name, data); err != nil {
+		return nil, errors.E(op, name, err)
+	}
+	candidate, err := access.Parse(name, data)
+	if err != nil {
+		return nil, errors.E(op, name, errors.Invalid, err)
+	}
+
+	es, ents, err := d.state.LookupAll(ctx, p)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	if len(es) != p.NElem()+1 {
+		if n := len(es); n > 0 && es[n-1].IsLink() {
+			return nil, errors.E(op, p.Path(), errors.Invalid, errors.Errorf("%s is a link", es[n-1].Name))
+		}
+		return nil, errors.E(op, p.Path(), errors.NotExist)
+	}
+	ent := ents[len(ents)-1]
+	if ent.Attr != upspin.AttrDirectory {
+		return nil, errors.E(op, p.Path(), errors.NotDir)
+	}
+
+	ae, err := d.accessFor(ctx, p, true)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	var current *access.Access
+	if ae != nil {
+		if current, err = d.loadAccess(ctx, ae); err != nil {
+			return nil, d.internalErr(ctx, op, p.Path(), err)
+		}
+	}
+
+	sim := &simulation{
+		ex:        &expansion{d: d, groups: make(map[upspin.PathName][]path.Parsed), failed: make(map[upspin.PathName]bool)},
+		current:   current,
+		candidate: candidate,
+		changes:   make(map[simulationKey][]Change),
+		diff:      &AccessDiff{Current: ae, Malformed: ae != nil && current == nil},
+	}
+	accessPath, _ := path.Parse(name)
+	sim.add(ctx, accessPath)
+	if err := sim.walk(ctx, ent, true); err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+
+	return sim.diff, nil
+}
+
+// simulation is the state of the walk simulating an Access file.
+type simulation struct {
+	ex                 *expansion
+	current, candidate *access.Access
+	// The changes to the rights of each kind of entry, with their paths
+	// unset.
+	changes map[simulationKey][]Change
+	diff    *AccessDiff
+}
+
+type simulationKey struct {
+	accessFile, groupFile bool
+}
+
+// walk adds the changes to the rights on a directory and the entries below it
+// that are not shadowed. The directory simulated is the root of the walk.
+func (sim *simulation) walk(ctx context.Context, ent state.Entry, root bool) error {
+	children, err := sim.ex.d.state.List(ctx, ent)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if c.Path.Elem(c.Path.NElem()-1) != access.AccessFile || c.Attr&(upspin.AttrDirectory|upspin.AttrLink) != 0 {
+			continue
+		}
+		if !root {
+			sim.diff.Shadowed = append(sim.diff.Shadowed, c.Path.Path())
+			return nil
+		}
+	}
+
+	sim.add(ctx, ent.Path)
+	for _, c := range children {
+		if c.Attr == upspin.AttrDirectory {
+			if err := sim.walk(ctx, c, false); err != nil {
+				return err
+			}
+		} else if !root || c.Path.Elem(c.Path.NElem()-1) != access.AccessFile {
+			// The root's Access file was added first.
+			sim.add(ctx, c.Path)
+		}
+	}
+
+	return nil
+}
+
+// add adds the changes to the rights on a path.
+func (sim *simulation) add(ctx context.Context, p path.Parsed) {
+	k := simulationKey{access.IsAccessFile(p.Path()), access.IsGroupFile(p.Path())}
+	changes, ok := sim.changes[k]
+	if !ok {
+		for _, r := range Rights {
+			before := sim.ex.holders(ctx, sim.current, r, p)
+			after := sim.ex.holders(ctx, sim.candidate, r, p)
+			added, removed := diffHolders(before, after), diffHolders(after, before)
+			if added.empty() && removed.empty() {
+				continue
+			}
+			changes = append(changes, Change{Right: r, Added: added, Removed: removed})
+		}
+		sim.changes[k] = changes
+	}
+
+	for _, c := range changes {
+		c.Path = p.Path()
+		sim.diff.Changes = append(sim.diff.Changes, c)
+	}
+}
+
+// diffHolders returns the holders in b that are not in a.
+func diffHolders(a, b *Holders) *Holders {
+	h := &Holders{}
+	for _, u := range b.Users {
+		if !slices.Contains(a.Users, u) {
+			h.Users = append(h.Users, u)
+		}
+	}
+	for _, dom := range b.Domains {
+		if !slices.Contains(a.Domains, dom) {
+			h.Domains = append(h.Domains, dom)
+		}
+	}
+	for _, g := range b.Unresolved {
+		if !slices.Contains(a.Unresolved, g) {
+			h.Unresolved = append(h.Unresolved, g)
+		}
+	}
+
+	return h
+}
+
+func (h *Holders) empty() bool {
+	return len(h.Users) == 0 && len(h.Domains) == 0 && len(h.Unresolved) == 0
+}
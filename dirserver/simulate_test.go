@@ -0,0 +1,83 @@
+package dirserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func TestSimulateAccess(t *testing.T) {
+	entries := []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/dir"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/dir/file"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/dir/shadow"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/dir/shadow/Access"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/dir/shadow/file"},
+	}
+
+	c := &groupCache{
+		cache: &cache{map[upspin.PathName]string{
+			"foo@example.com/Access":            "read: bar@example.com, foo@example.com/Group/pals",
+			"foo@example.com/dir/shadow/Access": "read: qux@example.com",
+		}},
+		groups: map[upspin.PathName]string{
+			"foo@example.com/Group/pals": "baz@example.com",
+		},
+	}
+	s := newTestServer(t, memory.New(), c, entries)
+	srv := s.as("srv@example.com")
+
+	diff, err := srv.SimulateAccess("foo@example.com/dir", []byte("read: foo@example.com/Group/pals\nwrite: *@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Current == nil || diff.Current.Name != "foo@example.com/Access" || diff.Malformed {
+		t.Errorf("current Access file: %v, malformed %t", diff.Current, diff.Malformed)
+	}
+	if want := []upspin.PathName{"foo@example.com/dir/shadow/Access"}; !reflect.DeepEqual(diff.Shadowed, want) {
+		t.Errorf("shadowed: got %v, want %v", diff.Shadowed, want)
+	}
+
+	got := make(map[upspin.PathName][]Change)
+	for _, ch := range diff.Changes {
+		got[ch.Path] = append(got[ch.Path], ch)
+	}
+	want := []Change{
+		{Right: access.Read, Added: &Holders{}, Removed: &Holders{Users: []upspin.UserName{"bar@example.com"}}},
+		{Right: access.Write, Added: &Holders{Domains: []string{"example.org"}}, Removed: &Holders{}},
+	}
+	for _, name := range []upspin.PathName{"foo@example.com/dir", "foo@example.com/dir/file"} {
+		for i := range want {
+			want[i].Path = name
+		}
+		if !reflect.DeepEqual(got[name], want) {
+			t.Errorf("%s: got changes %+v, want %+v", name, got[name], want)
+		}
+	}
+	// The Access file is affected, if differently.
+	if len(got["foo@example.com/dir/Access"]) == 0 {
+		t.Errorf("no changes to the Access file itself")
+	}
+	for _, name := range []upspin.PathName{"foo@example.com/", "foo@example.com/dir/shadow", "foo@example.com/dir/shadow/file"} {
+		if len(got[name]) != 0 {
+			t.Errorf("%s: got changes %+v, want none", name, got[name])
+		}
+	}
+
+	if _, err := srv.SimulateAccess("foo@example.com/dir", []byte("no colon")); !errors.Is(errors.Invalid, err) {
+		t.Errorf("malformed Access file: got %v, want errors.Invalid", err)
+	}
+	if _, err := srv.SimulateAccess("foo@example.com/dir/file", []byte("read: bar@example.com")); !errors.Is(errors.NotDir, err) {
+		t.Errorf("simulation for a file: got %v, want errors.NotDir", err)
+	}
+	foo := s.as("foo@example.com")
+	if _, err := foo.SimulateAccess("foo@example.com/dir", []byte("read: bar@example.com")); !errors.Is(errors.Permission, err) {
+		t.Errorf("simulation by a user other than the server user: got %v, want errors.Permission", err)
+	}
+}
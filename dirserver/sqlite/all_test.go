@@ -1,201 +1,699 @@
 package sqlite
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite/sink"
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"github.com/vvanpo/upspin-fly/dirserver/state/statetest"
 	"upspin.io/path"
 	"upspin.io/upspin"
 )
 
-func TestPutLookupAll(t *testing.T) {
+func TestConformance(t *testing.T) {
+	statetest.Run(t, func(t *testing.T) state.State {
+		s, err := Open(":memory:")
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+// Fsck reports no problems for a consistent database, finds problems
+// introduced into the projection, and repairs them from the log.
+func TestFsck(t *testing.T) {
 	ctx := context.Background()
 	s, err := Open(":memory:")
 	if err != nil {
 		t.Fatalf("Failed to open database: %v", err)
 	}
 
-	/// Puts
-	if err := s.Put(ctx, &upspin.DirEntry{
-		Attr:   upspin.AttrDirectory,
-		Writer: "foo@example.com",
-		Name:   "foo@example.com/",
-	}); err != nil {
-		t.Error(err)
+	for _, e := range []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/bar"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/bar/baz"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/qux"},
+	} {
+		if err := s.Put(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quxp, _ := path.Parse("foo@example.com/qux")
+	if err := s.Delete(ctx, quxp); err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := s.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := s.Put(ctx, &upspin.DirEntry{
-		Attr:   upspin.AttrDirectory,
-		Writer: "foo@example.com",
-		Name:   "foo@example.com/bar",
-	}); err != nil {
-		t.Error(err)
+	if len(ps) != 0 {
+		t.Fatalf("problems found in consistent database: %v", ps)
 	}
 
-	baz := &upspin.DirEntry{
-		Packing:  upspin.PlainPack,
-		Packdata: []byte("packd"),
-		Blocks: []upspin.DirBlock{
-			{
-				Location: upspin.Location{
-					Endpoint: upspin.Endpoint{
-						Transport: upspin.Remote,
-						NetAddr:   "localhost:123",
-					},
-					Reference: "bazref",
-				},
-				Offset: 0,
-				Size:   24,
-			},
-		},
-		Writer:     "foo@example.com",
-		Name:       "foo@example.com/bar/baz",
-		SignedName: "foo@example.com/bar/baz",
+	/// Corrupt the projection
+	if _, err := s.db.Exec(`UPDATE proj_entry SET sequence = 2 WHERE name = 'foo@example.com/'`); err != nil {
+		t.Fatal(err)
 	}
-	if err := s.Put(ctx, baz); err != nil {
-		t.Error(err)
+	if _, err := s.db.Exec(`DELETE FROM proj_entry WHERE name = 'foo@example.com/bar'`); err != nil {
+		t.Fatal(err)
 	}
-	baz.Writer = "qux@example.com"
-	baz.Blocks[0].Location.Reference = "bazref2"
-	baz.Blocks[0].Size = 40
-	if err := s.Put(ctx, baz); err != nil {
-		t.Error(err)
+	if _, err := s.db.Exec(`INSERT INTO log_put (writer) VALUES ('foo@example.com')`); err != nil {
+		t.Fatal(err)
 	}
 
-	bazp, _ := path.Parse(baz.Name)
+	ps, err = s.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[ProblemKind]bool)
+	for _, p := range ps {
+		found[p.Kind] = true
+	}
+	for _, k := range []ProblemKind{BadSequence, MissingAncestor, StaleEntry, OrphanPut} {
+		if !found[k] {
+			t.Errorf("%s not reported: %v", k, ps)
+		}
+	}
 
-	/// Lookup
-	es, err := s.LookupAll(ctx, bazp)
+	/// Repair, which leaves the append-only log alone
+	ps, err = s.Fsck(ctx, nil, true)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	for _, p := range ps {
+		if p.Repaired == (p.Kind == OrphanPut) {
+			t.Errorf("wrong repair of problem: %v", p)
+		}
+	}
+	ps, err = s.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Kind != OrphanPut {
+		t.Errorf("problems remain after repair: %v", ps)
+	}
+
+	bazp, _ := path.Parse("foo@example.com/bar/baz")
+	es, _, err := s.LookupAll(ctx, bazp)
+	if err != nil {
+		t.Fatal(err)
 	}
 	if len(es) != 3 {
-		t.Fatalf("wrong number of entries: %d", len(es))
+		t.Fatalf("wrong number of entries after repair: %d", len(es))
+	}
+	if es[0].Sequence != 5 {
+		t.Errorf("wrong sequence for root after repair: %d", es[0].Sequence)
+	}
+}
+
+// Compaction removes old versions outside the retention policy, leaves a
+// consistent database, and releases the blocks of removed versions to garbage
+// collection.
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(filepath.Join(t.TempDir(), "dir.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer s.Close()
+
+	store := upspin.Endpoint{Transport: upspin.Remote, NetAddr: "store.example.com:443"}
+	file := func(name upspin.PathName, ref upspin.Reference) *upspin.DirEntry {
+		return &upspin.DirEntry{
+			Packing: upspin.PlainPack,
+			Writer:  "foo@example.com",
+			Time:    1000,
+			Name:    name,
+			Blocks: []upspin.DirBlock{{
+				Location: upspin.Location{Endpoint: store, Reference: ref},
+				Size:     1,
+			}},
+		}
+	}
+	for _, e := range []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		file("foo@example.com/bar", "v1"),
+		file("foo@example.com/bar", "v2"),
+		file("foo@example.com/bar", "v3"),
+		file("foo@example.com/baz", "baz"),
+	} {
+		if err := s.Put(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bazp, _ := path.Parse("foo@example.com/baz")
+	if err := s.Delete(ctx, bazp); err != nil {
+		t.Fatal(err)
+	}
+	backdate(t, s, 1000)
+
+	// The two latest versions of bar are retained, so only the first is
+	// removed.
+	n, err := s.Compact(ctx, Retention{Versions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Operations != 1 {
+		t.Errorf("retained versions removed: %+v", n)
+	}
+
+	n, err = s.Compact(ctx, Retention{Versions: 1})
+	if err != nil {
+		t.Fatal(err)
 	}
-	e := es[len(es)-1]
-	if e.Name != "foo@example.com/bar/baz" {
-		t.Errorf("wrong name for baz: %s", e.Name)
+	if n.Operations != 2 || n.Puts != 2 || n.Blocks != 2 {
+		t.Errorf("wrong number of records reclaimed: %+v", n)
 	}
-	if e.Name != e.SignedName {
-		t.Errorf("signed name not equal to name: %s", e.SignedName)
+
+	ps, err := s.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if e.Blocks != nil {
-		t.Errorf("baz contains blocks: %v", e.Blocks)
+	if len(ps) != 0 {
+		t.Errorf("problems found after compaction: %v", ps)
 	}
-	if e.Packing != upspin.PlainPack {
-		t.Errorf("incorrect packing for baz: %x", e.Packing)
+
+	bar, err := s.Lookup(ctx, "foo@example.com/bar")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if string(e.Packdata) != "packd" {
-		t.Errorf("incorrect packdata for baz: %v", e.Packdata)
+	if bar.Sequence != 4 || len(bar.Blocks) != 1 || bar.Blocks[0].Location.Reference != "v3" {
+		t.Errorf("current version changed by compaction: %v", bar)
 	}
-	if es[1].Attr != upspin.AttrDirectory {
-		t.Errorf("bar not a directory: %v", es[1])
+
+	refs, head, err := s.Garbage(ctx, store, upspin.Now())
+	if err != nil {
+		t.Fatal(err)
 	}
-	if e.Sequence != 4 {
-		t.Errorf("wrong sequence for baz: %d", e.Sequence)
+	if len(refs) != 3 || refs[0] != "baz" || refs[1] != "v1" || refs[2] != "v2" {
+		t.Errorf("wrong blocks unreachable after compaction: %v", refs)
 	}
-	if es[0].Sequence != 4 {
-		t.Errorf("wrong sequence for root: %d", es[0].Sequence)
+
+	/// Collected blocks are unreachable again once used, even within the
+	/// second they were collected in
+	if err := s.MarkCollected(ctx, store, refs, head); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, file("foo@example.com/bar", "v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, file("foo@example.com/bar", "v4")); err != nil {
+		t.Fatal(err)
+	}
+	refs, _, err = s.Garbage(ctx, store, upspin.Now()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs[0] != "v1" || refs[1] != "v3" {
+		t.Errorf("wrong blocks unreachable after collection: %v", refs)
+	}
+
+	/// Hide the removal of an operation in a gap
+	if _, err := s.db.Exec(`UPDATE log_gap SET removed = removed + 1 WHERE op = (SELECT max(op) FROM log_gap)`); err != nil {
+		t.Fatal(err)
+	}
+	ps, err = s.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Kind != BadGap || ps[0].Name != "foo@example.com/" {
+		t.Errorf("gap not accounted for by compactions not reported: %v", ps)
+	}
+}
+
+// backdate records every operation in the log at time ts, as operations are
+// recorded at the current time.
+func backdate(t *testing.T, s *State, ts upspin.Time) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE log_operation SET timestamp = ?`, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := rechain(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestDelete(t *testing.T) {
+// The chain head changes with every operation, and Fsck detects operations
+// modified in place.
+func TestChain(t *testing.T) {
 	ctx := context.Background()
-	s, err := Open(":memory:")
+	s, err := Open(filepath.Join(t.TempDir(), "dir.db"))
 	if err != nil {
 		t.Fatalf("Failed to open database: %v", err)
 	}
+	defer s.Close()
 
-	/// Puts
-	if err := s.Put(ctx, &upspin.DirEntry{
-		Attr:   upspin.AttrDirectory,
-		Writer: "foo@example.com",
-		Name:   "foo@example.com/",
-	}); err != nil {
-		t.Error(err)
+	if h, err := s.ChainHead(ctx, "foo@example.com"); err != nil {
+		t.Fatal(err)
+	} else if h.Id != 0 || h.Hash != nil {
+		t.Errorf("head returned for nonexistent tree: %v", h)
 	}
-	bar := &upspin.DirEntry{
-		Writer: "foo@example.com",
-		Name:   "foo@example.com/bar",
+
+	var heads []Head
+	for _, e := range []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Attr: upspin.AttrLink, Link: "bar@example.com/", Writer: "foo@example.com", Name: "foo@example.com/bar"},
+		{
+			Packing:  upspin.PlainPack,
+			Packdata: []byte("packd"),
+			Blocks: []upspin.DirBlock{{
+				Location: upspin.Location{
+					Endpoint:  upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:123"},
+					Reference: "bazref",
+				},
+				Size: 24,
+			}},
+			Writer: "foo@example.com",
+			Name:   "foo@example.com/baz",
+		},
+	} {
+		if err := s.Put(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+		h, err := s.ChainHead(ctx, "foo@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, prev := range heads {
+			if string(prev.Hash) == string(h.Hash) {
+				t.Errorf("head hash repeated: %x", h.Hash)
+			}
+		}
+		heads = append(heads, h)
+	}
+	if heads[2].Sequence != 3 {
+		t.Errorf("wrong sequence for head: %d", heads[2].Sequence)
 	}
-	if err := s.Put(ctx, bar); err != nil {
-		t.Error(err)
+
+	ps, err := s.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 {
+		t.Fatalf("problems found in consistent database: %v", ps)
 	}
 
-	/// Delete
-	barp, _ := path.Parse(bar.Name)
-	if err := s.Delete(ctx, barp); err != nil {
-		t.Error(err)
+	/// Rewrite history
+	if _, err := s.db.Exec(`UPDATE log_block SET size = 25 WHERE reference = 'bazref'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`UPDATE log_put SET link = 'qux@example.com/' WHERE link IS NOT NULL`); err != nil {
+		t.Fatal(err)
 	}
 
-	/// LookupAll doesn't return deleted
-	es, err := s.LookupAll(ctx, barp)
+	ps, err = s.Fsck(ctx, nil, true)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	// The Merkle hashes of the projection no longer match either, but those
+	// are repaired.
+	var bad []Problem
+	for _, p := range ps {
+		if p.Kind == BadHash {
+			bad = append(bad, p)
+		} else if !p.Repaired {
+			t.Errorf("problem not repaired: %v", p)
+		}
+	}
+	if len(bad) != 2 || bad[0].Name != "foo@example.com/bar" || bad[1].Name != "foo@example.com/baz" {
+		t.Errorf("rewrites not reported: %v", ps)
+	}
+	for _, p := range bad {
+		if p.Repaired {
+			t.Errorf("bad hash repaired: %v", p)
+		}
 	}
-	if len(es) != 1 {
-		t.Errorf("Entry not deleted: %v", es)
+}
+
+// Trees with the same contents have the same root hash regardless of the order
+// and times of operations that produced them, and Diff finds where trees
+// differ.
+func TestMerkle(t *testing.T) {
+	ctx := context.Background()
+	open := func() *State {
+		s, err := Open(":memory:")
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	put := func(s *State, es ...*upspin.DirEntry) {
+		for _, e := range es {
+			if err := s.Put(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	root := func(s *State) []byte {
+		n, err := s.Node(ctx, "foo@example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n.Hash
+	}
+	diff := func(a, b *State) []upspin.PathName {
+		d, err := state.Diff(ctx, a, b, "foo@example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
 	}
-	if es[0].Sequence != 3 {
-		t.Errorf("Root sequence not incremented on delete: %d", es[0].Sequence)
+
+	dir := func(name upspin.PathName) *upspin.DirEntry {
+		return &upspin.DirEntry{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Time: 1000, Name: name}
+	}
+	file := func(name upspin.PathName, ref upspin.Reference) *upspin.DirEntry {
+		return &upspin.DirEntry{
+			Packing: upspin.PlainPack,
+			Writer:  "foo@example.com",
+			Time:    1000,
+			Name:    name,
+			Blocks: []upspin.DirBlock{{
+				Location: upspin.Location{
+					Endpoint:  upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:123"},
+					Reference: ref,
+				},
+				Size: 1,
+			}},
+		}
+	}
+
+	a, b := open(), open()
+	put(a, dir("foo@example.com/"), dir("foo@example.com/bar"), file("foo@example.com/bar/baz", "baz"), file("foo@example.com/qux", "qux"))
+	put(b, dir("foo@example.com/"), file("foo@example.com/qux", "old"), dir("foo@example.com/bar"), file("foo@example.com/qux", "qux"), file("foo@example.com/bar/baz", "baz"))
+	if root(a) == nil || string(root(a)) != string(root(b)) {
+		t.Errorf("root hashes differ for identical trees: %x, %x", root(a), root(b))
+	}
+	if d := diff(a, b); len(d) != 0 {
+		t.Errorf("identical trees differ: %v", d)
+	}
+
+	put(b, file("foo@example.com/bar/baz", "new"), dir("foo@example.com/quux"))
+	if string(root(a)) == string(root(b)) {
+		t.Errorf("root hash unchanged by modification")
+	}
+	if d := diff(a, b); len(d) != 2 || d[0] != "foo@example.com/bar/baz" || d[1] != "foo@example.com/quux" {
+		t.Errorf("wrong differences found: %v", d)
+	}
+
+	quuxp, _ := path.Parse("foo@example.com/quux")
+	if err := b.Delete(ctx, quuxp); err != nil {
+		t.Fatal(err)
+	}
+	put(b, file("foo@example.com/bar/baz", "baz"))
+	if string(root(a)) != string(root(b)) {
+		t.Errorf("root hashes differ after reverting modification")
+	}
+
+	// Times are not covered.
+	later := file("foo@example.com/qux", "qux")
+	later.Time = 2000
+	put(b, later)
+	if string(root(a)) != string(root(b)) {
+		t.Errorf("root hashes differ for entries put at different times")
+	}
+
+	ps, err := b.Fsck(ctx, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 {
+		t.Errorf("problems found in consistent database: %v", ps)
 	}
 }
 
-// LookupElem returns a negative id and no error when the root for the
-// requested does not exist.
-func TestLookupElemNoRoot(t *testing.T) {
+// Restoring a backup reproduces the database as of the time requested, across
+// generations, and the result passes Fsck.
+func TestBackup(t *testing.T) {
 	ctx := context.Background()
-	s, err := Open(":memory:")
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "dir.db"))
 	if err != nil {
 		t.Fatalf("Failed to open database: %v", err)
 	}
-
-	p, _ := path.Parse("a@b.com/foo/bar")
-	eid, rp, _, err := s.LookupElem(ctx, p)
+	defer s.Close()
+	sk, err := sink.OpenDir(filepath.Join(dir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.NewBackup(ctx, sk, BackupOptions{}, slog.Default())
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if eid >= 0 {
-		t.Errorf("non-negative entry identifier: %d", eid)
+	defer b.Close()
+
+	put := func(name upspin.PathName, attr upspin.Attribute) {
+		e := &upspin.DirEntry{Attr: attr, Packing: upspin.PlainPack, Writer: "foo@example.com", Name: name}
+		if err := s.Put(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func() time.Time {
+		if err := b.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+		// Segments are timestamped to the millisecond.
+		time.Sleep(2 * time.Millisecond)
+		at := time.Now()
+		time.Sleep(2 * time.Millisecond)
+		return at
 	}
-	if rp.NElem() > 0 {
-		t.Errorf("wrong number of elements: %d", rp.NElem())
+
+	put("foo@example.com/", upspin.AttrDirectory)
+	put("foo@example.com/bar", upspin.AttrNone)
+	first := sync()
+	put("foo@example.com/baz", upspin.AttrNone)
+	second := sync()
+
+	// A new generation starts after the backup is closed.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	barp, _ := path.Parse("foo@example.com/bar")
+	if err := s.Delete(ctx, barp); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	put("foo@example.com/qux", upspin.AttrNone)
+	sync()
+
+	for i, tt := range []struct {
+		at     time.Time
+		exists []upspin.PathName
+		absent []upspin.PathName
+	}{
+		{first, []upspin.PathName{"foo@example.com/bar"}, []upspin.PathName{"foo@example.com/baz"}},
+		{second, []upspin.PathName{"foo@example.com/bar", "foo@example.com/baz"}, []upspin.PathName{"foo@example.com/qux"}},
+		{time.Time{}, []upspin.PathName{"foo@example.com/baz", "foo@example.com/qux"}, []upspin.PathName{"foo@example.com/bar"}},
+	} {
+		file := filepath.Join(dir, fmt.Sprintf("restored%d.db", i))
+		if _, err := Restore(ctx, sk, file, tt.at); err != nil {
+			t.Fatalf("restore as of %v: %v", tt.at, err)
+		}
+		r, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range tt.exists {
+			if e, err := r.Lookup(ctx, name); err != nil || e == nil {
+				t.Errorf("restore as of %v: %s not found: %v", tt.at, name, err)
+			}
+		}
+		for _, name := range tt.absent {
+			if e, err := r.Lookup(ctx, name); err != nil || e != nil {
+				t.Errorf("restore as of %v: %s found: %v", tt.at, name, err)
+			}
+		}
+		ps, err := r.Fsck(ctx, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(ps) != 0 {
+			t.Errorf("restore as of %v: problems found: %v", tt.at, ps)
+		}
+		r.Close()
+	}
+
+	if _, err := Restore(ctx, sk, filepath.Join(dir, "restored0.db"), time.Time{}); err == nil {
+		t.Error("restore over an existing database succeeded")
+	}
+	if _, err := Restore(ctx, sk, filepath.Join(dir, "early.db"), first.Add(-time.Hour)); err == nil {
+		t.Error("restore as of a time before the backup succeeded")
 	}
 }
 
-// LookupElem returns the root path when no other elements of the rquested path
-// match.
-func TestLookupElemOnlyRoot(t *testing.T) {
+// Snapshots, plain or encrypted, hold a copy of the database passing Fsck.
+func TestSnapshot(t *testing.T) {
 	ctx := context.Background()
-	s, err := Open(":memory:")
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "dir.db"))
 	if err != nil {
 		t.Fatalf("Failed to open database: %v", err)
 	}
-	if err := s.Put(ctx, &upspin.DirEntry{
-		Attr:   upspin.AttrDirectory,
-		Writer: "a@b.com",
-		Name:   "a@b.com/",
-	}); err != nil {
-		t.Error(err)
+	defer s.Close()
+	for _, e := range []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/bar"},
+	} {
+		if err := s.Put(ctx, e); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	p, _ := path.Parse("a@b.com/foo/bar")
-	eid, rp, _, err := s.LookupElem(ctx, p)
+	plain := filepath.Join(dir, "plain.db")
+	if err := s.Snapshot(ctx, plain, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot(ctx, plain, nil); err == nil {
+		t.Error("snapshot over an existing file succeeded")
+	}
+	// The plaintext copy is made next to the database, not the snapshot.
+	out := t.TempDir()
+	encrypted := filepath.Join(out, "encrypted")
+	if err := s.Snapshot(ctx, encrypted, []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot(ctx, encrypted, []byte("passphrase")); err == nil {
+		t.Error("encrypted snapshot over an existing file succeeded")
+	}
+	if fs, err := os.ReadDir(out); err != nil {
+		t.Fatal(err)
+	} else if len(fs) != 1 {
+		t.Errorf("files left next to the encrypted snapshot: %v", fs)
+	}
+	enc, err := os.ReadFile(encrypted)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if eid < 0 {
-		t.Errorf("invalid entry identifier: %d", eid)
+	if err := DecryptSnapshot(io.Discard, bytes.NewReader(enc), []byte("wrong")); err == nil {
+		t.Error("decryption with a wrong passphrase succeeded")
 	}
-	if rp.String() != "a@b.com/" {
-		t.Errorf("path doesn't match root: %s", rp.String())
+	if err := DecryptSnapshot(io.Discard, bytes.NewReader(enc[:len(enc)-1]), []byte("passphrase")); err == nil {
+		t.Error("decryption of a truncated snapshot succeeded")
+	}
+	var dec bytes.Buffer
+	if err := DecryptSnapshot(&dec, bytes.NewReader(enc), []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	decrypted := filepath.Join(dir, "decrypted.db")
+	if err := os.WriteFile(decrypted, dec.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{plain, decrypted} {
+		c, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, err := c.Lookup(ctx, "foo@example.com/bar"); err != nil || e == nil {
+			t.Errorf("%s: entry not found: %v", file, err)
+		}
+		if ps, err := c.Fsck(ctx, nil, false); err != nil {
+			t.Fatal(err)
+		} else if len(ps) != 0 {
+			t.Errorf("%s: problems found: %v", file, ps)
+		}
+		c.Close()
 	}
 }
 
-// LookupElem returns a partial path that prefixes the requested path when the
-// requested path does not exist.
+// A database created with the schema preceding migrations is upgraded on Open,
+// and passes Fsck.
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "dir.db")
+	db, err := sql.Open("sqlite3", "file:"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE log_root (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, username TEXT UNIQUE NOT NULL)`,
+		`CREATE TABLE log_put (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, writer TEXT NOT NULL, dir BOOLEAN DEFAULT FALSE NOT NULL, link TEXT, packing INTEGER, packdata BLOB)`,
+		`CREATE TABLE log_operation (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, timestamp INTEGER DEFAULT (unixepoch()) NOT NULL, root REFERENCES log_root NOT NULL, path TEXT NOT NULL, put REFERENCES log_put UNIQUE)`,
+		`CREATE TABLE log_block (put REFERENCES log_put NOT NULL, endpoint TEXT NOT NULL, reference TEXT NOT NULL, offset INTEGER NOT NULL, size INTEGER NOT NULL, packdata BLOB, PRIMARY KEY(put, reference))`,
+		`CREATE TABLE proj_entry (name TEXT PRIMARY KEY NOT NULL, op REFERENCES log_operation UNIQUE NOT NULL, sequence INTEGER NOT NULL, parent REFERENCES log_put NOT NULL)`,
+		`INSERT INTO log_root (username) VALUES ('foo@example.com')`,
+		`INSERT INTO log_put (writer, dir) VALUES ('foo@example.com', TRUE)`,
+		`INSERT INTO log_operation (timestamp, root, path, put) VALUES (1000, 1, '', 1)`,
+		`INSERT INTO log_put (writer, packing) VALUES ('foo@example.com', 1)`,
+		`INSERT INTO log_operation (timestamp, root, path, put) VALUES (1001, 1, 'bar', 2)`,
+		`INSERT INTO log_block VALUES (2, 'localhost:123', 'barref', 0, 24, NULL)`,
+		`INSERT INTO log_put (writer, packing) VALUES ('foo@example.com', 1)`,
+		`INSERT INTO log_operation (timestamp, root, path, put) VALUES (1002, 1, 'baz', 3)`,
+		`INSERT INTO log_operation (timestamp, root, path) VALUES (1003, 1, 'baz')`,
+		`INSERT INTO proj_entry VALUES ('foo@example.com/', 1, 4, 1)`,
+		`INSERT INTO proj_entry VALUES ('foo@example.com/bar', 2, 2, 1)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
 
-// LookupElem returns AttrNone when the returned entry is a file.
+	s, err := Open(file)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	if ps, err := s.Fsck(ctx, nil, false); err != nil {
+		t.Fatal(err)
+	} else if len(ps) != 0 {
+		t.Errorf("problems found in migrated database: %v", ps)
+	}
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	} else if version != len(migrations) {
+		t.Errorf("got version %d, want %d", version, len(migrations))
+	}
 
-// LookupElem returns AttrDirectory when the returned entry is a directory.
+	e, err := s.Lookup(ctx, "foo@example.com/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Blocks) != 1 || e.Blocks[0].Location.Endpoint.Transport != upspin.Remote {
+		t.Errorf("wrong blocks after migration: %v", e.Blocks)
+	}
+	if e.Time != 1001 {
+		t.Errorf("wrong time after migration: %d", e.Time)
+	}
+	if err := s.Put(ctx, &upspin.DirEntry{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/qux"}); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := s.ChainHead(ctx, "foo@example.com"); err != nil {
+		t.Fatal(err)
+	} else if h.Sequence != 5 {
+		t.Errorf("wrong sequence for head: %d", h.Sequence)
+	}
+	s.Close()
 
-// LookupElem returns AttrLink when the returned entry is a link.
+	// Migrated databases are opened as is.
+	s, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if ps, err := s.Fsck(ctx, nil, false); err != nil {
+		t.Fatal(err)
+	} else if len(ps) != 0 {
+		t.Errorf("problems found in reopened database: %v", ps)
+	}
+}
@@ -0,0 +1,547 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite/sink"
+	"upspin.io/errors"
+)
+
+/*
+A backup ships the database to a sink continuously, in the manner of
+Litestream. It consists of generations, each made of a copy of the database
+file and the segments of its write-ahead log (WAL) appended since:
+
+	<generation>/snapshot.db
+	<generation>/<offset>-<time>.wal
+
+Generations are named by the Unix time in nanoseconds at which they started,
+and segments by the offset in the WAL at which they start and the Unix time in
+milliseconds at which they were shipped, all in fixed-width hexadecimal so that
+names sort in order. Every segment ends with a committed transaction, and the
+database can be restored as of the shipping of any segment.
+
+While a generation is live, the backup holds a read transaction open, which
+prevents SQLite from restarting the WAL, so that every frame appended to it is
+shipped. Once the WAL grows by a given size or the generation reaches an age, the WAL is
+checkpointed into the database file and truncated, and a new generation starts.
+A new generation also starts if the WAL was restarted regardless, which can
+only happen if the read transaction was lost.
+
+Checkpoints may write pages of the database file while it is copied, but only
+pages also held by the WAL, whose segments are applied over the snapshot on
+restore. The first segment of a generation is therefore shipped before the
+snapshot and timestamped with the start of the generation, and a generation is
+only restored once its snapshot is stored.
+*/
+
+// BackupOptions determine when a backup starts new generations and deletes old
+// ones.
+type BackupOptions struct {
+	// The size by which the WAL may grow before a new generation starts.
+	// Defaults to 64 MiB.
+	MaxWAL int64
+
+	// The age a generation may reach before a new one starts. Defaults to a
+	// day.
+	MaxAge time.Duration
+
+	// Generations are deleted once superseded for this long. Zero retains
+	// them forever.
+	Retain time.Duration
+}
+
+// Backup ships the database to a sink. It is not safe for concurrent use.
+type Backup struct {
+	s    State
+	sink sink.Sink
+	opts BackupOptions
+	log  *slog.Logger
+
+	// Holds the read transaction preventing the WAL from restarting.
+	conn *sql.Conn
+
+	gen     string
+	started time.Time
+	hdr     walHeader
+	// The end of the part of the WAL shipped, zero if none was, and the
+	// checksum of the WAL there. base is the end when the generation
+	// started, as the WAL is not truncated if checkpoints are kept busy.
+	off  int64
+	sum  [2]uint32
+	base int64
+}
+
+// errRestarted is returned when the WAL was restarted outside of the backup's
+// control, losing frames that were not shipped.
+var errRestarted = errors.Str("write-ahead log restarted")
+
+// NewBackup returns a backup of the database to sk, switching the database to
+// WAL mode. The backup starts with the first call to Sync or Run.
+func (s State) NewBackup(ctx context.Context, sk sink.Sink, opts BackupOptions, log *slog.Logger) (*Backup, error) {
+	var mode string
+	if err := s.db.QueryRowContext(ctx, `PRAGMA journal_mode=WAL`).Scan(&mode); err != nil {
+		return nil, fmt.Errorf("sqlite.NewBackup: %w", err)
+	} else if mode != "wal" {
+		return nil, fmt.Errorf("sqlite.NewBackup: database in %s journal mode can not be backed up", mode)
+	}
+	if opts.MaxWAL <= 0 {
+		opts.MaxWAL = 64 << 20
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+
+	return &Backup{s: s, sink: sk, opts: opts, log: log}, nil
+}
+
+// Run calls Sync at every interval until ctx is done, logging failures, then
+// closes the backup.
+func (b *Backup) Run(ctx context.Context, interval time.Duration) {
+	defer b.Close()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := b.Sync(ctx); err != nil {
+			b.log.ErrorContext(ctx, "backup failed", "err", err, "generation", b.gen)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Sync ships the transactions committed since the last call, first starting a
+// new generation if the current one is due to be replaced. A failure to ship is
+// retried by the next call.
+func (b *Backup) Sync(ctx context.Context) error {
+	if b.gen != "" && b.off-b.base < b.opts.MaxWAL && time.Since(b.started) < b.opts.MaxAge {
+		err := b.ship(ctx, time.Now())
+		if err != errRestarted {
+			return err
+		}
+		b.log.WarnContext(ctx, "write-ahead log restarted outside of backup", "generation", b.gen)
+	}
+
+	if err := b.generate(ctx); err != nil {
+		b.gen = ""
+		return fmt.Errorf("start generation: %w", err)
+	}
+
+	return nil
+}
+
+// Close releases the read transaction held by the backup. A later call to Sync
+// starts a new generation.
+func (b *Backup) Close() error {
+	b.gen = ""
+	return b.release()
+}
+
+// generate checkpoints and truncates the WAL, then starts a new generation.
+func (b *Backup) generate(ctx context.Context) error {
+	if err := b.release(); err != nil {
+		return err
+	}
+	// The checkpoint fails to complete if readers hold on to the WAL, which
+	// is merely a loss of space.
+	var busy, frames, done int
+	if err := b.s.db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &frames, &done); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+
+	b.started = time.Now()
+	b.gen, b.off = fmt.Sprintf("%016x", b.started.UnixNano()), 0
+	if err := b.ship(ctx, b.started); err != nil {
+		return err
+	}
+	b.base = b.off
+
+	f, err := os.Open(b.s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := b.sink.Put(ctx, b.gen+"/snapshot.db", io.NewSectionReader(f, 0, fi.Size()), fi.Size()); err != nil {
+		return fmt.Errorf("store snapshot: %w", err)
+	}
+	b.log.InfoContext(ctx, "started backup generation", "generation", b.gen, "size", fi.Size())
+
+	if b.opts.Retain > 0 {
+		if err := b.prune(ctx); err != nil {
+			b.log.ErrorContext(ctx, "pruning backup generations failed", "err", err)
+		}
+	}
+
+	return nil
+}
+
+// acquire opens the read transaction preventing the WAL from restarting.
+func (b *Backup) acquire(ctx context.Context) error {
+	conn, err := b.s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	// A transaction only takes its read lock once it reads.
+	var n int
+	if _, err := conn.ExecContext(ctx, `BEGIN`); err != nil {
+		conn.Close()
+		return fmt.Errorf("begin read transaction: %w", err)
+	} else if err := conn.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master`).Scan(&n); err != nil {
+		conn.ExecContext(ctx, `ROLLBACK`)
+		conn.Close()
+		return fmt.Errorf("begin read transaction: %w", err)
+	}
+	b.conn = conn
+
+	return nil
+}
+
+// release closes the read transaction, if open.
+func (b *Backup) release() error {
+	if b.conn == nil {
+		return nil
+	}
+	_, err := b.conn.ExecContext(context.Background(), `ROLLBACK`)
+	if cerr := b.conn.Close(); err == nil {
+		err = cerr
+	}
+	b.conn = nil
+
+	return err
+}
+
+// ship stores the frames of committed transactions appended to the WAL since
+// the last call as a segment shipped at time t.
+func (b *Backup) ship(ctx context.Context, t time.Time) error {
+	f, err := os.Open(b.s.file + "-wal")
+	if os.IsNotExist(err) && b.off == 0 {
+		return nil
+	} else if os.IsNotExist(err) {
+		return errRestarted
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(buf, 0); err == io.EOF && b.off == 0 {
+		return nil
+	} else if err == io.EOF {
+		return errRestarted
+	} else if err != nil {
+		return err
+	}
+	h, err := parseWALHeader(buf)
+	if b.off == 0 && err != nil {
+		return err
+	} else if b.off == 0 {
+		b.hdr, b.sum = h, h.sum
+	} else if err != nil || h.salt != b.hdr.salt {
+		return errRestarted
+	}
+
+	from := max(b.off, walHeaderSize)
+	end, sum, err := scanWAL(f, b.hdr, from, b.sum)
+	if err != nil {
+		return err
+	} else if end == from {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s/%016x-%016x.wal", b.gen, b.off, t.UnixMilli())
+	if err := b.sink.Put(ctx, name, io.NewSectionReader(f, b.off, end-b.off), end-b.off); err != nil {
+		return fmt.Errorf("store segment: %w", err)
+	}
+	b.off, b.sum = end, sum
+
+	return nil
+}
+
+// prune deletes the generations superseded for longer than the retention
+// period, and those that were never completed.
+func (b *Backup) prune(ctx context.Context) error {
+	gens, names, err := generations(ctx, b.sink)
+	if err != nil {
+		return err
+	}
+
+	// A generation is superseded once a later one is complete.
+	cutoff := time.Now().Add(-b.opts.Retain)
+	var superseded time.Time
+	for i := len(gens) - 1; i >= 0; i-- {
+		g := gens[i]
+		if g.name == b.gen || g.complete && (superseded.IsZero() || superseded.After(cutoff)) {
+			if g.complete {
+				superseded = g.start
+			}
+			continue
+		}
+		for _, n := range names[g.name] {
+			if err := b.sink.Delete(ctx, n); err != nil {
+				return err
+			}
+		}
+		b.log.InfoContext(ctx, "deleted backup generation", "generation", g.name)
+		if g.complete {
+			superseded = g.start
+		}
+	}
+
+	return nil
+}
+
+type generation struct {
+	name     string
+	start    time.Time
+	complete bool
+}
+
+// generations lists the generations stored in a sink, oldest first, along with
+// the names of their files.
+func generations(ctx context.Context, sk sink.Sink) ([]generation, map[string][]string, error) {
+	all, err := sk.List(ctx, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("list backup: %w", err)
+	}
+
+	var gens []generation
+	names := map[string][]string{}
+	for _, n := range all {
+		g, file, ok := strings.Cut(n, "/")
+		ns, err := strconv.ParseInt(g, 16, 64)
+		if !ok || err != nil {
+			continue
+		}
+		if len(names[g]) == 0 {
+			gens = append(gens, generation{name: g, start: time.Unix(0, ns)})
+		}
+		names[g] = append(names[g], n)
+		if file == "snapshot.db" {
+			gens[len(gens)-1].complete = true
+		}
+	}
+
+	return gens, names, nil
+}
+
+// Restore rebuilds the database backed up to sk in file, as of the given time
+// or, if zero, as of the latest segment shipped, and returns the time as of
+// which it was restored. The file must not exist. Any Open of the restored
+// database should be followed by a Fsck.
+func Restore(ctx context.Context, sk sink.Sink, file string, at time.Time) (time.Time, error) {
+	restored, err := restore(ctx, sk, file, at)
+	if err != nil {
+		os.Remove(file)
+		os.Remove(file + "-wal")
+		os.Remove(file + "-shm")
+		return time.Time{}, fmt.Errorf("sqlite.Restore: %w", err)
+	}
+
+	return restored, nil
+}
+
+func restore(ctx context.Context, sk sink.Sink, file string, at time.Time) (time.Time, error) {
+	for _, f := range []string{file, file + "-wal", file + "-shm"} {
+		if _, err := os.Stat(f); err == nil {
+			return time.Time{}, fmt.Errorf("%s already exists", f)
+		}
+	}
+	if at.IsZero() {
+		at = time.Unix(1<<62, 0)
+	}
+
+	gens, names, err := generations(ctx, sk)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var gen generation
+	for _, g := range gens {
+		if g.complete && !g.start.After(at) {
+			gen = g
+		}
+	}
+	if gen.name == "" {
+		return time.Time{}, errors.Str("no backup from before that time")
+	}
+
+	// Segments may have been shipped again from the same offset after a
+	// failure, in which case the latest is the longest.
+	segs := map[int64]string{}
+	times := map[string]time.Time{}
+	for _, n := range names[gen.name] {
+		var off, ms int64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(n, gen.name+"/"), "%016x-%016x.wal", &off, &ms); err != nil {
+			continue
+		}
+		if t := time.UnixMilli(ms); !t.After(at) {
+			segs[off] = n
+			times[n] = t
+		}
+	}
+
+	if err := fetch(ctx, sk, gen.name+"/snapshot.db", file); err != nil {
+		return time.Time{}, err
+	}
+	restored := gen.start
+	if _, ok := segs[0]; ok {
+		w, err := os.OpenFile(file+"-wal", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return time.Time{}, err
+		}
+		var off int64
+		for n, ok := segs[0]; ok; n, ok = segs[off] {
+			r, err := sk.Get(ctx, n)
+			if err != nil {
+				w.Close()
+				return time.Time{}, err
+			}
+			c, err := io.Copy(w, r)
+			r.Close()
+			if err != nil {
+				w.Close()
+				return time.Time{}, fmt.Errorf("fetch %s: %w", n, err)
+			}
+			off += c
+			restored = times[n]
+		}
+		if err := w.Close(); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	// Opening the database recovers the WAL, which is then checkpointed
+	// into the database file.
+	db, err := sql.Open("sqlite3", "file:"+file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+	var busy, frames, done int
+	if err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &frames, &done); err != nil {
+		return time.Time{}, fmt.Errorf("checkpoint: %w", err)
+	} else if busy != 0 {
+		return time.Time{}, errors.Str("checkpoint did not complete")
+	}
+
+	return restored, db.Close()
+}
+
+// fetch copies a file from a sink to a new local file.
+func fetch(ctx context.Context, sk sink.Sink, name, file string) error {
+	r, err := sk.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("fetch %s: %w", name, err)
+	}
+
+	return f.Close()
+}
+
+// The layout of WAL files is described at https://www.sqlite.org/fileformat.html.
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+type walHeader struct {
+	// Whether the checksums are computed over big-endian words.
+	bigEndian bool
+	pageSize  int64
+	salt      [8]byte
+	sum       [2]uint32
+}
+
+func parseWALHeader(b []byte) (walHeader, error) {
+	var h walHeader
+	switch m := binary.BigEndian.Uint32(b); m {
+	case 0x377f0682:
+	case 0x377f0683:
+		h.bigEndian = true
+	default:
+		return h, fmt.Errorf("bad WAL magic number %#x", m)
+	}
+	if h.pageSize = int64(binary.BigEndian.Uint32(b[8:])); h.pageSize == 1 {
+		h.pageSize = 1 << 16
+	}
+	copy(h.salt[:], b[16:24])
+
+	h.sum = walChecksum(h.bigEndian, [2]uint32{}, b[:24])
+	if h.sum[0] != binary.BigEndian.Uint32(b[24:]) || h.sum[1] != binary.BigEndian.Uint32(b[28:]) {
+		return h, errors.Str("bad WAL header checksum")
+	}
+
+	return h, nil
+}
+
+// scanWAL reads the valid frames of a WAL from off, where its checksum is sum,
+// and returns the end of the last committed transaction and the checksum
+// there, or off and sum if there is none.
+func scanWAL(r io.ReaderAt, h walHeader, off int64, sum [2]uint32) (int64, [2]uint32, error) {
+	end, endSum := off, sum
+	frame := make([]byte, walFrameHeaderSize+h.pageSize)
+	for {
+		if _, err := r.ReadAt(frame, off); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, sum, err
+		}
+		if !bytes.Equal(frame[8:16], h.salt[:]) {
+			break
+		}
+		sum = walChecksum(h.bigEndian, sum, frame[:8])
+		sum = walChecksum(h.bigEndian, sum, frame[walFrameHeaderSize:])
+		if sum[0] != binary.BigEndian.Uint32(frame[16:]) || sum[1] != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+
+		off += int64(len(frame))
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			end, endSum = off, sum
+		}
+	}
+
+	return end, endSum, nil
+}
+
+func walChecksum(bigEndian bool, s [2]uint32, b []byte) [2]uint32 {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(b); i += 8 {
+		s[0] += order.Uint32(b[i:]) + s[1]
+		s[1] += order.Uint32(b[i+4:]) + s[0]
+	}
+
+	return s
+}
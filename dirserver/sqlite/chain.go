@@ -0,0 +1,316 @@
+package sqlite
+
+// Provides the hash chain over the operations on each tree. Every operation
+// records a hash over the hash of the preceding operation on the same tree and
+// a canonical encoding of its contents, such that modifying, removing or
+// reordering any operation changes the hash of every operation following it.
+// Comparing the current head of a chain against one recorded earlier detects
+// rewrites of the history up to the recorded operation.
+//
+// Compaction removes operations from the chain. The hash preceding each
+// retained operation whose predecessor was removed is recorded in log_gap, so
+// that the remaining chain can still be verified, though the removed
+// operations can not. Every gap is accounted for by a record of the compaction
+// that left it, so that operations can not be removed by recording a gap
+// alone: the gaps of a tree must follow compactions of it, and together must
+// hold as many operations as its compactions removed.
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/upspin"
+)
+
+// Head identifies the latest operation on a tree and its hash.
+type Head struct {
+	Id       int64
+	Sequence int64
+	Hash     []byte
+}
+
+// ChainHead returns the head of the hash chain of the tree of the given user.
+// The head is empty if the tree does not exist.
+func (s State) ChainHead(ctx context.Context, user upspin.UserName) (Head, error) {
+	var h Head
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT o.id, o.sequence, o.hash
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		WHERE r.username = ?
+		ORDER BY o.id DESC
+		LIMIT 1`,
+		user,
+	).Scan(&h.Id, &h.Sequence, &h.Hash)
+	if err == sql.ErrNoRows {
+		return Head{}, nil
+	} else if err != nil {
+		return Head{}, fmt.Errorf("sqlite.ChainHead(%s): %w", user, err)
+	}
+
+	return h, nil
+}
+
+// chainPrev returns the hash of the latest operation on the tree of the given
+// user, or nil if there is none.
+func chainPrev(tx *sql.Tx, user upspin.UserName) ([]byte, error) {
+	var prev []byte
+	err := tx.QueryRow(
+		`SELECT o.hash
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		WHERE r.username = ?
+		ORDER BY o.id DESC
+		LIMIT 1`,
+		user,
+	).Scan(&prev)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return prev, err
+}
+
+// chainHash computes the hash of the operation with the given id on the path
+// fp of the tree of user, following the operation with hash prev. ts and t are
+// the timestamp and time of the operation. e is the entry that was put, or nil
+// for a deletion; only the fields persisted in the log are covered.
+func chainHash(prev []byte, id int64, user upspin.UserName, fp string, ts, t upspin.Time, seq int64, e *upspin.DirEntry) []byte {
+	h := sha256.New()
+	state.WriteBytes(h, prev)
+	state.WriteInt(h, id)
+	state.WriteBytes(h, []byte(user))
+	state.WriteBytes(h, []byte(fp))
+	state.WriteInt(h, int64(ts))
+	state.WriteInt(h, int64(t))
+	state.WriteInt(h, seq)
+
+	if e == nil {
+		state.WriteInt(h, 0)
+	} else {
+		state.WriteEntry(h, e)
+	}
+
+	return h.Sum(nil)
+}
+
+// chainOp is an operation as loaded for verification.
+type chainOp struct {
+	Operation
+	fp   string
+	pid  int64
+	hash []byte
+	// The hash preceding the operation if its predecessor was removed by
+	// compaction, else nil.
+	gap []byte
+}
+
+// roots returns the users of every tree, in the order created.
+func roots(tx *sql.Tx) ([]upspin.UserName, error) {
+	rs, err := tx.Query(`SELECT username FROM log_root ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("query roots: %w", err)
+	}
+	defer rs.Close()
+
+	var users []upspin.UserName
+	for rs.Next() {
+		var u upspin.UserName
+		if err := rs.Scan(&u); err != nil {
+			return nil, fmt.Errorf("query roots: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("query roots: %w", err)
+	}
+
+	return users, nil
+}
+
+// rechain recomputes the hash of every operation, in order. Chains continue
+// from the hashes recorded for gaps, as those of the removed operations can
+// not be recomputed.
+func rechain(tx *sql.Tx) error {
+	users, err := roots(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		ops, err := loadChain(tx, u)
+		if err != nil {
+			return err
+		}
+
+		var prev []byte
+		for _, op := range ops {
+			if op.gap != nil {
+				prev = op.gap
+			}
+			if op.Entry != nil && op.Entry.IsRegular() {
+				if op.Entry.Blocks, err = getBlocks(tx, op.pid); err != nil {
+					return err
+				}
+			}
+
+			prev = chainHash(prev, op.Id, u, op.fp, op.Timestamp, op.Time, op.Sequence, op.Entry)
+			if _, err := tx.Exec(`UPDATE log_operation SET hash = ? WHERE id = ?`, prev, op.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifyChains verifies the hash chain of every tree, reporting each
+// operation whose hash does not match.
+func verifyChains(tx *sql.Tx) ([]Problem, error) {
+	users, err := roots(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []Problem
+	for _, u := range users {
+		ops, err := loadChain(tx, u)
+		if err != nil {
+			return nil, err
+		}
+
+		var prev []byte
+		for _, op := range ops {
+			if op.gap != nil {
+				prev = op.gap
+			}
+			if op.Entry != nil && op.Entry.IsRegular() {
+				if op.Entry.Blocks, err = getBlocks(tx, op.pid); err != nil {
+					return nil, err
+				}
+			}
+
+			h := chainHash(prev, op.Id, u, op.fp, op.Timestamp, op.Time, op.Sequence, op.Entry)
+			if string(h) != string(op.hash) {
+				ps = append(ps, Problem{Kind: BadHash, Name: op.Name, Id: op.Id})
+			}
+			// Continue from the recorded hash, so that a single modified
+			// operation is reported once.
+			prev = op.hash
+		}
+	}
+
+	gapPs, err := verifyGaps(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ps, gapPs...), nil
+}
+
+// verifyGaps reports the gaps in the hash chains that are not accounted for
+// by the compactions of their trees: those not following a compaction of the
+// tree, and those of trees whose gaps do not hold as many operations as were
+// removed.
+func verifyGaps(tx *sql.Tx) ([]Problem, error) {
+	rs, err := tx.Query(
+		`SELECT r.username, o.path, o.id, g.removed > 0 AND coalesce(c.root = o.root AND c.head >= o.id, FALSE)
+		FROM log_gap g
+		INNER JOIN log_operation o ON g.op = o.id
+		INNER JOIN log_root r ON o.root = r.id
+		LEFT JOIN log_compaction c ON g.compaction = c.id
+		ORDER BY o.id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query gaps: %w", err)
+	}
+	var ps []Problem
+	for rs.Next() {
+		var u upspin.UserName
+		var fp string
+		var id int64
+		var ok bool
+		if err := rs.Scan(&u, &fp, &id, &ok); err != nil {
+			rs.Close()
+			return nil, fmt.Errorf("query gaps: %w", err)
+		}
+		if !ok {
+			name := upspin.PathName(string(u) + "/" + fp)
+			ps = append(ps, Problem{Kind: BadGap, Name: name, Id: id, Detail: "no compaction of the tree removed the operations preceding it"})
+		}
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("query gaps: %w", err)
+	}
+
+	rs, err = tx.Query(
+		`SELECT r.username, coalesce(gs.removed, 0), coalesce(cs.removed, 0)
+		FROM log_root r
+		LEFT JOIN (
+			SELECT o.root, sum(g.removed) AS removed
+			FROM log_gap g
+			INNER JOIN log_operation o ON g.op = o.id
+			GROUP BY o.root
+		) gs ON gs.root = r.id
+		LEFT JOIN (
+			SELECT root, sum(removed) AS removed
+			FROM log_compaction
+			GROUP BY root
+		) cs ON cs.root = r.id
+		WHERE coalesce(gs.removed, 0) != coalesce(cs.removed, 0)
+		ORDER BY r.id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query compactions: %w", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var u upspin.UserName
+		var gaps, removed int64
+		if err := rs.Scan(&u, &gaps, &removed); err != nil {
+			return nil, fmt.Errorf("query compactions: %w", err)
+		}
+		ps = append(ps, Problem{
+			Kind:   BadGap,
+			Name:   upspin.PathName(u + "/"),
+			Detail: fmt.Sprintf("gaps hold %d operations, compactions removed %d", gaps, removed),
+		})
+	}
+
+	return ps, rs.Err()
+}
+
+// loadChain loads the operations on the tree of user, in order.
+func loadChain(tx *sql.Tx, user upspin.UserName) ([]chainOp, error) {
+	rs, err := tx.Query(
+		`SELECT `+opColumns+`, o.path, o.hash, g.prev
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		LEFT JOIN log_put p ON o.put = p.id
+		LEFT JOIN log_gap g ON g.op = o.id
+		WHERE r.username = ?
+		ORDER BY o.id`,
+		user,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query log: %w", err)
+	}
+	defer rs.Close()
+
+	var ops []chainOp
+	for rs.Next() {
+		var op chainOp
+		op.Operation, op.pid, err = scanOp(rs, user, &op.fp, &op.hash, &op.gap)
+		if err != nil {
+			return nil, fmt.Errorf("query log: %w", err)
+		}
+		ops = append(ops, op)
+	}
+
+	return ops, rs.Err()
+}
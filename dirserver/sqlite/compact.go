@@ -0,0 +1,297 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// Retention determines which operations compaction removes from the log. An
+// operation is retained if any of the rules below applies to it.
+//
+// Regardless of the rules, the operations referenced by the projection and
+// the latest operation on every path are always retained: replaying the
+// remaining log must reproduce the projection and its sequences. Watchers are
+// not accounted for, as the directory server does not implement Watch; one
+// built on the log would have to hold back compaction of the operations it has
+// yet to deliver.
+type Retention struct {
+	// Operations within this period are retained. Zero retains none by age.
+	Age time.Duration
+
+	// The latest operations on each path, up to this number, are retained.
+	// Values less than 1 are treated as 1.
+	Versions int
+}
+
+// Reclaimed counts the log records removed by compaction.
+type Reclaimed struct {
+	Operations int64
+	Puts       int64
+	Blocks     int64
+}
+
+func (r *Reclaimed) add(o Reclaimed) {
+	r.Operations += o.Operations
+	r.Puts += o.Puts
+	r.Blocks += o.Blocks
+}
+
+// Compact removes the operations outside the retention policy from the log,
+// along with the records of what they put. Each tree is compacted in its own
+// transaction. The references of removed blocks remain known to Garbage, and
+// the hash chain of each tree remains verifiable across the removed
+// operations.
+func (s State) Compact(ctx context.Context, r Retention) (Reclaimed, error) {
+	var total Reclaimed
+
+	rs, err := s.db.QueryContext(ctx, `SELECT id, username FROM log_root ORDER BY id`)
+	if err != nil {
+		return total, fmt.Errorf("sqlite.Compact: %w", err)
+	}
+	type root struct {
+		id   int64
+		user upspin.UserName
+	}
+	var roots []root
+	for rs.Next() {
+		var rt root
+		if err := rs.Scan(&rt.id, &rt.user); err != nil {
+			rs.Close()
+			return total, fmt.Errorf("sqlite.Compact: %w", err)
+		}
+		roots = append(roots, rt)
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return total, fmt.Errorf("sqlite.Compact: %w", err)
+	}
+
+	before := upspin.TimeFromGo(time.Now().Add(-r.Age))
+	versions := max(r.Versions, 1)
+	for _, rt := range roots {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return total, fmt.Errorf("sqlite.Compact(%s): begin transaction: %w", rt.user, err)
+		}
+		n, err := compactRoot(tx, rt.id, before, versions)
+		if err != nil {
+			tx.Rollback()
+			return total, fmt.Errorf("sqlite.Compact(%s): %w", rt.user, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return total, fmt.Errorf("sqlite.Compact(%s): commit: %w", rt.user, err)
+		}
+		total.add(n)
+	}
+
+	return total, nil
+}
+
+// compactRoot removes the operations on a tree that are before the given time
+// and not among the latest versions on their path.
+func compactRoot(tx *sql.Tx, root int64, before upspin.Time, versions int) (Reclaimed, error) {
+	var n Reclaimed
+
+	_, err := tx.Exec(
+		`CREATE TEMP TABLE IF NOT EXISTS compact_operation (
+			id INTEGER PRIMARY KEY NOT NULL,
+			put INTEGER
+		)`,
+	)
+	if err != nil {
+		return n, err
+	}
+	if _, err := tx.Exec(`DELETE FROM temp.compact_operation`); err != nil {
+		return n, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO temp.compact_operation
+		SELECT id, put
+		FROM (
+			SELECT
+				id,
+				put,
+				timestamp,
+				ROW_NUMBER() OVER (PARTITION BY path ORDER BY id DESC) AS version
+			FROM log_operation
+			WHERE root = ?
+		)
+		WHERE version > ?
+			AND timestamp < ?
+			AND id NOT IN (SELECT op FROM proj_entry)`,
+		root,
+		versions,
+		before,
+	)
+	if err != nil {
+		return n, fmt.Errorf("select operations: %w", err)
+	}
+
+	var removed int64
+	if err := tx.QueryRow(`SELECT count(*) FROM temp.compact_operation`).Scan(&removed); err != nil {
+		return n, err
+	} else if removed == 0 {
+		return n, nil
+	}
+
+	// Keep the references of removed blocks, with the time and id of their
+	// last use, for garbage collection.
+	_, err = tx.Exec(
+		`INSERT INTO gc_released (endpoint, reference, timestamp, op)
+		SELECT b.endpoint, b.reference, MAX(o.timestamp), MAX(o.id)
+		FROM log_block b
+		INNER JOIN log_operation o ON o.put = b.put
+		WHERE o.id IN (SELECT id FROM temp.compact_operation)
+		GROUP BY b.endpoint, b.reference
+		ON CONFLICT (endpoint, reference) DO UPDATE SET
+			timestamp = MAX(timestamp, excluded.timestamp),
+			op = MAX(op, excluded.op)`,
+	)
+	if err != nil {
+		return n, fmt.Errorf("release blocks: %w", err)
+	}
+
+	if err := recordGaps(tx, root, removed); err != nil {
+		return n, fmt.Errorf("record chain gaps: %w", err)
+	}
+
+	for _, d := range []struct {
+		query string
+		count *int64
+	}{
+		{`DELETE FROM log_block WHERE put IN (SELECT put FROM temp.compact_operation)`, &n.Blocks},
+		{`DELETE FROM log_operation WHERE id IN (SELECT id FROM temp.compact_operation)`, &n.Operations},
+		{`DELETE FROM log_put WHERE id IN (SELECT put FROM temp.compact_operation)`, &n.Puts},
+	} {
+		r, err := tx.Exec(d.query)
+		if err != nil {
+			return n, err
+		}
+		if *d.count, err = r.RowsAffected(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// recordGaps records the compaction of a tree removing the given number of
+// operations, those in temp.compact_operation, and the hash preceding each
+// retained operation whose predecessor is removed. The gaps of removed
+// operations are merged into those following them.
+func recordGaps(tx *sql.Tx, root int64, removed int64) error {
+	r, err := tx.Exec(
+		`INSERT INTO log_compaction (root, head, removed)
+		VALUES (?, (SELECT max(id) FROM log_operation WHERE root = ?), ?)`,
+		root,
+		root,
+		removed,
+	)
+	if err != nil {
+		return err
+	}
+	cid, err := r.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	rs, err := tx.Query(
+		`SELECT o.id, o.hash, c.id IS NOT NULL, coalesce(g.removed, 0)
+		FROM log_operation o
+		LEFT JOIN temp.compact_operation c ON c.id = o.id
+		LEFT JOIN log_gap g ON g.op = o.id
+		WHERE o.root = ? AND o.id >= (SELECT min(id) FROM temp.compact_operation)
+		ORDER BY o.id`,
+		root,
+	)
+	if err != nil {
+		return err
+	}
+	type gap struct {
+		op      int64
+		prev    []byte
+		removed int64
+	}
+	var gaps []gap
+	var prev []byte
+	var pending int64
+	for rs.Next() {
+		var id, gapped int64
+		var h []byte
+		var gone bool
+		if err := rs.Scan(&id, &h, &gone, &gapped); err != nil {
+			rs.Close()
+			return err
+		}
+		if gone {
+			pending += 1 + gapped
+		} else if pending > 0 {
+			gaps = append(gaps, gap{id, prev, pending + gapped})
+			pending = 0
+		}
+		prev = h
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range gaps {
+		_, err := tx.Exec(
+			`INSERT INTO log_gap (op, prev, compaction, removed) VALUES (?, ?, ?, ?)
+			ON CONFLICT (op) DO UPDATE SET
+				prev = excluded.prev,
+				compaction = excluded.compaction,
+				removed = excluded.removed`,
+			g.op,
+			g.prev,
+			cid,
+			g.removed,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM log_gap WHERE op IN (SELECT id FROM temp.compact_operation)`)
+
+	return err
+}
+
+// RunCompaction compacts the log at every interval until ctx is done, logging
+// what was reclaimed.
+func (s State) RunCompaction(ctx context.Context, interval time.Duration, r Retention, log *slog.Logger) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var total Reclaimed
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := s.Compact(ctx, r)
+		if err != nil {
+			log.ErrorContext(ctx, "compaction failed", "err", err)
+			continue
+		}
+		total.add(n)
+		log.InfoContext(
+			ctx,
+			"compacted log",
+			"operations", n.Operations,
+			"puts", n.Puts,
+			"blocks", n.Blocks,
+			"total_operations", total.Operations,
+			"total_puts", total.Puts,
+			"total_blocks", total.Blocks,
+		)
+	}
+}
@@ -5,21 +5,33 @@ import (
 	"fmt"
 
 	"upspin.io/path"
+	"upspin.io/upspin"
 )
 
 // Delete implements dirserver.State.
 func (s State) Delete(ctx context.Context, p path.Parsed) error {
+	return s.DeleteAt(ctx, p, 0)
+}
+
+// DeleteAt implements state.TimedDeleter.
+func (s State) DeleteAt(ctx context.Context, p path.Parsed, t upspin.Time) error {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("begin transaction for Delete: %w", err)
 	}
 
-	if _, err := s.appendOp(tx, p, -1); err != nil {
+	seq, err := nextSeq(tx, p)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("compute sequence: %w", err)
+	}
+
+	if _, err := s.appendOp(tx, p, nil, -1, seq, 0, t); err != nil {
 		tx.Rollback()
 		return fmt.Errorf("persist delete to log: %w", err)
 	}
 
-	if err := projDelete(tx, p); err != nil {
+	if err := projDelete(tx, p, seq); err != nil {
 		tx.Rollback()
 		return fmt.Errorf("delete cache entry: %w", err)
 	}
@@ -0,0 +1,533 @@
+package sqlite
+
+// Provides a consistency checker for the database. The log tables are the
+// source of truth, so the projection is checked against a replay of the log,
+// and repairs only ever rewrite the projection. The log is append-only, so log
+// rows unreachable from any operation are reported but never removed.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/access"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// ProblemKind classifies an inconsistency found by Fsck.
+type ProblemKind int
+
+const (
+	// A projected entry references a deletion operation.
+	NullPut ProblemKind = iota
+	// A projected entry has an ancestor that is not in the projection.
+	MissingAncestor
+	// A projected entry has an ancestor that is a regular file.
+	FileAncestor
+	// A projected entry has an ancestor that is a link.
+	LinkAncestor
+	// A sequence in the log or projection does not follow the rules of
+	// projUpdateSeq.
+	BadSequence
+	// A projected entry differs from the one obtained by replaying the log.
+	StaleEntry
+	// A log_put record is not referenced by any operation.
+	OrphanPut
+	// A log_block record does not belong to a put referenced by any
+	// operation.
+	OrphanBlock
+	// An Access file can not be retrieved or parsed.
+	BadAccess
+	// A Group file can not be retrieved or parsed.
+	BadGroup
+	// An operation's hash does not match its contents and the hash
+	// preceding it in the chain of its tree.
+	BadHash
+	// A gap in the hash chain of a tree is not accounted for by its
+	// compactions.
+	BadGap
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case NullPut:
+		return "null put"
+	case MissingAncestor:
+		return "missing ancestor"
+	case FileAncestor:
+		return "file ancestor"
+	case LinkAncestor:
+		return "link ancestor"
+	case BadSequence:
+		return "bad sequence"
+	case StaleEntry:
+		return "stale entry"
+	case OrphanPut:
+		return "orphaned put"
+	case OrphanBlock:
+		return "orphaned block"
+	case BadAccess:
+		return "bad access file"
+	case BadGroup:
+		return "bad group file"
+	case BadHash:
+		return "bad hash"
+	case BadGap:
+		return "bad gap"
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// Problem describes a single inconsistency found by Fsck.
+type Problem struct {
+	Kind ProblemKind
+	// The path the problem was found at, if any.
+	Name upspin.PathName
+	// The log record involved, if any; for orphaned log_block records this is
+	// the id of the log_put the block refers to.
+	Id     int64
+	Detail string
+	// Whether the problem was fixed by a repair.
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := p.Kind.String()
+	if p.Name != "" {
+		s = string(p.Name) + ": " + s
+	} else {
+		s = fmt.Sprintf("%s %d", s, p.Id)
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// projRow is a proj_entry record, joined with the attributes of its put.
+type projRow struct {
+	op     int64
+	put    int64
+	seq    int64
+	parent int64
+	attr   upspin.Attribute
+	// Whether the referenced operation is a deletion.
+	null bool
+}
+
+// Fsck checks the consistency of the log and the projection, and verifies the
+// hash chain of every tree. If c is not nil, every Access and Group file in the
+// projection is retrieved and parsed through it. If repair is true, projection
+// entries that differ from a replay of the log are rewritten; problems that
+// were fixed are marked as such. Problems with the log itself, including
+// orphaned log records, or with file contents can not be repaired.
+func (s State) Fsck(ctx context.Context, c state.Cache, repair bool) ([]Problem, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: !repair})
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Fsck: begin transaction: %w", err)
+	}
+
+	ps, files, err := fsck(tx, repair)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("sqlite.Fsck: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("sqlite.Fsck: commit: %w", err)
+	}
+
+	if c == nil {
+		return ps, nil
+	}
+
+	// Retrieving file contents may involve remote calls, so is done outside
+	// of the transaction.
+	for _, name := range files {
+		e, err := s.Lookup(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite.Fsck: %w", err)
+		} else if e == nil {
+			// Deleted since the transaction committed.
+			continue
+		}
+
+		if access.IsAccessFile(name) {
+			if _, err := c.GetAccess(ctx, e); err != nil {
+				ps = append(ps, Problem{Kind: BadAccess, Name: name, Detail: err.Error()})
+			}
+			continue
+		}
+
+		p, _ := path.Parse(name)
+		g, err := c.GetGroup(ctx, name)
+		if err == nil {
+			_, err = access.ParseGroup(p, g)
+		}
+		if err != nil {
+			ps = append(ps, Problem{Kind: BadGroup, Name: name, Detail: err.Error()})
+		}
+	}
+
+	return ps, nil
+}
+
+// fsck performs all checks that only involve the database, repairing the
+// projection if requested. It returns the problems found along with the names
+// of all Access and Group files in the projection.
+func fsck(tx *sql.Tx, repair bool) ([]Problem, []upspin.PathName, error) {
+	ps, files, fix, err := check(tx)
+	if err != nil || !repair {
+		return ps, files, err
+	}
+
+	if err := fix.rebuild(tx); err != nil {
+		return nil, nil, fmt.Errorf("rebuild projection: %w", err)
+	}
+	if err := projRehash(tx); err != nil {
+		return nil, nil, fmt.Errorf("rehash projection: %w", err)
+	}
+
+	// Problems that persist after the rebuild originate in the log.
+	after, _, _, err := check(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	type key struct {
+		kind ProblemKind
+		name upspin.PathName
+		id   int64
+	}
+	remaining := make(map[key]bool)
+	for _, p := range after {
+		remaining[key{p.Kind, p.Name, p.Id}] = true
+	}
+	for i, p := range ps {
+		ps[i].Repaired = !remaining[key{p.Kind, p.Name, p.Id}]
+	}
+
+	return ps, files, nil
+}
+
+// projFix records what is needed to bring the projection in line with the
+// log.
+type projFix struct {
+	proj, expect map[upspin.PathName]projRow
+	stale        map[upspin.PathName]bool
+}
+
+func check(tx *sql.Tx) ([]Problem, []upspin.PathName, projFix, error) {
+	proj, err := loadProj(tx)
+	if err != nil {
+		return nil, nil, projFix{}, err
+	}
+
+	var ps []Problem
+	var files []upspin.PathName
+	names := sortedNames(proj)
+	for _, name := range names {
+		r := proj[name]
+		if r.null {
+			ps = append(ps, Problem{Kind: NullPut, Name: name, Id: r.op})
+		}
+
+		p, err := path.Parse(name)
+		if err != nil {
+			ps = append(ps, Problem{Kind: StaleEntry, Name: name, Detail: err.Error()})
+			continue
+		}
+		if r.attr == upspin.AttrNone && !r.null && access.IsAccessControlFile(name) {
+			files = append(files, name)
+		}
+
+		for i := 0; i < p.NElem(); i++ {
+			anc := p.First(i).Path()
+			a, ok := proj[anc]
+			if !ok {
+				ps = append(ps, Problem{Kind: MissingAncestor, Name: name, Detail: string(anc)})
+			} else if a.attr == upspin.AttrLink {
+				ps = append(ps, Problem{Kind: LinkAncestor, Name: name, Detail: string(anc)})
+			} else if a.attr != upspin.AttrDirectory {
+				ps = append(ps, Problem{Kind: FileAncestor, Name: name, Detail: string(anc)})
+			} else if a.seq < r.seq {
+				ps = append(ps, Problem{
+					Kind:   BadSequence,
+					Name:   name,
+					Detail: fmt.Sprintf("sequence %d exceeds that of ancestor %s (%d)", r.seq, anc, a.seq),
+				})
+			}
+		}
+	}
+
+	expect, logPs, err := replay(tx)
+	if err != nil {
+		return nil, nil, projFix{}, err
+	}
+	ps = append(ps, logPs...)
+
+	// Compare the projection against the replayed log.
+	fix := projFix{proj, expect, make(map[upspin.PathName]bool)}
+	for _, name := range names {
+		r := proj[name]
+		e, ok := expect[name]
+		switch {
+		case !ok:
+			ps = append(ps, Problem{Kind: StaleEntry, Name: name, Id: r.op, Detail: "not present in log"})
+		case e.op != r.op:
+			ps = append(ps, Problem{
+				Kind:   StaleEntry,
+				Name:   name,
+				Id:     r.op,
+				Detail: fmt.Sprintf("references operation %d, log has %d", r.op, e.op),
+			})
+		case e.seq != r.seq:
+			ps = append(ps, Problem{
+				Kind:   BadSequence,
+				Name:   name,
+				Id:     r.op,
+				Detail: fmt.Sprintf("sequence %d, log has %d", r.seq, e.seq),
+			})
+		case e.parent != r.parent:
+			ps = append(ps, Problem{
+				Kind:   StaleEntry,
+				Name:   name,
+				Id:     r.op,
+				Detail: fmt.Sprintf("parent %d, log has %d", r.parent, e.parent),
+			})
+		default:
+			continue
+		}
+		fix.stale[name] = true
+	}
+	for _, name := range sortedNames(expect) {
+		if _, ok := proj[name]; !ok {
+			ps = append(ps, Problem{Kind: StaleEntry, Name: name, Id: expect[name].op, Detail: "missing from projection"})
+			fix.stale[name] = true
+		}
+	}
+
+	orphans, err := findOrphans(tx)
+	if err != nil {
+		return nil, nil, projFix{}, err
+	}
+	ps = append(ps, orphans...)
+
+	hashPs, err := verifyHashes(tx, proj)
+	if err != nil {
+		return nil, nil, projFix{}, err
+	}
+	ps = append(ps, hashPs...)
+
+	chainPs, err := verifyChains(tx)
+	if err != nil {
+		return nil, nil, projFix{}, err
+	}
+	ps = append(ps, chainPs...)
+
+	return ps, files, fix, nil
+}
+
+func loadProj(tx *sql.Tx) (map[upspin.PathName]projRow, error) {
+	rs, err := tx.Query(
+		`SELECT e.name, e.op, e.sequence, e.parent, o.put, p.dir, p.link
+		FROM proj_entry e
+		INNER JOIN log_operation o ON e.op = o.id
+		LEFT JOIN log_put p ON o.put = p.id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query projection: %w", err)
+	}
+	defer rs.Close()
+
+	proj := make(map[upspin.PathName]projRow)
+	for rs.Next() {
+		var name string
+		var r projRow
+		var put sql.NullInt64
+		var dir sql.NullBool
+		var link sql.NullString
+		if err := rs.Scan(&name, &r.op, &r.seq, &r.parent, &put, &dir, &link); err != nil {
+			return nil, fmt.Errorf("query projection: %w", err)
+		}
+		r.put = put.Int64
+		r.null = !put.Valid
+		if dir.Bool {
+			r.attr = upspin.AttrDirectory
+		} else if link.Valid {
+			r.attr = upspin.AttrLink
+		}
+		proj[upspin.PathName(name)] = r
+	}
+
+	return proj, rs.Err()
+}
+
+// replay computes the projection from the log, and reports problems with the
+// sequences recorded in the log.
+func replay(tx *sql.Tx) (map[upspin.PathName]projRow, []Problem, error) {
+	rs, err := tx.Query(
+		`SELECT o.id, r.username, o.path, o.sequence, o.put, p.dir, p.link
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		LEFT JOIN log_put p ON o.put = p.id
+		ORDER BY o.id`,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query log: %w", err)
+	}
+	defer rs.Close()
+
+	var ps []Problem
+	expect := make(map[upspin.PathName]projRow)
+	last := make(map[upspin.UserName]int64)
+	for rs.Next() {
+		var user upspin.UserName
+		var fp string
+		var r projRow
+		var put sql.NullInt64
+		var dir sql.NullBool
+		var link sql.NullString
+		if err := rs.Scan(&r.op, &user, &fp, &r.seq, &put, &dir, &link); err != nil {
+			return nil, nil, fmt.Errorf("query log: %w", err)
+		}
+		r.put = put.Int64
+		if dir.Bool {
+			r.attr = upspin.AttrDirectory
+		} else if link.Valid {
+			r.attr = upspin.AttrLink
+		}
+
+		p, err := path.Parse(upspin.PathName(string(user) + "/" + fp))
+		if err != nil {
+			ps = append(ps, Problem{Kind: StaleEntry, Id: r.op, Detail: err.Error()})
+			continue
+		}
+		name := p.Path()
+
+		// Every operation increments the sequence of the root, which starts
+		// at upspin.SeqBase. Compacted logs may skip sequences.
+		if prev, ok := last[user]; ok && r.seq <= prev || !ok && r.seq < upspin.SeqBase {
+			ps = append(ps, Problem{
+				Kind:   BadSequence,
+				Name:   name,
+				Id:     r.op,
+				Detail: fmt.Sprintf("operation sequence %d does not follow %d", r.seq, prev),
+			})
+		}
+		last[user] = r.seq
+
+		if !put.Valid {
+			delete(expect, name)
+		} else if p.IsRoot() {
+			r.parent = r.put
+			expect[name] = r
+		} else if parent, ok := expect[p.Drop(1).Path()]; ok {
+			r.parent = parent.put
+			expect[name] = r
+		} else {
+			ps = append(ps, Problem{Kind: MissingAncestor, Name: name, Id: r.op, Detail: "put without parent in log"})
+		}
+
+		for i := 0; i < p.NElem(); i++ {
+			anc := p.First(i).Path()
+			if a, ok := expect[anc]; ok {
+				a.seq = r.seq
+				expect[anc] = a
+			}
+		}
+	}
+
+	return expect, ps, rs.Err()
+}
+
+func findOrphans(tx *sql.Tx) ([]Problem, error) {
+	var ps []Problem
+
+	rs, err := tx.Query(
+		`SELECT p.id
+		FROM log_put p
+		LEFT JOIN log_operation o ON o.put = p.id
+		WHERE o.id IS NULL`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query orphaned puts: %w", err)
+	}
+	for rs.Next() {
+		p := Problem{Kind: OrphanPut}
+		if err := rs.Scan(&p.Id); err != nil {
+			rs.Close()
+			return nil, fmt.Errorf("query orphaned puts: %w", err)
+		}
+		ps = append(ps, p)
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("query orphaned puts: %w", err)
+	}
+
+	rs, err = tx.Query(
+		`SELECT b.put, b.reference
+		FROM log_block b
+		LEFT JOIN log_operation o ON o.put = b.put
+		WHERE o.id IS NULL`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query orphaned blocks: %w", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		p := Problem{Kind: OrphanBlock}
+		if err := rs.Scan(&p.Id, &p.Detail); err != nil {
+			return nil, fmt.Errorf("query orphaned blocks: %w", err)
+		}
+		ps = append(ps, p)
+	}
+
+	return ps, rs.Err()
+}
+
+// rebuild rewrites the stale projection entries to match the log.
+func (f projFix) rebuild(tx *sql.Tx) error {
+	for name := range f.stale {
+		if _, ok := f.proj[name]; !ok {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM proj_entry WHERE name = ?`, name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedNames(f.expect) {
+		if !f.stale[name] {
+			continue
+		}
+		e := f.expect[name]
+		_, err := tx.Exec(
+			`INSERT INTO proj_entry (name, op, sequence, parent) VALUES (?, ?, ?, ?)`,
+			name,
+			e.op,
+			e.seq,
+			e.parent,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sortedNames(m map[upspin.PathName]projRow) []upspin.PathName {
+	names := make([]upspin.PathName, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
@@ -0,0 +1,118 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"upspin.io/upspin"
+)
+
+// Garbage returns the references to blocks in the store at the given endpoint
+// that are no longer reachable: those not referenced by the current entry of
+// any tree, including snapshots, and not used by any operation at or after
+// the time before. References already collected and not used since are
+// omitted. It also returns the id of the latest operation in the log, to be
+// passed to MarkCollected.
+func (s State) Garbage(ctx context.Context, store upspin.Endpoint, before upspin.Time) ([]upspin.Reference, int64, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, 0, fmt.Errorf("sqlite.Garbage: begin transaction: %w", err)
+	}
+	defer tx.Commit()
+
+	var head int64
+	if err := tx.QueryRow(`SELECT coalesce(max(id), 0) FROM log_operation`).Scan(&head); err != nil {
+		return nil, 0, fmt.Errorf("sqlite.Garbage: %w", err)
+	}
+
+	// Blocks are used by the operations in the log, and by those removed by
+	// compaction. Uses are ordered by operation id, as timestamps only have
+	// a resolution of seconds.
+	rs, err := tx.Query(
+		`WITH used (reference, timestamp, op) AS (
+			SELECT b.reference, o.timestamp, o.id
+			FROM log_block b
+			INNER JOIN log_operation o ON o.put = b.put
+			WHERE b.endpoint = ?
+			UNION ALL
+			SELECT reference, timestamp, op
+			FROM gc_released
+			WHERE endpoint = ?
+		)
+		SELECT u.reference
+		FROM used u
+		LEFT JOIN gc_deleted d ON d.endpoint = ? AND d.reference = u.reference
+		GROUP BY u.reference
+		HAVING MAX(u.timestamp) < ?
+			AND (MAX(d.op) IS NULL OR MAX(d.op) < MAX(u.op))
+			AND u.reference NOT IN (
+				SELECT pb.reference
+				FROM proj_entry e
+				INNER JOIN log_operation po ON e.op = po.id
+				INNER JOIN log_block pb ON pb.put = po.put
+				WHERE pb.endpoint = ?
+			)
+		ORDER BY u.reference`,
+		store.String(),
+		store.String(),
+		store.String(),
+		before,
+		store.String(),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("sqlite.Garbage: %w", err)
+	}
+	defer rs.Close()
+
+	var refs []upspin.Reference
+	for rs.Next() {
+		var ref upspin.Reference
+		if err := rs.Scan(&ref); err != nil {
+			return nil, 0, fmt.Errorf("sqlite.Garbage: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, 0, fmt.Errorf("sqlite.Garbage: %w", err)
+	}
+
+	return refs, head, nil
+}
+
+// MarkCollected records that blocks in the store at the given endpoint were
+// deleted, so that Garbage no longer returns them unless used by an operation
+// following head, as returned by Garbage along with them, and forgets those
+// released by compaction.
+func (s State) MarkCollected(ctx context.Context, store upspin.Endpoint, refs []upspin.Reference, head int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite.MarkCollected: begin transaction: %w", err)
+	}
+
+	for _, ref := range refs {
+		_, err := tx.Exec(
+			`INSERT INTO gc_deleted (endpoint, reference, op) VALUES (?, ?, ?)
+			ON CONFLICT DO UPDATE SET timestamp = excluded.timestamp, op = excluded.op`,
+			store.String(),
+			ref,
+			head,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite.MarkCollected(%s): %w", ref, err)
+		}
+
+		_, err = tx.Exec(
+			`DELETE FROM gc_released WHERE endpoint = ? AND reference = ?`,
+			store.String(),
+			ref,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite.MarkCollected(%s): %w", ref, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,84 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// RecordAccessProblem implements state.Health. The time the problem was first
+// recorded is kept while it concerns the same version of the file.
+func (s State) RecordAccessProblem(ctx context.Context, p state.AccessProblem) error {
+	parsed, err := path.Parse(p.Name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(
+		ctx,
+		`INSERT INTO access_health (name, username, sequence, malformed, error, first, last)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			first = CASE WHEN sequence = excluded.sequence THEN first ELSE excluded.first END,
+			sequence = excluded.sequence,
+			malformed = excluded.malformed,
+			error = excluded.error,
+			last = excluded.last`,
+		parsed.Path(),
+		parsed.User(),
+		p.Sequence,
+		p.Malformed,
+		p.Err,
+		p.First,
+		p.Last,
+	)
+	if err != nil {
+		return fmt.Errorf("sqlite.RecordAccessProblem(%s): %w", p.Name, err)
+	}
+
+	return nil
+}
+
+// ClearAccessProblem implements state.Health.
+func (s State) ClearAccessProblem(ctx context.Context, name upspin.PathName) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM access_health WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("sqlite.ClearAccessProblem(%s): %w", name, err)
+	}
+
+	return nil
+}
+
+// AccessProblems implements state.Health.
+func (s State) AccessProblems(ctx context.Context, user upspin.UserName) ([]state.AccessProblem, error) {
+	rs, err := s.db.QueryContext(
+		ctx,
+		`SELECT h.name, h.sequence, h.malformed, h.error, h.first, h.last
+		FROM access_health h
+		INNER JOIN proj_entry e ON e.name = h.name AND e.sequence = h.sequence
+		WHERE ? = '' OR h.username = ?
+		ORDER BY h.name`,
+		user,
+		user,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.AccessProblems(%s): %w", user, err)
+	}
+	defer rs.Close()
+
+	var ps []state.AccessProblem
+	for rs.Next() {
+		var p state.AccessProblem
+		if err := rs.Scan(&p.Name, &p.Sequence, &p.Malformed, &p.Err, &p.First, &p.Last); err != nil {
+			return nil, fmt.Errorf("sqlite.AccessProblems(%s): %w", user, err)
+		}
+		ps = append(ps, p)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite.AccessProblems(%s): %w", user, err)
+	}
+
+	return ps, nil
+}
@@ -0,0 +1,92 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Versions implements state.History.
+func (s State) Versions(ctx context.Context, name upspin.PathName) ([]state.Version, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := s.db.QueryContext(
+		ctx,
+		`SELECT `+opColumns+`
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		LEFT JOIN log_put p ON o.put = p.id
+		WHERE r.username = ? AND o.path = ?
+		ORDER BY o.id`,
+		p.User(),
+		p.FilePath(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Versions(%s): %w", name, err)
+	}
+	defer rs.Close()
+
+	var vs []state.Version
+	for rs.Next() {
+		op, _, err := scanOp(rs, p.User())
+		if err != nil {
+			return nil, fmt.Errorf("sqlite.Versions(%s): %w", name, err)
+		}
+
+		v := state.Version{Id: op.Id, Time: op.Time, Sequence: op.Sequence, Deleted: op.Entry == nil}
+		if op.Entry != nil {
+			v.Writer = op.Entry.Writer
+		}
+		vs = append(vs, v)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite.Versions(%s): %w", name, err)
+	}
+
+	return vs, nil
+}
+
+// Version implements state.History.
+func (s State) Version(ctx context.Context, name upspin.PathName, id int64) (*upspin.DirEntry, error) {
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Version(%s, %d): begin transaction: %w", name, id, err)
+	}
+	defer tx.Commit()
+
+	op, pid, err := scanOp(tx.QueryRow(
+		`SELECT `+opColumns+`
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE o.id = ? AND r.username = ? AND o.path = ?`,
+		id,
+		p.User(),
+		p.FilePath(),
+	), p.User())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("sqlite.Version(%s, %d): %w", name, id, err)
+	}
+
+	if op.Entry.IsRegular() {
+		if op.Entry.Blocks, err = getBlocks(tx, pid); err != nil {
+			return nil, fmt.Errorf("sqlite.Version(%s, %d): %w", name, id, err)
+		}
+	}
+
+	return op.Entry, nil
+}
@@ -6,65 +6,150 @@ import (
 	"fmt"
 
 	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
 	"upspin.io/upspin"
 )
 
-func (s State) List(ctx context.Context, eid state.EntryId) ([]*upspin.DirEntry, error) {
+// List implements state.State. Entries are ordered by name.
+//
+// If the directory version is the one projected, and its sequence is current,
+// its subtree is unchanged since and the children are those projected.
+// Otherwise, the children of the directory version are the latest operations
+// on each path directly under it that were applied after the directory was
+// put, and up to its sequence; those that are puts are listed. The sequence of
+// each child is that of the latest operation in its subtree within the same
+// range.
+func (s State) List(ctx context.Context, ent state.Entry) ([]state.Entry, error) {
+	name := ent.Path.Path()
+	if ent.Attr != upspin.AttrDirectory {
+		return nil, nil
+	}
+
 	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		return nil, fmt.Errorf("sqlite.List(%d): begin transaction: %w", eid, err)
+		return nil, fmt.Errorf("sqlite.List(%s): begin transaction: %w", name, err)
 	}
+	defer tx.Commit()
 
+	op, seq, _, err := getAttr(tx, name)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.List(%s): %w", name, err)
+	}
+	var ents []state.Entry
+	if op == ent.Id && seq == ent.Seq {
+		ents, err = listProj(tx, ent)
+	} else {
+		ents, err = listLog(tx, ent)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.List(%s): %w", name, err)
+	}
+
+	return ents, nil
+}
+
+// listProj lists the children of a projected directory.
+func listProj(tx *sql.Tx, ent state.Entry) ([]state.Entry, error) {
+	// The root directory is its own parent.
 	rs, err := tx.Query(
-		`SELECT
-			e.name, e.sequence, o.timestamp, p.writer, p.dir, p.link, p.packing, p.packdata
+		`SELECT e.name, e.op, e.sequence, p.dir, p.link
 		FROM proj_entry e
 		INNER JOIN log_operation o ON e.op = o.id
 		INNER JOIN log_put p ON o.put = p.id
-		WHERE e.parent = ?`,
-		eid,
+		WHERE e.parent = (SELECT put FROM log_operation WHERE id = ?) AND e.name != ?
+		ORDER BY e.name`,
+		ent.Id,
+		ent.Path.Path(),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("sqlite.List(%d): query: %w", eid, err)
+		return nil, fmt.Errorf("query: %w", err)
 	}
 	defer rs.Close()
 
+	var ents []state.Entry
 	for rs.Next() {
-
+		var name upspin.PathName
+		var c state.Entry
+		var dir bool
+		var link sql.NullString
+		if err := rs.Scan(&name, &c.Id, &c.Seq, &dir, &link); err != nil {
+			return nil, err
+		}
+		if c.Path, err = path.Parse(name); err != nil {
+			return nil, err
+		}
+		if dir {
+			c.Attr = upspin.AttrDirectory
+		} else if link.Valid {
+			c.Attr = upspin.AttrLink
+		}
+		ents = append(ents, c)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("sqlite.List(%d): commit: %w", eid, err)
+	return ents, rs.Err()
+}
+
+// listLog lists the children of a directory version from the log. Only the
+// operations in its subtree are read.
+func listLog(tx *sql.Tx, ent state.Entry) ([]state.Entry, error) {
+	// Paths in the log are relative to the root directory.
+	prefix := ent.Path.FilePath()
+	if !ent.Path.IsRoot() {
+		prefix += "/"
 	}
 
-	return nil, nil
-}
+	var root int64
+	if err := tx.QueryRow(`SELECT id FROM log_root WHERE username = ?`, ent.Path.User()).Scan(&root); err != nil {
+		return nil, fmt.Errorf("find root: %w", err)
+	}
 
-func scanEntry(rs *sql.Rows) (*upspin.DirEntry, error) {
-	e := &upspin.DirEntry{}
-	var name string
-	var dir bool
-	var link sql.NullString
-	var packing sql.NullByte
-	var packdata []byte
-	if err := rs.Scan(&name, &e.Sequence, &e.Time, &e.Writer, &dir, &link, &packing, &packdata); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("querying DirEntry: %w", err)
+	// Paths under a prefix sort between it and the prefix followed by 0xff,
+	// which can not occur in a path, so the ranges below are indexed. The
+	// unary + keeps the id from being preferred to the range, as in a large
+	// log most operations follow those of a directory's version.
+	rs, err := tx.Query(
+		`SELECT `+opColumns+`, (
+			SELECT max(d.sequence)
+			FROM log_operation d
+			WHERE d.root = o.root AND d.path >= o.path AND d.path < o.path || x'ff'
+				AND d.id >= o.id AND d.sequence <= ?1
+				AND (d.path = o.path OR substr(d.path, 1, length(o.path) + 1) = o.path || '/')
+		)
+		FROM log_operation o
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE o.id IN (
+			SELECT max(c.id)
+			FROM log_operation c
+			WHERE c.root = ?2
+				AND c.path > ?4 AND c.path < ?4 || x'ff'
+				AND +c.id > ?3 AND c.sequence <= ?1
+				AND instr(substr(c.path, length(?4) + 1), '/') = 0
+			GROUP BY c.path
+		)
+		ORDER BY o.path`,
+		ent.Seq,
+		root,
+		ent.Id,
+		prefix,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
 	}
+	defer rs.Close()
 
-	e.Name = upspin.PathName(name)
-	e.SignedName = e.Name
-	if dir {
-		e.Attr = upspin.AttrDirectory
-	} else if link.Valid {
-		e.Attr = upspin.AttrLink
-		e.Link = upspin.PathName(link.String)
-	} else {
-		e.Packing = upspin.Packing(packing.Byte)
-		e.Packdata = packdata
+	var ents []state.Entry
+	for rs.Next() {
+		var seq int64
+		op, _, err := scanOp(rs, ent.Path.User(), &seq)
+		if err != nil {
+			return nil, err
+		}
+		p, err := path.Parse(op.Name)
+		if err != nil {
+			return nil, err
+		}
+		ents = append(ents, state.Entry{Path: p, Attr: op.Entry.Attr, Seq: seq, Id: op.Id})
 	}
 
-	return e, nil
+	return ents, rs.Err()
 }
@@ -10,27 +10,24 @@ import (
 	"upspin.io/upspin"
 )
 
-func (s State) LookupElem(ctx context.Context, p path.Parsed) (state.EntryId, path.Parsed, upspin.Attribute, error) {
+// LookupElem implements state.State.
+func (s State) LookupElem(ctx context.Context, p path.Parsed) (state.Entry, error) {
 	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		return -1, path.Parsed{}, 0, fmt.Errorf("sqlite.LookupElem(%s): begin transaction: %w", p, err)
+		return state.Entry{}, fmt.Errorf("sqlite.LookupElem(%s): begin transaction: %w", p, err)
 	}
 
-	eid := state.EntryId(-1)
-	var ep path.Parsed
-	var attr upspin.Attribute
+	var ent state.Entry
 	for i := 0; i <= p.NElem(); i++ {
-		id, a, err := getAttr(tx, p.First(i).Path())
+		op, seq, a, err := getAttr(tx, p.First(i).Path())
 		if err != nil {
 			tx.Commit()
-			return -1, path.Parsed{}, 0, err
-		} else if id == -1 {
+			return state.Entry{}, err
+		} else if seq == -1 {
 			break
 		}
 
-		eid = id
-		ep = p.First(i)
-		attr = a
+		ent = state.Entry{Path: p.First(i), Attr: a, Seq: seq, Id: op}
 		if a != upspin.AttrDirectory {
 			// Only continue with lookups if we know there might be a child
 			// element.
@@ -39,30 +36,32 @@ func (s State) LookupElem(ctx context.Context, p path.Parsed) (state.EntryId, pa
 	}
 
 	if err := tx.Commit(); err != nil {
-		return -1, path.Parsed{}, 0, fmt.Errorf("sqlite.LookupElem(%s): commit: %w", p, err)
+		return state.Entry{}, fmt.Errorf("sqlite.LookupElem(%s): commit: %w", p, err)
 	}
 
-	return eid, ep, attr, nil
+	return ent, nil
 }
 
 // LookupAll implements state.State.
-func (s State) LookupAll(ctx context.Context, p path.Parsed) ([]*upspin.DirEntry, error) {
+func (s State) LookupAll(ctx context.Context, p path.Parsed) ([]*upspin.DirEntry, []state.Entry, error) {
 	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		return nil, fmt.Errorf("begin transaction for LookupAll(%s): %w", p, err)
+		return nil, nil, fmt.Errorf("begin transaction for LookupAll(%s): %w", p, err)
 	}
 
 	es := make([]*upspin.DirEntry, 0, p.NElem())
+	ents := make([]state.Entry, 0, p.NElem())
 	for i := 0; i <= p.NElem(); i++ {
-		e, err := get(tx, p.First(i).Path())
+		e, _, op, err := get(tx, p.First(i).Path())
 		if err != nil {
 			tx.Commit()
-			return nil, err
+			return nil, nil, err
 		} else if e == nil {
 			break
 		}
 
 		es = append(es, e)
+		ents = append(ents, state.Entry{Path: p.First(i), Attr: e.Attr, Seq: e.Sequence, Id: op})
 
 		if e.IsLink() {
 			break
@@ -70,10 +69,10 @@ func (s State) LookupAll(ctx context.Context, p path.Parsed) ([]*upspin.DirEntry
 	}
 
 	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("committing for LookupAll(%s): %w", p, err)
+		return nil, nil, fmt.Errorf("committing for LookupAll(%s): %w", p, err)
 	}
 
-	return es, nil
+	return es, ents, nil
 }
 
 // Lookup implements state.State.
@@ -83,12 +82,17 @@ func (s State) Lookup(ctx context.Context, name upspin.PathName) (*upspin.DirEnt
 		return nil, fmt.Errorf("begin transaction for Lookup(%s): %w", name, err)
 	}
 
-	e, err := get(tx, name)
+	e, pid, _, err := get(tx, name)
 	if err != nil {
 		tx.Commit()
 		return nil, err
 	}
-	// TODO get blocks
+	if e != nil && e.IsRegular() {
+		if e.Blocks, err = getBlocks(tx, pid); err != nil {
+			tx.Commit()
+			return nil, err
+		}
+	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("committing for Lookup(%s): %w", name, err)
@@ -97,10 +101,12 @@ func (s State) Lookup(ctx context.Context, name upspin.PathName) (*upspin.DirEnt
 	return e, nil
 }
 
-func get(tx *sql.Tx, name upspin.PathName) (*upspin.DirEntry, error) {
+// get retrieves the projected entry at name, without blocks, along with the ids
+// of its log_put and log_operation records.
+func get(tx *sql.Tx, name upspin.PathName) (*upspin.DirEntry, int64, int64, error) {
 	r := tx.QueryRow(
 		`SELECT
-			e.sequence, o.timestamp, p.writer, p.dir, p.link, p.packing, p.packdata
+			o.id, p.id, e.sequence, o.time, p.writer, p.dir, p.link, p.packing, p.packdata
 		FROM proj_entry e
 		INNER JOIN log_operation o ON e.op = o.id
 		INNER JOIN log_put p ON o.put = p.id
@@ -112,15 +118,16 @@ func get(tx *sql.Tx, name upspin.PathName) (*upspin.DirEntry, error) {
 		Name:       name,
 		SignedName: name,
 	}
+	var op, pid int64
 	var dir bool
 	var link sql.NullString
 	var packing sql.NullByte
 	var packdata []byte
-	if err := r.Scan(&e.Sequence, &e.Time, &e.Writer, &dir, &link, &packing, &packdata); err != nil {
+	if err := r.Scan(&op, &pid, &e.Sequence, &e.Time, &e.Writer, &dir, &link, &packing, &packdata); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil
+			return nil, -1, -1, nil
 		}
-		return nil, fmt.Errorf("querying DirEntry: %w", err)
+		return nil, -1, -1, fmt.Errorf("querying DirEntry: %w", err)
 	}
 	if dir {
 		e.Attr = upspin.AttrDirectory
@@ -132,12 +139,46 @@ func get(tx *sql.Tx, name upspin.PathName) (*upspin.DirEntry, error) {
 		e.Packdata = packdata
 	}
 
-	return e, nil
+	return e, pid, op, nil
+}
+
+// getBlocks retrieves the blocks belonging to a log_put record, in order.
+func getBlocks(tx *sql.Tx, pid int64) ([]upspin.DirBlock, error) {
+	rs, err := tx.Query(
+		`SELECT endpoint, reference, offset, size, packdata
+		FROM log_block
+		WHERE put = ?
+		ORDER BY offset`,
+		pid,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying blocks: %w", err)
+	}
+	defer rs.Close()
+
+	var bs []upspin.DirBlock
+	for rs.Next() {
+		var b upspin.DirBlock
+		var ep string
+		if err := rs.Scan(&ep, &b.Location.Reference, &b.Offset, &b.Size, &b.Packdata); err != nil {
+			return nil, fmt.Errorf("querying block: %w", err)
+		}
+		e, err := upspin.ParseEndpoint(ep)
+		if err != nil {
+			return nil, fmt.Errorf("block %s: %w", b.Location.Reference, err)
+		}
+		b.Location.Endpoint = *e
+		bs = append(bs, b)
+	}
+
+	return bs, rs.Err()
 }
 
-func getAttr(tx *sql.Tx, name upspin.PathName) (state.EntryId, upspin.Attribute, error) {
+// getAttr returns the operation id, sequence and attribute of the projected
+// entry at name, or a negative sequence if it does not exist.
+func getAttr(tx *sql.Tx, name upspin.PathName) (int64, int64, upspin.Attribute, error) {
 	r := tx.QueryRow(
-		`SELECT p.id, p.dir, p.link
+		`SELECT e.op, e.sequence, p.dir, p.link
 		FROM proj_entry e
 		INNER JOIN log_operation o ON e.op = o.id
 		INNER JOIN log_put p ON o.put = p.id
@@ -145,14 +186,14 @@ func getAttr(tx *sql.Tx, name upspin.PathName) (state.EntryId, upspin.Attribute,
 		name,
 	)
 
-	var eid state.EntryId
+	var op, seq int64
 	var dir bool
 	var link sql.NullString
-	if err := r.Scan(&eid, &dir, &link); err != nil {
+	if err := r.Scan(&op, &seq, &dir, &link); err != nil {
 		if err == sql.ErrNoRows {
-			return -1, 0, nil
+			return -1, -1, 0, nil
 		}
-		return -1, 0, fmt.Errorf("querying entry: %w", err)
+		return -1, -1, 0, fmt.Errorf("querying entry: %w", err)
 	}
 
 	attr := upspin.AttrNone
@@ -162,9 +203,36 @@ func getAttr(tx *sql.Tx, name upspin.PathName) (state.EntryId, upspin.Attribute,
 		attr = upspin.AttrLink
 	}
 
-	return eid, attr, nil
+	return op, seq, attr, nil
 }
 
-func (s State) getEntry(eid state.EntryId) (*upspin.DirEntry, error) {
-	return nil, nil
+// Get implements state.State.
+func (s State) Get(ctx context.Context, ent state.Entry) (*upspin.DirEntry, error) {
+	name := ent.Path.Path()
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Get(%s): begin transaction: %w", name, err)
+	}
+	defer tx.Commit()
+
+	op, pid, err := scanOp(tx.QueryRow(
+		`SELECT `+opColumns+`
+		FROM log_operation o
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE o.id = ?`,
+		ent.Id,
+	), ent.Path.User())
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Get(%s): operation %d: %w", name, ent.Id, err)
+	}
+
+	e := op.Entry
+	e.Sequence = ent.Seq
+	if e.IsRegular() {
+		if e.Blocks, err = getBlocks(tx, pid); err != nil {
+			return nil, fmt.Errorf("sqlite.Get(%s): %w", name, err)
+		}
+	}
+
+	return e, nil
 }
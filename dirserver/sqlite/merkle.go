@@ -0,0 +1,253 @@
+package sqlite
+
+// Maintains the Merkle tree defined by state.Tree over the projection. Every
+// projected entry carries its hash and, for directories, the sum of the hashes
+// of its children.
+//
+// The hashes are updated along the ancestor path of every put or delete, like
+// sequences are by projUpdateSeq, each from the sum of its children updated
+// with the old and new hash of the one that changed.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Node implements state.Tree. The hash of a root directory identifies its
+// entire tree.
+func (s State) Node(ctx context.Context, name upspin.PathName) (state.Node, error) {
+	n := state.Node{Name: name}
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT p.dir, e.hash
+		FROM proj_entry e
+		INNER JOIN log_operation o ON e.op = o.id
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE e.name = ?`,
+		name,
+	).Scan(&n.Dir, &n.Hash)
+	if err == sql.ErrNoRows {
+		return n, nil
+	} else if err != nil {
+		return n, fmt.Errorf("sqlite.Node(%s): %w", name, err)
+	}
+
+	return n, nil
+}
+
+// Children implements state.Tree.
+func (s State) Children(ctx context.Context, name upspin.PathName) ([]state.Node, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Children(%s): begin transaction: %w", name, err)
+	}
+	defer tx.Commit()
+
+	ns, err := children(tx, name)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Children(%s): %w", name, err)
+	}
+
+	return ns, nil
+}
+
+// children returns the nodes of the entries in the directory at name, ordered
+// by name.
+func children(tx *sql.Tx, name upspin.PathName) ([]state.Node, error) {
+	// The root directory is its own parent.
+	rs, err := tx.Query(
+		`SELECT e.name, p.dir, e.hash
+		FROM proj_entry e
+		INNER JOIN log_operation o ON e.op = o.id
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE e.parent = (
+			SELECT po.put
+			FROM proj_entry pe
+			INNER JOIN log_operation po ON pe.op = po.id
+			WHERE pe.name = ?
+		) AND e.name != ?
+		ORDER BY e.name`,
+		name,
+		name,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query children: %w", err)
+	}
+	defer rs.Close()
+
+	var ns []state.Node
+	for rs.Next() {
+		var n state.Node
+		if err := rs.Scan(&n.Name, &n.Dir, &n.Hash); err != nil {
+			return nil, fmt.Errorf("query children: %w", err)
+		}
+		ns = append(ns, n)
+	}
+
+	return ns, rs.Err()
+}
+
+// entryHash computes the hash of the projected entry at name from its
+// contents and the stored hashes of its children, and the sum of those if it
+// is a directory.
+func entryHash(tx *sql.Tx, name upspin.PathName) ([]byte, state.Sum, error) {
+	e, pid, _, err := get(tx, name)
+	if err != nil {
+		return nil, nil, err
+	} else if e == nil {
+		return nil, nil, fmt.Errorf("hash %s: entry not found", name)
+	}
+
+	var sum state.Sum
+	if e.IsDir() {
+		ns, err := children(tx, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, n := range ns {
+			sum = sum.Add(n.Name, n.Hash)
+		}
+	} else if e.IsRegular() {
+		if e.Blocks, err = getBlocks(tx, pid); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return state.NodeHash(e, sum), sum, nil
+}
+
+// projHash recomputes the stored hash of the projected entry at name, and the
+// sum of its children.
+func projHash(tx *sql.Tx, name upspin.PathName) error {
+	h, sum, err := entryHash(tx, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE proj_entry SET hash = ?, children = ? WHERE name = ?`, h, []byte(sum), name)
+	return err
+}
+
+// projHashPath updates the hashes of the ancestors of the entry at p, whose
+// hash changed from old, nil if it was added, to that stored, if any. All
+// ancestors must exist in the projection.
+func projHashPath(tx *sql.Tx, p path.Parsed, old []byte) error {
+	for i := p.NElem(); i > 0; i-- {
+		name, parent := p.First(i).Path(), p.First(i-1).Path()
+
+		var h []byte
+		err := tx.QueryRow(`SELECT hash FROM proj_entry WHERE name = ?`, name).Scan(&h)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		e, _, _, err := get(tx, parent)
+		if err != nil {
+			return err
+		} else if e == nil {
+			return fmt.Errorf("hash %s: entry not found", parent)
+		}
+		var parentOld, children []byte
+		err = tx.QueryRow(`SELECT hash, children FROM proj_entry WHERE name = ?`, parent).Scan(&parentOld, &children)
+		if err != nil {
+			return err
+		}
+
+		sum := state.Sum(children)
+		if old != nil {
+			sum = sum.Remove(name, old)
+		}
+		if h != nil {
+			sum = sum.Add(name, h)
+		}
+		_, err = tx.Exec(
+			`UPDATE proj_entry SET hash = ?, children = ? WHERE name = ?`,
+			state.NodeHash(e, sum),
+			[]byte(sum),
+			parent,
+		)
+		if err != nil {
+			return err
+		}
+		old = parentOld
+	}
+
+	return nil
+}
+
+// projRehash recomputes the hashes of every entry in the projection.
+func projRehash(tx *sql.Tx) error {
+	rs, err := tx.Query(`SELECT name FROM proj_entry`)
+	if err != nil {
+		return err
+	}
+	var names []upspin.PathName
+	for rs.Next() {
+		var n upspin.PathName
+		if err := rs.Scan(&n); err != nil {
+			rs.Close()
+			return err
+		}
+		names = append(names, n)
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return err
+	}
+
+	// Children have longer names than their parents, so are hashed first.
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, n := range names {
+		if err := projHash(tx, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyHashes reports projected entries whose stored hash does not match
+// their contents and the stored hashes of their children. Entries without a
+// put are skipped, as they are reported separately.
+func verifyHashes(tx *sql.Tx, proj map[upspin.PathName]projRow) ([]Problem, error) {
+	stored := make(map[upspin.PathName][]byte)
+	rs, err := tx.Query(`SELECT name, hash FROM proj_entry`)
+	if err != nil {
+		return nil, fmt.Errorf("query hashes: %w", err)
+	}
+	for rs.Next() {
+		var n upspin.PathName
+		var h []byte
+		if err := rs.Scan(&n, &h); err != nil {
+			rs.Close()
+			return nil, fmt.Errorf("query hashes: %w", err)
+		}
+		stored[n] = h
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("query hashes: %w", err)
+	}
+
+	var ps []Problem
+	for _, name := range sortedNames(proj) {
+		r := proj[name]
+		if r.null {
+			continue
+		}
+		h, _, err := entryHash(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		if string(h) != string(stored[name]) {
+			ps = append(ps, Problem{Kind: StaleEntry, Name: name, Id: r.op, Detail: "hash mismatch"})
+		}
+	}
+
+	return ps, nil
+}
@@ -0,0 +1,112 @@
+package sqlite
+
+// Provides the migrations upgrading databases created with earlier versions of
+// the schema. The schema only creates the tables that are missing, so columns
+// added to existing tables, and the values they must be backfilled with, are
+// added by migrations instead. The number of migrations applied is recorded
+// as the user_version of the database; a new database starts with all of them
+// applied.
+//
+// The store server's table may share the database, but is not versioned.
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"upspin.io/upspin"
+)
+
+// migrations are applied in order to databases whose user_version is lower
+// than their index plus one. Databases created before versions were recorded
+// have a user_version of 0, and the schema of the first release.
+var migrations = []func(*sql.Tx) error{
+	migrateBaseline,
+}
+
+// migrate creates the missing tables and applies the migrations not yet
+// applied to the database.
+func migrate(tx *sql.Tx) error {
+	var existing bool
+	err := tx.QueryRow(
+		`SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'log_operation'`,
+	).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for _, stmt := range strings.Split(schema, ";\n") {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if !existing {
+		version = len(migrations)
+	}
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("migrate to version %d: %w", version+1, err)
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+
+	return err
+}
+
+// migrateBaseline upgrades a database created with the schema of the first
+// release. It adds the root sequences, times and hash chain of the log, and the
+// Merkle hashes of the projection. Block endpoints recorded as network
+// addresses are converted to the form of upspin.Endpoint.String. The tables
+// of compactions and garbage collection did not exist yet, and are created
+// empty by the schema.
+func migrateBaseline(tx *sql.Tx) error {
+	for _, col := range []struct{ table, def string }{
+		{"log_operation", "sequence INTEGER NOT NULL DEFAULT 0"},
+		{"log_operation", "hash BLOB NOT NULL DEFAULT x''"},
+		{"log_operation", "time INTEGER NOT NULL DEFAULT 0"},
+		{"proj_entry", "hash BLOB"},
+		{"proj_entry", "children BLOB"},
+	} {
+		if _, err := tx.Exec(`ALTER TABLE ` + col.table + ` ADD COLUMN ` + col.def); err != nil {
+			return fmt.Errorf("add column to %s: %w", col.table, err)
+		}
+	}
+
+	// Every operation incremented the sequence of its root, and none was
+	// removed, as the log was never compacted.
+	_, err := tx.Exec(
+		`UPDATE log_operation
+		SET sequence = s.n + ?, time = timestamp
+		FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY root ORDER BY id) AS n
+			FROM log_operation
+		) s
+		WHERE s.id = log_operation.id`,
+		upspin.SeqBase-1,
+	)
+	if err != nil {
+		return fmt.Errorf("backfill operations: %w", err)
+	}
+	_, err = tx.Exec(
+		`UPDATE log_block
+		SET endpoint = 'remote,' || endpoint
+		WHERE instr(endpoint, ',') = 0`,
+	)
+	if err != nil {
+		return fmt.Errorf("convert block endpoints: %w", err)
+	}
+
+	if err := rechain(tx); err != nil {
+		return fmt.Errorf("backfill hash chain: %w", err)
+	}
+	if err := projRehash(tx); err != nil {
+		return fmt.Errorf("backfill projection hashes: %w", err)
+	}
+
+	return nil
+}
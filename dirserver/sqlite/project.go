@@ -6,57 +6,112 @@ package sqlite
 
 import (
 	"database/sql"
+	"fmt"
 	"strings"
 
 	"upspin.io/path"
-	"upspin.io/upspin"
 )
 
-// Updates a path in the projection.
-func projPut(tx *sql.Tx, p path.Parsed, op int64) error {
-	var seq int64 = upspin.SeqBase
-
+// Updates a path in the projection. seq is the sequence assigned to the
+// operation op.
+func projPut(tx *sql.Tx, p path.Parsed, op int64, seq int64) error {
 	if !p.IsRoot() {
-		var err error
-		seq, err = projUpdateSeq(tx, p.Drop(1))
-		if err != nil {
+		if err := projUpdateSeq(tx, p.Drop(1), seq); err != nil {
 			return err
 		}
 	}
 
+	var parent *sql.Row
+	if p.IsRoot() {
+		// The root directory is its own parent.
+		parent = tx.QueryRow(
+			`SELECT put
+			FROM log_operation
+			WHERE id = ?`,
+			op,
+		)
+	} else {
+		parent = tx.QueryRow(
+			`SELECT o.put
+			FROM proj_entry e
+			INNER JOIN log_operation o ON e.op = o.id
+			WHERE e.name = ?`,
+			p.Drop(1).Path(),
+		)
+	}
+	var pid int64
+	if err := parent.Scan(&pid); err != nil {
+		return fmt.Errorf("find parent of %s: %w", p, err)
+	}
+	old, err := projStoredHash(tx, p)
+	if err != nil {
+		return err
+	}
+
 	// Upsert the final entry
-	_, err := tx.Exec(
-		`INSERT INTO proj_entry
-		VALUES (?, ?, ?)
+	_, err = tx.Exec(
+		`INSERT INTO proj_entry (name, op, sequence, parent)
+		VALUES (?, ?, ?, ?)
 		ON CONFLICT(name) DO UPDATE SET
 			op = excluded.op,
-			sequence = excluded.sequence`,
+			sequence = excluded.sequence,
+			parent = excluded.parent`,
 		p.Path(),
 		op,
 		seq,
+		pid,
 	)
+	if err != nil {
+		return err
+	}
+	if err := projHash(tx, p.Path()); err != nil {
+		return err
+	}
 
-	return err
+	return projHashPath(tx, p, old)
 }
 
-// Deletes a path from the projection.
-func projDelete(tx *sql.Tx, p path.Parsed) error {
-	_, err := tx.Exec(
+// Deletes a path from the projection. seq is the sequence assigned to the
+// deletion operation.
+func projDelete(tx *sql.Tx, p path.Parsed, seq int64) error {
+	old, err := projStoredHash(tx, p)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
 		`DELETE FROM proj_entry
 		WHERE name = ?`,
 		p.Path(),
 	)
 	if err != nil {
 		return err
+	} else if p.IsRoot() {
+		return nil
 	}
 
-	_, err = projUpdateSeq(tx, p.Drop(1))
-	return err
+	if err := projUpdateSeq(tx, p.Drop(1), seq); err != nil {
+		return err
+	}
+
+	return projHashPath(tx, p, old)
+}
+
+// projStoredHash returns the stored hash of the projected entry at p, or nil
+// if there is none.
+func projStoredHash(tx *sql.Tx, p path.Parsed) ([]byte, error) {
+	var h []byte
+	err := tx.QueryRow(`SELECT hash FROM proj_entry WHERE name = ?`, p.Path()).Scan(&h)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return h, err
 }
 
-// Sets the sequence of all elements in the path to an incremented sequence and
-// returns it. All elements including the root directory must exist in the
-// projection.
+// Sets the sequence of all elements in the path to seq, which must be the
+// incremented sequence of the root directory. All elements including the root
+// directory must exist in the projection.
 //
 // For example, if
 //
@@ -67,19 +122,7 @@ func projDelete(tx *sql.Tx, p path.Parsed) error {
 //
 // See https://pkg.go.dev/upspin.io@v0.1.0/upspin#pkg-constants for a
 // description of sequence numbers.
-func projUpdateSeq(tx *sql.Tx, p path.Parsed) (int64, error) {
-	r := tx.QueryRow(
-		`SELECT sequence
-		FROM proj_entry
-		WHERE name = ?`,
-		p.First(0).Path(),
-	)
-	var seq int64
-	if err := r.Scan(&seq); err != nil {
-		return -1, err
-	}
-	seq++
-
+func projUpdateSeq(tx *sql.Tx, p path.Parsed, seq int64) error {
 	els := make([]any, p.NElem()+1)
 	for i := 0; i < p.NElem()+1; i++ {
 		els[i] = p.First(i).String()
@@ -94,5 +137,5 @@ func projUpdateSeq(tx *sql.Tx, p path.Parsed) (int64, error) {
 		bind...,
 	)
 
-	return seq, err
+	return err
 }
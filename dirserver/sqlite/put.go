@@ -9,7 +9,9 @@ import (
 	"upspin.io/upspin"
 )
 
-// Put implements dirserver.State.
+// Put implements dirserver.State. The entry keeps its Time if set, otherwise it
+// is given the current time; the operation is recorded at the current time
+// regardless.
 func (s State) Put(ctx context.Context, e *upspin.DirEntry) error {
 	p, _ := path.Parse(e.Name)
 	tx, err := s.db.BeginTx(ctx, nil)
@@ -30,32 +32,48 @@ func (s State) Put(ctx context.Context, e *upspin.DirEntry) error {
 		return fmt.Errorf("persist put to log: %w", err)
 	}
 
-	oid, err := s.appendOp(tx, p, pid)
+	seq, err := nextSeq(tx, p)
 	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("compute sequence: %w", err)
+	}
+
+	oid, err := s.appendOp(tx, p, e, pid, seq, 0, e.Time)
+	if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("persist operation to log: %w", err)
 	}
 
-	for _, b := range e.Blocks {
+	if err := appendBlocks(tx, pid, e.Blocks); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := projPut(tx, p, oid, seq); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("caching put: %w", err)
+	}
+	return tx.Commit()
+}
+
+// appendBlocks persists the blocks of the log_put record pid.
+func appendBlocks(tx *sql.Tx, pid int64, bs []upspin.DirBlock) error {
+	for _, b := range bs {
 		_, err := tx.Exec(
 			`INSERT INTO log_block VALUES (?, ?, ?, ?, ?, ?)`,
 			pid,
-			b.Location.Endpoint.NetAddr,
+			b.Location.Endpoint.String(),
 			b.Location.Reference,
 			b.Offset,
 			b.Size,
 			b.Packdata,
 		)
 		if err != nil {
-			tx.Rollback()
 			return fmt.Errorf("persist block %v: %w", b.Location, err)
 		}
 	}
 
-	if err := projPut(tx, p, oid); err != nil {
-		tx.Rollback()
-		return fmt.Errorf("caching put: %w", err)
-	}
-	return tx.Commit()
+	return nil
 }
 
 func appendPut(tx *sql.Tx, e *upspin.DirEntry) (int64, error) {
@@ -0,0 +1,165 @@
+package sqlite
+
+// Supports replicating the log of a primary server into the database of a
+// read-only replica. Operations are applied with the sequence, time and
+// timestamp they were assigned by the primary, such that clients observe the same sequences
+// on either server, and the replica records the primary's id of the last
+// operation it applied to resume from.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Roots returns the users whose trees have operations in the log, ordered by
+// name.
+func (s State) Roots(ctx context.Context) ([]upspin.UserName, error) {
+	rs, err := s.db.QueryContext(ctx, `SELECT username FROM log_root ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Roots: %w", err)
+	}
+	defer rs.Close()
+
+	var us []upspin.UserName
+	for rs.Next() {
+		var u upspin.UserName
+		if err := rs.Scan(&u); err != nil {
+			return nil, fmt.Errorf("sqlite.Roots: %w", err)
+		}
+		us = append(us, u)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite.Roots: %w", err)
+	}
+
+	return us, nil
+}
+
+// Positions returns, for every tree replicated with Apply, the id of the last
+// operation applied from the primary's log.
+func (s State) Positions(ctx context.Context) (map[upspin.UserName]int64, error) {
+	rs, err := s.db.QueryContext(ctx, `SELECT username, op FROM replica_position`)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.Positions: %w", err)
+	}
+	defer rs.Close()
+
+	pos := make(map[upspin.UserName]int64)
+	for rs.Next() {
+		var u upspin.UserName
+		var op int64
+		if err := rs.Scan(&u, &op); err != nil {
+			return nil, fmt.Errorf("sqlite.Positions: %w", err)
+		}
+		pos[u] = op
+	}
+	if err := rs.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite.Positions: %w", err)
+	}
+
+	return pos, nil
+}
+
+// Apply appends an operation read from the log of a primary, as returned by
+// its WalkLog, keeping the operation's sequence, time and timestamp, and
+// records its id
+// as the position of the tree. The sequence must exceed that of the tree.
+//
+// The primary's log may have been compacted, in which case a deletion can
+// refer to a path whose put was removed before the replica observed it; the
+// deletion is then only recorded in the log.
+func (s State) Apply(ctx context.Context, op Operation) error {
+	p, err := path.Parse(op.Name)
+	if err != nil {
+		return fmt.Errorf("sqlite.Apply(%d): %w", op.Id, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite.Apply(%d): begin transaction: %w", op.Id, err)
+	}
+
+	if err := s.apply(tx, p, op); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("sqlite.Apply(%d): %s: %w", op.Id, op.Name, err)
+	}
+
+	return tx.Commit()
+}
+
+func (s State) apply(tx *sql.Tx, p path.Parsed, op Operation) error {
+	if seq, err := nextSeq(tx, p); err != nil {
+		return fmt.Errorf("compute sequence: %w", err)
+	} else if op.Sequence < seq {
+		return fmt.Errorf("sequence %d does not follow %d", op.Sequence, seq-1)
+	}
+
+	_, err := tx.Exec(
+		`INSERT INTO log_root (username) VALUES (?) ON CONFLICT(username) DO NOTHING`,
+		p.User(),
+	)
+	if err != nil {
+		return fmt.Errorf("create root: %w", err)
+	}
+
+	if e := op.Entry; e != nil {
+		pid, err := appendPut(tx, e)
+		if err != nil {
+			return fmt.Errorf("persist put to log: %w", err)
+		}
+		oid, err := s.appendOp(tx, p, e, pid, op.Sequence, op.Timestamp, op.Time)
+		if err != nil {
+			return fmt.Errorf("persist operation to log: %w", err)
+		}
+		if err := appendBlocks(tx, pid, e.Blocks); err != nil {
+			return err
+		}
+		if err := projPut(tx, p, oid, op.Sequence); err != nil {
+			return fmt.Errorf("caching put: %w", err)
+		}
+	} else {
+		if _, err := s.appendOp(tx, p, nil, -1, op.Sequence, op.Timestamp, op.Time); err != nil {
+			return fmt.Errorf("persist delete to log: %w", err)
+		}
+		if err := applyDelete(tx, p, op.Sequence); err != nil {
+			return fmt.Errorf("delete cache entry: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO replica_position (username, op) VALUES (?, ?)
+		ON CONFLICT(username) DO UPDATE SET op = excluded.op`,
+		p.User(),
+		op.Id,
+	)
+	if err != nil {
+		return fmt.Errorf("record position: %w", err)
+	}
+
+	return nil
+}
+
+// applyDelete removes a path from the projection like projDelete, but only
+// updates those ancestors that exist.
+func applyDelete(tx *sql.Tx, p path.Parsed, seq int64) error {
+	if op, _, _, err := getAttr(tx, p.Path()); err != nil {
+		return err
+	} else if op >= 0 {
+		return projDelete(tx, p, seq)
+	}
+
+	for i := p.NElem() - 1; i >= 0; i-- {
+		if op, _, _, err := getAttr(tx, p.First(i).Path()); err != nil {
+			return err
+		} else if op >= 0 {
+			// Nothing was removed, so no hashes change.
+			return projUpdateSeq(tx, p.First(i), seq)
+		}
+	}
+
+	return nil
+}
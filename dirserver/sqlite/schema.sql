@@ -2,12 +2,12 @@
 -- immutable. They serve as the source-of-truth for the state of each user tree
 -- managed by this server.
 
-CREATE TABLE log_root (
+CREATE TABLE IF NOT EXISTS log_root (
 	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
 	username TEXT UNIQUE NOT NULL
 );
 
-CREATE TABLE log_put (
+CREATE TABLE IF NOT EXISTS log_put (
 	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
 	writer TEXT NOT NULL,
 	-- If true, the below fields are not present
@@ -18,18 +18,31 @@ CREATE TABLE log_put (
 	packdata BLOB
 );
 
-CREATE TABLE log_operation (
+CREATE TABLE IF NOT EXISTS log_operation (
 	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
 	timestamp INTEGER DEFAULT (unixepoch()) NOT NULL,
 	root REFERENCES log_root NOT NULL,
 	-- Path under the root directory, without the username or leading /
 	path TEXT NOT NULL,
+	-- The sequence of the root directory after this operation was applied
+	sequence INTEGER NOT NULL,
 	-- If null, implies this operation is a deletion
-	put REFERENCES log_put UNIQUE
+	put REFERENCES log_put UNIQUE,
+	-- SHA-256 over the hash of the preceding operation on the same root and
+	-- the id and contents of this one; see chain.go
+	hash BLOB NOT NULL,
+	-- The time of the operation as reported to clients: the Time of the entry
+	-- put, or that of the deletion. timestamp is when the server recorded the
+	-- operation, and governs retention and garbage collection.
+	time INTEGER NOT NULL
 );
 
-CREATE TABLE log_block (
+-- Serves lookups of the operations in a subtree, by path range.
+CREATE INDEX IF NOT EXISTS log_operation_path ON log_operation (root, path);
+
+CREATE TABLE IF NOT EXISTS log_block (
 	put REFERENCES log_put NOT NULL,
+	-- Formatted as by upspin.Endpoint.String()
 	endpoint TEXT NOT NULL,
 	reference TEXT NOT NULL,
 	offset INTEGER NOT NULL,
@@ -38,14 +51,91 @@ CREATE TABLE log_block (
 	PRIMARY KEY(put, reference)
 );
 
+-- Compactions of the log of a tree, which account for the gaps they leave in
+-- its hash chain. See compact.go.
+CREATE TABLE IF NOT EXISTS log_compaction (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	timestamp INTEGER DEFAULT (unixepoch()) NOT NULL,
+	root REFERENCES log_root NOT NULL,
+	-- The latest operation on the tree when it was compacted
+	head INTEGER NOT NULL,
+	-- The number of operations removed
+	removed INTEGER NOT NULL
+);
+
+-- The hash preceding an operation in its chain, for operations whose
+-- predecessors were removed by compaction.
+CREATE TABLE IF NOT EXISTS log_gap (
+	op REFERENCES log_operation PRIMARY KEY NOT NULL,
+	prev BLOB NOT NULL,
+	-- The latest compaction removing operations preceding op
+	compaction REFERENCES log_compaction NOT NULL,
+	-- The number of operations removed between op and the retained
+	-- operation preceding it
+	removed INTEGER NOT NULL
+);
+
 -- Represents the current state of tree as projected from the log history. Can
 -- be computed by replaying the log, but is kept in sync with every put or
 -- delete operation to serve as a cache of the current sequence.
-CREATE TABLE proj_entry (
+CREATE TABLE IF NOT EXISTS proj_entry (
 	name TEXT PRIMARY KEY NOT NULL,
 	-- This must reference an op with a non-null `put` column
 	op REFERENCES log_operation UNIQUE NOT NULL,
 	sequence INTEGER NOT NULL,
 	-- The parent directory. Only the root path of a tree references itself.
-	parent REFERENCES log_put NOT NULL
+	parent REFERENCES log_put NOT NULL,
+	-- The Merkle hash over the entry and, for directories, its children. See
+	-- merkle.go.
+	hash BLOB,
+	-- For directories, the state.Sum of the hashes of the children
+	children BLOB
+);
+
+-- Serves listings of the projected children of a directory.
+CREATE INDEX IF NOT EXISTS proj_entry_parent ON proj_entry (parent);
+
+-- Store blocks deleted by garbage collection. A reference is only collected
+-- again if an operation has used it since it was deleted.
+CREATE TABLE IF NOT EXISTS gc_deleted (
+	-- Formatted as by upspin.Endpoint.String()
+	endpoint TEXT NOT NULL,
+	reference TEXT NOT NULL,
+	timestamp INTEGER DEFAULT (unixepoch()) NOT NULL,
+	-- The id of the latest operation in the log when the block was found
+	-- unreachable; uses by operations with greater ids followed the deletion
+	op INTEGER NOT NULL,
+	PRIMARY KEY(endpoint, reference)
+);
+
+-- Block references whose log_block records were removed by compaction, with
+-- the time and operation id of their last use, so that they remain known to
+-- garbage collection.
+CREATE TABLE IF NOT EXISTS gc_released (
+	-- Formatted as by upspin.Endpoint.String()
+	endpoint TEXT NOT NULL,
+	reference TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	op INTEGER NOT NULL,
+	PRIMARY KEY(endpoint, reference)
+);
+
+-- On a replica, the id of the last operation applied from the primary's log
+-- for each tree. See replica.go.
+CREATE TABLE IF NOT EXISTS replica_position (
+	username TEXT PRIMARY KEY NOT NULL,
+	op INTEGER NOT NULL
+);
+
+-- Access files that could not be read or parsed when checking access rights,
+-- for their owners to fix. Rows for versions no longer current are ignored.
+CREATE TABLE IF NOT EXISTS access_health (
+	name TEXT PRIMARY KEY NOT NULL,
+	username TEXT NOT NULL,
+	sequence INTEGER NOT NULL,
+	-- If false, the file could not be read
+	malformed BOOLEAN NOT NULL,
+	error TEXT NOT NULL,
+	first INTEGER NOT NULL,
+	last INTEGER NOT NULL
 );
@@ -0,0 +1,314 @@
+package sink
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config describes a bucket of an S3-compatible object store.
+type S3Config struct {
+	// The base URL of the API, e.g. https://s3.us-east-1.amazonaws.com.
+	// Buckets are addressed by path rather than by virtual host, which all
+	// compatible stores support.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Prefix is prepended to the names of all files, separated by a slash.
+	Prefix string
+
+	AccessKey string
+	SecretKey string
+
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// S3 is a Sink storing files as objects in a bucket, authenticating its
+// requests with AWS Signature Version 4.
+type S3 struct {
+	cfg S3Config
+}
+
+// NewS3 returns a sink for the bucket described by cfg.
+func NewS3(cfg S3Config) *S3 {
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	return &S3{cfg}
+}
+
+// The payload hash of requests without a body, and the placeholder for
+// uploads, whose bodies are streamed rather than hashed up front.
+const (
+	emptyHash       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+func (s *S3) key(name string) string {
+	if s.cfg.Prefix == "" {
+		return name
+	}
+
+	return s.cfg.Prefix + "/" + name
+}
+
+// request returns a signed request for an object, or for the bucket if key is
+// empty.
+func (s *S3) request(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Request, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", err)
+	}
+	u.Path += "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	hash := emptyHash
+	if body != nil {
+		// A zero length would otherwise make the body be sent chunked.
+		if req.ContentLength = size; size == 0 {
+			req.Body = http.NoBody
+		}
+		hash = unsignedPayload
+	}
+	s.sign(req, hash, time.Now())
+
+	return req, nil
+}
+
+// do sends a request and returns its response if it succeeded.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		Code    string
+		Message string
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if xml.Unmarshal(b, &e) != nil || e.Code == "" {
+		e.Code = resp.Status
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: req.Method, Path: req.URL.Path, Err: fs.ErrNotExist}
+	}
+
+	return nil, fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, e.Code, e.Message)
+}
+
+// Put implements Sink.
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	req, err := s.request(ctx, http.MethodPut, s.key(name), nil, io.NopCloser(r), size)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// Get implements Sink.
+func (s *S3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	req, err := s.request(ctx, http.MethodGet, s.key(name), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// List implements Sink, following continuation tokens until the listing is
+// complete.
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	q := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+	if s.cfg.Prefix != "" && prefix == "" {
+		q.Set("prefix", s.cfg.Prefix+"/")
+	}
+
+	var names []string
+	for {
+		req, err := s.request(ctx, http.MethodGet, "", q, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode listing: %w", err)
+		}
+
+		for _, c := range res.Contents {
+			name := c.Key
+			if s.cfg.Prefix != "" {
+				name = strings.TrimPrefix(name, s.cfg.Prefix+"/")
+			}
+			names = append(names, name)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		q.Set("continuation-token", res.NextContinuationToken)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Delete implements Sink.
+func (s *S3) Delete(ctx context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	req, err := s.request(ctx, http.MethodDelete, s.key(name), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// sign sets the headers authenticating a request made at time t, whose payload
+// has the given hash. The request's URL must already be in canonical form.
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.UTC().Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("Authorization", s.authorization(req))
+}
+
+// authorization returns the Authorization header of a request carrying the
+// X-Amz-Date and X-Amz-Content-Sha256 headers, which are signed along with the
+// host.
+func (s *S3) authorization(req *http.Request) string {
+	stamp := req.Header.Get("X-Amz-Date")
+	date := stamp
+	if len(date) > 8 {
+		date = date[:8]
+	}
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	const signed = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + host,
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + stamp,
+		"",
+		signed,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	h := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := []byte("AWS4" + s.cfg.SecretKey)
+	for _, v := range []string{date, s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+
+	return fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign)),
+	)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by name, as signatures require.
+func canonicalQuery(q url.Values) string {
+	var ps []string
+	for k, vs := range q {
+		for _, v := range vs {
+			ps = append(ps, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(ps)
+
+	return strings.Join(ps, "&")
+}
+
+// uriEncode percent-encodes every byte of s other than unreserved characters
+// and, unless encodeSlash is set, slashes.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,89 @@
+// Package sink implements the object stores to which backups of the directory
+// server database are shipped.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Sink stores the files of a backup under slash-separated names. Files are
+// written once and never modified.
+type Sink interface {
+	// Put stores the size bytes read from r under name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+
+	// Get opens the file stored under name. If there is none, the returned
+	// error satisfies os.IsNotExist.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// List returns the names of the files starting with prefix, in lexical
+	// order.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Delete removes the file stored under name, if any.
+	Delete(ctx context.Context, name string) error
+}
+
+// Open returns the sink described by a URL, which is either the path of a local
+// directory, optionally as a file:// URL, or of the form
+//
+//	s3://bucket/prefix?endpoint=https://host&region=region
+//
+// in which case the credentials are taken from the environment variables
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. The endpoint defaults to that of
+// AWS in the region, and the region to us-east-1.
+func Open(s string) (Sink, error) {
+	if !strings.Contains(s, "://") {
+		return OpenDir(s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return OpenDir(u.Path)
+	case "s3":
+		q := u.Query()
+		cfg := S3Config{
+			Endpoint:  q.Get("endpoint"),
+			Region:    q.Get("region"),
+			Bucket:    u.Host,
+			Prefix:    strings.TrimPrefix(u.Path, "/"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+		if cfg.Region == "" {
+			cfg.Region = "us-east-1"
+		}
+		if cfg.Endpoint == "" {
+			cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+		}
+		if cfg.Bucket == "" {
+			return nil, fmt.Errorf("no bucket in %q", s)
+		}
+		return NewS3(cfg), nil
+	}
+
+	return nil, fmt.Errorf("unknown sink scheme %q", u.Scheme)
+}
+
+// checkName rejects names that could escape the sink.
+func checkName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == "" || e == "." || e == ".." {
+			return fmt.Errorf("invalid name %q", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	d, err := OpenDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSink(t, d)
+}
+
+func TestS3(t *testing.T) {
+	for _, prefix := range []string{"", "backups/db"} {
+		t.Run("prefix="+prefix, func(t *testing.T) {
+			cfg := S3Config{
+				Region:    "eu-west-1",
+				Bucket:    "bucket",
+				Prefix:    prefix,
+				AccessKey: "AKID",
+				SecretKey: "secret",
+			}
+			srv := httptest.NewServer(newFakeS3(t, cfg))
+			defer srv.Close()
+			cfg.Endpoint = srv.URL
+			testSink(t, NewS3(cfg))
+
+			cfg.SecretKey = "wrong"
+			if _, err := NewS3(cfg).List(context.Background(), ""); err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+				t.Errorf("listing with a wrong secret: %v", err)
+			}
+		})
+	}
+}
+
+func testSink(t *testing.T, s Sink) {
+	ctx := context.Background()
+	files := map[string]string{
+		"0001/snapshot.db":   "snapshot",
+		"0001/0000-0001.wal": "segment one",
+		"0001/0010-0002.wal": "segment two",
+		"0002/snapshot.db":   "",
+		"0002/a b+c.wal":     "odd name",
+	}
+	for name, data := range files {
+		if err := s.Put(ctx, name, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+	}
+
+	for name, want := range files {
+		r, err := s.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("get %s: %v", name, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != want {
+			t.Errorf("get %s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := s.Get(ctx, "0003/snapshot.db"); !os.IsNotExist(err) {
+		t.Errorf("get of absent file: %v", err)
+	}
+	if err := s.Put(ctx, "../escape", strings.NewReader(""), 0); err == nil {
+		t.Error("put of name outside the sink succeeded")
+	}
+
+	names, err := s.List(ctx, "0001/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0001/0000-0001.wal", "0001/0010-0002.wal", "0001/snapshot.db"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("list = %q, want %q", names, want)
+	}
+
+	for _, name := range want {
+		if err := s.Delete(ctx, name); err != nil {
+			t.Fatalf("delete %s: %v", name, err)
+		}
+	}
+	if err := s.Delete(ctx, want[0]); err != nil {
+		t.Errorf("delete of absent file: %v", err)
+	}
+	names, err = s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"0002/a b+c.wal", "0002/snapshot.db"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("list after deletion = %q, want %q", names, want)
+	}
+}
+
+// fakeS3 is a stand-in for an S3-compatible store serving a single bucket,
+// which checks the signatures of requests and paginates listings by two keys.
+type fakeS3 struct {
+	t    *testing.T
+	s    *S3
+	mu   sync.Mutex
+	objs map[string][]byte
+}
+
+func newFakeS3(t *testing.T, cfg S3Config) *fakeS3 {
+	return &fakeS3{t: t, s: NewS3(cfg), objs: map[string][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if got, want := r.Header.Get("Authorization"), f.s.authorization(r); got != want {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.s.cfg.Bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		if r.ContentLength < 0 {
+			f.error(w, http.StatusLengthRequired, "MissingContentLength")
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.t.Error(err)
+		}
+		f.objs[key] = b
+	case r.Method == http.MethodGet:
+		b, ok := f.objs[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(b)
+	case r.Method == http.MethodDelete:
+		delete(f.objs, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		f.error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	var keys []string
+	for k := range f.objs {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct{ Key string }
+	var res struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[1]
+	}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, content{k})
+	}
+
+	var b bytes.Buffer
+	if err := xml.NewEncoder(&b).Encode(res); err != nil {
+		f.t.Error(err)
+	}
+	w.Write(b.Bytes())
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: http.StatusText(status)})
+}
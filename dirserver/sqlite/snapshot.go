@@ -0,0 +1,250 @@
+package sqlite
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+	"upspin.io/errors"
+)
+
+/*
+Unlike a backup, a snapshot is a single self-contained copy of the database,
+written by VACUUM INTO within one read transaction, so that it is consistent
+even while the server writes to the database, and readers are never blocked.
+
+Encrypted snapshots start with a magic number and the salt from which the key
+is derived from the passphrase with scrypt. The copy follows in chunks, each
+preceded by its length and sealed with AES-GCM under a nonce counting the
+chunks; the last chunk is marked in its additional data, so that truncation is
+detected.
+*/
+
+const (
+	snapshotMagic = "FLYSNAP1"
+	snapshotChunk = 64 << 10
+)
+
+// Snapshot writes a consistent copy of the database to file, which must not
+// exist, encrypted with the passphrase unless it is nil. The copy is checked
+// with PRAGMA integrity_check before it is written to file.
+func (s State) Snapshot(ctx context.Context, file string, passphrase []byte) error {
+	if err := s.snapshot(ctx, file, passphrase); err != nil {
+		return fmt.Errorf("sqlite.Snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (s State) snapshot(ctx context.Context, file string, passphrase []byte) error {
+	// Fail early; the file is created without replacing one either way.
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%s already exists", file)
+	}
+
+	// A plain copy is made next to the file, so that it can be linked into
+	// place. An encrypted one must not leave its plaintext where the
+	// snapshot is written, so is made next to the database instead. VACUUM
+	// INTO accepts existing files only if empty.
+	dir := filepath.Dir(file)
+	var w *os.File
+	if passphrase != nil {
+		dir = filepath.Dir(s.file)
+		var err error
+		if w, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return abortSnapshot(w, err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err := s.db.ExecContext(ctx, `VACUUM INTO ?`, tmp.Name()); err != nil {
+		return abortSnapshot(w, fmt.Errorf("copy database: %w", err))
+	}
+	if err := checkIntegrity(ctx, tmp.Name()); err != nil {
+		return abortSnapshot(w, err)
+	}
+
+	if passphrase == nil {
+		// Unlike a rename, linking fails if the file was created meanwhile.
+		return os.Link(tmp.Name(), file)
+	}
+	r, err := os.Open(tmp.Name())
+	if err != nil {
+		return abortSnapshot(w, err)
+	}
+	defer r.Close()
+	if err := encryptSnapshot(w, r, passphrase); err != nil {
+		return abortSnapshot(w, err)
+	}
+	if err := w.Sync(); err != nil {
+		return abortSnapshot(w, err)
+	}
+
+	return w.Close()
+}
+
+// abortSnapshot removes the partially written snapshot w, if any, and returns
+// err.
+func abortSnapshot(w *os.File, err error) error {
+	if w != nil {
+		w.Close()
+		os.Remove(w.Name())
+	}
+
+	return err
+}
+
+// checkIntegrity runs PRAGMA integrity_check on a database file.
+func checkIntegrity(ctx context.Context, file string) error {
+	db, err := sql.Open("sqlite3", "file:"+file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rs, err := db.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("check integrity: %w", err)
+	}
+	defer rs.Close()
+	var msgs []string
+	for rs.Next() {
+		var m string
+		if err := rs.Scan(&m); err != nil {
+			return fmt.Errorf("check integrity: %w", err)
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rs.Err(); err != nil {
+		return fmt.Errorf("check integrity: %w", err)
+	}
+	if len(msgs) != 1 || msgs[0] != "ok" {
+		return fmt.Errorf("integrity check of copy failed: %q", msgs)
+	}
+
+	return nil
+}
+
+// DecryptSnapshot writes the database held by an encrypted snapshot read from
+// r to w.
+func DecryptSnapshot(w io.Writer, r io.Reader, passphrase []byte) error {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(snapshotMagic)+16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return fmt.Errorf("sqlite.DecryptSnapshot: read header: %w", err)
+	} else if string(hdr[:len(snapshotMagic)]) != snapshotMagic {
+		return errors.Str("sqlite.DecryptSnapshot: not an encrypted snapshot")
+	}
+	aead, err := snapshotCipher(passphrase, hdr[len(snapshotMagic):])
+	if err != nil {
+		return fmt.Errorf("sqlite.DecryptSnapshot: %w", err)
+	}
+
+	buf := make([]byte, snapshotChunk+aead.Overhead())
+	out := make([]byte, 0, snapshotChunk)
+	nonce := make([]byte, aead.NonceSize())
+	for i := uint64(0); ; i++ {
+		var n uint32
+		if err := binary.Read(br, binary.BigEndian, &n); err == io.EOF {
+			return errors.Str("sqlite.DecryptSnapshot: snapshot truncated")
+		} else if err != nil {
+			return fmt.Errorf("sqlite.DecryptSnapshot: %w", err)
+		} else if int(n) > len(buf) {
+			return errors.Str("sqlite.DecryptSnapshot: chunk too large")
+		}
+		if _, err := io.ReadFull(br, buf[:n]); err != nil {
+			return fmt.Errorf("sqlite.DecryptSnapshot: %w", err)
+		}
+
+		binary.BigEndian.PutUint64(nonce, i)
+		last := false
+		p, err := aead.Open(out[:0], nonce, buf[:n], []byte{0})
+		if err != nil {
+			last = true
+			p, err = aead.Open(out[:0], nonce, buf[:n], []byte{1})
+		}
+		if err != nil {
+			return errors.Str("sqlite.DecryptSnapshot: wrong passphrase or corrupt snapshot")
+		}
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func encryptSnapshot(w io.Writer, r io.Reader, passphrase []byte) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := snapshotCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	bw.Write(salt)
+
+	// Reading a chunk ahead tells whether the current one is the last.
+	cur := make([]byte, snapshotChunk)
+	next := make([]byte, snapshotChunk)
+	n, err := io.ReadFull(r, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealed := make([]byte, 0, snapshotChunk+aead.Overhead())
+	for i := uint64(0); ; i++ {
+		m := 0
+		if n == snapshotChunk {
+			m, err = io.ReadFull(r, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		last := byte(0)
+		if m == 0 {
+			last = 1
+		}
+
+		binary.BigEndian.PutUint64(nonce, i)
+		sealed = aead.Seal(sealed[:0], nonce, cur[:n], []byte{last})
+		binary.Write(bw, binary.BigEndian, uint32(len(sealed)))
+		bw.Write(sealed)
+		if last == 1 {
+			return bw.Flush()
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+func snapshotCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(b)
+}
@@ -3,10 +3,11 @@ package sqlite
 import (
 	"database/sql"
 	_ "embed"
-	"strings"
+	"fmt"
 
 	_ "github.com/mattn/go-sqlite3"
 	"upspin.io/path"
+	"upspin.io/upspin"
 )
 
 //go:embed schema.sql
@@ -14,20 +15,21 @@ var schema string
 
 type State struct {
 	db *sql.DB
+	// The path of the database file, for backups.
+	file string
 }
 
 // Open accepts a SQLite database file path and initializes it, creating the
-// schema if not present.
+// schema if not present and migrating it if created by an earlier version.
 func Open(p string) (*State, error) {
 	// TODO Learn how best to deal with the mattn driver by reviewing the
 	// advice in https://www.reddit.com/r/golang/comments/1exk981/comment/lj7d3u6/
-	db, err := sql.Open("sqlite3", "file:"+p+"?_fk=true")
+	db, err := sql.Open("sqlite3", "file:"+p+"?_fk=true&_busy_timeout=5000")
 	if err != nil {
 		return nil, err
 	}
-	s := &State{db}
+	s := &State{db: db, file: p}
 
-	//TODO only if not present
 	if err := s.create(); err != nil {
 		return nil, err
 	}
@@ -47,44 +49,74 @@ func (s State) create() error {
 		return err
 	}
 
-	for _, stmt := range strings.Split(schema, ";\n") {
-		_, err = tx.Exec(stmt)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
+	if err := migrate(tx); err != nil {
+		tx.Rollback()
+		return err
 	}
 
 	return tx.Commit()
 }
 
-// appendOp appends an operation to the log and returns its id. pid is the id
-// of the corresponding log_put record, <0 indicates a deletion operation.
-func (s State) appendOp(tx *sql.Tx, p path.Parsed, pid int64) (int64, error) {
-	var r sql.Result
-	var err error
-	if pid < 0 {
-		r, err = tx.Exec(
-			`INSERT INTO log_operation (root, path) VALUES ((SELECT id FROM log_root WHERE username = ?), ?)`,
-			p.User(),
-			p.FilePath(),
-		)
-	} else {
-		r, err = tx.Exec(
-			`INSERT INTO log_operation (root, path, put) VALUES ((SELECT id FROM log_root WHERE username = ?), ?, ?)`,
-			p.User(),
-			p.FilePath(),
-			pid,
-		)
+// appendOp appends an operation to the log and returns its id. e is the entry
+// that was put and pid the id of its log_put record, or nil and <0 for a
+// deletion. seq is the sequence of the root directory resulting from the
+// operation. ts is the time the operation is recorded at, and t the time of the
+// operation reported to clients; if zero, ts defaults to the current time and t
+// to ts. Only replicas, which copy the log of the primary, pass a non-zero ts.
+func (s State) appendOp(tx *sql.Tx, p path.Parsed, e *upspin.DirEntry, pid int64, seq int64, ts, t upspin.Time) (int64, error) {
+	if ts == 0 {
+		ts = upspin.Now()
 	}
+	if t == 0 {
+		t = ts
+	}
+	prev, err := chainPrev(tx, p.User())
 	if err != nil {
-		tx.Rollback()
+		return -1, fmt.Errorf("find previous operation: %w", err)
 	}
 
+	// The hash covers the id, so is set once it is assigned.
+	put := sql.NullInt64{Int64: pid, Valid: pid >= 0}
+	r, err := tx.Exec(
+		`INSERT INTO log_operation (timestamp, time, root, path, sequence, put, hash) VALUES (?, ?, (SELECT id FROM log_root WHERE username = ?), ?, ?, ?, x'')`,
+		ts,
+		t,
+		p.User(),
+		p.FilePath(),
+		seq,
+		put,
+	)
+	if err != nil {
+		return -1, err
+	}
 	i, err := r.LastInsertId()
 	if err != nil {
 		return -1, err
 	}
 
-	return i, err
+	h := chainHash(prev, i, p.User(), p.FilePath(), ts, t, seq, e)
+	if _, err := tx.Exec(`UPDATE log_operation SET hash = ? WHERE id = ?`, h, i); err != nil {
+		return -1, err
+	}
+
+	return i, nil
+}
+
+// nextSeq returns the sequence the next operation on the tree containing p
+// will be assigned.
+func nextSeq(tx *sql.Tx, p path.Parsed) (int64, error) {
+	r := tx.QueryRow(
+		`SELECT sequence
+		FROM proj_entry
+		WHERE name = ?`,
+		p.First(0).Path(),
+	)
+	var seq int64
+	if err := r.Scan(&seq); err == sql.ErrNoRows {
+		return upspin.SeqBase, nil
+	} else if err != nil {
+		return -1, err
+	}
+
+	return seq + 1, nil
 }
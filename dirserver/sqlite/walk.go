@@ -0,0 +1,248 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"upspin.io/upspin"
+)
+
+// The number of records read from the database at a time while walking.
+const walkPage = 256
+
+// Operation is a record of the log.
+type Operation struct {
+	Id   int64
+	Name upspin.PathName
+	// The time of the operation reported to clients, and that at which it
+	// was recorded.
+	Time, Timestamp upspin.Time
+	Sequence        int64
+	// The complete entry that was put, with its Time and Sequence set to
+	// those of the operation. Nil if the operation is a deletion.
+	Entry *upspin.DirEntry
+}
+
+// WalkLog calls fn for every operation on the tree of the given user with an
+// id greater than after, in order. The walk is performed in a single
+// transaction; an error returned by fn stops it and is returned.
+func (s State) WalkLog(ctx context.Context, user upspin.UserName, after int64, fn func(Operation) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("sqlite.WalkLog(%s): begin transaction: %w", user, err)
+	}
+	defer tx.Commit()
+
+	for {
+		ops, pids, err := logPage(tx, user, after)
+		if err != nil {
+			return fmt.Errorf("sqlite.WalkLog(%s): %w", user, err)
+		}
+
+		for i, op := range ops {
+			if op.Entry != nil && op.Entry.IsRegular() {
+				if op.Entry.Blocks, err = getBlocks(tx, pids[i]); err != nil {
+					return fmt.Errorf("sqlite.WalkLog(%s): %w", user, err)
+				}
+			}
+			if err := fn(op); err != nil {
+				return err
+			}
+			after = op.Id
+		}
+
+		if len(ops) < walkPage {
+			return nil
+		}
+	}
+}
+
+// logPage retrieves the operations on a user tree following the given id,
+// along with their log_put ids, without blocks.
+func logPage(tx *sql.Tx, user upspin.UserName, after int64) ([]Operation, []int64, error) {
+	rs, err := tx.Query(
+		`SELECT `+opColumns+`
+		FROM log_operation o
+		INNER JOIN log_root r ON o.root = r.id
+		LEFT JOIN log_put p ON o.put = p.id
+		WHERE r.username = ? AND o.id > ?
+		ORDER BY o.id
+		LIMIT ?`,
+		user,
+		after,
+		walkPage,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query log: %w", err)
+	}
+	defer rs.Close()
+
+	var ops []Operation
+	var pids []int64
+	for rs.Next() {
+		op, pid, err := scanOp(rs, user)
+		if err != nil {
+			return nil, nil, fmt.Errorf("query log: %w", err)
+		}
+
+		ops = append(ops, op)
+		pids = append(pids, pid)
+	}
+
+	return ops, pids, rs.Err()
+}
+
+// opColumns are the columns of an operation on a tree scanned by scanOp, for a
+// query joining log_operation o with log_put p.
+const opColumns = `o.id, o.path, o.sequence, o.time, o.timestamp,
+	p.id, p.writer, p.dir, p.link, p.packing, p.packdata`
+
+// scanOp scans an operation on the tree of user, without blocks, and returns
+// the id of its log_put record. Any columns following opColumns are scanned
+// into extra.
+func scanOp(r interface{ Scan(...any) error }, user upspin.UserName, extra ...any) (Operation, int64, error) {
+	var op Operation
+	var fp string
+	var pid sql.NullInt64
+	var writer sql.NullString
+	var dir sql.NullBool
+	var link sql.NullString
+	var packing sql.NullByte
+	var packdata []byte
+	dest := []any{&op.Id, &fp, &op.Sequence, &op.Time, &op.Timestamp, &pid, &writer, &dir, &link, &packing, &packdata}
+	if err := r.Scan(append(dest, extra...)...); err != nil {
+		return op, -1, err
+	}
+	op.Name = upspin.PathName(string(user) + "/" + fp)
+
+	if pid.Valid {
+		e := &upspin.DirEntry{
+			Name:       op.Name,
+			SignedName: op.Name,
+			Writer:     upspin.UserName(writer.String),
+			Time:       op.Time,
+			Sequence:   op.Sequence,
+		}
+		if dir.Bool {
+			e.Attr = upspin.AttrDirectory
+		} else if link.Valid {
+			e.Attr = upspin.AttrLink
+			e.Link = upspin.PathName(link.String)
+		} else {
+			e.Packing = upspin.Packing(packing.Byte)
+			e.Packdata = packdata
+		}
+		op.Entry = e
+	}
+
+	return op, pid.Int64, nil
+}
+
+// WalkProj calls fn with the complete entry of every element of the tree of
+// the given user, ordered such that parents precede their children. The walk is
+// performed in a single transaction; an error returned by fn stops it and is
+// returned.
+func (s State) WalkProj(ctx context.Context, user upspin.UserName, fn func(*upspin.DirEntry) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("sqlite.WalkProj(%s): begin transaction: %w", user, err)
+	}
+	defer tx.Commit()
+
+	// All paths in the tree sort between the root and the first string
+	// following its prefix.
+	prefix := string(user) + "/"
+	last := ""
+	for {
+		es, pids, err := projPage(tx, prefix, last)
+		if err != nil {
+			return fmt.Errorf("sqlite.WalkProj(%s): %w", user, err)
+		}
+
+		for i, e := range es {
+			if e.IsRegular() {
+				if e.Blocks, err = getBlocks(tx, pids[i]); err != nil {
+					return fmt.Errorf("sqlite.WalkProj(%s): %w", user, err)
+				}
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+			last = string(e.Name)
+		}
+
+		if len(es) < walkPage {
+			return nil
+		}
+	}
+}
+
+// projPage retrieves the projected entries with the given prefix that sort
+// after the given name, along with their log_put ids, without blocks.
+func projPage(tx *sql.Tx, prefix, after string) ([]*upspin.DirEntry, []int64, error) {
+	rs, err := tx.Query(
+		`SELECT
+			e.name, e.sequence, o.time, p.writer, p.dir, p.link, p.packing, p.packdata, p.id
+		FROM proj_entry e
+		INNER JOIN log_operation o ON e.op = o.id
+		INNER JOIN log_put p ON o.put = p.id
+		WHERE e.name >= ? AND e.name < ? AND e.name > ?
+		ORDER BY e.name
+		LIMIT ?`,
+		prefix,
+		prefix[:len(prefix)-1]+"0",
+		after,
+		walkPage,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query projection: %w", err)
+	}
+	defer rs.Close()
+
+	var es []*upspin.DirEntry
+	var pids []int64
+	for rs.Next() {
+		var pid int64
+		e, err := scanEntry(rs, &pid)
+		if err != nil {
+			return nil, nil, err
+		}
+		es = append(es, e)
+		pids = append(pids, pid)
+	}
+
+	return es, pids, rs.Err()
+}
+
+// scanEntry scans a row of the columns selected by projPage into an entry
+// without blocks. Any additional columns are scanned into extra.
+func scanEntry(rs *sql.Rows, extra ...any) (*upspin.DirEntry, error) {
+	e := &upspin.DirEntry{}
+	var name string
+	var dir bool
+	var link sql.NullString
+	var packing sql.NullByte
+	var packdata []byte
+	dest := append([]any{&name, &e.Sequence, &e.Time, &e.Writer, &dir, &link, &packing, &packdata}, extra...)
+	if err := rs.Scan(dest...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("querying DirEntry: %w", err)
+	}
+
+	e.Name = upspin.PathName(name)
+	e.SignedName = e.Name
+	if dir {
+		e.Attr = upspin.AttrDirectory
+	} else if link.Valid {
+		e.Attr = upspin.AttrLink
+		e.Link = upspin.PathName(link.String)
+	} else {
+		e.Packing = upspin.Packing(packing.Byte)
+		e.Packdata = packdata
+	}
+
+	return e, nil
+}
@@ -0,0 +1,212 @@
+package state
+
+// Defines the Merkle tree that states may maintain over their projection.
+// Every entry has a hash over its contents and, for directories, over the
+// names and hashes of its children, such that the hash of a root directory
+// identifies the entire tree. Neither sequences nor times are covered, so trees
+// with the same contents have the same hashes regardless of the history that
+// produced them or of the implementation holding them. The hashes are not
+// signed, and serve to compare trees the caller can read, such as those of a
+// primary and its replica, rather than to verify lookups.
+//
+// The children of a directory are combined into a Sum, a homomorphic hash
+// after LtHash (https://eprint.iacr.org/2019/227): each child is expanded into
+// a vector of 1024 16-bit integers, which are added lane-wise. A child can so
+// be added or removed without reading the others, and the hash of every
+// ancestor updated from the old and new hash of the entry that changed.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sort"
+
+	"golang.org/x/crypto/sha3"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Node is an element of the Merkle tree.
+type Node struct {
+	Name upspin.PathName
+	Dir  bool
+	// Nil if the entry does not exist.
+	Hash []byte
+}
+
+// Tree is implemented by states that maintain a Merkle tree, to compare it
+// with another.
+type Tree interface {
+	// Node returns the node of the entry at the given path, with a nil hash
+	// if it doesn't exist.
+	Node(context.Context, upspin.PathName) (Node, error)
+
+	// Children returns the nodes of the entries in the directory at the
+	// given path, ordered by name.
+	Children(context.Context, upspin.PathName) ([]Node, error)
+}
+
+// sumSize is the size in bytes of a Sum.
+const sumSize = 2048
+
+// Sum combines the hashes of the children of a directory. The empty Sum is
+// that of no children.
+type Sum []byte
+
+// Add returns the sum with the child of the given name and hash added. The
+// receiver is not modified.
+func (s Sum) Add(name upspin.PathName, h []byte) Sum {
+	return s.combine(name, h, false)
+}
+
+// Remove returns the sum with the child of the given name and hash removed,
+// which must have been added. The receiver is not modified.
+func (s Sum) Remove(name upspin.PathName, h []byte) Sum {
+	return s.combine(name, h, true)
+}
+
+func (s Sum) combine(name upspin.PathName, h []byte, remove bool) Sum {
+	// Children are identified by their final element, so that equal
+	// subtrees under different paths have equal hashes.
+	p, _ := path.Parse(name)
+	in := sha256.New()
+	WriteBytes(in, []byte(p.Elem(p.NElem()-1)))
+	WriteBytes(in, h)
+	term := make([]byte, sumSize)
+	sha3.ShakeSum256(term, in.Sum(nil))
+
+	out := make(Sum, sumSize)
+	copy(out, s)
+	for i := 0; i < sumSize; i += 2 {
+		lane, t := binary.LittleEndian.Uint16(out[i:]), binary.LittleEndian.Uint16(term[i:])
+		if remove {
+			lane -= t
+		} else {
+			lane += t
+		}
+		binary.LittleEndian.PutUint16(out[i:], lane)
+	}
+
+	return out
+}
+
+// NodeHash computes the hash of an entry, whose blocks must be present, given
+// the sum of its children if it is a directory.
+func NodeHash(e *upspin.DirEntry, children Sum) []byte {
+	h := sha256.New()
+	WriteEntry(h, e)
+
+	if e.IsDir() {
+		if len(children) == 0 {
+			children = make(Sum, sumSize)
+		}
+		h.Write(children)
+	}
+
+	return h.Sum(nil)
+}
+
+// WriteEntry writes a canonical encoding of a non-nil entry to h, covering the
+// fields persisted by states other than its name, time and sequence.
+func WriteEntry(h hash.Hash, e *upspin.DirEntry) {
+	switch e.Attr {
+	case upspin.AttrDirectory:
+		WriteInt(h, 1)
+		WriteBytes(h, []byte(e.Writer))
+	case upspin.AttrLink:
+		WriteInt(h, 2)
+		WriteBytes(h, []byte(e.Writer))
+		WriteBytes(h, []byte(e.Link))
+	default:
+		WriteInt(h, 3)
+		WriteBytes(h, []byte(e.Writer))
+		WriteInt(h, int64(e.Packing))
+		WriteBytes(h, e.Packdata)
+
+		bs := append([]upspin.DirBlock(nil), e.Blocks...)
+		sort.SliceStable(bs, func(i, j int) bool { return bs[i].Offset < bs[j].Offset })
+		WriteInt(h, int64(len(bs)))
+		for _, b := range bs {
+			WriteBytes(h, []byte(b.Location.Endpoint.String()))
+			WriteBytes(h, []byte(b.Location.Reference))
+			WriteInt(h, b.Offset)
+			WriteInt(h, b.Size)
+			WriteBytes(h, b.Packdata)
+		}
+	}
+}
+
+// WriteInt writes a varint encoding of i to h.
+func WriteInt(h hash.Hash, i int64) {
+	h.Write(binary.AppendVarint(nil, i))
+}
+
+// WriteBytes writes b to h, prefixed with its length so that consecutive
+// strings can not be confused.
+func WriteBytes(h hash.Hash, b []byte) {
+	h.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	h.Write(b)
+}
+
+// Diff returns the paths at which the trees a and b differ, at or below name,
+// descending only into directories whose hashes differ. The trees should not
+// change meanwhile, or differences may be missed or spurious. A path present in only
+// one of the trees is returned without its contents. A directory is returned
+// if its own entries differ, or if it is a directory in only one of the trees.
+func Diff(ctx context.Context, a, b Tree, name upspin.PathName) ([]upspin.PathName, error) {
+	na, err := a.Node(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	nb, err := b.Node(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(na.Hash) == string(nb.Hash) {
+		return nil, nil
+	}
+	if na.Hash == nil || nb.Hash == nil || !na.Dir || !nb.Dir {
+		return []upspin.PathName{name}, nil
+	}
+
+	ca, err := a.Children(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	cb, err := b.Children(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff []upspin.PathName
+	i, j := 0, 0
+	for i < len(ca) || j < len(cb) {
+		switch {
+		case j == len(cb) || i < len(ca) && ca[i].Name < cb[j].Name:
+			diff = append(diff, ca[i].Name)
+			i++
+		case i == len(ca) || cb[j].Name < ca[i].Name:
+			diff = append(diff, cb[j].Name)
+			j++
+		default:
+			if string(ca[i].Hash) != string(cb[j].Hash) {
+				d, err := Diff(ctx, a, b, ca[i].Name)
+				if err != nil {
+					return nil, err
+				}
+				diff = append(diff, d...)
+			}
+			i++
+			j++
+		}
+	}
+
+	// The directory entry itself differs.
+	if len(diff) == 0 {
+		diff = []upspin.PathName{name}
+	}
+
+	return diff, nil
+}
@@ -14,10 +14,18 @@ import (
 // managed by State and should only be created by State implementations. It
 // should never be modified before being passed to State methods. Attribute is
 // only ever one of AttrNone, AttrLink, or AttrDirectory.
+//
+// An entry is a handle to a specific version in the log, so that operations
+// spanning multiple calls see exactly the versions they resolved without
+// holding a transaction, even if the tree is modified in the meantime. It
+// remains valid until the version is removed by compaction.
 type Entry struct {
 	Path path.Parsed
 	Attr upspin.Attribute
 	Seq  int64
+	// Opaque identifier of the operation that put the entry, only meaningful
+	// to the State that returned it.
+	Id int64
 }
 
 // State provides a persistence interface for all data managed by the directory
@@ -33,9 +41,10 @@ type State interface {
 	// not exist on this server for the requested path.
 	LookupElem(context.Context, path.Parsed) (Entry, error)
 
-	// List retrieves all entries contained in the directory at the given path
-	// and sequence. If the entry does not represent a directory, the lookup
-	// will return no entries.
+	// List retrieves all entries contained in the directory at the version
+	// identified by the entry, ordered by name, as they were at the
+	// directory's sequence. If the entry does not represent a directory, the
+	// lookup will return no entries.
 	List(context.Context, Entry) ([]Entry, error)
 
 	// LookupAll retrieves the entries for all elements in a path. If a link is
@@ -43,8 +52,9 @@ type State interface {
 	// this completes the requested path. If an entry does not exist, the
 	// elements up to and including its nearest existing parent are returned.
 	// If a regular file entry is returned, it contains packdata without
-	// blocks, but is not marked incomplete.
-	LookupAll(context.Context, path.Parsed) ([]*upspin.DirEntry, error)
+	// blocks, but is not marked incomplete. The handles identifying the
+	// returned versions are returned in the same order.
+	LookupAll(context.Context, path.Parsed) ([]*upspin.DirEntry, []Entry, error)
 
 	// Lookup retrieves the entry at the requested path, if it exists. It does
 	// not attempt to evaluate links along the path. The path should be clean
@@ -52,8 +62,10 @@ type State interface {
 	// complete.
 	Lookup(context.Context, upspin.PathName) (*upspin.DirEntry, error)
 
-	// Get returns the full directory entry for an entry at the given path and
-	// sequence. Performs no validation; the entry must exist.
+	// Get returns the full directory entry for the version identified by the
+	// entry, with the entry's sequence, even if it has since been replaced or
+	// deleted. Performs no validation; the version must exist.
+	Get(context.Context, Entry) (*upspin.DirEntry, error)
 
 	// Put persists a put operation. Performs no validation; all intermediate
 	// elements must exist and be directories or it will result in state
@@ -66,6 +78,15 @@ type State interface {
 	Delete(context.Context, path.Parsed) error
 }
 
+// TimedDeleter is implemented by states that can record a deletion at a time
+// other than the current one, such as when importing the history of a tree.
+type TimedDeleter interface {
+
+	// DeleteAt is as Delete, with the deletion reported to clients as having
+	// occurred at the given time.
+	DeleteAt(context.Context, path.Parsed, upspin.Time) error
+}
+
 // Cache provides an interface for transparent caching of all data depended on
 // by the directory server that is stored elsewhere, i.e. access and group file
 // contents.
@@ -75,12 +96,70 @@ type Cache interface {
 	GetAccess(context.Context, *upspin.DirEntry) (*access.Access, error)
 
 	// GetGroup retrieves a local or remote group file. Must be passed to every
-	// invocation of access.Can().
-	//
-	// Currently this method does not live up to the interface's promise;
-	// upspin.io/access uses its own global group cache, which this and
-	// RemoveGroup will have to be implemented to manipulate.
+	// invocation of access.Can(). As upspin.io/access keeps the groups it
+	// loads in its own global cache, implementations must remove groups from
+	// it whenever they would fetch them anew.
 	GetGroup(context.Context, upspin.PathName) ([]byte, error)
 
+	// RemoveGroup removes a group from the cache, and from upspin.io/access's
+	// global cache, after its file is put or deleted.
 	RemoveGroup(context.Context, upspin.PathName) error
 }
+
+// GroupExpirer is implemented by caches that remove groups of their own accord,
+// such as remote groups that may have changed unnoticed.
+type GroupExpirer interface {
+	// OnGroupExpired registers a function to be called with the name of
+	// every group removed other than by RemoveGroup.
+	OnGroupExpired(func(upspin.PathName))
+}
+
+// Version describes an operation on a path.
+type Version struct {
+	Id       int64
+	Time     upspin.Time
+	Sequence int64
+	// The writer of the entry that was put; empty for deletions.
+	Writer  upspin.UserName
+	Deleted bool
+}
+
+// History is implemented by states that retain past versions of entries.
+type History interface {
+
+	// Versions lists the operations retained for a path, oldest first.
+	Versions(context.Context, upspin.PathName) ([]Version, error)
+
+	// Version returns the complete entry put by the operation with the given
+	// id on the path, with the sequence of the operation, or nil if there is
+	// no such put.
+	Version(context.Context, upspin.PathName, int64) (*upspin.DirEntry, error)
+}
+
+// AccessProblem records an Access file that could not be used to check access
+// rights.
+type AccessProblem struct {
+	Name     upspin.PathName
+	Sequence int64
+	// Whether the file could not be parsed, rather than read.
+	Malformed bool
+	Err       string
+	// When the problem was first and last recorded for this version.
+	First, Last upspin.Time
+}
+
+// Health is implemented by states that record problems with Access files.
+type Health interface {
+
+	// RecordAccessProblem records a problem with the current version of an
+	// Access file, replacing any recorded for it before.
+	RecordAccessProblem(context.Context, AccessProblem) error
+
+	// ClearAccessProblem forgets the problem recorded for an Access file.
+	ClearAccessProblem(context.Context, upspin.PathName) error
+
+	// AccessProblems lists the problems recorded for the current versions of
+	// Access files in the tree of a user, or of all users if empty, ordered
+	// by name.
+	AccessProblems(context.Context, upspin.UserName) ([]AccessProblem, error)
+}
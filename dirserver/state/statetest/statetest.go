@@ -0,0 +1,633 @@
+// Provides conformance tests for implementations of state.State.
+package statetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/state"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// Run runs the conformance tests against the states returned by open, which
+// must return a new, empty state on every call.
+func Run(t *testing.T, open func(t *testing.T) state.State) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, state.State)
+	}{
+		{"PutLookupAll", testPutLookupAll},
+		{"Delete", testDelete},
+		{"LookupAllLink", testLookupAllLink},
+		{"Lookup", testLookup},
+		{"LookupElemNoRoot", testLookupElemNoRoot},
+		{"LookupElemOnlyRoot", testLookupElemOnlyRoot},
+		{"LookupElemPartial", testLookupElemPartial},
+		{"LookupElemAttr", testLookupElemAttr},
+		{"ListGet", testListGet},
+		{"Handles", testHandles},
+		{"History", testHistory},
+		{"Tree", testTree},
+		{"MissingAncestor", testMissingAncestor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+// put puts the entries into s, failing the test on error.
+func put(t *testing.T, s state.State, es ...*upspin.DirEntry) {
+	t.Helper()
+	for _, e := range es {
+		if err := s.Put(context.Background(), e); err != nil {
+			t.Fatalf("put %s: %v", e.Name, err)
+		}
+	}
+}
+
+func dir(name upspin.PathName) *upspin.DirEntry {
+	p, _ := path.Parse(name)
+	return &upspin.DirEntry{
+		Attr:   upspin.AttrDirectory,
+		Writer: p.User(),
+		Name:   name,
+	}
+}
+
+func file(name upspin.PathName) *upspin.DirEntry {
+	p, _ := path.Parse(name)
+	return &upspin.DirEntry{
+		Packing:    upspin.PlainPack,
+		Writer:     p.User(),
+		Name:       name,
+		SignedName: name,
+	}
+}
+
+func link(name, target upspin.PathName) *upspin.DirEntry {
+	p, _ := path.Parse(name)
+	return &upspin.DirEntry{
+		Attr:   upspin.AttrLink,
+		Link:   target,
+		Writer: p.User(),
+		Name:   name,
+	}
+}
+
+func testPutLookupAll(t *testing.T, s state.State) {
+	ctx := context.Background()
+
+	/// Puts
+	put(t, s, dir("foo@example.com/"), dir("foo@example.com/bar"))
+	baz := &upspin.DirEntry{
+		Packing:  upspin.PlainPack,
+		Packdata: []byte("packd"),
+		Blocks: []upspin.DirBlock{
+			{
+				Location: upspin.Location{
+					Endpoint: upspin.Endpoint{
+						Transport: upspin.Remote,
+						NetAddr:   "localhost:123",
+					},
+					Reference: "bazref",
+				},
+				Offset: 0,
+				Size:   24,
+			},
+		},
+		Writer:     "foo@example.com",
+		Name:       "foo@example.com/bar/baz",
+		SignedName: "foo@example.com/bar/baz",
+	}
+	put(t, s, baz)
+	baz.Writer = "qux@example.com"
+	baz.Blocks[0].Location.Reference = "bazref2"
+	baz.Blocks[0].Size = 40
+	put(t, s, baz)
+
+	bazp, _ := path.Parse(baz.Name)
+
+	/// Lookup
+	es, _, err := s.LookupAll(ctx, bazp)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(es) != 3 {
+		t.Fatalf("wrong number of entries: %d", len(es))
+	}
+	e := es[len(es)-1]
+	if e.Name != "foo@example.com/bar/baz" {
+		t.Errorf("wrong name for baz: %s", e.Name)
+	}
+	if e.Name != e.SignedName {
+		t.Errorf("signed name not equal to name: %s", e.SignedName)
+	}
+	if e.Blocks != nil {
+		t.Errorf("baz contains blocks: %v", e.Blocks)
+	}
+	if e.Packing != upspin.PlainPack {
+		t.Errorf("incorrect packing for baz: %x", e.Packing)
+	}
+	if string(e.Packdata) != "packd" {
+		t.Errorf("incorrect packdata for baz: %v", e.Packdata)
+	}
+	if e.Writer != "qux@example.com" {
+		t.Errorf("wrong writer for baz: %s", e.Writer)
+	}
+	if es[1].Attr != upspin.AttrDirectory {
+		t.Errorf("bar not a directory: %v", es[1])
+	}
+	if e.Sequence != 4 {
+		t.Errorf("wrong sequence for baz: %d", e.Sequence)
+	}
+	if es[1].Sequence != 4 {
+		t.Errorf("wrong sequence for bar: %d", es[1].Sequence)
+	}
+	if es[0].Sequence != 4 {
+		t.Errorf("wrong sequence for root: %d", es[0].Sequence)
+	}
+}
+
+func testDelete(t *testing.T, s state.State) {
+	ctx := context.Background()
+
+	/// Puts
+	put(t, s, dir("foo@example.com/"), file("foo@example.com/bar"))
+
+	/// Delete
+	barp, _ := path.Parse("foo@example.com/bar")
+	if err := s.Delete(ctx, barp); err != nil {
+		t.Error(err)
+	}
+
+	/// LookupAll doesn't return deleted
+	es, _, err := s.LookupAll(ctx, barp)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(es) != 1 {
+		t.Errorf("Entry not deleted: %v", es)
+	}
+	if es[0].Sequence != 3 {
+		t.Errorf("Root sequence not incremented on delete: %d", es[0].Sequence)
+	}
+
+	/// The path can be put again, with a new sequence
+	put(t, s, file("foo@example.com/bar"))
+	e, err := s.Lookup(ctx, "foo@example.com/bar")
+	if err != nil {
+		t.Fatal(err)
+	} else if e == nil {
+		t.Fatal("entry not recreated")
+	}
+	if e.Sequence != 4 {
+		t.Errorf("wrong sequence for recreated entry: %d", e.Sequence)
+	}
+}
+
+// LookupAll stops at the first link along the path.
+func testLookupAllLink(t *testing.T, s state.State) {
+	ctx := context.Background()
+	put(t, s,
+		dir("foo@example.com/"),
+		dir("foo@example.com/bar"),
+		link("foo@example.com/bar/baz", "foo@example.com/qux"),
+	)
+
+	p, _ := path.Parse("foo@example.com/bar/baz/quux")
+	es, ents, err := s.LookupAll(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 3 || len(ents) != 3 {
+		t.Fatalf("wrong number of entries: %d, %d handles", len(es), len(ents))
+	}
+	if ents[2].Path.Path() != "foo@example.com/bar/baz" || ents[2].Attr != upspin.AttrLink {
+		t.Errorf("wrong handle for the link: %v", ents[2])
+	}
+	if !es[2].IsLink() || es[2].Link != "foo@example.com/qux" {
+		t.Errorf("last entry not the link: %v", es[2])
+	}
+}
+
+// Lookup returns complete entries, and nil for paths that don't exist.
+func testLookup(t *testing.T, s state.State) {
+	ctx := context.Background()
+	baz := file("foo@example.com/baz")
+	baz.Blocks = []upspin.DirBlock{
+		{
+			Location: upspin.Location{
+				Endpoint:  upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:123"},
+				Reference: "ref0",
+			},
+			Size: 10,
+		},
+		{
+			Location: upspin.Location{
+				Endpoint:  upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:123"},
+				Reference: "ref1",
+			},
+			Offset:   10,
+			Size:     5,
+			Packdata: []byte("blockpackd"),
+		},
+	}
+	put(t, s, dir("foo@example.com/"), baz)
+
+	e, err := s.Lookup(ctx, "foo@example.com/baz")
+	if err != nil {
+		t.Fatal(err)
+	} else if e == nil {
+		t.Fatal("entry not found")
+	}
+	if len(e.Blocks) != 2 {
+		t.Fatalf("wrong number of blocks: %d", len(e.Blocks))
+	}
+	for i, b := range e.Blocks {
+		if b.Location != baz.Blocks[i].Location || b.Offset != baz.Blocks[i].Offset || b.Size != baz.Blocks[i].Size {
+			t.Errorf("block %d differs: %v, want %v", i, b, baz.Blocks[i])
+		}
+	}
+	if string(e.Blocks[1].Packdata) != "blockpackd" {
+		t.Errorf("wrong block packdata: %v", e.Blocks[1].Packdata)
+	}
+
+	if e, err := s.Lookup(ctx, "foo@example.com/qux"); err != nil {
+		t.Error(err)
+	} else if e != nil {
+		t.Errorf("entry returned for non-existent path: %v", e)
+	}
+}
+
+// LookupElem returns an empty entry and no error when the root for the
+// requested does not exist.
+func testLookupElemNoRoot(t *testing.T, s state.State) {
+	ctx := context.Background()
+
+	p, _ := path.Parse("a@b.com/foo/bar")
+	e, err := s.LookupElem(ctx, p)
+	if err != nil {
+		t.Error(err)
+	}
+	if e.Seq != 0 {
+		t.Errorf("non-empty entry: %v", e)
+	}
+	if e.Path.NElem() > 0 {
+		t.Errorf("wrong number of elements: %d", e.Path.NElem())
+	}
+}
+
+// LookupElem returns the root path when no other elements of the rquested path
+// match.
+func testLookupElemOnlyRoot(t *testing.T, s state.State) {
+	ctx := context.Background()
+	put(t, s, dir("a@b.com/"))
+
+	p, _ := path.Parse("a@b.com/foo/bar")
+	e, err := s.LookupElem(ctx, p)
+	if err != nil {
+		t.Error(err)
+	}
+	if e.Seq < upspin.SeqBase {
+		t.Errorf("invalid sequence: %d", e.Seq)
+	}
+	if e.Path.String() != "a@b.com/" {
+		t.Errorf("path doesn't match root: %s", e.Path.String())
+	}
+}
+
+// LookupElem returns a partial path that prefixes the requested path when the
+// requested path does not exist.
+func testLookupElemPartial(t *testing.T, s state.State) {
+	ctx := context.Background()
+	put(t, s, dir("a@b.com/"), dir("a@b.com/foo"))
+
+	p, _ := path.Parse("a@b.com/foo/bar/baz")
+	e, err := s.LookupElem(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Path.String() != "a@b.com/foo" {
+		t.Errorf("wrong path: %s", e.Path)
+	}
+	if e.Seq != 2 {
+		t.Errorf("wrong sequence: %d", e.Seq)
+	}
+}
+
+// LookupElem returns AttrNone when the returned entry is a file, AttrDirectory
+// when it is a directory, and AttrLink when it is a link.
+func testLookupElemAttr(t *testing.T, s state.State) {
+	ctx := context.Background()
+	put(t, s,
+		dir("a@b.com/"),
+		dir("a@b.com/dir"),
+		file("a@b.com/file"),
+		link("a@b.com/link", "a@b.com/file"),
+	)
+
+	for name, attr := range map[upspin.PathName]upspin.Attribute{
+		"a@b.com/dir":        upspin.AttrDirectory,
+		"a@b.com/file/foo":   upspin.AttrNone,
+		"a@b.com/link/foo":   upspin.AttrLink,
+		"a@b.com/dir/foo":    upspin.AttrDirectory,
+		"a@b.com/nothing/it": upspin.AttrDirectory,
+	} {
+		p, _ := path.Parse(name)
+		e, err := s.LookupElem(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Attr != attr {
+			t.Errorf("wrong attribute for %s: %v", name, e.Attr)
+		}
+	}
+}
+
+// List returns the children of a directory, which Get resolves to complete
+// entries.
+func testListGet(t *testing.T, s state.State) {
+	ctx := context.Background()
+	put(t, s,
+		dir("a@b.com/"),
+		dir("a@b.com/dir"),
+		file("a@b.com/dir/file"),
+		file("a@b.com/file"),
+		link("a@b.com/link", "a@b.com/file"),
+	)
+
+	p, _ := path.Parse("a@b.com/")
+	root, err := s.LookupElem(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents, err := s.List(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []upspin.PathName{"a@b.com/dir", "a@b.com/file", "a@b.com/link"}
+	if len(ents) != len(want) {
+		t.Fatalf("wrong number of entries: %v", ents)
+	}
+	for i, ent := range ents {
+		if ent.Path.Path() != want[i] {
+			t.Errorf("wrong entry %d: %s, want %s", i, ent.Path, want[i])
+		}
+	}
+
+	e, err := s.Get(ctx, ents[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "a@b.com/file" || e.Packing != upspin.PlainPack {
+		t.Errorf("wrong entry returned by Get: %v", e)
+	}
+
+	// Files have no children.
+	ents, err = s.List(ctx, ents[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 0 {
+		t.Errorf("file has children: %v", ents)
+	}
+}
+
+// Handles returned by lookups keep identifying the versions they resolved
+// after the tree is modified.
+func testHandles(t *testing.T, s state.State) {
+	ctx := context.Background()
+	put(t, s,
+		dir("a@b.com/"),
+		dir("a@b.com/dir"),
+		file("a@b.com/dir/file"),
+		file("a@b.com/dir/other"),
+	)
+
+	p, _ := path.Parse("a@b.com/dir/file")
+	es, ents, err := s.LookupAll(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 3 {
+		t.Fatalf("wrong number of handles: %v", ents)
+	}
+	for i, ent := range ents {
+		if ent.Path.Path() != es[i].Name || ent.Seq != es[i].Sequence {
+			t.Errorf("handle %d does not match entry %v: %v", i, es[i], ent)
+		}
+	}
+	dirEnt, fileEnt := ents[1], ents[2]
+
+	/// Modify the tree
+	f := file("a@b.com/dir/file")
+	f.Packdata = []byte("new")
+	put(t, s, f, file("a@b.com/dir/new"), dir("a@b.com/dir/sub"), file("a@b.com/dir/sub/file"))
+	otherp, _ := path.Parse("a@b.com/dir/other")
+	if err := s.Delete(ctx, otherp); err != nil {
+		t.Fatal(err)
+	}
+
+	/// The old versions are unchanged
+	e, err := s.Get(ctx, fileEnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Packdata) != 0 || e.Sequence != 3 {
+		t.Errorf("wrong version returned by Get: %v", e)
+	}
+	old, err := s.List(ctx, dirEnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 2 || old[0].Path.Path() != "a@b.com/dir/file" || old[0].Id != fileEnt.Id ||
+		old[1].Path.Path() != "a@b.com/dir/other" || old[1].Seq != 4 {
+		t.Errorf("wrong entries in old version of directory: %v", old)
+	}
+
+	/// The current version
+	dirp, _ := path.Parse("a@b.com/dir")
+	cur, err := s.LookupElem(ctx, dirp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.Id != dirEnt.Id || cur.Seq != 9 {
+		t.Errorf("wrong handle for current directory: %v", cur)
+	}
+	ents, err = s.List(ctx, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []upspin.PathName{"a@b.com/dir/file", "a@b.com/dir/new", "a@b.com/dir/sub"}
+	if len(ents) != len(want) {
+		t.Fatalf("wrong entries in current directory: %v", ents)
+	}
+	for i, ent := range ents {
+		if ent.Path.Path() != want[i] {
+			t.Errorf("wrong entry %d: %s, want %s", i, ent.Path, want[i])
+		}
+	}
+	if ents[2].Attr != upspin.AttrDirectory || ents[2].Seq != 8 {
+		t.Errorf("wrong handle for subdirectory: %v", ents[2])
+	}
+	e, err = s.Get(ctx, ents[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Packdata) != "new" || e.Sequence != 5 {
+		t.Errorf("wrong version returned by Get: %v", e)
+	}
+}
+
+// Skipped for states that don't implement state.History.
+func testHistory(t *testing.T, s state.State) {
+	h, ok := s.(state.History)
+	if !ok {
+		t.Skip("state.History not implemented")
+	}
+	ctx := context.Background()
+
+	v1 := file("foo@example.com/bar")
+	v1.Time = 1000
+	v1.Blocks = []upspin.DirBlock{{
+		Location: upspin.Location{
+			Endpoint:  upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:123"},
+			Reference: "v1",
+		},
+		Size: 1,
+	}}
+	v2 := file("foo@example.com/bar")
+	v2.Writer = "baz@example.com"
+	put(t, s, dir("foo@example.com/"), v1, v2)
+	barp, _ := path.Parse("foo@example.com/bar")
+	if err := s.Delete(ctx, barp); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := h.Versions(ctx, "foo@example.com/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 3 {
+		t.Fatalf("wrong number of versions: %v", vs)
+	}
+	if vs[0].Time != 1000 || vs[0].Sequence != 2 || vs[0].Writer != "foo@example.com" || vs[0].Deleted ||
+		vs[1].Writer != "baz@example.com" || !vs[2].Deleted || vs[2].Sequence != 4 {
+		t.Errorf("wrong versions: %v", vs)
+	}
+
+	e, err := h.Version(ctx, "foo@example.com/bar", vs[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Time != 1000 || e.Sequence != 2 || len(e.Blocks) != 1 || e.Blocks[0].Location.Reference != "v1" {
+		t.Errorf("wrong entry for first version: %v", e)
+	}
+
+	for _, id := range []int64{vs[2].Id, vs[0].Id + 1000} {
+		if e, err := h.Version(ctx, "foo@example.com/bar", id); err != nil {
+			t.Error(err)
+		} else if e != nil {
+			t.Errorf("entry returned for operation %d: %v", id, e)
+		}
+	}
+	if e, err := h.Version(ctx, "foo@example.com/", vs[0].Id); err != nil {
+		t.Error(err)
+	} else if e != nil {
+		t.Errorf("entry returned for operation on another path: %v", e)
+	}
+}
+
+// Skipped for states that don't implement state.Tree. The hashes are those
+// defined by state.NodeHash, so that trees held by different implementations
+// can be compared.
+func testTree(t *testing.T, s state.State) {
+	tr, ok := s.(state.Tree)
+	if !ok {
+		t.Skip("state.Tree not implemented")
+	}
+	ctx := context.Background()
+
+	root, sub := dir("foo@example.com/"), dir("foo@example.com/dir")
+	bar := file("foo@example.com/bar")
+	bar.Time = 1000
+	bar.Blocks = []upspin.DirBlock{{
+		Location: upspin.Location{
+			Endpoint:  upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:123"},
+			Reference: "bar",
+		},
+		Size: 1,
+	}}
+	ln := link("foo@example.com/dir/link", "foo@example.com/bar")
+	put(t, s, root, bar, sub, ln)
+
+	hash := func(name upspin.PathName) []byte {
+		t.Helper()
+		n, err := tr.Node(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n.Hash
+	}
+	hBar, hLink := state.NodeHash(bar, nil), state.NodeHash(ln, nil)
+	hSub := state.NodeHash(sub, state.Sum(nil).Add(ln.Name, hLink))
+	hRoot := state.NodeHash(root, state.Sum(nil).Add(bar.Name, hBar).Add(sub.Name, hSub))
+	if got := hash(root.Name); string(got) != string(hRoot) {
+		t.Errorf("root hash: got %x, want %x", got, hRoot)
+	}
+
+	ns, err := tr.Children(ctx, root.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 2 || ns[0].Name != bar.Name || ns[0].Dir || string(ns[0].Hash) != string(hBar) ||
+		ns[1].Name != sub.Name || !ns[1].Dir || string(ns[1].Hash) != string(hSub) {
+		t.Errorf("wrong children: %v", ns)
+	}
+
+	// Removing the link restores the hashes of an empty directory, and
+	// times are not covered.
+	lnp, _ := path.Parse(ln.Name)
+	if err := s.Delete(ctx, lnp); err != nil {
+		t.Fatal(err)
+	}
+	bar.Time = 2000
+	put(t, s, bar)
+	hRoot = state.NodeHash(root, state.Sum(nil).Add(bar.Name, hBar).Add(sub.Name, state.NodeHash(sub, nil)))
+	if got := hash(root.Name); string(got) != string(hRoot) {
+		t.Errorf("root hash after delete: got %x, want %x", got, hRoot)
+	}
+	if got := hash(ln.Name); got != nil {
+		t.Errorf("hash returned for deleted entry: %x", got)
+	}
+}
+
+// Operations on paths with a missing ancestor fail, without changing the tree.
+func testMissingAncestor(t *testing.T, s state.State) {
+	ctx := context.Background()
+	put(t, s, dir("foo@example.com/"))
+
+	if err := s.Put(ctx, file("foo@example.com/bar/baz")); err == nil {
+		t.Error("put below a missing directory succeeded")
+	}
+	bazp, _ := path.Parse("foo@example.com/bar/baz")
+	if err := s.Delete(ctx, bazp); err == nil {
+		t.Error("delete below a missing directory succeeded")
+	}
+
+	root, err := s.Lookup(ctx, "foo@example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root == nil || root.Sequence != upspin.SeqBase {
+		t.Errorf("root changed by failed operations: %v", root)
+	}
+	if e, err := s.Lookup(ctx, "foo@example.com/bar/baz"); err != nil {
+		t.Error(err)
+	} else if e != nil {
+		t.Errorf("entry put below a missing directory: %v", e)
+	}
+}
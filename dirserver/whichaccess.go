@@ -2,6 +2,7 @@ package dirserver
 
 import (
 	"context"
+	"log/slog"
 
 	"upspin.io/access"
 	"upspin.io/errors"
@@ -35,10 +36,10 @@ func (d *dialed) WhichAccess(name upspin.PathName) (*upspin.DirEntry, error) {
 	ctx, op := d.setCtx("WhichAccess")
 	d.log = d.log.With("pathname", name)
 
-	p, e, _, ae, err := d.lookup(ctx, name)
+	p, e, _, _, ae, err := d.lookup(ctx, name)
 	if err == upspin.ErrFollowLink {
 		return e, err
-	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) {
+	} else if errors.Is(errors.Invalid, err) || errors.Is(errors.Private, err) || errors.Is(errors.NotExist, err) {
 		return nil, errors.E(op, p.Path(), err)
 	} else if err != nil {
 		return nil, d.internalErr(ctx, op, p.Path(), err)
@@ -48,16 +49,22 @@ func (d *dialed) WhichAccess(name upspin.PathName) (*upspin.DirEntry, error) {
 }
 
 // Returns the access file entry defining access rules for the path.
-// Does not follow links.
+// Does not follow links. The result is cached for the directories walked.
 func (s *server) accessFor(ctx context.Context, p path.Parsed, isDir bool) (*upspin.DirEntry, error) {
 	if !isDir {
 		p = p.Drop(1)
 	}
+	if ae, ok := s.rights.governing(p.Path()); ok {
+		return ae, nil
+	}
+	gen := s.rights.generation()
 
 	var ae *upspin.DirEntry
 	var err error
+	var walked []upspin.PathName
 	for i := p.NElem(); i >= 0; i-- {
 		dir := p.Path()
+		walked = append(walked, dir)
 		if i != 0 {
 			dir += "/"
 		}
@@ -69,48 +76,65 @@ func (s *server) accessFor(ctx context.Context, p path.Parsed, isDir bool) (*ups
 
 		p = p.Drop(1)
 	}
+	if err == nil {
+		s.rights.setGoverning(gen, walked, ae)
+	}
 
 	return ae, err
 }
 
 // can is a wrapper for access.Can(), with the addition that it interprets a
-// nil access file argument as indicating default owner-only access.
+// nil access file argument as indicating default owner-only access. ae is the
+// entry a was parsed from; decisions are cached unless it could not be parsed.
 // Returned errors are either internal or Group file parsing errors, but
 // access.Can() makes it difficult to discern.
-func (d *dialed) can(ctx context.Context, a *access.Access, right access.Right, p path.Parsed) (bool, error) {
+func (d *dialed) can(ctx context.Context, ae *upspin.DirEntry, a *access.Access, right access.Right, p path.Parsed) (bool, error) {
+	k := decisionKey{
+		requester:  d.requester,
+		access:     p.First(0).Path(),
+		seq:        -1,
+		right:      right,
+		accessFile: access.IsAccessFile(p.Path()),
+		groupFile:  access.IsGroupFile(p.Path()),
+	}
+	if ae != nil {
+		k.access, k.seq = ae.Name, ae.Sequence
+	}
+	cacheable := (ae == nil) == (a == nil)
+	if granted, ok := d.rights.decision(k); ok && cacheable {
+		return granted, nil
+	}
+	gen := d.rights.generation()
+
+	groups := a != nil && grantsGroups(a)
 	if a == nil {
 		// TODO remove and update access.Can() to allow nil receiver as a
 		// shortcut for an owner check
 		a, _ = access.New(p.First(0).Path())
 	}
 
+	// access.Can() may or may not return the errors of the loader, so they
+	// are logged here, once, with the result of the check. The cache logs
+	// their causes.
+	var failed []any
 	getGroup := func(n upspin.PathName) ([]byte, error) {
 		g, err := d.cache.GetGroup(ctx, n)
 		if err != nil {
-			// TODO error distinctions:
-			// - local group not parseable: error
-			// - local store server not reachable: warning
-			// - remote dir or store server not reachable: maybe warning?
-			// - remote group not parseable: maybe warning?
-			// - local or remote group not existent: info
-			d.log.WarnContext(
-				ctx,
-				"failed to load group from cache",
-				"group", n,
-			)
+			failed = append(failed, slog.String(string(n), err.Error()))
 		}
 		return g, err
 	}
 	granted, err := a.Can(d.requester, right, p.Path(), getGroup)
-	if err != nil {
-		// TODO if https://github.com/upspin/upspin/issues/489 is fixed this
-		// will begin double-logging the warning from `getGroup()` above
+	if err != nil || len(failed) > 0 {
 		d.log.WarnContext(
 			ctx,
 			"access check failed",
-			"right", access.AnyRight.String(),
+			"right", right.String(),
 			"err", err,
+			slog.Group("groups", failed...),
 		)
+	} else if cacheable {
+		d.rights.setDecision(gen, k, decision{granted, groups})
 	}
 
 	return granted, err
@@ -5,7 +5,7 @@ import (
 	"log/slog"
 	"testing"
 
-	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
 	"upspin.io/access"
 	"upspin.io/upspin"
 )
@@ -26,8 +26,7 @@ func (_ *cache) RemoveGroup(ctx context.Context, n upspin.PathName) error {
 }
 
 func TestWhichAccess(t *testing.T) {
-	st, _ := sqlite.Open(":memory:")
-	defer st.Close()
+	st := memory.New()
 	ctx := context.Background()
 	st.Put(ctx, &upspin.DirEntry{
 		Attr:   upspin.AttrDirectory,
@@ -0,0 +1,195 @@
+package dirserver
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+/*
+Who holds the rights on a path is answered through WhoCan, by the Access file
+governing the path, as found by accessFor, with its groups expanded through the
+cache:
+- users are listed as they appear, including access.AllUsers
+- wildcard users of the form *@domain are listed by their domain
+- groups that can not be retrieved or parsed are listed as unresolved, as any
+  of their members may also hold the right
+The owner is listed with the rights access.Can grants it implicitly, such as
+reading Access and Group files.
+*/
+
+// Rights lists the rights reported by WhoCan.
+var Rights = []access.Right{access.Read, access.Write, access.List, access.Create, access.Delete}
+
+// WhoCan is an administrative query implemented by the servers returned by New
+// and their Dial method.
+type WhoCan interface {
+	// WhoCan returns who holds each right on a path.
+	WhoCan(upspin.PathName) (*Grants, error)
+}
+
+// Grants describes who holds the rights on a path.
+type Grants struct {
+	// The governing Access file, or nil if the default owner-only rights
+	// apply.
+	Access *upspin.DirEntry
+	// Whether the Access file could not be parsed, in which case the
+	// default owner-only rights apply.
+	Malformed bool
+	// The holders of every right in Rights.
+	Rights map[access.Right]*Holders
+}
+
+// Holders lists who holds a right, sorted.
+type Holders struct {
+	Users []upspin.UserName
+	// Domains all of whose users hold the right.
+	Domains []string
+	// Groups that could not be resolved.
+	Unresolved []upspin.PathName
+}
+
+// WhoCan implements WhoCan.
+func (d *dialed) WhoCan(name upspin.PathName) (*Grants, error) {
+	ctx, op := d.setCtx("WhoCan")
+	d.log = d.log.With("pathname", name)
+
+	p, err := path.Parse(name)
+	if err != nil {
+		return nil, errors.E(op, name, errors.Invalid, err)
+	}
+	if d.requester != d.cfg.UserName() {
+		return nil, errors.E(op, p.Path(), errors.Permission)
+	}
+
+	es, _, err := d.state.LookupAll(ctx, p)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	// Rights on the target of a link are governed elsewhere.
+	if n := len(es); n > 0 && n <= p.NElem() && es[n-1].IsLink() {
+		return nil, errors.E(op, p.Path(), errors.Invalid, errors.Errorf("%s is a link", es[n-1].Name))
+	}
+	isDir := len(es) == p.NElem()+1 && es[p.NElem()].IsDir()
+
+	ae, err := d.accessFor(ctx, p, isDir)
+	if err != nil {
+		return nil, d.internalErr(ctx, op, p.Path(), err)
+	}
+	var a *access.Access
+	if ae != nil {
+		if a, err = d.loadAccess(ctx, ae); err != nil {
+			return nil, d.internalErr(ctx, op, p.Path(), err)
+		}
+	}
+
+	g := &Grants{Access: ae, Malformed: ae != nil && a == nil, Rights: make(map[access.Right]*Holders)}
+	ex := &expansion{d: d, groups: make(map[upspin.PathName][]path.Parsed), failed: make(map[upspin.PathName]bool)}
+	for _, r := range Rights {
+		g.Rights[r] = ex.holders(ctx, a, r, p)
+	}
+
+	return g, nil
+}
+
+// expansion expands the groups of an Access file, retrieving each only once.
+type expansion struct {
+	d *dialed
+	// The members of the groups retrieved, and the groups that could not
+	// be.
+	groups map[upspin.PathName][]path.Parsed
+	failed map[upspin.PathName]bool
+}
+
+// holders returns the holders of a right on a path granted by an Access file,
+// or by the default owner-only rights if nil.
+func (ex *expansion) holders(ctx context.Context, a *access.Access, right access.Right, p path.Parsed) *Holders {
+	owner := p.User()
+	users := make(map[upspin.UserName]bool)
+	domains := make(map[string]bool)
+	unresolved := make(map[upspin.PathName]bool)
+
+	if a == nil {
+		users[owner] = true
+	} else {
+		ex.expand(ctx, a.List(right), users, domains, unresolved, make(map[upspin.PathName]bool))
+		load := func(n upspin.PathName) ([]byte, error) {
+			return ex.d.cache.GetGroup(ctx, n)
+		}
+		if ok, _ := a.Can(owner, right, p.Path(), load); ok {
+			users[owner] = true
+		}
+	}
+
+	h := &Holders{}
+	for u := range users {
+		h.Users = append(h.Users, u)
+	}
+	for dom := range domains {
+		h.Domains = append(h.Domains, dom)
+	}
+	for g := range unresolved {
+		h.Unresolved = append(h.Unresolved, g)
+	}
+	sort.Slice(h.Users, func(i, j int) bool { return h.Users[i] < h.Users[j] })
+	sort.Strings(h.Domains)
+	sort.Slice(h.Unresolved, func(i, j int) bool { return h.Unresolved[i] < h.Unresolved[j] })
+
+	return h
+}
+
+// expand adds the users and domains named by a list of users and groups,
+// recursing into groups not yet visited.
+func (ex *expansion) expand(ctx context.Context, ps []path.Parsed, users map[upspin.UserName]bool, domains map[string]bool, unresolved, visited map[upspin.PathName]bool) {
+	for _, p := range ps {
+		if p.NElem() == 0 {
+			if u := p.User(); strings.HasPrefix(string(u), "*@") {
+				domains[string(u[2:])] = true
+			} else {
+				users[u] = true
+			}
+			continue
+		}
+
+		name := p.Path()
+		if visited[name] {
+			continue
+		}
+		visited[name] = true
+		members, ok := ex.group(ctx, p)
+		if !ok {
+			unresolved[name] = true
+			continue
+		}
+		ex.expand(ctx, members, users, domains, unresolved, visited)
+	}
+}
+
+// group returns the members of a group, and whether it could be resolved.
+func (ex *expansion) group(ctx context.Context, p path.Parsed) ([]path.Parsed, bool) {
+	name := p.Path()
+	if ms, ok := ex.groups[name]; ok {
+		return ms, true
+	} else if ex.failed[name] {
+		return nil, false
+	}
+
+	data, err := ex.d.cache.GetGroup(ctx, name)
+	var ms []path.Parsed
+	if err == nil {
+		ms, err = access.ParseGroup(p, data)
+	}
+	if err != nil {
+		ex.d.log.InfoContext(ctx, "group unresolved", "group", name, "err", err)
+		ex.failed[name] = true
+		return nil, false
+	}
+	ex.groups[name] = ms
+
+	return ms, true
+}
@@ -0,0 +1,87 @@
+package dirserver
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/dirserver/memory"
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func TestWhoCan(t *testing.T) {
+	entries := []*upspin.DirEntry{
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/"},
+		{Attr: upspin.AttrDirectory, Writer: "foo@example.com", Name: "foo@example.com/dir"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/dir/file"},
+		{Packing: upspin.PlainPack, Writer: "foo@example.com", Name: "foo@example.com/Access"},
+		{Attr: upspin.AttrDirectory, Writer: "nob@example.com", Name: "nob@example.com/"},
+	}
+
+	c := &groupCache{
+		cache: &cache{map[upspin.PathName]string{
+			"foo@example.com/Access": "read: bar@example.com, foo@example.com/Group/pals, *@example.org\n" +
+				"write: remote@example.net/Group/team",
+		}},
+		groups: map[upspin.PathName]string{
+			// Groups may include each other.
+			"foo@example.com/Group/pals":  "baz@example.com, foo@example.com/Group/inner",
+			"foo@example.com/Group/inner": "qux@example.com, foo@example.com/Group/pals",
+		},
+	}
+	s := newTestServer(t, memory.New(), c, entries)
+	srv := s.as("srv@example.com")
+
+	g, err := srv.WhoCan("foo@example.com/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Access == nil || g.Access.Name != "foo@example.com/Access" || g.Malformed {
+		t.Errorf("governing Access file: %v, malformed %t", g.Access, g.Malformed)
+	}
+	want := map[access.Right]*Holders{
+		access.Read: {
+			Users:   []upspin.UserName{"bar@example.com", "baz@example.com", "qux@example.com"},
+			Domains: []string{"example.org"},
+		},
+		access.Write:  {Unresolved: []upspin.PathName{"remote@example.net/Group/team"}},
+		access.List:   {},
+		access.Create: {},
+		access.Delete: {},
+	}
+	if !reflect.DeepEqual(g.Rights, want) {
+		for r, h := range g.Rights {
+			t.Errorf("%s: got %+v, want %+v", r, h, want[r])
+		}
+	}
+
+	// The owner may read its Access files.
+	g, err = srv.WhoCan("foo@example.com/Access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := g.Rights[access.Read]; !slices.Contains(h.Users, "foo@example.com") {
+		t.Errorf("owner missing from readers of its Access file: %+v", h)
+	}
+
+	// Without an Access file, only the owner holds rights.
+	g, err = srv.WhoCan("nob@example.com/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Access != nil {
+		t.Errorf("got Access file %s, want none", g.Access.Name)
+	}
+	for _, r := range Rights {
+		if h := g.Rights[r]; !reflect.DeepEqual(h.Users, []upspin.UserName{"nob@example.com"}) {
+			t.Errorf("%s: got %+v, want the owner only", r, h)
+		}
+	}
+
+	foo := s.as("foo@example.com")
+	if _, err := foo.WhoCan("foo@example.com/dir/file"); !errors.Is(errors.Permission, err) {
+		t.Errorf("query by a user other than the server user: got %v, want errors.Permission", err)
+	}
+}
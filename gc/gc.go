@@ -0,0 +1,135 @@
+// Collects store blocks that are no longer referenced by the trees of a
+// directory server.
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Options configures a collection.
+type Options struct {
+	// Blocks used by operations within this period are retained, allowing
+	// earlier versions of files to be retrieved from the log.
+	History time.Duration
+
+	// Blocks used by operations within this period, or put to the store
+	// within it, are retained. It should exceed the time clients take
+	// between putting blocks and putting the entry that references them,
+	// since a client may put a block identical to an unreferenced one.
+	Grace time.Duration
+
+	// Collect from stores that can not report when blocks were put, which
+	// Collect otherwise refuses. Only the grace period of operations is
+	// then observed, so a block put again by a client just before it is
+	// deleted is lost.
+	NoGrace bool
+
+	// The number of blocks deleted between recording progress. Defaults to
+	// 100.
+	Batch int
+
+	// Report what would be deleted without deleting anything.
+	DryRun bool
+}
+
+// Failure records a block that could not be deleted.
+type Failure struct {
+	Reference upspin.Reference
+	Err       error
+}
+
+func (f Failure) String() string {
+	return fmt.Sprintf("%s: %v", f.Reference, f.Err)
+}
+
+// Report summarizes a collection.
+type Report struct {
+	// The number of unreachable blocks found.
+	Unreachable int
+	// Unreachable blocks spared because they were put within the grace
+	// period.
+	Recent int
+	// Blocks deleted, or that would have been in a dry run.
+	Deleted []upspin.Reference
+	Failed  []Failure
+}
+
+// Stored is implemented by store servers that can report when a block was last
+// put, as required by Collect for the grace period unless NoGrace is set.
+type Stored interface {
+	Stored(upspin.Reference) (time.Time, error)
+}
+
+// Collect deletes the blocks of store that are unreachable from the directory
+// state, and records them as collected. store must be dialed as its server
+// user, the only user permitted to delete blocks.
+//
+// Only blocks referenced at some point by the log are considered; blocks never
+// referenced by any entry are not known to the directory server. Failures to
+// delete individual blocks are reported and retried by the next collection.
+func Collect(ctx context.Context, st *sqlite.State, store upspin.StoreServer, opts Options, log *slog.Logger) (Report, error) {
+	var r Report
+	if opts.Batch <= 0 {
+		opts.Batch = 100
+	}
+	stored, _ := store.(Stored)
+	if stored == nil && !opts.NoGrace {
+		return r, errors.Str("store can not report when blocks were put; set NoGrace to collect regardless")
+	}
+	retain := max(opts.History, opts.Grace)
+	before := upspin.TimeFromGo(time.Now().Add(-retain))
+
+	refs, head, err := st.Garbage(ctx, store.Endpoint(), before)
+	if err != nil {
+		return r, err
+	}
+	r.Unreachable = len(refs)
+
+	for len(refs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return r, err
+		}
+
+		n := min(opts.Batch, len(refs))
+		var deleted []upspin.Reference
+		for _, ref := range refs[:n] {
+			if stored != nil {
+				t, err := stored.Stored(ref)
+				if err == nil && time.Since(t) < opts.Grace {
+					r.Recent++
+					continue
+				} else if err != nil && !errors.Is(errors.NotExist, err) {
+					r.Failed = append(r.Failed, Failure{ref, err})
+					continue
+				}
+			}
+
+			if !opts.DryRun {
+				err := store.Delete(ref)
+				if err != nil && !errors.Is(errors.NotExist, err) {
+					r.Failed = append(r.Failed, Failure{ref, err})
+					continue
+				}
+			}
+			deleted = append(deleted, ref)
+		}
+		refs = refs[n:]
+
+		if !opts.DryRun && len(deleted) > 0 {
+			if err := st.MarkCollected(ctx, store.Endpoint(), deleted, head); err != nil {
+				return r, err
+			}
+		}
+		r.Deleted = append(r.Deleted, deleted...)
+		log.DebugContext(ctx, "collected batch", "deleted", len(deleted), "remaining", len(refs), "dry_run", opts.DryRun)
+	}
+
+	return r, nil
+}
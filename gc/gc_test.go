@@ -0,0 +1,130 @@
+package gc
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vvanpo/upspin-fly/dirserver/sqlite"
+	"github.com/vvanpo/upspin-fly/storeserver"
+	"github.com/vvanpo/upspin-fly/storeserver/disk"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st, err := sqlite.Open(filepath.Join(dir, "dir.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	blocks, err := disk.Open(filepath.Join(dir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.SetUserName(config.New(), "srv@example.com")
+	cfg = config.SetStoreEndpoint(cfg, upspin.Endpoint{Transport: upspin.Remote, NetAddr: "store.example.com:443"})
+	store := storeserver.New(cfg, blocks, nil, slog.Default())
+
+	// Operations are applied as by a replica, recorded at old times, so that
+	// they fall outside the history.
+	seq := int64(upspin.SeqBase)
+	apply := func(name upspin.PathName, e *upspin.DirEntry) {
+		err := st.Apply(ctx, sqlite.Operation{Id: seq, Name: name, Time: 1000, Timestamp: 1000, Sequence: seq, Entry: e})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq++
+	}
+	file := func(name upspin.PathName, data string) upspin.Reference {
+		ref, err := store.Put([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		apply(name, &upspin.DirEntry{
+			Name:    name,
+			Packing: upspin.PlainPack,
+			Writer:  "foo@example.com",
+			Time:    1000,
+			Blocks: []upspin.DirBlock{{
+				Location: upspin.Location{Endpoint: cfg.StoreEndpoint(), Reference: ref.Reference},
+				Size:     int64(len(data)),
+			}},
+		})
+		return ref.Reference
+	}
+	apply("foo@example.com/", &upspin.DirEntry{Name: "foo@example.com/", Attr: upspin.AttrDirectory, Writer: "foo@example.com"})
+	old := file("foo@example.com/bar", "old")
+	current := file("foo@example.com/bar", "current")
+	deleted := file("foo@example.com/baz", "deleted")
+	apply("foo@example.com/baz", nil)
+	unreachable := []upspin.Reference{old, deleted}
+	if deleted < old {
+		unreachable = []upspin.Reference{deleted, old}
+	}
+
+	collect := func(opts Options) Report {
+		r, err := Collect(ctx, st, store, opts, slog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Failed) > 0 {
+			t.Fatalf("failures: %v", r.Failed)
+		}
+		return r
+	}
+	exists := func(ref upspin.Reference) bool {
+		_, _, _, err := store.Get(ref)
+		if err != nil && !errors.Is(errors.NotExist, err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	if r := collect(Options{History: time.Since(time.Unix(1000, 0)) + time.Hour}); r.Unreachable != 0 {
+		t.Errorf("blocks within history unreachable: %d", r.Unreachable)
+	}
+
+	// Stores that can not report when blocks were put are only collected from
+	// with NoGrace.
+	type unstored struct{ upspin.StoreServer }
+	if _, err := Collect(ctx, st, unstored{store}, Options{DryRun: true}, slog.Default()); err == nil {
+		t.Error("collected from a store without put times")
+	}
+	if r, err := Collect(ctx, st, unstored{store}, Options{DryRun: true, NoGrace: true}, slog.Default()); err != nil {
+		t.Error(err)
+	} else if len(r.Deleted) != 2 {
+		t.Errorf("wrong blocks collected without put times: %v", r.Deleted)
+	}
+
+	if r := collect(Options{Grace: time.Hour}); r.Recent != 2 || len(r.Deleted) != 0 {
+		t.Errorf("blocks put within grace period collected: %+v", r)
+	}
+
+	r := collect(Options{DryRun: true, Batch: 1})
+	if len(r.Deleted) != 2 || r.Deleted[0] != unreachable[0] || r.Deleted[1] != unreachable[1] {
+		t.Errorf("wrong blocks collected: %v", r.Deleted)
+	}
+	if !exists(old) || !exists(deleted) {
+		t.Error("blocks deleted in dry run")
+	}
+
+	if r := collect(Options{Batch: 1}); len(r.Deleted) != 2 {
+		t.Errorf("wrong blocks collected: %v", r.Deleted)
+	}
+	if exists(old) || exists(deleted) {
+		t.Error("unreachable blocks not deleted")
+	}
+	if !exists(current) {
+		t.Error("reachable block deleted")
+	}
+
+	if r := collect(Options{}); r.Unreachable != 0 {
+		t.Errorf("collected blocks still unreachable: %d", r.Unreachable)
+	}
+}
@@ -3,12 +3,13 @@ module github.com/vvanpo/upspin-fly
 go 1.23.4
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.22.0
 	upspin.io v0.1.0
 )
 
 require (
-	golang.org/x/crypto v0.22.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,27 @@
+package keyserver
+
+import (
+	"upspin.io/upspin"
+)
+
+// Dial implements upspin.Dialer.
+func (s *server) Dial(rc upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
+	requester := rc.UserName()
+	d := &dialed{
+		server:    s,
+		log:       s.log.With("requester", requester),
+		requester: requester,
+	}
+
+	return d, nil
+}
+
+// Endpoint implements upspin.Service.
+func (d *dialed) Endpoint() upspin.Endpoint {
+	return d.server.cfg.KeyEndpoint()
+}
+
+// Close implements upspin.Service.
+func (d *dialed) Close() {
+	d.log.Info("closed")
+}
@@ -0,0 +1,115 @@
+package keyserver
+
+import (
+	"fmt"
+
+	"upspin.io/errors"
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+	"upspin.io/user"
+)
+
+// Lookup implements upspin.KeyServer. Records are public.
+func (d *dialed) Lookup(name upspin.UserName) (*upspin.User, error) {
+	ctx, op := d.setCtx("Lookup")
+	d.log = d.log.With("username", name)
+
+	if _, err := validName(name); err != nil {
+		return nil, errors.E(op, name, errors.Invalid, err)
+	}
+
+	u, err := d.storage.Lookup(ctx, name)
+	if errors.Is(errors.NotExist, err) {
+		return nil, errors.E(op, name, errors.NotExist)
+	} else if err != nil {
+		return nil, d.internalErr(ctx, op, name, err)
+	}
+
+	return u, nil
+}
+
+// Put implements upspin.KeyServer. Users may update their own record, and
+// create records for suffixed variants of their name. Only admins may create
+// records for new users or update those of other users.
+func (d *dialed) Put(u *upspin.User) error {
+	ctx, op := d.setCtx("Put")
+	if u == nil {
+		return errors.E(op, errors.Invalid, errors.Str("nil user"))
+	}
+	d.log = d.log.With("username", u.Name)
+
+	base, err := validName(u.Name)
+	if err != nil {
+		return errors.E(op, u.Name, errors.Invalid, err)
+	}
+	if err := validUser(u); err != nil {
+		return errors.E(op, u.Name, errors.Invalid, err)
+	}
+
+	if !d.admins[d.requester] {
+		if d.requester != u.Name && d.requester != base {
+			return errors.E(op, d.requester, errors.Permission)
+		}
+
+		// Only admins may create records for new users.
+		if d.requester == u.Name && base == u.Name {
+			_, err := d.storage.Lookup(ctx, u.Name)
+			if errors.Is(errors.NotExist, err) {
+				return errors.E(op, d.requester, errors.Permission, errors.Str("user not registered"))
+			} else if err != nil {
+				return d.internalErr(ctx, op, u.Name, err)
+			}
+		}
+	}
+
+	if err := d.storage.Put(ctx, u); err != nil {
+		return d.internalErr(ctx, op, u.Name, err)
+	}
+	d.log.InfoContext(ctx, "user record updated")
+
+	return nil
+}
+
+// validName checks that a user name is canonical and returns the name without
+// its suffix.
+func validName(name upspin.UserName) (upspin.UserName, error) {
+	u, suffix, domain, err := user.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	if u == "*" {
+		return "", errors.Str("wildcard user name")
+	}
+	if clean, err := user.Clean(name); err != nil {
+		return "", err
+	} else if clean != name {
+		return "", fmt.Errorf("user name not canonical, expected %s", clean)
+	}
+
+	if suffix == "" {
+		return name, nil
+	}
+
+	// The user part includes the suffix.
+	return upspin.UserName(u[:len(u)-len(suffix)-1] + "@" + domain), nil
+}
+
+func validUser(u *upspin.User) error {
+	if _, _, err := factotum.ParsePublicKey(u.PublicKey); err != nil {
+		return fmt.Errorf("public key: %w", err)
+	}
+
+	for _, e := range append(append([]upspin.Endpoint(nil), u.Dirs...), u.Stores...) {
+		switch e.Transport {
+		case upspin.Remote:
+			if e.NetAddr == "" {
+				return fmt.Errorf("endpoint %s: missing network address", e)
+			}
+		case upspin.InProcess:
+		default:
+			return fmt.Errorf("endpoint %s: unsupported transport", e)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package keyserver
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/keyserver/sqlite"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/key/keygen"
+	"upspin.io/upspin"
+)
+
+func newServer(t *testing.T) upspin.KeyServer {
+	st, err := sqlite.Open(filepath.Join(t.TempDir(), "key.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	cfg := config.SetUserName(config.New(), "srv@example.com")
+	return New(cfg, st, []upspin.UserName{"admin@example.com"}, slog.Default())
+}
+
+func dial(t *testing.T, s upspin.KeyServer, requester upspin.UserName) upspin.KeyServer {
+	d, err := s.(upspin.Dialer).Dial(config.SetUserName(config.New(), requester), upspin.Endpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d.(upspin.KeyServer)
+}
+
+func newUser(t *testing.T, name upspin.UserName) *upspin.User {
+	pub, _, err := keygen.Generate("p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &upspin.User{
+		Name:      name,
+		Dirs:      []upspin.Endpoint{{Transport: upspin.Remote, NetAddr: "upspin.example.com:443"}},
+		Stores:    []upspin.Endpoint{{Transport: upspin.Remote, NetAddr: "upspin.example.com:443"}},
+		PublicKey: upspin.PublicKey(pub),
+	}
+}
+
+func TestPutLookup(t *testing.T) {
+	s := newServer(t)
+	foo := newUser(t, "foo@example.com")
+
+	if err := dial(t, s, "admin@example.com").Put(foo); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := dial(t, s, "bar@example.com").Lookup("foo@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PublicKey != foo.PublicKey || len(u.Dirs) != 1 || u.Dirs[0] != foo.Dirs[0] ||
+		len(u.Stores) != 1 || u.Stores[0] != foo.Stores[0] {
+		t.Errorf("wrong user record: %v", u)
+	}
+
+	if _, err := s.Lookup("bar@example.com"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("unregistered user found: %v", err)
+	}
+}
+
+// Users may only update their own records, or create suffixed variants of
+// their name, once registered by an admin.
+func TestPermission(t *testing.T) {
+	s := newServer(t)
+
+	foo := dial(t, s, "foo@example.com")
+	if err := foo.Put(newUser(t, "foo@example.com")); !errors.Is(errors.Permission, err) {
+		t.Errorf("unregistered user allowed to create record: %v", err)
+	}
+	if err := s.Put(newUser(t, "foo@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := foo.Put(newUser(t, "foo@example.com")); err != nil {
+		t.Errorf("user not allowed to update own record: %v", err)
+	}
+	if err := foo.Put(newUser(t, "foo+snapshot@example.com")); err != nil {
+		t.Errorf("user not allowed to create suffixed record: %v", err)
+	}
+	if err := foo.Put(newUser(t, "bar@example.com")); !errors.Is(errors.Permission, err) {
+		t.Errorf("user allowed to create record of another: %v", err)
+	}
+	if err := dial(t, s, "bar@example.com").Put(newUser(t, "foo@example.com")); !errors.Is(errors.Permission, err) {
+		t.Errorf("user allowed to update record of another: %v", err)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	s := newServer(t)
+
+	for _, u := range []*upspin.User{
+		newUser(t, "Foo@Example.com"),
+		newUser(t, "*@example.com"),
+		newUser(t, "example.com"),
+		{Name: "foo@example.com", PublicKey: "not a key"},
+		func() *upspin.User {
+			u := newUser(t, "foo@example.com")
+			u.Dirs = []upspin.Endpoint{{Transport: upspin.Remote}}
+			return u
+		}(),
+	} {
+		if err := s.Put(u); !errors.Is(errors.Invalid, err) {
+			t.Errorf("invalid record %v accepted: %v", u, err)
+		}
+	}
+}
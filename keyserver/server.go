@@ -0,0 +1,77 @@
+// Implements an upspin.KeyServer for the users of a self-contained deployment.
+package keyserver
+
+import (
+	"context"
+	"log/slog"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Storage persists user records. Looking up a user that is not present returns
+// errors.NotExist.
+type Storage interface {
+	Lookup(context.Context, upspin.UserName) (*upspin.User, error)
+
+	// Put creates or replaces the record for a user.
+	Put(context.Context, *upspin.User) error
+}
+
+// Implements an upspin.Dialer that returns an upspin.KeyServer.
+type server struct {
+	storage Storage
+	log     *slog.Logger
+
+	// The upspin user the server is running as.
+	cfg upspin.Config
+	// Users allowed to create and update any record, including the server
+	// user.
+	admins map[upspin.UserName]bool
+}
+
+// Implements an upspin.KeyServer serving a user that must be authenticated.
+type dialed struct {
+	*server
+	log       *slog.Logger
+	requester upspin.UserName
+}
+
+// New returns an upspin.KeyServer serving as the user in cfg, whose Dial method
+// returns servers for other users. Only the server user and the given admins
+// may create records; other users may only update their own.
+func New(cfg upspin.Config, st Storage, admins []upspin.UserName, log *slog.Logger) upspin.KeyServer {
+	s := &server{
+		storage: st,
+		log:     log,
+		cfg:     cfg,
+		admins:  map[upspin.UserName]bool{cfg.UserName(): true},
+	}
+	for _, a := range admins {
+		s.admins[a] = true
+	}
+
+	return &dialed{
+		server:    s,
+		log:       log.With("requester", cfg.UserName()),
+		requester: cfg.UserName(),
+	}
+}
+
+func (d *dialed) setCtx(op string) (context.Context, errors.Op) {
+	op = "key." + op
+	d.log = d.log.With("operation", op)
+
+	return context.TODO(), errors.Op(op)
+}
+
+// Logs and formats an internal error to pass to the user, eliding details.
+func (d *dialed) internalErr(ctx context.Context, op errors.Op, name upspin.UserName, err error) error {
+	d.log.ErrorContext(
+		ctx,
+		"internal error returned to user",
+		"err", err,
+	)
+
+	return errors.E(op, name, errors.Internal)
+}
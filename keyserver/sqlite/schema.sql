@@ -0,0 +1,9 @@
+-- User records served by the key server. Endpoints are formatted as by
+-- upspin.Endpoint.String() and separated by newlines.
+
+CREATE TABLE IF NOT EXISTS key_user (
+	name TEXT PRIMARY KEY NOT NULL,
+	public_key TEXT NOT NULL,
+	dirs TEXT NOT NULL,
+	stores TEXT NOT NULL
+)
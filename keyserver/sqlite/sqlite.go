@@ -0,0 +1,112 @@
+// Implements keyserver.Storage in a SQLite database, which may be shared with
+// the directory server's state.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+//go:embed schema.sql
+var schema string
+
+type Storage struct {
+	db *sql.DB
+}
+
+// Open accepts a SQLite database file path and initializes it, creating the
+// schema if not present.
+func Open(p string) (*Storage, error) {
+	db, err := sql.Open("sqlite3", "file:"+p+"?_fk=true&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Storage{db}, nil
+}
+
+// Close closes the database.
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Lookup implements keyserver.Storage.
+func (s *Storage) Lookup(ctx context.Context, name upspin.UserName) (*upspin.User, error) {
+	u := &upspin.User{Name: name}
+	var dirs, stores string
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT public_key, dirs, stores FROM key_user WHERE name = ?`,
+		name,
+	).Scan(&u.PublicKey, &dirs, &stores)
+	if err == sql.ErrNoRows {
+		return nil, errors.E(name, errors.NotExist)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if u.Dirs, err = parseEndpoints(dirs); err != nil {
+		return nil, fmt.Errorf("directory endpoints of %s: %w", name, err)
+	}
+	if u.Stores, err = parseEndpoints(stores); err != nil {
+		return nil, fmt.Errorf("store endpoints of %s: %w", name, err)
+	}
+
+	return u, nil
+}
+
+// Put implements keyserver.Storage.
+func (s *Storage) Put(ctx context.Context, u *upspin.User) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO key_user VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			public_key = excluded.public_key,
+			dirs = excluded.dirs,
+			stores = excluded.stores`,
+		u.Name,
+		u.PublicKey,
+		formatEndpoints(u.Dirs),
+		formatEndpoints(u.Stores),
+	)
+
+	return err
+}
+
+func formatEndpoints(es []upspin.Endpoint) string {
+	s := make([]string, len(es))
+	for i, e := range es {
+		s[i] = e.String()
+	}
+
+	return strings.Join(s, "\n")
+}
+
+func parseEndpoints(s string) ([]upspin.Endpoint, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var es []upspin.Endpoint
+	for _, f := range strings.Split(s, "\n") {
+		e, err := upspin.ParseEndpoint(f)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, *e)
+	}
+
+	return es, nil
+}
@@ -0,0 +1,111 @@
+// Implements storeserver.Storage on a local directory, storing each block in
+// its own file.
+package disk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+type Storage struct {
+	root string
+}
+
+// Open accepts the path of a directory in which to store blocks, creating it if
+// not present.
+func Open(root string) (*Storage, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &Storage{root}, nil
+}
+
+// Blocks are spread over subdirectories named by the first two characters of
+// their reference, to keep directories small.
+func (s *Storage) path(ref upspin.Reference) string {
+	r := string(ref)
+	if len(r) < 3 {
+		return filepath.Join(s.root, r)
+	}
+
+	return filepath.Join(s.root, r[:2], r[2:])
+}
+
+// Get implements storeserver.Storage.
+func (s *Storage) Get(ctx context.Context, ref upspin.Reference) ([]byte, error) {
+	data, err := os.ReadFile(s.path(ref))
+	if os.IsNotExist(err) {
+		return nil, errors.E(errors.NotExist, err)
+	}
+
+	return data, err
+}
+
+// Put implements storeserver.Storage. The block is written to a temporary file
+// and renamed into place, so that readers never observe partial blocks.
+func (s *Storage) Put(ctx context.Context, ref upspin.Reference, data []byte) error {
+	p := s.path(ref)
+	if _, err := os.Stat(p); err == nil {
+		now := time.Now()
+		return os.Chtimes(p, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("write block: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("sync block: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Stored implements storeserver.Storage, returning the modification time of
+// the block's file.
+func (s *Storage) Stored(ctx context.Context, ref upspin.Reference) (time.Time, error) {
+	fi, err := os.Stat(s.path(ref))
+	if os.IsNotExist(err) {
+		return time.Time{}, errors.E(errors.NotExist, err)
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
+
+// Delete implements storeserver.Storage.
+func (s *Storage) Delete(ctx context.Context, ref upspin.Reference) error {
+	err := os.Remove(s.path(ref))
+	if os.IsNotExist(err) {
+		return errors.E(errors.NotExist, err)
+	}
+
+	return err
+}
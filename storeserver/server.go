@@ -0,0 +1,105 @@
+// Implements an upspin.StoreServer, storing blocks by content-addressed
+// references.
+package storeserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Storage persists the blocks of a store server. Retrieving or deleting a
+// reference that is not present returns errors.NotExist.
+type Storage interface {
+	Get(context.Context, upspin.Reference) ([]byte, error)
+
+	// Put stores data under a reference. Storing a reference that is already
+	// present must succeed, and updates the time it was stored.
+	Put(context.Context, upspin.Reference, []byte) error
+
+	Delete(context.Context, upspin.Reference) error
+
+	// Stored returns the last time a reference was put.
+	Stored(context.Context, upspin.Reference) (time.Time, error)
+}
+
+// Implements an upspin.Dialer that returns an upspin.StoreServer.
+type server struct {
+	storage Storage
+	log     *slog.Logger
+
+	// The upspin user the server is running as; the only user allowed to
+	// delete blocks.
+	cfg upspin.Config
+	// Users allowed to put blocks, in addition to the server user.
+	writers map[upspin.UserName]bool
+}
+
+// Implements an upspin.StoreServer serving a user that must be authenticated.
+type dialed struct {
+	*server
+	log       *slog.Logger
+	requester upspin.UserName
+}
+
+// New returns an upspin.StoreServer serving as the user in cfg, whose Dial
+// method returns servers for other users. Only the server user and the given
+// writers may put blocks.
+func New(cfg upspin.Config, st Storage, writers []upspin.UserName, log *slog.Logger) upspin.StoreServer {
+	s := &server{
+		storage: st,
+		log:     log,
+		cfg:     cfg,
+		writers: make(map[upspin.UserName]bool),
+	}
+	for _, w := range writers {
+		s.writers[w] = true
+	}
+
+	return &dialed{
+		server:    s,
+		log:       log.With("requester", cfg.UserName()),
+		requester: cfg.UserName(),
+	}
+}
+
+func (d *dialed) setCtx(op string) (context.Context, errors.Op) {
+	op = "store." + op
+	d.log = d.log.With("operation", op)
+
+	return context.TODO(), errors.Op(op)
+}
+
+// Logs and formats an internal error to pass to the user, eliding details.
+func (d *dialed) internalErr(ctx context.Context, op errors.Op, ref upspin.Reference, err error) error {
+	d.log.ErrorContext(
+		ctx,
+		"internal error returned to user",
+		"err", err,
+	)
+
+	return errors.E(op, errors.Internal, errors.Errorf("reference %s", ref))
+}
+
+// reference returns the content-addressed reference for data.
+func reference(data []byte) upspin.Reference {
+	sum := sha256.Sum256(data)
+	return upspin.Reference(hex.EncodeToString(sum[:]))
+}
+
+// validReference reports whether ref could have been returned by reference, so
+// that arbitrary strings are never passed to the storage.
+func validReference(ref upspin.Reference) bool {
+	if len(ref) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(string(ref))
+
+	return err == nil && strings.ToLower(string(ref)) == string(ref)
+}
@@ -0,0 +1,9 @@
+-- Blocks are keyed by their content-addressed reference, and may be shared by
+-- any number of directory entries.
+
+CREATE TABLE IF NOT EXISTS store_block (
+	reference TEXT PRIMARY KEY NOT NULL,
+	data BLOB NOT NULL,
+	-- The last time the block was put, in seconds since the Unix epoch
+	stored INTEGER DEFAULT (unixepoch()) NOT NULL
+)
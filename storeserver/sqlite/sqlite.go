@@ -0,0 +1,106 @@
+// Implements storeserver.Storage as blobs in a SQLite database, which may be
+// shared with the directory server's state.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+//go:embed schema.sql
+var schema string
+
+type Storage struct {
+	db *sql.DB
+}
+
+// Open accepts a SQLite database file path and initializes it, creating the
+// schema if not present.
+func Open(p string) (*Storage, error) {
+	db, err := sql.Open("sqlite3", "file:"+p+"?_fk=true&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Storage{db}, nil
+}
+
+// Close closes the database.
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Get implements storeserver.Storage.
+func (s *Storage) Get(ctx context.Context, ref upspin.Reference) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT data FROM store_block WHERE reference = ?`,
+		ref,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errors.E(errors.NotExist, errors.Errorf("reference %s", ref))
+	}
+
+	return data, err
+}
+
+// Put implements storeserver.Storage.
+func (s *Storage) Put(ctx context.Context, ref upspin.Reference, data []byte) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO store_block (reference, data) VALUES (?, ?)
+		ON CONFLICT (reference) DO UPDATE SET stored = unixepoch()`,
+		ref,
+		data,
+	)
+
+	return err
+}
+
+// Stored implements storeserver.Storage.
+func (s *Storage) Stored(ctx context.Context, ref upspin.Reference) (time.Time, error) {
+	var t int64
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT stored FROM store_block WHERE reference = ?`,
+		ref,
+	).Scan(&t)
+	if err == sql.ErrNoRows {
+		return time.Time{}, errors.E(errors.NotExist, errors.Errorf("reference %s", ref))
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(t, 0), nil
+}
+
+// Delete implements storeserver.Storage.
+func (s *Storage) Delete(ctx context.Context, ref upspin.Reference) error {
+	r, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM store_block WHERE reference = ?`,
+		ref,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.E(errors.NotExist, errors.Errorf("reference %s", ref))
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package storeserver
+
+import (
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Get implements upspin.StoreServer. Blocks are readable by anyone; their
+// contents are protected by their packing.
+func (d *dialed) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	ctx, op := d.setCtx("Get")
+	d.log = d.log.With("reference", ref)
+
+	if !validReference(ref) {
+		return nil, nil, nil, errors.E(op, errors.NotExist, errors.Errorf("reference %s", ref))
+	}
+
+	data, err := d.storage.Get(ctx, ref)
+	if errors.Is(errors.NotExist, err) {
+		return nil, nil, nil, errors.E(op, errors.NotExist, errors.Errorf("reference %s", ref))
+	} else if err != nil {
+		return nil, nil, nil, d.internalErr(ctx, op, ref, err)
+	}
+	if reference(data) != ref {
+		return nil, nil, nil, d.internalErr(ctx, op, ref, errors.Str("stored data does not match reference"))
+	}
+
+	return data, &upspin.Refdata{Reference: ref}, nil, nil
+}
+
+// Put implements upspin.StoreServer. Only the server user and the configured
+// writers may put blocks.
+func (d *dialed) Put(data []byte) (*upspin.Refdata, error) {
+	ctx, op := d.setCtx("Put")
+
+	if d.requester != d.cfg.UserName() && !d.writers[d.requester] {
+		return nil, errors.E(op, d.requester, errors.Permission)
+	}
+
+	ref := reference(data)
+	if err := d.storage.Put(ctx, ref, data); err != nil {
+		return nil, d.internalErr(ctx, op, ref, err)
+	}
+
+	return &upspin.Refdata{Reference: ref}, nil
+}
+
+// Delete implements upspin.StoreServer. Only the server user may delete
+// blocks.
+func (d *dialed) Delete(ref upspin.Reference) error {
+	ctx, op := d.setCtx("Delete")
+	d.log = d.log.With("reference", ref)
+
+	if d.requester != d.cfg.UserName() {
+		return errors.E(op, d.requester, errors.Permission)
+	}
+	if !validReference(ref) {
+		return errors.E(op, errors.NotExist, errors.Errorf("reference %s", ref))
+	}
+
+	err := d.storage.Delete(ctx, ref)
+	if errors.Is(errors.NotExist, err) {
+		return errors.E(op, errors.NotExist, errors.Errorf("reference %s", ref))
+	} else if err != nil {
+		return d.internalErr(ctx, op, ref, err)
+	}
+
+	return nil
+}
+
+// Stored returns the last time the block at ref was put, so that garbage
+// collection can spare blocks that were put recently but are not yet
+// referenced by any directory entry. It is not part of upspin.StoreServer, and
+// only available to callers in the same process.
+func (d *dialed) Stored(ref upspin.Reference) (time.Time, error) {
+	ctx, op := d.setCtx("Stored")
+	d.log = d.log.With("reference", ref)
+
+	if !validReference(ref) {
+		return time.Time{}, errors.E(op, errors.NotExist, errors.Errorf("reference %s", ref))
+	}
+
+	t, err := d.storage.Stored(ctx, ref)
+	if errors.Is(errors.NotExist, err) {
+		return time.Time{}, errors.E(op, errors.NotExist, errors.Errorf("reference %s", ref))
+	} else if err != nil {
+		return time.Time{}, d.internalErr(ctx, op, ref, err)
+	}
+
+	return t, nil
+}
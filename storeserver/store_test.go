@@ -0,0 +1,109 @@
+package storeserver
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/vvanpo/upspin-fly/storeserver/disk"
+	"github.com/vvanpo/upspin-fly/storeserver/sqlite"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func storages(t *testing.T) map[string]Storage {
+	dir := t.TempDir()
+	dk, err := disk.Open(filepath.Join(dir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sq, err := sqlite.Open(filepath.Join(dir, "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sq.Close() })
+
+	return map[string]Storage{"disk": dk, "sqlite": sq}
+}
+
+func dial(t *testing.T, st Storage, requester upspin.UserName) upspin.StoreServer {
+	cfg := config.SetUserName(config.New(), "srv@example.com")
+	s := New(cfg, st, []upspin.UserName{"foo@example.com"}, slog.Default())
+
+	d, err := s.Dial(config.SetUserName(config.New(), requester), upspin.Endpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d.(upspin.StoreServer)
+}
+
+func TestPutGetDelete(t *testing.T) {
+	for name, st := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			foo := dial(t, st, "foo@example.com")
+			ref, err := foo.Put([]byte("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Reference != reference([]byte("data")) {
+				t.Errorf("wrong reference: %s", ref.Reference)
+			}
+			// Putting the same data again is idempotent.
+			if _, err := foo.Put([]byte("data")); err != nil {
+				t.Error(err)
+			}
+
+			data, _, _, err := dial(t, st, "bar@example.com").Get(ref.Reference)
+			if err != nil {
+				t.Fatal(err)
+			} else if string(data) != "data" {
+				t.Errorf("wrong data: %q", data)
+			}
+
+			if err := dial(t, st, "srv@example.com").Delete(ref.Reference); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err := foo.Get(ref.Reference); !errors.Is(errors.NotExist, err) {
+				t.Errorf("deleted reference retrievable: %v", err)
+			}
+		})
+	}
+}
+
+// Only writers may put, and only the server user may delete.
+func TestPermission(t *testing.T) {
+	for name, st := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := dial(t, st, "bar@example.com").Put([]byte("data")); !errors.Is(errors.Permission, err) {
+				t.Errorf("non-writer allowed to put: %v", err)
+			}
+
+			ref, err := dial(t, st, "srv@example.com").Put([]byte("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dial(t, st, "foo@example.com").Delete(ref.Reference); !errors.Is(errors.Permission, err) {
+				t.Errorf("writer allowed to delete: %v", err)
+			}
+		})
+	}
+}
+
+// References not produced by the server are never passed to the storage.
+func TestInvalidReference(t *testing.T) {
+	for name, st := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			srv := dial(t, st, "srv@example.com")
+			for _, ref := range []upspin.Reference{"", "../../etc/passwd", "ab", upspin.Reference(reference(nil)[:63] + "/")} {
+				if _, _, _, err := srv.Get(ref); !errors.Is(errors.NotExist, err) {
+					t.Errorf("get %q: %v", ref, err)
+				}
+				if err := srv.Delete(ref); !errors.Is(errors.NotExist, err) {
+					t.Errorf("delete %q: %v", ref, err)
+				}
+			}
+		})
+	}
+}